@@ -1,6 +1,8 @@
 package nebula
 
 import (
+	"sync/atomic"
+
 	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 )
@@ -13,6 +15,26 @@ type Bits struct {
 	lostCounter        metrics.Counter
 	dupeCounter        metrics.Counter
 	outOfWindowCounter metrics.Counter
+
+	// These mirror the global counters above for just this window so lossy tunnels can be picked out
+	lost        atomic.Uint64
+	duplicate   atomic.Uint64
+	outOfWindow atomic.Uint64
+	reordered   atomic.Uint64
+}
+
+// WindowStats describes the packets a tunnel has received
+type WindowStats struct {
+	// Size is the number of message counters behind the newest one that are still accepted
+	Size uint64 `json:"size"`
+	// Lost is the number of message counters that left the window without being seen
+	Lost uint64 `json:"lost"`
+	// Duplicate is the number of packets dropped because their message counter was already seen
+	Duplicate uint64 `json:"duplicate"`
+	// OutOfWindow is the number of packets dropped because their message counter was too old
+	OutOfWindow uint64 `json:"outOfWindow"`
+	// Reordered is the number of packets accepted after a packet with a newer message counter
+	Reordered uint64 `json:"reordered"`
 }
 
 func NewBits(bits uint64) *Bits {
@@ -34,25 +56,37 @@ func (b *Bits) Check(l logrus.FieldLogger, i uint64) bool {
 
 	// If i is within the window, check if it's been set already. The first window will fail this check
 	if i > b.current-b.length {
-		return !b.bits[i%b.length]
+		return b.checkDuplicate(i)
 	}
 
 	// If i is within the first window
 	if i < b.length {
-		return !b.bits[i%b.length]
+		return b.checkDuplicate(i)
 	}
 
 	// Not within the window
 	l.Debugf("rejected a packet (top) %d %d\n", b.current, i)
+	b.outOfWindow.Add(1)
 	return false
 }
 
+// checkDuplicate reports if i has not been seen yet, i must be within the window. Most replays are caught here before
+// the packet is decrypted so they are counted against the tunnel here as well.
+func (b *Bits) checkDuplicate(i uint64) bool {
+	if b.bits[i%b.length] {
+		b.duplicate.Add(1)
+		return false
+	}
+	return true
+}
+
 func (b *Bits) Update(l *logrus.Logger, i uint64) bool {
 	// If i is the next number, return true and update current.
 	if i == b.current+1 {
 		// Report missed packets, we can only understand what was missed after the first window has been gone through
 		if i > b.length && b.bits[i%b.length] == false {
 			b.lostCounter.Inc(1)
+			b.lost.Add(1)
 		}
 		b.bits[i%b.length] = true
 		b.current = i
@@ -93,6 +127,7 @@ func (b *Bits) Update(l *logrus.Logger, i uint64) bool {
 		}
 
 		b.lostCounter.Inc(lost)
+		b.lost.Add(uint64(lost))
 
 		if l.Level >= logrus.DebugLevel {
 			l.WithField("receiveWindow", m{"accepted": true, "currentCounter": b.current, "incomingCounter": i, "reason": "window shifting"}).
@@ -119,6 +154,7 @@ func (b *Bits) Update(l *logrus.Logger, i uint64) bool {
 					Debug("Receive window")
 			}
 			b.dupeCounter.Inc(1)
+			b.duplicate.Add(1)
 			return false
 		}
 
@@ -128,16 +164,19 @@ func (b *Bits) Update(l *logrus.Logger, i uint64) bool {
 					Debug("Receive window")
 			}
 			b.dupeCounter.Inc(1)
+			b.duplicate.Add(1)
 			return false
 		}
 
 		b.bits[i%b.length] = true
+		b.reordered.Add(1)
 		return true
 
 	}
 
 	// In all other cases, fail and don't change current.
 	b.outOfWindowCounter.Inc(1)
+	b.outOfWindow.Add(1)
 	if l.Level >= logrus.DebugLevel {
 		l.WithField("accepted", false).
 			WithField("currentCounter", b.current).
@@ -148,6 +187,17 @@ func (b *Bits) Update(l *logrus.Logger, i uint64) bool {
 	return false
 }
 
+// Stats returns the counters for this window
+func (b *Bits) Stats() WindowStats {
+	return WindowStats{
+		Size:        b.length,
+		Lost:        b.lost.Load(),
+		Duplicate:   b.duplicate.Load(),
+		OutOfWindow: b.outOfWindow.Load(),
+		Reordered:   b.reordered.Load(),
+	}
+}
+
 func maxInt64(a, b int64) int64 {
 	if a > b {
 		return a
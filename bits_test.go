@@ -214,6 +214,34 @@ func TestBitsLostCounter(t *testing.T) {
 	assert.Equal(t, int64(0), b.outOfWindowCounter.Count())
 }
 
+func TestBitsStats(t *testing.T) {
+	l := test.NewLogger()
+	b := NewBits(10)
+	assert.Equal(t, WindowStats{Size: 10}, b.Stats())
+
+	assert.True(t, b.Update(l, 1))
+	assert.True(t, b.Update(l, 3))
+	// 2 arrived late but is still in the window
+	assert.True(t, b.Update(l, 2))
+	assert.False(t, b.Update(l, 2))
+	assert.False(t, b.Update(l, 3))
+
+	// Jumping ahead counts what can no longer arrive as lost
+	assert.True(t, b.Update(l, 25))
+	assert.False(t, b.Update(l, 4))
+
+	assert.Equal(t, WindowStats{Size: 10, Lost: 12, Duplicate: 2, OutOfWindow: 1, Reordered: 1}, b.Stats())
+
+	// Packets turned away before they are decrypted are counted too
+	assert.False(t, b.Check(l, 25))
+	assert.False(t, b.Check(l, 12))
+	assert.True(t, b.Check(l, 24))
+	assert.Equal(t, WindowStats{Size: 10, Lost: 12, Duplicate: 3, OutOfWindow: 2, Reordered: 1}, b.Stats())
+
+	// Each window keeps its own counts
+	assert.Equal(t, WindowStats{Size: 10}, NewBits(10).Stats())
+}
+
 func BenchmarkBits(b *testing.B) {
 	z := NewBits(10)
 	for n := 0; n < b.N; n++ {
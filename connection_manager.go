@@ -197,10 +197,25 @@ func (n *connectionManager) doTrafficCheck(localIndex uint32, p, nb, out []byte,
 		n.migrateRelayUsed(hostinfo, primary)
 
 	case tryRehandshake:
-		n.tryRehandshake(hostinfo)
+		n.tryRehandshake(hostinfo, now)
+		if n.shouldTryDirectPath(hostinfo, now) {
+			n.tryDirectPath(hostinfo, p, nb, out)
+		}
+		n.probePaths(hostinfo, now, nb, out)
+		n.intf.probePathMtu(hostinfo, now, nb, out)
 
 	case sendTestPacket:
-		n.intf.SendMessageToHostInfo(header.Test, header.TestRequest, hostinfo, p, nb, out)
+		n.failover(hostinfo, now)
+		if hostinfo.remote != nil {
+			// Probes are test packets that also measure the path
+			n.intf.sendProbe(hostinfo, hostinfo.remote, nb, out)
+			if n.intf.probeFailover.Load() {
+				// Any answer keeps the tunnel alive long enough to fail over to the remote that gave it
+				n.probeCandidates(hostinfo, hostinfo.remote, nb, out)
+			}
+		} else {
+			n.intf.SendMessageToHostInfo(header.Test, header.TestRequest, hostinfo, p, nb, out)
+		}
 	}
 
 	n.resetRelayTrafficCheck(hostinfo)
@@ -239,7 +254,7 @@ func (n *connectionManager) migrateRelayUsed(oldhostinfo, newhostinfo *HostInfo)
 				relayTo = existing.PeerIp
 			case ForwardingType:
 				relayFrom = existing.PeerIp
-				relayTo = newhostinfo.vpnIp
+				relayTo = existing.Origin(newhostinfo)
 			default:
 				// should never happen
 			}
@@ -253,7 +268,7 @@ func (n *connectionManager) migrateRelayUsed(oldhostinfo, newhostinfo *HostInfo)
 			n.relayUsedLock.RUnlock()
 			// The relay doesn't exist at all; create some relay state and send the request.
 			var err error
-			index, err = AddRelay(n.l, newhostinfo, n.hostMap, r.PeerIp, nil, r.Type, Requested)
+			index, err = addChainRelay(n.l, newhostinfo, n.hostMap, r.PeerIp, r.NextHopIp, r.OriginIp, nil, r.Type, Requested)
 			if err != nil {
 				n.l.WithError(err).Error("failed to migrate relay to new hostinfo")
 				continue
@@ -264,7 +279,7 @@ func (n *connectionManager) migrateRelayUsed(oldhostinfo, newhostinfo *HostInfo)
 				relayTo = r.PeerIp
 			case ForwardingType:
 				relayFrom = r.PeerIp
-				relayTo = newhostinfo.vpnIp
+				relayTo = r.Origin(newhostinfo)
 			default:
 				// should never happen
 			}
@@ -277,6 +292,11 @@ func (n *connectionManager) migrateRelayUsed(oldhostinfo, newhostinfo *HostInfo)
 			RelayFromIp:         uint32(relayFrom),
 			RelayToIp:           uint32(relayTo),
 		}
+		if relayTo != newhostinfo.vpnIp && r.Type == ForwardingType {
+			// newhostinfo is the next relay in a relay chain, make sure the request can't loop back to us
+			req.MaxHops = n.intf.relayManager.GetMaxHops()
+			req.RelayPath = []uint32{uint32(n.intf.myVpnIp)}
+		}
 		msg, err := req.Marshal()
 		if err != nil {
 			n.l.WithError(err).Error("failed to marshal Control message to migrate relay")
@@ -468,15 +488,142 @@ func (n *connectionManager) sendPunch(hostinfo *HostInfo) {
 	}
 }
 
-func (n *connectionManager) tryRehandshake(hostinfo *HostInfo) {
-	certState := n.intf.pki.GetCertState()
-	if bytes.Equal(hostinfo.ConnectionState.myCert.Signature, certState.Certificate.Signature) {
+// shouldTryDirectPath returns true if hostinfo is relayed and it is time to look for a direct path again
+func (n *connectionManager) shouldTryDirectPath(hostinfo *HostInfo, now time.Time) bool {
+	if hostinfo.remote != nil || len(hostinfo.relayState.CopyRelayIps()) == 0 {
+		return false
+	}
+
+	interval := n.intf.relayManager.GetUpgradeInterval()
+	if interval <= 0 {
+		return false
+	}
+
+	last := hostinfo.lastDirectAttempt.Load()
+	if now.Sub(time.Unix(0, last)) < interval {
+		return false
+	}
+
+	return hostinfo.lastDirectAttempt.CompareAndSwap(last, now.UnixNano())
+}
+
+// tryDirectPath sends a test packet to every known underlay address of a relayed tunnel. If one gets through the
+// remote will roam to that address and answer directly, which moves the tunnel off the relay without a new handshake.
+func (n *connectionManager) tryDirectPath(hostinfo *HostInfo, p, nb, out []byte) {
+	// Refresh the addresses we know about, this also has the lighthouse ask the remote to punch towards us
+	n.intf.lightHouse.QueryServer(hostinfo.vpnIp)
+
+	if n.l.Level >= logrus.DebugLevel {
+		hostinfo.logger(n.l).
+			WithField("udpAddrs", hostinfo.remotes.CopyAddrs(n.hostMap.preferredRanges)).
+			Debug("Trying to find a direct path for relayed tunnel")
+	}
+
+	hostinfo.remotes.ForEach(n.hostMap.preferredRanges, func(addr *udp.Addr, preferred bool) {
+		if addr == nil {
+			return
+		}
+		n.intf.sendTo(header.Test, header.TestRequest, hostinfo.ConnectionState, hostinfo, addr, p, nb, out)
+	})
+}
+
+// probePaths measures the path to the current remote of an active tunnel every probes.interval. With
+// probes.candidates or probes.failover set every other known remote is measured as well, so TryPromoteBest can move to
+// a faster one and failover has somewhere to go.
+func (n *connectionManager) probePaths(hostinfo *HostInfo, now time.Time, nb, out []byte) {
+	interval := time.Duration(n.intf.probeInterval.Load())
+	if interval <= 0 || hostinfo.remote == nil || !hostinfo.paths.due(now, interval) {
+		return
+	}
+
+	n.failover(hostinfo, now)
+	remote := hostinfo.remote
+	n.intf.sendProbe(hostinfo, remote, nb, out)
+
+	if n.intf.probeCandidates.Load() || n.intf.probeFailover.Load() {
+		n.probeCandidates(hostinfo, remote, nb, out)
+	}
+}
+
+// probeCandidates sends a probe to every known remote of hostinfo other than remote
+func (n *connectionManager) probeCandidates(hostinfo *HostInfo, remote *udp.Addr, nb, out []byte) {
+	if hostinfo.remotes == nil {
+		return
+	}
+
+	hostinfo.remotes.ForEach(n.hostMap.preferredRanges, func(addr *udp.Addr, preferred bool) {
+		if addr == nil || addr.Equals(remote) {
+			return
+		}
+		n.intf.sendProbe(hostinfo, addr, nb, out)
+	})
+}
+
+// failover moves hostinfo off its current remote when that remote lost several probes in a row and another one still
+// answers. The tunnel keeps its keys, only the address we send to changes.
+func (n *connectionManager) failover(hostinfo *HostInfo, now time.Time) {
+	if !n.intf.probeFailover.Load() {
+		return
+	}
+
+	// Count the probes that timed out first, only lost probes are a reason to move
+	n.intf.probeMetrics.lost.Inc(int64(hostinfo.paths.expire(now)))
+
+	remote := hostinfo.remote
+	addr := hostinfo.paths.failover(remote, now)
+	if addr == nil {
+		return
+	}
+
+	hostinfo.logger(n.l).WithField("udpAddr", remote).WithField("newAddr", addr).
+		Info("Remote stopped answering probes, failing over")
+
+	n.intf.probeMetrics.failovers.Inc(1)
+	hostinfo.lastRoam = now
+	hostinfo.lastRoamRemote = remote
+	hostinfo.SetRemote(addr)
+}
+
+func (n *connectionManager) tryRehandshake(hostinfo *HostInfo, now time.Time) {
+	reason := n.rehandshakeReason(hostinfo, now)
+	if reason == "" {
 		return
 	}
 
 	n.l.WithField("vpnIp", hostinfo.vpnIp).
-		WithField("reason", "local certificate is not current").
+		WithField("reason", reason).
 		Info("Re-handshaking with remote")
 
 	n.intf.handshakeManager.StartHandshake(hostinfo.vpnIp, nil)
 }
+
+// rehandshakeReason returns why hostinfo needs a new handshake, or an empty string if the current one is fine.
+// The old tunnel keeps carrying traffic until the new one completes so rekeying does not drop anything.
+func (n *connectionManager) rehandshakeReason(hostinfo *HostInfo, now time.Time) string {
+	ci := hostinfo.ConnectionState
+	certState := n.intf.pki.GetCertState()
+	if !bytes.Equal(ci.myCert.Signature, certState.Certificate.Signature) {
+		return "local certificate is not current"
+	}
+
+	if ci.messageCounter.Load() >= rekeyMessageCounter {
+		return "message counter is nearly exhausted"
+	}
+
+	// Both sides of a tunnel reach the rekey limits at about the same time. The initiator rekeys at the limit and the
+	// responder only steps in at twice the limit, which keeps both sides from racing to replace the tunnel.
+	scale := int64(1)
+	if !ci.initiator {
+		scale = 2
+	}
+
+	if interval := n.intf.rekeyInterval.Load(); interval > 0 && now.Sub(ci.created) >= time.Duration(interval*scale) {
+		return "keys are older than handshakes.rekey_interval"
+	}
+
+	if limit := n.intf.rekeyBytes.Load(); limit > 0 && ci.Bytes() >= limit*uint64(scale) {
+		return "keys have been used for more than handshakes.rekey_bytes"
+	}
+
+	return ""
+}
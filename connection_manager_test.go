@@ -298,3 +298,87 @@ func Test_NewConnectionManagerTest_DisconnectInvalid(t *testing.T) {
 	invalid = nc.isInvalidCertificate(nextTick, hostinfo)
 	assert.True(t, invalid)
 }
+
+func Test_connectionManager_rehandshakeReason(t *testing.T) {
+	l := test.NewLogger()
+	ifce := &Interface{pki: &PKI{}, l: l}
+	ifce.pki.cs.Store(&CertState{Certificate: &cert.NebulaCertificate{Signature: []byte("current")}})
+	nc := &connectionManager{intf: ifce, l: l}
+
+	now := time.Now()
+	newHostInfo := func(initiator bool, age time.Duration) *HostInfo {
+		return &HostInfo{ConnectionState: &ConnectionState{
+			myCert:    &cert.NebulaCertificate{Signature: []byte("current")},
+			initiator: initiator,
+			created:   now.Add(-age),
+			eKey:      &NebulaCipherState{},
+			dKey:      &NebulaCipherState{},
+		}}
+	}
+
+	// Nothing to do without rekey limits
+	hostinfo := newHostInfo(true, 24*time.Hour)
+	assert.Equal(t, "", nc.rehandshakeReason(hostinfo, now))
+
+	hostinfo.ConnectionState.myCert = &cert.NebulaCertificate{Signature: []byte("old")}
+	assert.Equal(t, "local certificate is not current", nc.rehandshakeReason(hostinfo, now))
+
+	// The message counter limit always applies
+	hostinfo = newHostInfo(false, 0)
+	hostinfo.ConnectionState.messageCounter.Store(rekeyMessageCounter - 1)
+	assert.Equal(t, "", nc.rehandshakeReason(hostinfo, now))
+	hostinfo.ConnectionState.messageCounter.Store(rekeyMessageCounter)
+	assert.Equal(t, "message counter is nearly exhausted", nc.rehandshakeReason(hostinfo, now))
+
+	ifce.rekeyInterval.Store(int64(time.Hour))
+	assert.Equal(t, "", nc.rehandshakeReason(newHostInfo(true, 59*time.Minute), now))
+	assert.Equal(t, "keys are older than handshakes.rekey_interval", nc.rehandshakeReason(newHostInfo(true, time.Hour), now))
+
+	// The responder gives the initiator a chance to rekey first
+	assert.Equal(t, "", nc.rehandshakeReason(newHostInfo(false, time.Hour), now))
+	assert.Equal(t, "keys are older than handshakes.rekey_interval", nc.rehandshakeReason(newHostInfo(false, 2*time.Hour), now))
+
+	ifce.rekeyInterval.Store(0)
+	ifce.rekeyBytes.Store(1000)
+
+	// Bytes in both directions count
+	hostinfo = newHostInfo(true, 0)
+	hostinfo.ConnectionState.eKey.bytes.Store(600)
+	hostinfo.ConnectionState.dKey.bytes.Store(399)
+	assert.Equal(t, "", nc.rehandshakeReason(hostinfo, now))
+	hostinfo.ConnectionState.dKey.bytes.Store(400)
+	assert.Equal(t, "keys have been used for more than handshakes.rekey_bytes", nc.rehandshakeReason(hostinfo, now))
+
+	hostinfo.ConnectionState.initiator = false
+	assert.Equal(t, "", nc.rehandshakeReason(hostinfo, now))
+	hostinfo.ConnectionState.eKey.bytes.Store(1600)
+	assert.Equal(t, "keys have been used for more than handshakes.rekey_bytes", nc.rehandshakeReason(hostinfo, now))
+}
+
+func Test_connectionManager_shouldTryDirectPath(t *testing.T) {
+	l := test.NewLogger()
+	_, vpncidr, _ := net.ParseCIDR("172.1.1.1/24")
+	hostMap := NewHostMap(l, vpncidr, nil)
+	rm, err := NewRelayManager(context.Background(), l, hostMap, config.NewC(l))
+	assert.NoError(t, err)
+	nc := &connectionManager{intf: &Interface{relayManager: rm}, l: l}
+
+	hostinfo := &HostInfo{
+		vpnIp: iputil.Ip2VpnIp(net.ParseIP("172.1.1.2")),
+		relayState: RelayState{
+			relays:        map[iputil.VpnIp]struct{}{iputil.Ip2VpnIp(net.ParseIP("172.1.1.3")): {}},
+			relayForByIp:  map[iputil.VpnIp]*Relay{},
+			relayForByIdx: map[uint32]*Relay{},
+		},
+	}
+
+	// A relayed tunnel looks for a direct path once every relay.upgrade_interval
+	now := time.Now()
+	assert.True(t, nc.shouldTryDirectPath(hostinfo, now))
+	assert.False(t, nc.shouldTryDirectPath(hostinfo, now.Add(time.Second)))
+	assert.True(t, nc.shouldTryDirectPath(hostinfo, now.Add(DefaultRelayUpgradeInterval)))
+
+	// A direct tunnel never does
+	hostinfo.remote = udp.NewAddr(net.ParseIP("10.1.1.1"), 4242)
+	assert.False(t, nc.shouldTryDirectPath(hostinfo, now.Add(time.Hour)))
+}
@@ -3,16 +3,41 @@ package nebula
 import (
 	"crypto/rand"
 	"encoding/json"
+	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/flynn/noise"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/noiseutil"
 )
 
-const ReplayWindow = 1024
+const (
+	// ReplayWindow is the default number of message counters behind the newest one a tunnel will still accept
+	ReplayWindow = 1024
+	// MaxReplayWindow bounds the replay window, every tunnel holds a slot for each counter in its window
+	MaxReplayWindow = 1 << 20
+)
+
+const (
+	// rekeyMessageCounter is the message counter that triggers a rehandshake no matter what handshakes.rekey_* are set to
+	rekeyMessageCounter = 1 << 62
+	// maxMessageCounter is the last message counter we send with a set of keys. Going past it would eventually reuse
+	// a nonce so the tunnel stops sending until a rehandshake gives it fresh keys.
+	maxMessageCounter = 1 << 63
+)
+
+// replayWindowFromConfig returns the size of the replay window new tunnels should use
+func replayWindowFromConfig(c *config.C) (uint64, error) {
+	n := c.GetInt("replay_window", ReplayWindow)
+	if n < 1 || n > MaxReplayWindow {
+		return 0, fmt.Errorf("replay_window must be between 1 and %d, got %d", MaxReplayWindow, n)
+	}
+	return uint64(n), nil
+}
 
 type ConnectionState struct {
 	eKey           *NebulaCipherState
@@ -24,6 +49,20 @@ type ConnectionState struct {
 	messageCounter atomic.Uint64
 	window         *Bits
 	writeLock      sync.Mutex
+
+	// counterExhausted is set once messageCounter passes maxMessageCounter and a rehandshake was started
+	counterExhausted atomic.Bool
+
+	// cipher is the name of the cipher used for tunnel traffic, which can differ from the one used for the handshake
+	cipher string
+
+	// kemKey is the kem key an initiator offered, it is only held until the handshake completes
+	kemKey *kemDecapsulationKey
+	// hybridKem is true when a kem shared secret was mixed into the tunnel keys
+	hybridKem bool
+
+	// created is when the handshake for these keys began, used to decide when to rekey
+	created time.Time
 }
 
 func NewConnectionState(l *logrus.Logger, cipher string, certState *CertState, initiator bool, pattern noise.HandshakePattern, psk []byte, pskStage int) *ConnectionState {
@@ -40,17 +79,13 @@ func NewConnectionState(l *logrus.Logger, cipher string, certState *CertState, i
 
 	var cs noise.CipherSuite
 	if cipher == "chachapoly" {
-		cs = noise.NewCipherSuite(dhFunc, noise.CipherChaChaPoly, noise.HashSHA256)
+		cs = noise.NewCipherSuite(dhFunc, keyedCipherFunc{noise.CipherChaChaPoly}, noise.HashSHA256)
 	} else {
-		cs = noise.NewCipherSuite(dhFunc, noiseutil.CipherAESGCM, noise.HashSHA256)
+		cs = noise.NewCipherSuite(dhFunc, keyedCipherFunc{noiseutil.CipherAESGCM}, noise.HashSHA256)
 	}
 
 	static := noise.DHKey{Private: certState.PrivateKey, Public: certState.PublicKey}
 
-	b := NewBits(ReplayWindow)
-	// Clear out bit 0, we never transmit it and we don't want it showing as packet loss
-	b.Update(l, 0)
-
 	hs, err := noise.NewHandshakeState(noise.Config{
 		CipherSuite:           cs,
 		Random:                rand.Reader,
@@ -69,17 +104,33 @@ func NewConnectionState(l *logrus.Logger, cipher string, certState *CertState, i
 	ci := &ConnectionState{
 		H:         hs,
 		initiator: initiator,
-		window:    b,
 		myCert:    certState.Certificate,
+		created:   time.Now(),
 	}
 
 	return ci
 }
 
+// setReplayWindow gives the tunnel a replay window of n counters. It is left out of NewConnectionState since a
+// responder builds a ConnectionState for every psk and cipher it tries before any of them authenticates.
+func (cs *ConnectionState) setReplayWindow(l *logrus.Logger, n uint64) {
+	b := NewBits(n)
+	// Clear out bit 0, we never transmit it and we don't want it showing as packet loss
+	b.Update(l, 0)
+	cs.window = b
+}
+
+// Bytes returns how many bytes have been sealed or opened with the tunnel keys
+func (cs *ConnectionState) Bytes() uint64 {
+	return cs.eKey.Bytes() + cs.dKey.Bytes()
+}
+
 func (cs *ConnectionState) MarshalJSON() ([]byte, error) {
 	return json.Marshal(m{
 		"certificate":     cs.peerCert,
 		"initiator":       cs.initiator,
 		"message_counter": cs.messageCounter.Load(),
+		"cipher":          cs.cipher,
+		"hybrid_kem":      cs.hybridKem,
 	})
 }
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
@@ -48,6 +49,11 @@ type ControlHostInfo struct {
 	CurrentRemote          *udp.Addr               `json:"currentRemote"`
 	CurrentRelaysToMe      []iputil.VpnIp          `json:"currentRelaysToMe"`
 	CurrentRelaysThroughMe []iputil.VpnIp          `json:"currentRelaysThroughMe"`
+	RelayedSince           *time.Time              `json:"relayedSince,omitempty"`
+	DirectSince            *time.Time              `json:"directSince,omitempty"`
+	Window                 WindowStats             `json:"window"`
+	Paths                  []PathStats             `json:"paths"`
+	PathMtu                int                     `json:"pathMtu"`
 }
 
 // Start actually runs nebula, this is a nonblocking call. To block use Control.ShutdownBlock()
@@ -149,6 +155,11 @@ func (c *Control) GetHostInfoByVpnIp(vpnIp iputil.VpnIp, pending bool) *ControlH
 	return &ch
 }
 
+// GetCertificate returns a copy of the certificate we present to other hosts
+func (c *Control) GetCertificate() *cert.NebulaCertificate {
+	return c.f.pki.GetCertState().Certificate.Copy()
+}
+
 // SetRemoteForTunnel forces a tunnel to use a specific remote
 func (c *Control) SetRemoteForTunnel(vpnIp iputil.VpnIp, addr udp.Addr) *ControlHostInfo {
 	hostInfo := c.f.hostMap.QueryVpnIp(vpnIp)
@@ -245,10 +256,15 @@ func copyHostInfo(h *HostInfo, preferredRanges []*net.IPNet) ControlHostInfo {
 		RemoteAddrs:            h.remotes.CopyAddrs(preferredRanges),
 		CurrentRelaysToMe:      h.relayState.CopyRelayIps(),
 		CurrentRelaysThroughMe: h.relayState.CopyRelayForIps(),
+		Paths:                  h.paths.stats(),
+		PathMtu:                int(h.pmtu.mtu.Load()),
 	}
 
 	if h.ConnectionState != nil {
 		chi.MessageCounter = h.ConnectionState.messageCounter.Load()
+		if h.ConnectionState.window != nil {
+			chi.Window = h.ConnectionState.window.Stats()
+		}
 	}
 
 	if c := h.GetCert(); c != nil {
@@ -259,6 +275,16 @@ func copyHostInfo(h *HostInfo, preferredRanges []*net.IPNet) ControlHostInfo {
 		chi.CurrentRemote = h.remote.Copy()
 	}
 
+	if since := h.relayedSince.Load(); since != 0 {
+		t := time.Unix(0, since)
+		chi.RelayedSince = &t
+	}
+
+	if since := h.directSince.Load(); since != 0 {
+		t := time.Unix(0, since)
+		chi.DirectSince = &t
+	}
+
 	return chi
 }
 
@@ -55,6 +55,7 @@ func TestControl_GetHostInfoByVpnIp(t *testing.T) {
 		remotes: remotes,
 		ConnectionState: &ConnectionState{
 			peerCert: crt,
+			window:   NewBits(ReplayWindow),
 		},
 		remoteIndexId: 200,
 		localIndexId:  201,
@@ -91,6 +92,10 @@ func TestControl_GetHostInfoByVpnIp(t *testing.T) {
 
 	thi := c.GetHostInfoByVpnIp(iputil.Ip2VpnIp(ipNet.IP), false)
 
+	// A host added with a remote is on a direct path
+	assert.NotNil(t, thi.DirectSince)
+	directSince := *thi.DirectSince
+
 	expectedInfo := ControlHostInfo{
 		VpnIp:                  net.IPv4(1, 2, 3, 4).To4(),
 		LocalIndex:             201,
@@ -101,10 +106,13 @@ func TestControl_GetHostInfoByVpnIp(t *testing.T) {
 		CurrentRemote:          udp.NewAddr(net.ParseIP("0.0.0.100"), 4444),
 		CurrentRelaysToMe:      []iputil.VpnIp{},
 		CurrentRelaysThroughMe: []iputil.VpnIp{},
+		DirectSince:            &directSince,
+		Window:                 WindowStats{Size: ReplayWindow},
+		Paths:                  []PathStats{},
 	}
 
 	// Make sure we don't have any unexpected fields
-	assertFields(t, []string{"VpnIp", "LocalIndex", "RemoteIndex", "RemoteAddrs", "Cert", "MessageCounter", "CurrentRemote", "CurrentRelaysToMe", "CurrentRelaysThroughMe"}, thi)
+	assertFields(t, []string{"VpnIp", "LocalIndex", "RemoteIndex", "RemoteAddrs", "Cert", "MessageCounter", "CurrentRemote", "CurrentRelaysToMe", "CurrentRelaysThroughMe", "RelayedSince", "DirectSince", "Window", "Paths", "PathMtu"}, thi)
 	test.AssertDeepCopyEqual(t, &expectedInfo, thi)
 
 	// Make sure we don't panic if the host info doesn't have a cert yet
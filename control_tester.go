@@ -106,6 +106,11 @@ func (c *Control) InjectUDPPacket(p *udp.Packet) {
 	c.f.outside.(*udp.TesterConn).Send(p)
 }
 
+// InjectTunPacket puts a raw ip packet on the tun interface
+func (c *Control) InjectTunPacket(p []byte) {
+	c.f.inside.(*overlay.TestTun).Send(p)
+}
+
 // InjectTunUDPPacket puts a udp packet on the tun interface. Using UDP here because it's a simpler protocol
 func (c *Control) InjectTunUDPPacket(toIp net.IP, toPort uint16, fromPort uint16, data []byte) {
 	ip := layers.IPv4{
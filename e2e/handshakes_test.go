@@ -4,6 +4,8 @@
 package e2e
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"net"
 	"testing"
@@ -16,6 +18,7 @@ import (
 	"github.com/slackhq/nebula/iputil"
 	"github.com/slackhq/nebula/udp"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/ipv4"
 	"gopkg.in/yaml.v2"
 )
 
@@ -94,6 +97,216 @@ func TestGoodHandshake(t *testing.T) {
 	//TODO: assert hostmaps
 }
 
+func TestMixedCipherHandshake(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{"cipher": "aes", "ciphers": []string{"aes", "chachapoly"}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"cipher": "chachapoly", "ciphers": []string{"chachapoly", "aes"}})
+	otherControl, otherVpnIpNet, otherUdpAddr, _ := newSimpleServer(ca, caKey, "other", net.IP{10, 0, 0, 3}, m{"cipher": "chachapoly", "ciphers": []string{"chachapoly", "aes"}})
+
+	// They will reach out to me and I will reach out to other
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+	myControl.InjectLightHouseAddr(otherVpnIpNet.IP, otherUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, theirControl, otherControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+	otherControl.Start()
+
+	t.Log("They run the handshake with chachapoly and I pick aes for the tunnel")
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	assertHostInfoPair(t, myUdpAddr, theirUdpAddr, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl)
+
+	t.Log("I run the handshake with aes and other picks chachapoly for the tunnel")
+	assertTunnel(t, otherVpnIpNet.IP, myVpnIpNet.IP, otherControl, myControl, r)
+	assertHostInfoPair(t, otherUdpAddr, myUdpAddr, otherVpnIpNet.IP, myVpnIpNet.IP, otherControl, myControl)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl, otherControl)
+	myControl.Stop()
+	theirControl.Stop()
+	otherControl.Stop()
+}
+
+func TestNoCommonCipherHandshake(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{"cipher": "aes"})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"cipher": "chachapoly"})
+
+	// Put their info in our lighthouse
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("They do not accept aes and should ignore my handshake")
+	assertHandshakeIgnored(t, myVpnIpNet.IP, theirVpnIpNet.IP, myUdpAddr, theirUdpAddr, myControl, theirControl)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestPskHandshake(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	// I have not picked up the new key yet, they have and also run the handshake with another cipher
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{"psk": m{"mode": "enforced", "keys": []string{"old key"}}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{
+		"cipher":  "chachapoly",
+		"ciphers": []string{"chachapoly", "aes"},
+		"psk":     m{"mode": "enforced", "keys": []string{"new key", "old key"}},
+	})
+
+	// Put their info in our lighthouse
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("They still accept the old key")
+	assertTunnel(t, theirVpnIpNet.IP, myVpnIpNet.IP, theirControl, myControl, r)
+	assertHostInfoPair(t, theirUdpAddr, myUdpAddr, theirVpnIpNet.IP, myVpnIpNet.IP, theirControl, myControl)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestPskEnforced(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	theirPsk := m{"psk": m{"mode": "enforced", "keys": []string{"the key"}}}
+
+	for name, myPsk := range map[string]m{
+		"no psk":    nil,
+		"wrong psk": {"psk": m{"mode": "enforced", "keys": []string{"not the key"}}},
+		"accepting": {"psk": m{"mode": "transitional-accepting", "keys": []string{"the key"}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, myPsk)
+			theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, theirPsk)
+
+			// Put their info in our lighthouse
+			myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+
+			// Start the servers
+			myControl.Start()
+			theirControl.Start()
+
+			t.Log("They require the psk and should ignore my handshake")
+			assertHandshakeIgnored(t, myVpnIpNet.IP, theirVpnIpNet.IP, myUdpAddr, theirUdpAddr, myControl, theirControl)
+
+			myControl.Stop()
+			theirControl.Stop()
+		})
+	}
+}
+
+func TestPskTransitional(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, nil)
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"psk": m{"mode": "transitional-accepting", "keys": []string{"the key"}}})
+	otherControl, otherVpnIpNet, otherUdpAddr, _ := newSimpleServer(ca, caKey, "other", net.IP{10, 0, 0, 3}, m{"psk": m{"mode": "transitional-sending", "keys": []string{"the key"}}})
+
+	// I have no psk and reach out to them, other sends a psk and also reaches out to them
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	otherControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, theirControl, otherControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+	otherControl.Start()
+
+	t.Log("They accept a handshake without a psk")
+	assertTunnel(t, theirVpnIpNet.IP, myVpnIpNet.IP, theirControl, myControl, r)
+	assertHostInfoPair(t, theirUdpAddr, myUdpAddr, theirVpnIpNet.IP, myVpnIpNet.IP, theirControl, myControl)
+
+	t.Log("They accept a handshake with a psk")
+	assertTunnel(t, theirVpnIpNet.IP, otherVpnIpNet.IP, theirControl, otherControl, r)
+	assertHostInfoPair(t, theirUdpAddr, otherUdpAddr, theirVpnIpNet.IP, otherVpnIpNet.IP, theirControl, otherControl)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl, otherControl)
+	myControl.Stop()
+	theirControl.Stop()
+	otherControl.Stop()
+}
+
+func TestHandshakeCookies(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, nil)
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"handshakes": m{"cookie_threshold": 0}})
+
+	// Put their info in our lighthouse
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	stage0 := myControl.GetFromUDP(true)
+
+	t.Log("They always require a cookie and ignore an initiator that can't receive one")
+	noIndex := stage0.Copy()
+	copy(noIndex.Data[4:8], []byte{0, 0, 0, 0})
+	theirControl.InjectUDPPacket(noIndex)
+	assertRecvError(t, myUdpAddr, theirUdpAddr, theirControl)
+	assert.Nil(t, theirControl.GetFromUDP(false))
+
+	t.Log("They send me a cookie instead of a response")
+	theirControl.InjectUDPPacket(stage0)
+	reply := theirControl.GetFromUDP(true)
+	h := &header.H{}
+	assert.NoError(t, h.Parse(reply.Data))
+	assert.Equal(t, header.Handshake, h.Type)
+	assert.Equal(t, header.HandshakeCookie, h.Subtype)
+	assert.Less(t, len(reply.Data), len(stage0.Data))
+	assert.Nil(t, theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false))
+
+	t.Log("A cookie from someone else is ignored")
+	wrong := reply.Copy()
+	wrong.Data[header.Len] ^= 0xff
+	myControl.InjectUDPPacket(wrong)
+
+	t.Log("I echo the cookie and they complete the handshake")
+	myControl.InjectUDPPacket(reply)
+	retry := myControl.GetFromUDP(true)
+	assert.NoError(t, h.Parse(retry.Data))
+	assert.Equal(t, header.HandshakeCookie, h.Subtype)
+	theirControl.InjectUDPPacket(retry)
+	stage1 := theirControl.GetFromUDP(true)
+	assert.NoError(t, h.Parse(stage1.Data))
+	assert.Equal(t, header.HandshakeIXPSK0, h.Subtype)
+	assert.Equal(t, uint64(2), h.MessageCounter)
+	myControl.InjectUDPPacket(stage1)
+
+	t.Log("Get the cached packet and make sure it looks right")
+	myControl.WaitForType(1, 0, theirControl)
+	myCachedPacket := theirControl.GetFromTun(true)
+	assertUdpPacket(t, []byte("Hi from me"), myCachedPacket, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	assertHostInfoPair(t, myUdpAddr, theirUdpAddr, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+}
+
 func TestWrongResponderHandshake(t *testing.T) {
 	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
 
@@ -370,6 +583,200 @@ func TestRelays(t *testing.T) {
 	//TODO: assert we actually used the relay even though it should be impossible for a tunnel to have occurred without it
 }
 
+func TestRelayChain(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me     ", net.IP{10, 0, 0, 1}, m{"relay": m{"use_relays": true, "max_hops": 2}})
+	relay1Control, relay1VpnIpNet, relay1UdpAddr, _ := newSimpleServer(ca, caKey, "relay1 ", net.IP{10, 0, 0, 128}, m{"relay": m{"am_relay": true, "max_hops": 2}})
+	relay2Control, relay2VpnIpNet, relay2UdpAddr, _ := newSimpleServer(ca, caKey, "relay2 ", net.IP{10, 0, 0, 129}, m{"relay": m{"am_relay": true, "max_hops": 2, "chain_peers": []string{relay1VpnIpNet.IP.String()}}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them   ", net.IP{10, 0, 0, 2}, m{"relay": m{"use_relays": true}})
+
+	// I can only reach relay1, relay1 can only reach relay2, and only relay2 can reach them
+	myControl.InjectLightHouseAddr(relay1VpnIpNet.IP, relay1UdpAddr)
+	myControl.InjectRelays(theirVpnIpNet.IP, []net.IP{relay1VpnIpNet.IP})
+	relay1Control.InjectLightHouseAddr(relay2VpnIpNet.IP, relay2UdpAddr)
+	relay1Control.InjectRelays(theirVpnIpNet.IP, []net.IP{relay2VpnIpNet.IP})
+	relay2Control.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, relay1Control, relay2Control, theirControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	relay1Control.Start()
+	relay2Control.Start()
+	theirControl.Start()
+
+	t.Log("Trigger a handshake from me to them via the relay chain")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+
+	p := r.RouteForAllUntilTxTun(theirControl)
+	r.Log("Assert the tunnel works")
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+
+	r.Log("Assert the tunnel works in the other direction")
+	theirControl.InjectTunUDPPacket(myVpnIpNet.IP, 80, 80, []byte("Hi from them"))
+	p = r.RouteForAllUntilTxTun(myControl)
+	assertUdpPacket(t, []byte("Hi from them"), p, theirVpnIpNet.IP, myVpnIpNet.IP, 80, 80)
+
+	r.RenderHostmaps("Final hostmaps", myControl, relay1Control, relay2Control, theirControl)
+	myControl.Stop()
+	relay1Control.Stop()
+	relay2Control.Stop()
+	theirControl.Stop()
+}
+
+func TestRelayChainMaxHops(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me     ", net.IP{10, 0, 0, 1}, m{"relay": m{"use_relays": true}})
+	relay1Control, relay1VpnIpNet, relay1UdpAddr, _ := newSimpleServer(ca, caKey, "relay1 ", net.IP{10, 0, 0, 128}, m{"relay": m{"am_relay": true, "max_hops": 2}})
+	relay2Control, relay2VpnIpNet, relay2UdpAddr, _ := newSimpleServer(ca, caKey, "relay2 ", net.IP{10, 0, 0, 129}, m{"relay": m{"am_relay": true, "max_hops": 2}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them   ", net.IP{10, 0, 0, 2}, m{"relay": m{"use_relays": true}})
+
+	myControl.InjectLightHouseAddr(relay1VpnIpNet.IP, relay1UdpAddr)
+	myControl.InjectRelays(theirVpnIpNet.IP, []net.IP{relay1VpnIpNet.IP})
+	relay1Control.InjectLightHouseAddr(relay2VpnIpNet.IP, relay2UdpAddr)
+	relay1Control.InjectRelays(theirVpnIpNet.IP, []net.IP{relay2VpnIpNet.IP})
+	relay2Control.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+
+	r := router.NewR(t, myControl, relay1Control, relay2Control, theirControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	relay1Control.Start()
+	relay2Control.Start()
+	theirControl.Start()
+
+	r.Log("Get a tunnel between me and relay1")
+	assertTunnel(t, relay1VpnIpNet.IP, myVpnIpNet.IP, relay1Control, myControl, r)
+
+	r.Log("Ask for a relay to them, which needs 2 relays while I only allow 1")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	r.RouteUntilAfterMsgType(myControl, header.Control, header.MessageNone)
+
+	// Give relay1 a chance to act on the request
+	time.Sleep(time.Second)
+	r.FlushAll()
+
+	relay2VpnIp := iputil.Ip2VpnIp(relay2VpnIpNet.IP)
+	assert.Nil(t, relay1Control.GetHostInfoByVpnIp(relay2VpnIp, true), "relay1 should not have extended the relay chain to relay2")
+	assert.Nil(t, relay1Control.GetHostInfoByVpnIp(relay2VpnIp, false), "relay1 should not have extended the relay chain to relay2")
+	assert.Nil(t, theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false))
+
+	myControl.Stop()
+	relay1Control.Stop()
+	relay2Control.Stop()
+	theirControl.Stop()
+}
+
+func TestRelayDeniedByACL(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, _, _ := newSimpleServer(ca, caKey, "me     ", net.IP{10, 0, 0, 1}, m{"relay": m{"use_relays": true}})
+	relayControl, relayVpnIpNet, relayUdpAddr, _ := newSimpleServer(ca, caKey, "relay  ", net.IP{10, 0, 0, 128}, m{"relay": m{
+		"am_relay": true,
+		"acl":      []m{{"from_groups": []string{"contractors"}}},
+	}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them   ", net.IP{10, 0, 0, 2}, m{"relay": m{"use_relays": true}})
+
+	myControl.InjectLightHouseAddr(relayVpnIpNet.IP, relayUdpAddr)
+	myControl.InjectRelays(theirVpnIpNet.IP, []net.IP{relayVpnIpNet.IP})
+	relayControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+
+	r := router.NewR(t, myControl, relayControl, theirControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	relayControl.Start()
+	theirControl.Start()
+
+	r.Log("Get a tunnel between me and the relay, and between the relay and them")
+	assertTunnel(t, relayVpnIpNet.IP, myVpnIpNet.IP, relayControl, myControl, r)
+	assertTunnel(t, theirVpnIpNet.IP, relayVpnIpNet.IP, theirControl, relayControl, r)
+
+	r.Log("Ask the relay for a relay to them, I am not a contractor so it should be denied")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	r.RouteUntilAfterMsgType(myControl, header.Control, header.MessageNone)
+	r.RouteUntilAfterMsgType(relayControl, header.Control, header.MessageNone)
+
+	// Give me a chance to act on the denial
+	time.Sleep(time.Second)
+	r.FlushAll()
+
+	relayHostInfo := myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(relayVpnIpNet.IP), false)
+	assert.Empty(t, relayHostInfo.CurrentRelaysThroughMe, "I should have forgotten the denied relay request")
+
+	myHostInfo := relayControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false)
+	assert.Empty(t, myHostInfo.CurrentRelaysThroughMe, "The relay should not have created any relay state")
+	assert.Nil(t, theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false))
+
+	myControl.Stop()
+	relayControl.Stop()
+	theirControl.Stop()
+}
+
+func TestRelayUpgradeToDirect(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me     ", net.IP{10, 0, 0, 1}, m{"relay": m{"use_relays": true, "upgrade_interval": "1s"}})
+	relayControl, relayVpnIpNet, relayUdpAddr, _ := newSimpleServer(ca, caKey, "relay  ", net.IP{10, 0, 0, 128}, m{"relay": m{"am_relay": true}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them   ", net.IP{10, 0, 0, 2}, m{"relay": m{"use_relays": true, "upgrade_interval": "1s"}})
+
+	// Teach my how to get to the relay and that their can be reached via the relay
+	myControl.InjectLightHouseAddr(relayVpnIpNet.IP, relayUdpAddr)
+	myControl.InjectRelays(theirVpnIpNet.IP, []net.IP{relayVpnIpNet.IP})
+	relayControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, relayControl, theirControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	relayControl.Start()
+	theirControl.Start()
+
+	t.Log("Trigger a handshake from me to them via the relay")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+
+	hi := myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false)
+	assert.Nil(t, hi.CurrentRemote)
+	assert.NotNil(t, hi.RelayedSince)
+	assert.Nil(t, hi.DirectSince)
+
+	r.Log("Learn their real address, the tunnel should move off the relay")
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+
+	for i := 0; ; i++ {
+		assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+		hi = myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false)
+		if hi.CurrentRemote != nil {
+			break
+		}
+		if i > 10 {
+			t.Fatal("Tunnel never found a direct path")
+		}
+		time.Sleep(time.Second)
+	}
+
+	r.Log("Assert both sides are using the direct path")
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	hi = myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false)
+	assert.Equal(t, theirUdpAddr.String(), hi.CurrentRemote.String())
+	assert.Nil(t, hi.RelayedSince)
+	assert.NotNil(t, hi.DirectSince)
+
+	hi = theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false)
+	assert.Equal(t, myUdpAddr.String(), hi.CurrentRemote.String())
+	assert.Nil(t, hi.RelayedSince)
+	assert.NotNil(t, hi.DirectSince)
+
+	r.RenderHostmaps("Final hostmaps", myControl, relayControl, theirControl)
+	myControl.Stop()
+	relayControl.Stop()
+	theirControl.Stop()
+}
+
 func TestStage1RaceRelays(t *testing.T) {
 	//NOTE: this is a race between me and relay resulting in a full tunnel from me to them via relay
 	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
@@ -808,6 +1215,257 @@ func TestRehandshaking(t *testing.T) {
 	theirControl.Stop()
 }
 
+func TestRekeyInterval(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{"handshakes": m{"rekey_interval": "1s"}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
+
+	// Put their info in our lighthouse and vice versa
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Stand up a tunnel that I initiate")
+	assertTunnel(t, theirVpnIpNet.IP, myVpnIpNet.IP, theirControl, myControl, r)
+	first := myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false)
+
+	r.Log("Keep traffic flowing until I rekey the tunnel")
+	for {
+		assertTunnel(t, theirVpnIpNet.IP, myVpnIpNet.IP, theirControl, myControl, r)
+		c := myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false)
+		if c.LocalIndex != first.LocalIndex {
+			break
+		}
+
+		time.Sleep(time.Second)
+	}
+
+	t.Log("Both sides moved to the new tunnel")
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	assertHostInfoPair(t, myUdpAddr, theirUdpAddr, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestReplayWindow(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, nil)
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"replay_window": 4096})
+
+	// Put their info in our lighthouse and vice versa
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Stand up a tunnel")
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+	hi := theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false)
+	assert.Equal(t, uint64(4096), hi.Window.Size)
+	hi = myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false)
+	assert.Equal(t, uint64(nebula.ReplayWindow), hi.Window.Size)
+
+	t.Log("Send them a packet twice")
+	myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+	p := myControl.GetFromUDP(true)
+	theirControl.InjectUDPPacket(p)
+	assertUdpPacket(t, []byte("Hi from me"), theirControl.GetFromTun(true), myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+	theirControl.InjectUDPPacket(p)
+
+	t.Log("Make sure they dropped the replay")
+	// The replay is answered with a recv_error, drain it before checking
+	h := &header.H{}
+	assert.NoError(t, h.Parse(theirControl.GetFromUDP(true).Data))
+	assert.Equal(t, header.RecvError, h.Type)
+
+	hi = theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false)
+	assert.Equal(t, uint64(1), hi.Window.Duplicate)
+	assert.Equal(t, uint64(0), hi.Window.OutOfWindow)
+	assert.Equal(t, uint64(0), hi.Window.Lost)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestPathProbes(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{"probes": m{"interval": "1s"}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
+
+	// Put their info in our lighthouse and vice versa
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Stand up a tunnel")
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+	r.Log("Keep traffic flowing until a probe has been answered")
+	var paths []nebula.PathStats
+	for i := 0; i < 20; i++ {
+		assertTunnel(t, theirVpnIpNet.IP, myVpnIpNet.IP, theirControl, myControl, r)
+		paths = myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false).Paths
+		if len(paths) > 0 && paths[0].Received > 0 {
+			break
+		}
+
+		time.Sleep(time.Second)
+	}
+
+	assert.Len(t, paths, 1)
+	assert.Equal(t, theirUdpAddr.String(), paths[0].Addr.String())
+	assert.NotZero(t, paths[0].Received)
+	assert.NotZero(t, paths[0].Rtt)
+
+	t.Log("They did not probe")
+	assert.Empty(t, theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(myVpnIpNet.IP), false).Paths)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestPathFailover(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{"probes": m{"interval": "1s", "failover": true}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
+
+	// They can also be reached on a second address
+	theirOtherUdpAddr := &net.UDPAddr{IP: net.ParseIP("172.16.0.2"), Port: theirUdpAddr.Port}
+
+	// Put their info in our lighthouse and vice versa
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirOtherUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, theirControl)
+	// The handshake goes to both of their addresses
+	r.AddRoute(theirOtherUdpAddr.IP, uint16(theirOtherUdpAddr.Port), theirControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Stand up a tunnel")
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	first := myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false)
+	assert.Equal(t, theirUdpAddr.String(), first.CurrentRemote.String())
+
+	// Route by hand so the other address does not get NAT treatment, they always answer from their first address.
+	// Packets to their first address are dropped once it breaks.
+	broken := false
+	route := func() {
+		for {
+			moved := false
+			if p := myControl.GetFromUDP(false); p != nil {
+				moved = true
+				if !broken || !p.ToIp.Equal(theirUdpAddr.IP) || int(p.ToPort) != theirUdpAddr.Port {
+					r.InjectUDPPacket(myControl, theirControl, p)
+				}
+			}
+			if p := theirControl.GetFromUDP(false); p != nil {
+				moved = true
+				r.InjectUDPPacket(theirControl, myControl, p)
+			}
+			if !moved {
+				return
+			}
+		}
+	}
+
+	send := func(msg string) {
+		myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte(msg))
+		for i := 0; ; i++ {
+			if i == 50 {
+				t.Fatalf("%s never made it", msg)
+			}
+			time.Sleep(50 * time.Millisecond)
+			route()
+			if p := theirControl.GetFromTun(false); p != nil && bytes.HasSuffix(p, []byte(msg)) {
+				return
+			}
+		}
+	}
+
+	r.Log("Keep traffic flowing until both paths have answered a probe")
+	warm := func() bool {
+		paths := myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false).Paths
+		for _, p := range paths {
+			if p.Received == 0 {
+				return false
+			}
+		}
+		return len(paths) == 2
+	}
+	for i := 0; !warm(); i++ {
+		if i == 20 {
+			t.Fatal("Both paths never answered")
+		}
+		send("Hi from me")
+		time.Sleep(time.Second)
+	}
+	assert.Equal(t, theirUdpAddr.String(), myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false).CurrentRemote.String())
+
+	r.Log("Their first address stops working")
+	broken = true
+	// Two probes in a row have to time out before we move
+	for i := 0; ; i++ {
+		if i == 200 {
+			t.Fatal("Never failed over")
+		}
+		myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+		time.Sleep(100 * time.Millisecond)
+		route()
+		for theirControl.GetFromTun(false) != nil {
+		}
+
+		hi := myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false)
+		if hi == nil {
+			t.Fatal("The tunnel was torn down")
+		}
+		if hi.CurrentRemote.String() == theirOtherUdpAddr.String() {
+			break
+		}
+	}
+
+	t.Log("The tunnel moved to their other address without a new handshake")
+	hi := myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false)
+	assert.Equal(t, first.LocalIndex, hi.LocalIndex)
+	assert.Equal(t, first.RemoteIndex, hi.RemoteIndex)
+
+	send("Hi again from me")
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+}
+
 func TestRehandshakingLoser(t *testing.T) {
 	// The purpose of this test is that the race loser renews their certificate and rehandshakes. The final tunnel
 	// Should be the one with the new certificate
@@ -974,3 +1632,143 @@ func TestRaceRegression(t *testing.T) {
 // Race loser renews and handshakes
 // Does race winner repin the cert to old?
 //TODO: add a test with many lies
+
+func TestPathMtu(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{
+		"tun":    m{"mtu": 1600},
+		"pmtu":   m{"enabled": true, "min": 1300},
+		"timers": m{"connection_alive_interval": 1},
+	})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
+
+	// Put their info in our lighthouse and vice versa
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Stand up a tunnel")
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	// Unknown until the connection manager looks at the tunnel
+	assert.Zero(t, myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false).PathMtu)
+
+	// The underlay between us is 1500 bytes, anything bigger than that less the ip and udp headers is dropped
+	const underlay = 1500 - 28
+	route := func() {
+		for {
+			moved := false
+			if p := myControl.GetFromUDP(false); p != nil {
+				moved = true
+				if len(p.Data) <= underlay {
+					r.InjectUDPPacket(myControl, theirControl, p)
+				}
+			}
+			if p := theirControl.GetFromUDP(false); p != nil {
+				moved = true
+				r.InjectUDPPacket(theirControl, myControl, p)
+			}
+			if !moved {
+				return
+			}
+		}
+	}
+
+	r.Log("Keep traffic flowing until the search is done")
+	fits := underlay - header.Len - 16
+	for i := 0; ; i++ {
+		if i == 300 {
+			t.Fatal("Never found the path mtu")
+		}
+		myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte("Hi from me"))
+		time.Sleep(100 * time.Millisecond)
+		route()
+		for theirControl.GetFromTun(false) != nil {
+		}
+
+		if myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false).PathMtu > fits-16 {
+			break
+		}
+	}
+	assert.LessOrEqual(t, myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false).PathMtu, fits)
+
+	t.Log("A packet that does not fit and may not be fragmented is bounced back to the sender")
+	big := ipv4.Header{
+		Version:  4,
+		Len:      ipv4.HeaderLen,
+		TotalLen: 1550,
+		Flags:    ipv4.DontFragment,
+		TTL:      64,
+		Protocol: 17,
+		Src:      myVpnIpNet.IP,
+		Dst:      theirVpnIpNet.IP,
+	}
+	b, err := big.Marshal()
+	assert.NoError(t, err)
+	b = append(b, make([]byte, 1550-ipv4.HeaderLen)...)
+	myControl.InjectTunPacket(b)
+
+	var icmp []byte
+	select {
+	case icmp = <-myControl.GetTunTxChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Never got the icmp error")
+	}
+	h, err := ipv4.ParseHeader(icmp)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, h.Protocol)
+	assert.True(t, h.Dst.Equal(myVpnIpNet.IP))
+	assert.Equal(t, []byte{3, 4}, icmp[h.Len:h.Len+2])
+	mtu := myControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(theirVpnIpNet.IP), false).PathMtu
+	assert.Equal(t, uint16(mtu), binary.BigEndian.Uint16(icmp[h.Len+6:]))
+
+	t.Log("The same packet is sent if it may be fragmented")
+	b[6] = 0
+	myControl.InjectTunPacket(b)
+	p := myControl.GetFromUDP(true)
+	assert.Greater(t, len(p.Data), underlay)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestTunBatch(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{"tun": m{"batch": 8}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"tun": m{"batch": 8}})
+
+	// Put their info in our lighthouse and vice versa
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Stand up a tunnel")
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+
+	t.Log("Send more packets than fit in a batch and make sure they all come out the other side in order")
+	for i := 0; i < 20; i++ {
+		myControl.InjectTunUDPPacket(theirVpnIpNet.IP, 80, 80, []byte(fmt.Sprintf("Hi from me %d", i)))
+	}
+
+	for i := 0; i < 20; i++ {
+		p := r.RouteForAllUntilTxTun(theirControl)
+		assertUdpPacket(t, []byte(fmt.Sprintf("Hi from me %d", i)), p, myVpnIpNet.IP, theirVpnIpNet.IP, 80, 80)
+	}
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+}
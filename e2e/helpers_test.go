@@ -19,7 +19,9 @@ import (
 	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/e2e/router"
+	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/udp"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/yaml.v2"
 )
@@ -135,6 +137,34 @@ func assertTunnel(t *testing.T, vpnIpA, vpnIpB net.IP, controlA, controlB *nebul
 	assertUdpPacket(t, []byte("Hello from A"), aPacket, vpnIpA, vpnIpB, 90, 80)
 }
 
+// assertHandshakeIgnored starts a handshake from A to B and makes sure B does not respond or create a tunnel for it.
+// The routers are not used so the handshake is not retried.
+func assertHandshakeIgnored(t *testing.T, vpnIpA, vpnIpB net.IP, addrA, addrB *net.UDPAddr, controlA, controlB *nebula.Control) {
+	controlA.InjectTunUDPPacket(vpnIpB, 80, 80, []byte("Hi from A"))
+	controlB.InjectUDPPacket(controlA.GetFromUDP(true))
+	assertRecvError(t, addrA, addrB, controlB)
+
+	assert.Nil(t, controlB.GetHostInfoByVpnIp(iputil.Ip2VpnIp(vpnIpA), false))
+	assert.Nil(t, controlB.GetHostInfoByVpnIp(iputil.Ip2VpnIp(vpnIpA), true))
+}
+
+// assertRecvError sends B a message from A for an unknown tunnel and waits for the recv_error B sends back, which
+// proves every packet injected into B before it was processed
+func assertRecvError(t *testing.T, addrA, addrB *net.UDPAddr, controlB *nebula.Control) {
+	controlB.InjectUDPPacket(&udp.Packet{
+		ToIp:     addrB.IP,
+		ToPort:   uint16(addrB.Port),
+		FromIp:   addrA.IP,
+		FromPort: uint16(addrA.Port),
+		Data:     header.Encode(make([]byte, header.Len+16), header.Version, header.Message, 0, 12345, 1)[:header.Len+16],
+	})
+
+	p := controlB.GetFromUDP(true)
+	h := &header.H{}
+	assert.NoError(t, h.Parse(p.Data))
+	assert.Equal(t, header.RecvError, h.Type)
+}
+
 func assertHostInfoPair(t *testing.T, addrA, addrB *net.UDPAddr, vpnIpA, vpnIpB net.IP, controlA, controlB *nebula.Control) {
 	// Get both host infos
 	hBinA := controlA.GetHostInfoByVpnIp(iputil.Ip2VpnIp(vpnIpB), false)
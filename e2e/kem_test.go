@@ -0,0 +1,78 @@
+//go:build e2e_testing && go1.24
+// +build e2e_testing,go1.24
+
+package e2e
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/e2e/router"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHybridKemHandshake(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{"handshakes": m{"hybrid_kem": "preferred"}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"handshakes": m{"hybrid_kem": "required"}})
+	otherControl, otherVpnIpNet, otherUdpAddr, _ := newSimpleServer(ca, caKey, "other", net.IP{10, 0, 0, 3}, nil)
+
+	// They will reach out to me and I will reach out to other
+	theirControl.InjectLightHouseAddr(myVpnIpNet.IP, myUdpAddr)
+	myControl.InjectLightHouseAddr(otherVpnIpNet.IP, otherUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(t, myControl, theirControl, otherControl)
+	defer r.RenderFlow()
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+	otherControl.Start()
+
+	t.Log("They require the kem exchange and I take part")
+	assertTunnel(t, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl, r)
+	assertHostInfoPair(t, myUdpAddr, theirUdpAddr, myVpnIpNet.IP, theirVpnIpNet.IP, myControl, theirControl)
+
+	t.Log("Other does not support the kem exchange and I fall back to a classic handshake")
+	assertTunnel(t, otherVpnIpNet.IP, myVpnIpNet.IP, otherControl, myControl, r)
+	assertHostInfoPair(t, otherUdpAddr, myUdpAddr, otherVpnIpNet.IP, myVpnIpNet.IP, otherControl, myControl)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl, otherControl)
+	myControl.Stop()
+	theirControl.Stop()
+	otherControl.Stop()
+}
+
+func TestHybridKemRequired(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, nil)
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"handshakes": m{"hybrid_kem": "required"}})
+	otherControl, otherVpnIpNet, otherUdpAddr, _ := newSimpleServer(ca, caKey, "other", net.IP{10, 0, 0, 3}, nil)
+
+	// I will reach out to them and they will reach out to other
+	myControl.InjectLightHouseAddr(theirVpnIpNet.IP, theirUdpAddr)
+	theirControl.InjectLightHouseAddr(otherVpnIpNet.IP, otherUdpAddr)
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+	otherControl.Start()
+
+	t.Log("They require the kem exchange and should ignore my classic handshake")
+	assertHandshakeIgnored(t, myVpnIpNet.IP, theirVpnIpNet.IP, myUdpAddr, theirUdpAddr, myControl, theirControl)
+
+	t.Log("They require the kem exchange and give up on their handshake when other does not take part")
+	theirControl.InjectTunUDPPacket(otherVpnIpNet.IP, 80, 80, []byte("Hi from them"))
+	otherControl.InjectUDPPacket(theirControl.GetFromUDP(true))
+	theirControl.InjectUDPPacket(otherControl.GetFromUDP(true))
+	assertRecvError(t, otherUdpAddr, theirUdpAddr, theirControl)
+	assert.Nil(t, theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(otherVpnIpNet.IP), true))
+	assert.Nil(t, theirControl.GetHostInfoByVpnIp(iputil.Ip2VpnIp(otherVpnIpNet.IP), false))
+
+	myControl.Stop()
+	theirControl.Stop()
+	otherControl.Stop()
+}
@@ -45,6 +45,9 @@ type conn struct {
 type Firewall struct {
 	Conntrack *FirewallConntrack
 
+	// Fragments tracks the first fragment of fragmented packets when firewall.fragments.track is set, nil otherwise
+	Fragments *FirewallFragments
+
 	InRules  *FirewallTable
 	OutRules *FirewallTable
 
@@ -207,6 +210,12 @@ func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *conf
 		//TODO: max_connections
 	)
 
+	var err error
+	fw.Fragments, err = newFirewallFragmentsFromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
 	//TODO: Flip to false after v1.9 release
 	fw.defaultLocalCIDRAny = c.GetBool("firewall.default_local_cidr_any", true)
 
@@ -232,7 +241,7 @@ func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *conf
 		fw.OutSendReject = false
 	}
 
-	err := AddFirewallRulesFromConfig(l, false, c, fw)
+	err = AddFirewallRulesFromConfig(l, false, c, fw)
 	if err != nil {
 		return nil, err
 	}
@@ -423,6 +432,24 @@ var ErrNoMatchingRule = errors.New("no matching rule in firewall table")
 // Drop returns an error if the packet should be dropped, explaining why. It
 // returns nil if the packet should not be dropped.
 func (f *Firewall) Drop(packet []byte, fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache firewall.ConntrackCache) error {
+	if f.Fragments == nil {
+		return f.drop(packet, fp, incoming, h, caPool, localCache)
+	}
+
+	// The rest of a fragmented packet follows its first fragment, which is the only one with ports
+	if fp.Fragment {
+		return f.Fragments.allow(packet, fp, incoming, h)
+	}
+
+	err := f.drop(packet, fp, incoming, h, caPool, localCache)
+	if err == nil && isFirstFragment(packet) {
+		return f.Fragments.add(packet, fp, incoming, h)
+	}
+
+	return err
+}
+
+func (f *Firewall) drop(packet []byte, fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache firewall.ConntrackCache) error {
 	// Check if we spoke to this tuple, if we did then allow this packet
 	if f.inConns(packet, fp, incoming, h, caPool, localCache) {
 		return nil
@@ -0,0 +1,186 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+)
+
+const (
+	// DefaultFragmentTimeout is how long the rest of a fragmented packet is allowed through after its first fragment,
+	// the same as the linux ipfrag_time
+	DefaultFragmentTimeout = 30 * time.Second
+	// DefaultMaxFragmentedPackets is how many fragmented packets are tracked at once
+	DefaultMaxFragmentedPackets = 4096
+)
+
+var ErrNoFirstFragment = errors.New("no first fragment was allowed for this packet")
+var ErrTooManyFragments = errors.New("too many fragmented packets are being tracked")
+
+// fragmentKey identifies the fragments of a single ipv4 packet from a single peer
+type fragmentKey struct {
+	Peer     iputil.VpnIp
+	RemoteIP iputil.VpnIp
+	LocalIP  iputil.VpnIp
+	ID       uint16
+	Protocol uint8
+	Incoming bool
+}
+
+// FirewallFragments remembers the first fragment of every fragmented packet the firewall allowed. The rest of the
+// fragments carry no ports so they can't be matched against the rules, instead they are allowed only if their first
+// fragment was.
+type FirewallFragments struct {
+	sync.Mutex
+
+	Packets    map[fragmentKey]time.Time
+	TimerWheel *TimerWheel[fragmentKey]
+
+	timeout time.Duration
+	max     int
+
+	droppedNoFirst metrics.Counter
+	droppedFull    metrics.Counter
+}
+
+// NewFirewallFragments creates a fragment tracker that lets the rest of a packet through for timeout after its first
+// fragment and tracks at most maxPackets packets at a time
+func NewFirewallFragments(timeout time.Duration, maxPackets int) *FirewallFragments {
+	return &FirewallFragments{
+		Packets:        make(map[fragmentKey]time.Time),
+		TimerWheel:     NewTimerWheel[fragmentKey](time.Second, max(timeout, time.Second)),
+		timeout:        timeout,
+		max:            maxPackets,
+		droppedNoFirst: metrics.GetOrRegisterCounter("firewall.fragments.dropped.no_first", nil),
+		droppedFull:    metrics.GetOrRegisterCounter("firewall.fragments.dropped.full", nil),
+	}
+}
+
+// newFirewallFragmentsFromConfig returns a fragment tracker if firewall.fragments.track is set, nil otherwise
+func newFirewallFragmentsFromConfig(c *config.C) (*FirewallFragments, error) {
+	timeout := c.GetDuration("firewall.fragments.timeout", DefaultFragmentTimeout)
+	if timeout <= 0 {
+		return nil, fmt.Errorf("firewall.fragments.timeout must be greater than 0, got %s", timeout)
+	}
+
+	maxPackets := c.GetInt("firewall.fragments.max", DefaultMaxFragmentedPackets)
+	if maxPackets <= 0 {
+		return nil, fmt.Errorf("firewall.fragments.max must be greater than 0, got %d", maxPackets)
+	}
+
+	if !c.GetBool("firewall.fragments.track", false) {
+		return nil, nil
+	}
+
+	return NewFirewallFragments(timeout, maxPackets), nil
+}
+
+// carry copies the packets old is still tracking so a firewall reload doesn't drop the rest of packets whose first
+// fragment was already allowed. Nothing is tracked for longer than our timeout or beyond our max.
+func (ff *FirewallFragments) carry(old *FirewallFragments) {
+	old.Lock()
+	defer old.Unlock()
+	ff.Lock()
+	defer ff.Unlock()
+
+	now := time.Now()
+	ff.purge(now)
+	for key, expires := range old.Packets {
+		if len(ff.Packets) >= ff.max {
+			return
+		}
+
+		left := min(expires.Sub(now), ff.timeout)
+		if left <= 0 {
+			continue
+		}
+
+		if _, ok := ff.Packets[key]; !ok {
+			ff.TimerWheel.Add(key, left)
+		}
+		ff.Packets[key] = now.Add(left)
+	}
+}
+
+func newFragmentKey(packet []byte, fp firewall.Packet, incoming bool, h *HostInfo) fragmentKey {
+	return fragmentKey{
+		Peer:     h.vpnIp,
+		RemoteIP: fp.RemoteIP,
+		LocalIP:  fp.LocalIP,
+		ID:       binary.BigEndian.Uint16(packet[4:6]),
+		Protocol: fp.Protocol,
+		Incoming: incoming,
+	}
+}
+
+// isFirstFragment reports if packet is the start of a packet that was fragmented, it has more fragments and no offset
+func isFirstFragment(packet []byte) bool {
+	return len(packet) >= 8 && binary.BigEndian.Uint16(packet[6:8])&0x3FFF == 0x2000
+}
+
+// allow checks that the first fragment of the packet fp belongs to was allowed
+func (ff *FirewallFragments) allow(packet []byte, fp firewall.Packet, incoming bool, h *HostInfo) error {
+	ff.Lock()
+	defer ff.Unlock()
+
+	ff.purge(time.Now())
+	if _, ok := ff.Packets[newFragmentKey(packet, fp, incoming, h)]; ok {
+		return nil
+	}
+
+	ff.droppedNoFirst.Inc(1)
+	return ErrNoFirstFragment
+}
+
+// add records an allowed first fragment so the rest of the packet can follow it
+func (ff *FirewallFragments) add(packet []byte, fp firewall.Packet, incoming bool, h *HostInfo) error {
+	ff.Lock()
+	defer ff.Unlock()
+
+	now := time.Now()
+	ff.purge(now)
+
+	key := newFragmentKey(packet, fp, incoming, h)
+	if _, ok := ff.Packets[key]; !ok {
+		if len(ff.Packets) >= ff.max {
+			ff.droppedFull.Inc(1)
+			return ErrTooManyFragments
+		}
+
+		ff.TimerWheel.Add(key, ff.timeout)
+	}
+
+	ff.Packets[key] = now.Add(ff.timeout)
+	return nil
+}
+
+// purge forgets every packet whose fragments are no longer allowed. Caller must own the lock!
+func (ff *FirewallFragments) purge(now time.Time) {
+	ff.TimerWheel.Advance(now)
+	for {
+		key, has := ff.TimerWheel.Purge()
+		if !has {
+			return
+		}
+
+		expires, ok := ff.Packets[key]
+		if !ok {
+			continue
+		}
+
+		if left := expires.Sub(now); left > 0 {
+			// The first fragment was seen again, keep it around
+			ff.TimerWheel.Add(key, left)
+			continue
+		}
+
+		delete(ff.Packets, key)
+	}
+}
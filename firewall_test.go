@@ -504,6 +504,122 @@ func TestFirewall_Drop3(t *testing.T) {
 	assert.Equal(t, fw.Drop([]byte{}, p, true, &h3, cp, nil), ErrNoMatchingRule)
 }
 
+func TestFirewall_DropFragments(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{&ipNet},
+			Groups:         []string{"default-group"},
+			InvertedGroups: map[string]struct{}{"default-group": {}},
+			Issuer:         "signer-shasum",
+		},
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &c,
+		},
+		vpnIp: iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 5)),
+	}
+	h.CreateRemoteCIDR(&c)
+
+	// fragment builds an incoming udp packet from 1.2.3.5 to 1.2.3.4 port 80
+	fragment := func(id uint16, flagsFrags uint16, port uint16) ([]byte, firewall.Packet) {
+		b := make([]byte, 28)
+		b[0] = 0x45
+		binary.BigEndian.PutUint16(b[4:6], id)
+		binary.BigEndian.PutUint16(b[6:8], flagsFrags)
+		b[9] = firewall.ProtoUDP
+		copy(b[12:16], net.IPv4(1, 2, 3, 5).To4())
+		copy(b[16:20], net.IPv4(1, 2, 3, 4).To4())
+		binary.BigEndian.PutUint16(b[20:22], 9000)
+		binary.BigEndian.PutUint16(b[22:24], port)
+
+		fp := firewall.Packet{}
+		assert.NoError(t, newPacket(b, true, &fp))
+		return b, fp
+	}
+
+	cp := cert.NewCAPool()
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoUDP, 80, 80, []string{"any"}, "", nil, nil, "", ""))
+	assert.Nil(t, fw.AddRule(true, firewall.ProtoUDP, firewall.PortFragment, firewall.PortFragment, []string{"any"}, "", nil, nil, "", ""))
+
+	// Without tracking `port: fragment` lets any fragment in
+	b, fp := fragment(1, 100, 0)
+	assert.NoError(t, fw.Drop(b, fp, true, &h, cp, nil))
+
+	fw.Fragments = NewFirewallFragments(time.Minute, 2)
+
+	// The rest of a packet is dropped until its first fragment was allowed, no matter the rules
+	b, fp = fragment(2, 100, 0)
+	assert.Equal(t, ErrNoFirstFragment, fw.Drop(b, fp, true, &h, cp, nil))
+
+	first, firstFp := fragment(2, 0x2000, 80)
+	assert.NoError(t, fw.Drop(first, firstFp, true, &h, cp, nil))
+	assert.NoError(t, fw.Drop(b, fp, true, &h, cp, nil))
+	b, fp = fragment(2, 200, 0)
+	assert.NoError(t, fw.Drop(b, fp, true, &h, cp, nil))
+
+	// A first fragment the rules drop lets nothing through
+	first, firstFp = fragment(3, 0x2000, 81)
+	assert.Equal(t, ErrNoMatchingRule, fw.Drop(first, firstFp, true, &h, cp, nil))
+	b, fp = fragment(3, 100, 0)
+	assert.Equal(t, ErrNoFirstFragment, fw.Drop(b, fp, true, &h, cp, nil))
+
+	// Fragments of the same packet from another direction or peer are not the same packet
+	b, fp = fragment(2, 100, 0)
+	assert.Equal(t, ErrNoFirstFragment, fw.Drop(b, fp, false, &h, cp, nil))
+	other := HostInfo{ConnectionState: h.ConnectionState, vpnIp: iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 6))}
+	other.CreateRemoteCIDR(&c)
+	assert.Equal(t, ErrNoFirstFragment, fw.Drop(b, fp, true, &other, cp, nil))
+
+	// Unfragmented packets are not tracked
+	b, fp = fragment(4, 0x4000, 80)
+	assert.NoError(t, fw.Drop(b, fp, true, &h, cp, nil))
+	assert.Len(t, fw.Fragments.Packets, 1)
+
+	// Only so many packets are tracked at once
+	first, firstFp = fragment(5, 0x2000, 80)
+	assert.NoError(t, fw.Drop(first, firstFp, true, &h, cp, nil))
+	first, firstFp = fragment(6, 0x2000, 80)
+	assert.Equal(t, ErrTooManyFragments, fw.Drop(first, firstFp, true, &h, cp, nil))
+
+	// And only for so long
+	fw.Fragments.purge(time.Now().Add(2 * time.Minute))
+	assert.Empty(t, fw.Fragments.Packets)
+	b, fp = fragment(2, 100, 0)
+	assert.Equal(t, ErrNoFirstFragment, fw.Drop(b, fp, true, &h, cp, nil))
+
+	// A reload keeps what was tracked, within the new limits
+	first, firstFp = fragment(7, 0x2000, 80)
+	assert.NoError(t, fw.Drop(first, firstFp, true, &h, cp, nil))
+	first, firstFp = fragment(8, 0x2000, 80)
+	assert.NoError(t, fw.Drop(first, firstFp, true, &h, cp, nil))
+	reloaded := NewFirewallFragments(time.Minute, 1)
+	reloaded.carry(fw.Fragments)
+	assert.Len(t, reloaded.Packets, 1)
+	fw.Fragments = reloaded
+	b, fp = fragment(7, 100, 0)
+	b2, fp2 := fragment(8, 100, 0)
+	err7, err8 := fw.Drop(b, fp, true, &h, cp, nil), fw.Drop(b2, fp2, true, &h, cp, nil)
+	assert.True(t, (err7 == nil) != (err8 == nil))
+
+	reloaded = NewFirewallFragments(time.Second, 10)
+	reloaded.carry(fw.Fragments)
+	assert.Len(t, reloaded.Packets, 1)
+	reloaded.purge(time.Now().Add(time.Minute))
+	assert.Empty(t, reloaded.Packets)
+}
+
 func TestFirewall_DropConntrackReload(t *testing.T) {
 	l := test.NewLogger()
 	ob := &bytes.Buffer{}
@@ -740,6 +856,17 @@ func TestNewFirewallFromConfig(t *testing.T) {
 	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "1", "proto": "any", "group": "a", "groups": []string{"b", "c"}}}}
 	_, err = NewFirewallFromConfig(l, c, conf)
 	assert.EqualError(t, err, "firewall.inbound rule #0; only one of group or groups should be defined, both provided")
+
+	// Test fragment tracking limits
+	conf = config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{"fragments": map[interface{}]interface{}{"track": true, "max": 0}}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.fragments.max must be greater than 0, got 0")
+
+	conf = config.NewC(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{"fragments": map[interface{}]interface{}{"track": true, "timeout": "-1s"}}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.fragments.timeout must be greater than 0, got -1s")
 }
 
 func TestAddFirewallRulesFromConfig(t *testing.T) {
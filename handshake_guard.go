@@ -0,0 +1,278 @@
+package nebula
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+)
+
+const (
+	DefaultHandshakeCookieThreshold = 1000
+	DefaultHandshakeRateLimitBurst  = 10
+
+	// handshakeCookieLen is the size of the cookie a responder hands out and an initiator echoes
+	handshakeCookieLen = 16
+	// handshakeCookieEchoLen is how much of the stage 0 message a cookie reply echoes, which is part of the initiators
+	// ephemeral key and proves the reply came from someone that saw the handshake
+	handshakeCookieEchoLen = 16
+	// handshakeCookieRotation is how often the cookie secret changes, cookies are good for up to twice this long
+	handshakeCookieRotation = 2 * time.Minute
+	// handshakeGuardMaxSources bounds the per source rate limit state, the source we heard from least recently is
+	// forgotten to make room for a new one
+	handshakeGuardMaxSources = 65536
+)
+
+// handshakeGuard protects a responder from handshake floods. When more stage 0 handshakes arrive in a second than
+// handshakes.cookie_threshold the initiator is sent a cookie tied to its address instead of a response, and only
+// handshakes that echo a valid cookie get the expensive certificate and DH work. This proves the initiator can receive
+// traffic at the address it claims without us keeping any state. Each source ip can also be held to
+// handshakes.rate_limit handshakes per second.
+type handshakeGuard struct {
+	threshold atomic.Int64
+	rateLimit atomic.Int64
+	rateBurst atomic.Int64
+
+	secretLock    sync.RWMutex
+	secrets       [2][32]byte // the current and previous cookie secret
+	secretRotated time.Time
+
+	loadSecond atomic.Int64
+	loadCount  atomic.Int64
+	lastCount  atomic.Int64
+
+	// sources holds the rate of each source ip, sourcesLRU orders them from most to least recently seen
+	sourcesLock sync.Mutex
+	sources     map[[16]byte]*list.Element
+	sourcesLRU  *list.List
+
+	metricCookieSent     metrics.Counter
+	metricCookieAccepted metrics.Counter
+	metricCookieRejected metrics.Counter
+	metricCookieReceived metrics.Counter
+	metricRateLimited    metrics.Counter
+	metricLoadDropped    metrics.Counter
+
+	l *logrus.Logger
+}
+
+// handshakeRate is a token bucket for the handshakes from a single source ip
+type handshakeRate struct {
+	key    [16]byte
+	tokens float64
+	last   time.Time
+}
+
+func newHandshakeGuardFromConfig(l *logrus.Logger, c *config.C) *handshakeGuard {
+	g := newHandshakeGuard(l, time.Now())
+
+	g.reload(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		g.reload(c, false)
+	})
+
+	return g
+}
+
+func newHandshakeGuard(l *logrus.Logger, now time.Time) *handshakeGuard {
+	g := &handshakeGuard{
+		sources:              map[[16]byte]*list.Element{},
+		sourcesLRU:           list.New(),
+		metricCookieSent:     metrics.GetOrRegisterCounter("handshake_manager.cookies.sent", nil),
+		metricCookieAccepted: metrics.GetOrRegisterCounter("handshake_manager.cookies.accepted", nil),
+		metricCookieRejected: metrics.GetOrRegisterCounter("handshake_manager.cookies.rejected", nil),
+		metricCookieReceived: metrics.GetOrRegisterCounter("handshake_manager.cookies.received", nil),
+		metricRateLimited:    metrics.GetOrRegisterCounter("handshake_manager.rate_limited", nil),
+		metricLoadDropped:    metrics.GetOrRegisterCounter("handshake_manager.load_dropped", nil),
+		l:                    l,
+	}
+
+	g.threshold.Store(DefaultHandshakeCookieThreshold)
+	g.rateBurst.Store(DefaultHandshakeRateLimitBurst)
+	g.rotateSecret(now)
+	g.rotateSecret(now)
+	return g
+}
+
+func (g *handshakeGuard) reload(c *config.C, initial bool) {
+	if initial || c.HasChanged("handshakes.cookie_threshold") {
+		g.threshold.Store(int64(c.GetInt("handshakes.cookie_threshold", DefaultHandshakeCookieThreshold)))
+		if !initial {
+			g.l.WithField("cookieThreshold", g.threshold.Load()).Info("handshakes.cookie_threshold changed")
+		}
+	}
+
+	if initial || c.HasChanged("handshakes.rate_limit") || c.HasChanged("handshakes.rate_limit_burst") {
+		g.rateLimit.Store(int64(c.GetInt("handshakes.rate_limit", 0)))
+		g.rateBurst.Store(int64(c.GetInt("handshakes.rate_limit_burst", DefaultHandshakeRateLimitBurst)))
+
+		g.sourcesLock.Lock()
+		g.sources = map[[16]byte]*list.Element{}
+		g.sourcesLRU.Init()
+		g.sourcesLock.Unlock()
+
+		if !initial {
+			g.l.WithField("rateLimit", g.rateLimit.Load()).WithField("rateLimitBurst", g.rateBurst.Load()).
+				Info("handshakes.rate_limit changed")
+		}
+	}
+}
+
+// underLoad records a stage 0 handshake arriving and reports if cookies are required right now. Load is measured as
+// the number of handshakes in the current and previous second. A negative threshold never requires cookies and 0
+// always does.
+func (g *handshakeGuard) underLoad(now time.Time) bool {
+	threshold := g.threshold.Load()
+	if threshold < 0 {
+		return false
+	}
+
+	sec := now.Unix()
+	if prev := g.loadSecond.Swap(sec); prev != sec {
+		count := g.loadCount.Swap(0)
+		if prev != sec-1 {
+			// Nothing arrived last second
+			count = 0
+		}
+		g.lastCount.Store(count)
+	}
+
+	n := g.loadCount.Add(1)
+	return n > threshold || g.lastCount.Load() > threshold
+}
+
+// allowSource reports if ip is within handshakes.rate_limit
+func (g *handshakeGuard) allowSource(ip net.IP, now time.Time) bool {
+	rate := g.rateLimit.Load()
+	if rate <= 0 {
+		return true
+	}
+	burst := float64(max(g.rateBurst.Load(), 1))
+
+	var key [16]byte
+	copy(key[:], ip.To16())
+
+	g.sourcesLock.Lock()
+	defer g.sourcesLock.Unlock()
+
+	var r *handshakeRate
+	if e, ok := g.sources[key]; ok {
+		g.sourcesLRU.MoveToFront(e)
+		r = e.Value.(*handshakeRate)
+	} else {
+		// Sources are spoofable, so a full table only gives up the one we heard from least recently. A source that
+		// keeps trying stays near the front no matter how many new ones show up.
+		if len(g.sources) >= handshakeGuardMaxSources {
+			oldest := g.sourcesLRU.Back()
+			delete(g.sources, oldest.Value.(*handshakeRate).key)
+			g.sourcesLRU.Remove(oldest)
+		}
+		r = &handshakeRate{key: key, tokens: burst, last: now}
+		g.sources[key] = g.sourcesLRU.PushFront(r)
+	}
+
+	r.tokens += now.Sub(r.last).Seconds() * float64(rate)
+	if r.tokens > burst {
+		r.tokens = burst
+	}
+	r.last = now
+
+	if r.tokens < 1 {
+		g.metricRateLimited.Inc(1)
+		return false
+	}
+
+	r.tokens--
+	return true
+}
+
+func (g *handshakeGuard) rotateSecret(now time.Time) {
+	g.secrets[1] = g.secrets[0]
+	_, _ = rand.Read(g.secrets[0][:])
+	g.secretRotated = now
+}
+
+// cookieSecrets returns the current and previous cookie secrets, rotating them when it is time
+func (g *handshakeGuard) cookieSecrets(now time.Time) [2][32]byte {
+	g.secretLock.RLock()
+	if now.Sub(g.secretRotated) < handshakeCookieRotation {
+		defer g.secretLock.RUnlock()
+		return g.secrets
+	}
+	g.secretLock.RUnlock()
+
+	g.secretLock.Lock()
+	defer g.secretLock.Unlock()
+	if now.Sub(g.secretRotated) >= handshakeCookieRotation {
+		g.rotateSecret(now)
+	}
+	return g.secrets
+}
+
+func handshakeCookie(secret [32]byte, addr *udp.Addr) []byte {
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write(addr.IP.To16())
+	mac.Write(binary.BigEndian.AppendUint16(nil, addr.Port))
+	return mac.Sum(nil)[:handshakeCookieLen]
+}
+
+// cookieReply builds the message asking the initiator of stage0 to try again with a cookie. The reply is smaller than
+// the handshake that triggered it so it can't be used to amplify traffic.
+func (g *handshakeGuard) cookieReply(addr *udp.Addr, stage0 []byte, h *header.H, now time.Time) []byte {
+	secrets := g.cookieSecrets(now)
+	out := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeCookie, h.RemoteIndex, 2)
+	out = append(out, stage0[header.Len:header.Len+handshakeCookieEchoLen]...)
+	return append(out, handshakeCookie(secrets[0], addr)...)
+}
+
+// openCookie checks the cookie an initiator echoed and returns the stage 0 handshake it wraps, or nil if the cookie is
+// not one we handed out to addr recently
+func (g *handshakeGuard) openCookie(addr *udp.Addr, packet []byte, now time.Time) []byte {
+	if len(packet) < header.Len+handshakeCookieLen+header.Len {
+		g.metricCookieRejected.Inc(1)
+		return nil
+	}
+
+	cookie := packet[header.Len : header.Len+handshakeCookieLen]
+	for _, secret := range g.cookieSecrets(now) {
+		if hmac.Equal(cookie, handshakeCookie(secret, addr)) {
+			g.metricCookieAccepted.Inc(1)
+			return packet[header.Len+handshakeCookieLen:]
+		}
+	}
+
+	g.metricCookieRejected.Inc(1)
+	return nil
+}
+
+// parseCookieReply returns the cookie from a responder if the reply is for stage0, the handshake we sent
+func parseCookieReply(packet []byte, stage0 []byte) []byte {
+	if len(packet) != header.Len+handshakeCookieEchoLen+handshakeCookieLen || len(stage0) < header.Len+handshakeCookieEchoLen {
+		return nil
+	}
+
+	echo := packet[header.Len : header.Len+handshakeCookieEchoLen]
+	if !hmac.Equal(echo, stage0[header.Len:header.Len+handshakeCookieEchoLen]) {
+		return nil
+	}
+
+	return packet[header.Len+handshakeCookieEchoLen:]
+}
+
+// withCookie wraps a stage 0 handshake with the cookie a responder gave us
+func withCookie(cookie []byte, stage0 []byte) []byte {
+	out := header.Encode(make([]byte, header.Len, header.Len+len(cookie)+len(stage0)), header.Version, header.Handshake, header.HandshakeCookie, 0, 1)
+	out = append(out, cookie...)
+	return append(out, stage0...)
+}
@@ -0,0 +1,138 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandshakeGuard_reload(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	g := newHandshakeGuardFromConfig(l, c)
+	assert.Equal(t, int64(DefaultHandshakeCookieThreshold), g.threshold.Load())
+	assert.Equal(t, int64(0), g.rateLimit.Load())
+	assert.Equal(t, int64(DefaultHandshakeRateLimitBurst), g.rateBurst.Load())
+
+	assert.NoError(t, c.ReloadConfigString("handshakes: {cookie_threshold: 5, rate_limit: 2, rate_limit_burst: 3}"))
+	assert.Equal(t, int64(5), g.threshold.Load())
+	assert.Equal(t, int64(2), g.rateLimit.Load())
+	assert.Equal(t, int64(3), g.rateBurst.Load())
+}
+
+func TestHandshakeGuard_underLoad(t *testing.T) {
+	g := newHandshakeGuard(test.NewLogger(), time.Now())
+	now := time.Unix(1000, 0)
+
+	g.threshold.Store(2)
+	assert.False(t, g.underLoad(now))
+	assert.False(t, g.underLoad(now))
+	assert.True(t, g.underLoad(now))
+
+	// The load from the previous second still counts
+	now = now.Add(time.Second)
+	assert.True(t, g.underLoad(now))
+
+	// But not once a quiet second has passed
+	now = now.Add(2 * time.Second)
+	assert.False(t, g.underLoad(now))
+
+	g.threshold.Store(0)
+	assert.True(t, g.underLoad(now))
+
+	g.threshold.Store(-1)
+	for i := 0; i < 10; i++ {
+		assert.False(t, g.underLoad(now))
+	}
+}
+
+func TestHandshakeGuard_allowSource(t *testing.T) {
+	g := newHandshakeGuard(test.NewLogger(), time.Now())
+	now := time.Now()
+	a := net.ParseIP("1.2.3.4")
+	b := net.ParseIP("1.2.3.5")
+
+	// No limit by default
+	for i := 0; i < 100; i++ {
+		assert.True(t, g.allowSource(a, now))
+	}
+
+	g.rateLimit.Store(2)
+	g.rateBurst.Store(3)
+	assert.True(t, g.allowSource(a, now))
+	assert.True(t, g.allowSource(a, now))
+	assert.True(t, g.allowSource(a, now))
+	assert.False(t, g.allowSource(a, now))
+
+	// Other sources have their own budget
+	assert.True(t, g.allowSource(b, now))
+
+	// Tokens come back at the configured rate
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, g.allowSource(a, now))
+	assert.False(t, g.allowSource(a, now))
+
+	// Cycling through more sources than we track does not reset a source that keeps trying
+	assert.False(t, g.allowSource(a, now))
+	for i := 0; i < handshakeGuardMaxSources; i++ {
+		assert.True(t, g.allowSource(net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), now))
+		if i%1000 == 0 {
+			assert.False(t, g.allowSource(a, now))
+		}
+	}
+	assert.False(t, g.allowSource(a, now))
+	assert.Len(t, g.sources, handshakeGuardMaxSources)
+	assert.Equal(t, handshakeGuardMaxSources, g.sourcesLRU.Len())
+
+	// b went quiet and was forgotten to make room
+	_, ok := g.sources[[16]byte(b.To16())]
+	assert.False(t, ok)
+}
+
+func TestHandshakeGuard_cookies(t *testing.T) {
+	now := time.Now()
+	g := newHandshakeGuard(test.NewLogger(), now)
+	addr := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+	other := udp.NewAddr(net.ParseIP("1.2.3.4"), 4243)
+
+	stage0 := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeIXPSK0, 1234, 1)
+	stage0 = append(stage0, []byte("the initiators ephemeral key and the rest of the handshake")...)
+	h := &header.H{}
+	assert.NoError(t, h.Parse(stage0))
+
+	reply := g.cookieReply(addr, stage0, h, now)
+	assert.NoError(t, h.Parse(reply))
+	assert.Equal(t, header.HandshakeCookie, h.Subtype)
+	assert.Equal(t, uint32(1234), h.RemoteIndex)
+	assert.Equal(t, uint64(2), h.MessageCounter)
+	assert.Less(t, len(reply), len(stage0))
+
+	// The initiator only takes a cookie that echoes its own handshake
+	cookie := parseCookieReply(reply, stage0)
+	assert.Len(t, cookie, handshakeCookieLen)
+	assert.Nil(t, parseCookieReply(reply, append(stage0[:header.Len:header.Len], []byte("a different handshake entirely")...)))
+	assert.Nil(t, parseCookieReply(reply[:len(reply)-1], stage0))
+
+	packet := withCookie(cookie, stage0)
+	assert.NoError(t, h.Parse(packet))
+	assert.Equal(t, header.HandshakeCookie, h.Subtype)
+	assert.Equal(t, uint64(1), h.MessageCounter)
+	assert.Equal(t, stage0, g.openCookie(addr, packet, now))
+
+	// Cookies are tied to the address they were handed to
+	assert.Nil(t, g.openCookie(other, packet, now))
+	assert.Nil(t, g.openCookie(addr, packet[:header.Len+handshakeCookieLen], now))
+
+	// A cookie survives one rotation of the secret but not two
+	now = now.Add(handshakeCookieRotation)
+	assert.Equal(t, stage0, g.openCookie(addr, packet, now))
+	now = now.Add(handshakeCookieRotation)
+	assert.Nil(t, g.openCookie(addr, packet, now))
+}
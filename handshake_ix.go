@@ -1,6 +1,8 @@
 package nebula
 
 import (
+	"errors"
+	"slices"
 	"time"
 
 	"github.com/flynn/noise"
@@ -23,13 +25,27 @@ func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
 	}
 
 	certState := f.pki.GetCertState()
-	ci := NewConnectionState(f.l, f.cipher, certState, true, noise.HandshakeIX, []byte{}, 0)
+	ci := NewConnectionState(f.l, f.cipher, certState, true, noise.HandshakeIX, f.psk.Load().Primary(), 0)
+	ci.setReplayWindow(f.l, f.replayWindow.Load())
 	hh.hostinfo.ConnectionState = ci
 
+	ci.kemKey, err = newKemKey(f.hybridKem)
+	if err != nil {
+		f.l.WithError(err).WithField("vpnIp", hh.hostinfo.vpnIp).
+			WithField("handshake", m{"stage": 0, "style": "ix_psk0"}).Error("Failed to generate kem key")
+		return false
+	}
+
 	hsProto := &NebulaHandshakeDetails{
-		InitiatorIndex: hh.hostinfo.localIndexId,
-		Time:           uint64(time.Now().UnixNano()),
-		Cert:           certState.RawCertificateNoKey,
+		InitiatorIndex:     hh.hostinfo.localIndexId,
+		Time:               uint64(time.Now().UnixNano()),
+		Cert:               certState.RawCertificateNoKey,
+		InitiatorMultiPort: f.multiPort.details().proto(),
+		Cipher:             f.cipher,
+		Ciphers:            f.ciphers,
+	}
+	if ci.kemKey != nil {
+		hsProto.KemEncapsulationKey = kemEncapsulationKey(ci.kemKey)
 	}
 
 	hsBytes := []byte{}
@@ -45,7 +61,8 @@ func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
 		return false
 	}
 
-	h := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeIXPSK0, 0, 1)
+	// Our index goes in the remote index field so a responder under load can address a cookie reply to this handshake
+	h := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeIXPSK0, hh.hostinfo.localIndexId, 1)
 	ci.messageCounter.Add(1)
 
 	msg, _, _, err := ci.H.WriteMessage(h, hsBytes)
@@ -64,17 +81,52 @@ func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
 	return true
 }
 
-func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []byte, h *header.H) {
-	certState := f.pki.GetCertState()
-	ci := NewConnectionState(f.l, f.cipher, certState, false, noise.HandshakeIX, []byte{}, 0)
-	// Mark packet 1 as seen so it doesn't show up as missed
-	ci.window.Update(f.l, 1)
+// ixReadStage1Message reads the initiators handshake message, trying each cipher and psk we accept until one works.
+// Without the right psk and cipher nothing in the message can be read, so outsiders are turned away before we look at
+// their certificate. The returned ConnectionState is nil if the message could not be read.
+func ixReadStage1Message(f *Interface, certState *CertState, addr *udp.Addr, packet []byte) (*ConnectionState, *NebulaHandshake) {
+	read := func(cipher string, psk []byte) (*ConnectionState, []byte, error) {
+		ci := NewConnectionState(f.l, cipher, certState, false, noise.HandshakeIX, psk, 0)
+		msg, _, _, err := ci.H.ReadMessage(nil, packet[header.Len:])
+		return ci, msg, err
+	}
+
+	// Our own cipher is the most likely, try it first
+	ciphers := []string{f.cipher}
+	for _, c := range f.ciphers {
+		if c != f.cipher {
+			ciphers = append(ciphers, c)
+		}
+	}
+	psk := f.psk.Load()
+
+	// Every psk and cipher pair is tried before no psk. Under psk0 the static key of a psk message is encrypted, read
+	// without a psk those bytes would be taken as a cleartext static key.
+	var ci *ConnectionState
+	var msg []byte
+	var usedPsk []byte
+	err := errors.New("no psk accepted")
+	for _, key := range psk.Keys() {
+		for _, cipher := range ciphers {
+			ci, msg, err = read(cipher, key)
+			if err == nil {
+				usedPsk = key
+				break
+			}
+		}
+		if err == nil {
+			break
+		}
+	}
+
+	if err != nil && psk.AllowNone() {
+		ci, msg, err = read(f.cipher, nil)
+	}
 
-	msg, _, _, err := ci.H.ReadMessage(nil, packet[header.Len:])
 	if err != nil {
 		f.l.WithError(err).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed to call noise.ReadMessage")
-		return
+		return nil, nil
 	}
 
 	hs := &NebulaHandshake{}
@@ -85,6 +137,37 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 	if err != nil || hs.Details == nil {
 		f.l.WithError(err).WithField("udpAddr", addr).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed unmarshal handshake message")
+		return nil, nil
+	}
+
+	// A message without a psk reads with any cipher, the initiator tells us which one it ran the handshake with
+	if usedPsk == nil && hs.Details.Cipher != "" && hs.Details.Cipher != f.cipher {
+		if !slices.Contains(f.ciphers, hs.Details.Cipher) {
+			f.l.WithField("udpAddr", addr).WithField("cipher", hs.Details.Cipher).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+				Info("Refusing handshake using a cipher we do not accept")
+			return nil, nil
+		}
+
+		ci, _, err = read(hs.Details.Cipher, nil)
+		if err != nil {
+			f.l.WithError(err).WithField("udpAddr", addr).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed to call noise.ReadMessage")
+			return nil, nil
+		}
+	}
+
+	// Only now that a candidate read the message is it worth holding a replay window for it
+	ci.setReplayWindow(f.l, f.replayWindow.Load())
+	// Mark packet 1 as seen so it doesn't show up as missed
+	ci.window.Update(f.l, 1)
+	return ci, hs
+}
+
+func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, streamed bool, packet []byte, h *header.H) {
+	certState := f.pki.GetCertState()
+	ci, hs := ixReadStage1Message(f, certState, addr, packet)
+	if ci == nil {
 		return
 	}
 
@@ -116,6 +199,43 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 		}
 	}
 
+	// Hosts that do not list their ciphers can only use the one they ran the handshake with, which must be ours
+	tunnelCipher := f.cipher
+	if len(hs.Details.Ciphers) > 0 {
+		tunnelCipher = negotiateCipher(f.ciphers, hs.Details.Ciphers)
+		if tunnelCipher == "" {
+			f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+				WithField("certName", certName).
+				WithField("fingerprint", fingerprint).
+				WithField("issuer", issuer).
+				WithField("ciphers", hs.Details.Ciphers).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+				Info("Refusing handshake from host without a cipher in common")
+			return
+		}
+	}
+
+	kemSecret, kemCiphertext, err := kemEncapsulate(f.hybridKem, hs.Details.KemEncapsulationKey)
+	if err != nil {
+		f.l.WithError(err).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			Info("Invalid kem key from host")
+		return
+	}
+
+	if kemSecret == nil && f.hybridKem == HybridKemRequired {
+		f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			Info("Refusing handshake from host without a kem key")
+		return
+	}
+
 	myIndex, err := generateIndex(f.l)
 	if err != nil {
 		f.l.WithError(err).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
@@ -146,12 +266,20 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 		WithField("issuer", issuer).
 		WithField("initiatorIndex", hs.Details.InitiatorIndex).WithField("responderIndex", hs.Details.ResponderIndex).
 		WithField("remoteIndex", h.RemoteIndex).WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+		WithField("cipher", tunnelCipher).WithField("hybridKem", kemSecret != nil).
 		Info("Handshake message received")
 
 	hs.Details.ResponderIndex = myIndex
 	hs.Details.Cert = certState.RawCertificateNoKey
 	// Update the time in case their clock is way off from ours
 	hs.Details.Time = uint64(time.Now().UnixNano())
+	hs.Details.ResponderMultiPort = f.multiPort.details().proto()
+	// Tell the initiator which cipher we picked for the tunnel
+	hs.Details.Cipher = tunnelCipher
+	hs.Details.Ciphers = nil
+	// Send back the kem ciphertext instead of echoing their key
+	hs.Details.KemEncapsulationKey = nil
+	hs.Details.KemCiphertext = kemCiphertext
 
 	hsBytes, err := hs.Marshal()
 	if err != nil {
@@ -194,10 +322,23 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 	ci.window.Update(f.l, 2)
 
 	ci.peerCert = remoteCert
-	ci.dKey = NewNebulaCipherState(dKey)
-	ci.eKey = NewNebulaCipherState(eKey)
+	ci.cipher = tunnelCipher
+	ci.hybridKem = kemSecret != nil
+	ci.dKey, err = NewNebulaCipherState(dKey, tunnelCipher, kemSecret)
+	if err == nil {
+		ci.eKey, err = NewNebulaCipherState(eKey, tunnelCipher, kemSecret)
+	}
+	if err != nil {
+		f.l.WithError(err).WithField("vpnIp", hostinfo.vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed to create tunnel cipher")
+		return
+	}
 
 	hostinfo.remotes = f.lightHouse.QueryCache(vpnIp)
+	hostinfo.SetMultiPort(newMultiPortDetails(hs.Details.InitiatorMultiPort))
 	hostinfo.SetRemote(addr)
 	hostinfo.CreateRemoteCIDR(remoteCert)
 
@@ -278,6 +419,10 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 		}
 	}
 
+	if !streamed {
+		f.udpHandshakeComplete(addr)
+	}
+
 	// Do the send
 	f.messageMetrics.Tx(header.Handshake, header.MessageSubType(msg[1]), 1)
 	if addr != nil {
@@ -322,7 +467,7 @@ func ixHandshakeStage1(f *Interface, addr *udp.Addr, via *ViaSender, packet []by
 	return
 }
 
-func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, hh *HandshakeHostInfo, packet []byte, h *header.H) bool {
+func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, streamed bool, hh *HandshakeHostInfo, packet []byte, h *header.H) bool {
 	if hh == nil {
 		// Nothing here to tear down, got a bogus stage 2 packet
 		return true
@@ -424,6 +569,50 @@ func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, hh *Handsha
 	// Mark packet 2 as seen so it doesn't show up as missed
 	ci.window.Update(f.l, 2)
 
+	// Responders that do not tell us the cipher they picked are using the one we ran the handshake with
+	tunnelCipher := f.cipher
+	if hs.Details.Cipher != "" {
+		if !slices.Contains(f.ciphers, hs.Details.Cipher) {
+			f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+				WithField("certName", certName).
+				WithField("fingerprint", fingerprint).
+				WithField("issuer", issuer).
+				WithField("cipher", hs.Details.Cipher).
+				WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
+				Error("Responder picked a cipher we do not accept")
+
+			// The handshake state machine is complete, if things break now there is no chance to recover. Tear down and start again
+			return true
+		}
+		tunnelCipher = hs.Details.Cipher
+	}
+
+	kemSecret, err := kemDecapsulate(ci.kemKey, hs.Details.KemCiphertext)
+	ci.kemKey = nil
+	if err != nil {
+		f.l.WithError(err).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
+			Error("Failed to complete the kem exchange")
+
+		// The handshake state machine is complete, if things break now there is no chance to recover. Tear down and start again
+		return true
+	}
+
+	if kemSecret == nil && f.hybridKem == HybridKemRequired {
+		f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
+			Error("Responder did not complete the kem exchange")
+
+		// The handshake state machine is complete, if things break now there is no chance to recover. Tear down and start again
+		return true
+	}
+
 	duration := time.Since(hh.startTime).Nanoseconds()
 	f.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
 		WithField("certName", certName).
@@ -431,17 +620,33 @@ func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, hh *Handsha
 		WithField("issuer", issuer).
 		WithField("initiatorIndex", hs.Details.InitiatorIndex).WithField("responderIndex", hs.Details.ResponderIndex).
 		WithField("remoteIndex", h.RemoteIndex).WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
+		WithField("cipher", tunnelCipher).WithField("hybridKem", kemSecret != nil).
 		WithField("durationNs", duration).
 		WithField("sentCachedPackets", len(hh.packetStore)).
 		Info("Handshake message received")
 
 	hostinfo.remoteIndexId = hs.Details.ResponderIndex
 	hostinfo.lastHandshakeTime = hs.Details.Time
+	hostinfo.SetMultiPort(newMultiPortDetails(hs.Details.ResponderMultiPort))
 
 	// Store their cert and our symmetric keys
 	ci.peerCert = remoteCert
-	ci.dKey = NewNebulaCipherState(dKey)
-	ci.eKey = NewNebulaCipherState(eKey)
+	ci.cipher = tunnelCipher
+	ci.hybridKem = kemSecret != nil
+	ci.dKey, err = NewNebulaCipherState(dKey, tunnelCipher, kemSecret)
+	if err == nil {
+		ci.eKey, err = NewNebulaCipherState(eKey, tunnelCipher, kemSecret)
+	}
+	if err != nil {
+		f.l.WithError(err).WithField("vpnIp", vpnIp).WithField("udpAddr", addr).
+			WithField("certName", certName).
+			WithField("fingerprint", fingerprint).
+			WithField("issuer", issuer).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).Error("Failed to create tunnel cipher")
+
+		// The handshake state machine is complete, if things break now there is no chance to recover. Tear down and start again
+		return true
+	}
 
 	// Make sure the current udpAddr being used is set for responding
 	if addr != nil {
@@ -455,6 +660,9 @@ func ixHandshakeStage2(f *Interface, addr *udp.Addr, via *ViaSender, hh *Handsha
 
 	// Complete our handshake and update metrics, this will replace any existing tunnels for this vpnIp
 	f.handshakeManager.Complete(hostinfo, f)
+	if !streamed {
+		f.udpHandshakeComplete(addr)
+	}
 	f.connectionManager.AddTrafficWatch(hostinfo.localIndexId)
 
 	hostinfo.ConnectionState.messageCounter.Store(2)
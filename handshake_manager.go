@@ -14,6 +14,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/stream"
 	"github.com/slackhq/nebula/udp"
 )
 
@@ -22,6 +23,7 @@ const (
 	DefaultHandshakeRetries       = 10
 	DefaultHandshakeTriggerBuffer = 64
 	DefaultUseRelays              = true
+	DefaultStreamFallbackAfter    = 3
 )
 
 var (
@@ -30,6 +32,8 @@ var (
 		retries:       DefaultHandshakeRetries,
 		triggerBuffer: DefaultHandshakeTriggerBuffer,
 		useRelays:     DefaultUseRelays,
+
+		streamFallbackAfter: DefaultStreamFallbackAfter,
 	}
 )
 
@@ -39,7 +43,11 @@ type HandshakeConfig struct {
 	triggerBuffer int
 	useRelays     bool
 
+	// streamFallbackAfter is how many handshake attempts go unanswered over udp before we also try stream addresses
+	streamFallbackAfter int
+
 	messageMetrics *MessageMetrics
+	guard          *handshakeGuard
 }
 
 type HandshakeManager struct {
@@ -49,9 +57,13 @@ type HandshakeManager struct {
 	vpnIps  map[iputil.VpnIp]*HandshakeHostInfo
 	indexes map[uint32]*HandshakeHostInfo
 
-	mainHostMap            *HostMap
-	lightHouse             *LightHouse
-	outside                udp.Conn
+	mainHostMap *HostMap
+	lightHouse  *LightHouse
+	outside     udp.Conn
+	stream      *stream.Conn
+	// udp is outside without the stream mux, handshakes to udp remotes always go over udp so a stream we fell back
+	// to doesn't keep us from finding out udp works again
+	udp                    udp.Conn
 	config                 HandshakeConfig
 	OutboundHandshakeTimer *LockingTimerWheel[iputil.VpnIp]
 	messageMetrics         *MessageMetrics
@@ -73,6 +85,10 @@ type HandshakeHostInfo struct {
 	lastRemotes []*udp.Addr     // Remotes that we sent to during the previous attempt
 	packetStore []*cachedPacket // A set of packets to be transmitted once the handshake completes
 
+	deniedRelays map[iputil.VpnIp]struct{} // Relays that refused to relay for this handshake
+	cookies      map[string][]byte         // Cookies responders under load asked us to echo, by their address
+	streamed     bool                      // Have we fallen back to sending over streams yet
+
 	hostinfo *HostInfo
 }
 
@@ -102,12 +118,21 @@ func (hh *HandshakeHostInfo) cachePacket(l *logrus.Logger, t header.MessageType,
 }
 
 func NewHandshakeManager(l *logrus.Logger, mainHostMap *HostMap, lightHouse *LightHouse, outside udp.Conn, config HandshakeConfig) *HandshakeManager {
+	var s *stream.Conn
+	u := outside
+	if mux, ok := outside.(*stream.Mux); ok {
+		s = mux.Stream()
+		u = mux.Unwrap()
+	}
+
 	return &HandshakeManager{
 		vpnIps:                 map[iputil.VpnIp]*HandshakeHostInfo{},
 		indexes:                map[uint32]*HandshakeHostInfo{},
 		mainHostMap:            mainHostMap,
 		lightHouse:             lightHouse,
 		outside:                outside,
+		stream:                 s,
+		udp:                    u,
 		config:                 config,
 		trigger:                make(chan iputil.VpnIp, config.triggerBuffer),
 		OutboundHandshakeTimer: NewLockingTimerWheel[iputil.VpnIp](config.tryInterval, hsTimeout(config.retries, config.tryInterval)),
@@ -134,7 +159,8 @@ func (c *HandshakeManager) Run(ctx context.Context) {
 	}
 }
 
-func (hm *HandshakeManager) HandleIncoming(addr *udp.Addr, via *ViaSender, packet []byte, h *header.H) {
+// HandleIncoming processes a handshake packet, streamed is set when it arrived over a tcp stream instead of udp
+func (hm *HandshakeManager) HandleIncoming(addr *udp.Addr, via *ViaSender, streamed bool, packet []byte, h *header.H) {
 	// First remote allow list check before we know the vpnIp
 	if addr != nil {
 		if !hm.lightHouse.GetRemoteAllowList().AllowUnknownVpnIp(addr.IP) {
@@ -147,15 +173,130 @@ func (hm *HandshakeManager) HandleIncoming(addr *udp.Addr, via *ViaSender, packe
 	case header.HandshakeIXPSK0:
 		switch h.MessageCounter {
 		case 1:
-			ixHandshakeStage1(hm.f, addr, via, packet, h)
+			if hm.guardStage0(addr, packet, h) {
+				ixHandshakeStage1(hm.f, addr, via, streamed, packet, h)
+			}
 
 		case 2:
 			newHostinfo := hm.queryIndex(h.RemoteIndex)
-			tearDown := ixHandshakeStage2(hm.f, addr, via, newHostinfo, packet, h)
+			tearDown := ixHandshakeStage2(hm.f, addr, via, streamed, newHostinfo, packet, h)
 			if tearDown && newHostinfo != nil {
 				hm.DeleteHostInfo(newHostinfo.hostinfo)
 			}
 		}
+
+	case header.HandshakeCookie:
+		switch h.MessageCounter {
+		case 1:
+			hm.handleCookieStage0(addr, via, streamed, packet)
+		case 2:
+			hm.handleCookieReply(addr, packet, h)
+		}
+	}
+}
+
+// guardStage0 decides if a stage 0 handshake from addr is worth the work of a response. Under load the initiator is
+// asked to come back with a cookie instead. Relayed handshakes already came through an authenticated tunnel.
+func (hm *HandshakeManager) guardStage0(addr *udp.Addr, packet []byte, h *header.H) bool {
+	g := hm.config.guard
+	if g == nil || addr == nil {
+		return true
+	}
+
+	now := time.Now()
+	loaded := g.underLoad(now)
+	if !g.allowSource(addr.IP, now) {
+		return false
+	}
+
+	if !loaded {
+		return true
+	}
+
+	// Older initiators do not send their index and have no way to receive a cookie, they have to wait out the load
+	if h.RemoteIndex == 0 || len(packet) < header.Len+handshakeCookieEchoLen {
+		g.metricLoadDropped.Inc(1)
+		return false
+	}
+
+	reply := g.cookieReply(addr, packet, h, now)
+	hm.messageMetrics.Tx(header.Handshake, header.HandshakeCookie, 1)
+	err := hm.outside.WriteTo(reply, addr)
+	if err != nil {
+		hm.l.WithError(err).WithField("udpAddr", addr).Debug("Failed to send handshake cookie")
+		return false
+	}
+
+	g.metricCookieSent.Inc(1)
+	return false
+}
+
+// handleCookieStage0 processes a stage 0 handshake that echoes a cookie, which skips the load check
+func (hm *HandshakeManager) handleCookieStage0(addr *udp.Addr, via *ViaSender, streamed bool, packet []byte) {
+	g := hm.config.guard
+	if g == nil || addr == nil {
+		return
+	}
+
+	now := time.Now()
+	g.underLoad(now)
+	if !g.allowSource(addr.IP, now) {
+		return
+	}
+
+	stage0 := g.openCookie(addr, packet, now)
+	if stage0 == nil {
+		hm.l.WithField("udpAddr", addr).Debug("Invalid handshake cookie")
+		return
+	}
+
+	h := &header.H{}
+	if err := h.Parse(stage0); err != nil || h.Type != header.Handshake || h.Subtype != header.HandshakeIXPSK0 || h.MessageCounter != 1 {
+		return
+	}
+
+	ixHandshakeStage1(hm.f, addr, via, streamed, stage0, h)
+}
+
+// handleCookieReply stores the cookie a responder under load handed out for one of our handshakes and retries
+// right away with it
+func (hm *HandshakeManager) handleCookieReply(addr *udp.Addr, packet []byte, h *header.H) {
+	if addr == nil {
+		return
+	}
+
+	hh := hm.queryIndex(h.RemoteIndex)
+	if hh == nil {
+		return
+	}
+
+	hh.Lock()
+	defer hh.Unlock()
+
+	cookie := parseCookieReply(packet, hh.hostinfo.HandshakePacket[0])
+	if cookie == nil {
+		hh.hostinfo.logger(hm.l).WithField("udpAddr", addr).Debug("Ignoring a handshake cookie that is not for this handshake")
+		return
+	}
+
+	if g := hm.config.guard; g != nil {
+		g.metricCookieReceived.Inc(1)
+	}
+
+	if hh.cookies == nil {
+		hh.cookies = map[string][]byte{}
+	}
+	hh.cookies[addr.String()] = append([]byte{}, cookie...)
+
+	hh.hostinfo.logger(hm.l).WithField("udpAddr", addr).
+		WithField("initiatorIndex", hh.hostinfo.localIndexId).
+		WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+		Info("Responder is under load, retrying handshake with a cookie")
+
+	hm.messageMetrics.Tx(header.Handshake, header.HandshakeCookie, 1)
+	err := hm.outside.WriteTo(withCookie(cookie, hh.hostinfo.HandshakePacket[0]), addr)
+	if err != nil {
+		hh.hostinfo.logger(hm.l).WithField("udpAddr", addr).WithError(err).Error("Failed to send handshake message")
 	}
 }
 
@@ -236,8 +377,13 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 	// Send the handshake to all known ips, stage 2 takes care of assigning the hostinfo.remote based on the first to reply
 	var sentTo []*udp.Addr
 	hostinfo.remotes.ForEach(hm.mainHostMap.preferredRanges, func(addr *udp.Addr, _ bool) {
-		hm.messageMetrics.Tx(header.Handshake, header.MessageSubType(hostinfo.HandshakePacket[0][1]), 1)
-		err := hm.outside.WriteTo(hostinfo.HandshakePacket[0], addr)
+		packet := hostinfo.HandshakePacket[0]
+		if cookie, ok := hh.cookies[addr.String()]; ok {
+			packet = withCookie(cookie, packet)
+		}
+
+		hm.messageMetrics.Tx(header.Handshake, header.MessageSubType(packet[1]), 1)
+		err := hm.udp.WriteTo(packet, addr)
 		if err != nil {
 			hostinfo.logger(hm.l).WithField("udpAddr", addr).
 				WithField("initiatorIndex", hostinfo.localIndexId).
@@ -263,6 +409,12 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 			Debug("Handshake message sent")
 	}
 
+	// Udp may be dropped somewhere between us, so try the addresses the remote accepts streams on once udp has gone
+	// unanswered for a while or right away if there is nothing else to try
+	if hm.stream != nil && (len(remotes) == 0 || hh.counter > hm.config.streamFallbackAfter) {
+		hm.handshakeOverStreams(hh)
+	}
+
 	if hm.config.useRelays && len(hostinfo.remotes.relays) > 0 {
 		hostinfo.logger(hm.l).WithField("relays", hostinfo.remotes.relays).Info("Attempt to relay through hosts")
 		// Send a RelayRequest to all known Relay IP's
@@ -271,6 +423,10 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 			if *relay == vpnIp || *relay == hm.lightHouse.myVpnIp {
 				continue
 			}
+			// Don't keep asking a relay that already said no
+			if _, ok := hh.deniedRelays[*relay]; ok {
+				continue
+			}
 			relayHostInfo := hm.mainHostMap.QueryVpnIp(*relay)
 			if relayHostInfo == nil || relayHostInfo.remote == nil {
 				hostinfo.logger(hm.l).WithField("relay", relay.String()).Info("Establish tunnel to relay target")
@@ -291,6 +447,7 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 						InitiatorRelayIndex: existingRelay.LocalIndex,
 						RelayFromIp:         uint32(hm.lightHouse.myVpnIp),
 						RelayToIp:           uint32(vpnIp),
+						MaxHops:             hm.f.relayManager.GetMaxHops(),
 					}
 					msg, err := m.Marshal()
 					if err != nil {
@@ -327,6 +484,7 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 						InitiatorRelayIndex: idx,
 						RelayFromIp:         uint32(hm.lightHouse.myVpnIp),
 						RelayToIp:           uint32(vpnIp),
+						MaxHops:             hm.f.relayManager.GetMaxHops(),
 					}
 					msg, err := m.Marshal()
 					if err != nil {
@@ -353,6 +511,70 @@ func (hm *HandshakeManager) handleOutbound(vpnIp iputil.VpnIp, lighthouseTrigger
 	}
 }
 
+// RelayDenied records that relayIp refused to relay for the pending handshake with vpnIp. The relay is skipped for
+// the rest of the handshake and another attempt is made right away so the remaining relays can be used.
+func (hm *HandshakeManager) RelayDenied(vpnIp, relayIp iputil.VpnIp) {
+	hh := hm.queryVpnIp(vpnIp)
+	if hh == nil {
+		return
+	}
+
+	hh.Lock()
+	if hh.deniedRelays == nil {
+		hh.deniedRelays = map[iputil.VpnIp]struct{}{}
+	}
+	hh.deniedRelays[relayIp] = struct{}{}
+	hh.Unlock()
+
+	select {
+	case hm.trigger <- vpnIp:
+	default:
+	}
+}
+
+// handshakeOverStreams sends the first handshake message to every stream address we know for the host
+func (hm *HandshakeManager) handshakeOverStreams(hh *HandshakeHostInfo) {
+	hostinfo := hh.hostinfo
+	streams := hostinfo.remotes.CopyStreams(hm.mainHostMap.preferredRanges)
+	if len(streams) == 0 {
+		return
+	}
+
+	var sentTo []*udp.Addr
+	for _, r := range streams {
+		packet := hostinfo.HandshakePacket[0]
+		if cookie, ok := hh.cookies[r.Addr.String()]; ok {
+			packet = withCookie(cookie, packet)
+		}
+
+		// Anything else we send to this address has to go over the stream too
+		hm.stream.AddRemote(r)
+		hm.messageMetrics.Tx(header.Handshake, header.MessageSubType(packet[1]), 1)
+		err := hm.stream.WriteTo(packet, r.Addr)
+		if err != nil {
+			hostinfo.logger(hm.l).WithField("streamAddr", r.Addr).
+				WithField("initiatorIndex", hostinfo.localIndexId).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+				WithError(err).Error("Failed to send handshake message over stream")
+		} else {
+			sentTo = append(sentTo, r.Addr)
+		}
+	}
+
+	if !hh.streamed {
+		hh.streamed = true
+		hostinfo.logger(hm.l).WithField("streamAddrs", sentTo).
+			WithField("initiatorIndex", hostinfo.localIndexId).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			Info("Handshake message sent over stream")
+	} else if hm.l.IsLevelEnabled(logrus.DebugLevel) {
+		hostinfo.logger(hm.l).WithField("streamAddrs", sentTo).
+			WithField("initiatorIndex", hostinfo.localIndexId).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			Debug("Handshake message sent over stream")
+	}
+}
+
 // GetOrHandshake will try to find a hostinfo with a fully formed tunnel or start a new handshake if one is not present
 // The 2nd argument will be true if the hostinfo is ready to transmit traffic
 func (hm *HandshakeManager) GetOrHandshake(vpnIp iputil.VpnIp, cacheCb func(*HandshakeHostInfo)) (*HostInfo, bool) {
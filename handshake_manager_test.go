@@ -32,6 +32,7 @@ func Test_NewHandshakeManagerVpnIp(t *testing.T) {
 	blah := NewHandshakeManager(l, mainHM, lh, &udp.NoopConn{}, defaultHandshakeConfig)
 	blah.f = &Interface{handshakeManager: blah, pki: &PKI{}, l: l}
 	blah.f.pki.cs.Store(cs)
+	blah.f.replayWindow.Store(ReplayWindow)
 
 	now := time.Now()
 	blah.NextOutboundHandshakeTimerTick(now)
@@ -64,6 +65,36 @@ func Test_NewHandshakeManagerVpnIp(t *testing.T) {
 	assert.NotContains(t, blah.vpnIps, ip)
 }
 
+func TestInterface_messageCounterExhausted(t *testing.T) {
+	l := test.NewLogger()
+	_, vpncidr, _ := net.ParseCIDR("172.1.1.1/24")
+	ip := iputil.Ip2VpnIp(net.ParseIP("172.1.1.2"))
+	hm := NewHandshakeManager(l, NewHostMap(l, vpncidr, nil), newTestLighthouse(), &udp.NoopConn{}, defaultHandshakeConfig)
+	f := &Interface{handshakeManager: hm, l: l}
+	hostinfo := &HostInfo{vpnIp: ip, ConnectionState: &ConnectionState{}}
+	// The metric is shared with the other handshake managers in this package
+	initiated := hm.metricInitiated.Count()
+
+	// The first drop starts the rehandshake
+	f.messageCounterExhausted(hostinfo, hostinfo.ConnectionState, maxMessageCounter+1)
+	assert.Contains(t, hm.vpnIps, ip)
+	assert.Equal(t, initiated+1, hm.metricInitiated.Count())
+
+	// The rest of the packets sent with the same keys don't start another one, even once the first is gone
+	hm.DeleteHostInfo(hm.vpnIps[ip].hostinfo)
+	for i := uint64(2); i < 100; i++ {
+		f.messageCounterExhausted(hostinfo, hostinfo.ConnectionState, maxMessageCounter+i)
+	}
+	assert.NotContains(t, hm.vpnIps, ip)
+	assert.Equal(t, initiated+1, hm.metricInitiated.Count())
+
+	// New keys get their own rehandshake when they run out
+	hostinfo.ConnectionState = &ConnectionState{}
+	f.messageCounterExhausted(hostinfo, hostinfo.ConnectionState, maxMessageCounter+1)
+	assert.Contains(t, hm.vpnIps, ip)
+	assert.Equal(t, initiated+2, hm.metricInitiated.Count())
+}
+
 func testCountTimerWheelEntries(tw *LockingTimerWheel[iputil.VpnIp]) (c int) {
 	for _, i := range tw.t.wheel {
 		n := i.Head
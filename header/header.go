@@ -55,20 +55,25 @@ const (
 )
 
 const (
-	TestRequest MessageSubType = 0
-	TestReply   MessageSubType = 1
+	TestRequest    MessageSubType = 0
+	TestReply      MessageSubType = 1
+	TestMtuRequest MessageSubType = 2
+	TestMtuReply   MessageSubType = 3
 )
 
 const (
 	HandshakeIXPSK0 MessageSubType = 0
 	HandshakeXXPSK0 MessageSubType = 1
+	HandshakeCookie MessageSubType = 2
 )
 
 var ErrHeaderTooShort = errors.New("header is too short")
 
 var subTypeTestMap = map[MessageSubType]string{
-	TestRequest: "testRequest",
-	TestReply:   "testReply",
+	TestRequest:    "testRequest",
+	TestReply:      "testReply",
+	TestMtuRequest: "testMtuRequest",
+	TestMtuReply:   "testMtuReply",
 }
 
 var subTypeNoneMap = map[MessageSubType]string{0: "none"}
@@ -84,6 +89,7 @@ var subTypeMap = map[MessageType]*map[MessageSubType]string{
 	CloseTunnel: &subTypeNoneMap,
 	Handshake: {
 		HandshakeIXPSK0: "ix_psk0",
+		HandshakeCookie: "cookie",
 	},
 	Control: &subTypeNoneMap,
 }
@@ -96,6 +96,7 @@ func TestTypeMap(t *testing.T) {
 		CloseTunnel: &subTypeNoneMap,
 		Handshake: {
 			HandshakeIXPSK0: "ix_psk0",
+			HandshakeCookie: "cookie",
 		},
 		Control: &subTypeNoneMap,
 	}, subTypeMap)
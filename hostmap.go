@@ -49,6 +49,28 @@ type Relay struct {
 	LocalIndex  uint32
 	RemoteIndex uint32
 	PeerIp      iputil.VpnIp
+	// NextHopIp is set when a forwarding relay is part of a relay chain and the packets must be handed to another relay
+	// instead of directly to PeerIp
+	NextHopIp iputil.VpnIp
+	// OriginIp is set when a forwarding relay is part of a relay chain and the relay HostInfo is not the far end of the
+	// relay, it holds the vpn ip of the far end
+	OriginIp iputil.VpnIp
+}
+
+// NextHop returns the vpn ip of the host that packets for this relay should be forwarded to
+func (r *Relay) NextHop() iputil.VpnIp {
+	if r.NextHopIp != 0 {
+		return r.NextHopIp
+	}
+	return r.PeerIp
+}
+
+// Origin returns the vpn ip of the far end of the relay on the side of relayHostInfo
+func (r *Relay) Origin(relayHostInfo *HostInfo) iputil.VpnIp {
+	if r.OriginIp != 0 {
+		return r.OriginIp
+	}
+	return relayHostInfo.vpnIp
 }
 
 type HostMap struct {
@@ -229,6 +251,31 @@ type HostInfo struct {
 	lastRoam       time.Time
 	lastRoamRemote *udp.Addr
 
+	// relayedSince and directSince hold the unix nano time the tunnel started using a relay or a direct path,
+	// only one of them is set at a time
+	relayedSince atomic.Int64
+	directSince  atomic.Int64
+
+	// lastDirectAttempt is the unix nano time the connection manager last probed for a direct path while relayed
+	lastDirectAttempt atomic.Int64
+
+	// multiPort is the range of ports the peer listens on and sends from, learned during the handshake.
+	// multiPortAddrs holds each of those ports at the current remote, or nil if they can't be used from there.
+	// multiPortConfirmed is set once the peer sends to one of our extra ports, which it only does when it sees our
+	// base port untranslated and will accept traffic from the rest of our ports.
+	multiPort          multiPortDetails
+	multiPortAddrs     atomic.Pointer[[]*udp.Addr]
+	multiPortConfirmed atomic.Bool
+
+	// paths holds the rtt, jitter and loss measured to each remote
+	paths pathProbes
+
+	// relayStats caches the relay accounting for this host, see relayQuotas
+	relayStats atomic.Pointer[relayPeerStats]
+
+	// pmtu is the largest inner packet that fits through the underlay to the current remote
+	pmtu pathMtu
+
 	// Used to track other hostinfos for this vpn ip since only 1 can be primary
 	// Synchronised via hostmap lock and not the hostinfo lock.
 	next, prev *HostInfo
@@ -278,12 +325,19 @@ func (hm *HostMap) EmitStats() {
 	indexLen := len(hm.Indexes)
 	remoteIndexLen := len(hm.RemoteIndexes)
 	relaysLen := len(hm.Relays)
+	relayedLen := 0
+	for _, h := range hm.Hosts {
+		if h.remote == nil {
+			relayedLen++
+		}
+	}
 	hm.RUnlock()
 
 	metrics.GetOrRegisterGauge("hostmap.main.hosts", nil).Update(int64(hostLen))
 	metrics.GetOrRegisterGauge("hostmap.main.indexes", nil).Update(int64(indexLen))
 	metrics.GetOrRegisterGauge("hostmap.main.remoteIndexes", nil).Update(int64(remoteIndexLen))
 	metrics.GetOrRegisterGauge("hostmap.main.relayIndexes", nil).Update(int64(relaysLen))
+	metrics.GetOrRegisterGauge("hostmap.main.relayed", nil).Update(int64(relayedLen))
 }
 
 func (hm *HostMap) RemoveRelay(localIdx uint32) {
@@ -486,6 +540,12 @@ func (hm *HostMap) unlockedAddHostInfo(hostinfo *HostInfo, f *Interface) {
 	hm.Indexes[hostinfo.localIndexId] = hostinfo
 	hm.RemoteIndexes[hostinfo.remoteIndexId] = hostinfo
 
+	if hostinfo.remote == nil {
+		hostinfo.setRelayed()
+	} else {
+		hostinfo.setDirect()
+	}
+
 	if hm.l.Level >= logrus.DebugLevel {
 		hm.l.WithField("hostMap", m{"vpnIp": hostinfo.vpnIp, "mapTotalSize": len(hm.Hosts),
 			"hostinfo": m{"existing": true, "localIndexId": hostinfo.localIndexId, "hostId": hostinfo.vpnIp}}).
@@ -542,6 +602,16 @@ func (i *HostInfo) TryPromoteBest(preferredRanges []*net.IPNet, ifce *Interface)
 			}
 		}
 
+		// Move to a remote that probes have found to be clearly faster
+		if best := i.paths.best(remote, time.Now()); best != nil {
+			i.logger(ifce.l).WithField("udpAddr", remote).WithField("newAddr", best).
+				Info("Promoting a faster remote")
+			i.lastRoam = time.Now()
+			i.lastRoamRemote = remote
+			i.SetRemote(best)
+			return
+		}
+
 		i.remotes.ForEach(preferredRanges, func(addr *udp.Addr, preferred bool) {
 			if remote != nil && (addr == nil || !preferred) {
 				return
@@ -565,6 +635,16 @@ func (i *HostInfo) TryPromoteBest(preferredRanges []*net.IPNet, ifce *Interface)
 	}
 }
 
+func (i *HostInfo) setRelayed() {
+	i.relayedSince.Store(time.Now().UnixNano())
+	i.directSince.Store(0)
+}
+
+func (i *HostInfo) setDirect() {
+	i.directSince.Store(time.Now().UnixNano())
+	i.relayedSince.Store(0)
+}
+
 func (i *HostInfo) GetCert() *cert.NebulaCertificate {
 	if i.ConnectionState != nil {
 		return i.ConnectionState.peerCert
@@ -575,8 +655,29 @@ func (i *HostInfo) GetCert() *cert.NebulaCertificate {
 func (i *HostInfo) SetRemote(remote *udp.Addr) {
 	// We copy here because we likely got this remote from a source that reuses the object
 	if !i.remote.Equals(remote) {
+		if i.remote == nil {
+			// We were using relays or had no path at all before
+			i.setDirect()
+		}
 		i.remote = remote.Copy()
 		i.remotes.LearnRemote(i.vpnIp, remote.Copy())
+		i.setMultiPortAddrs()
+		// Where the peer sees us may have changed too, wait for it to tell us again
+		i.multiPortConfirmed.Store(false)
+	}
+}
+
+// SetMultiPort records the ports the peer told us about in the handshake
+func (i *HostInfo) SetMultiPort(d multiPortDetails) {
+	i.multiPort = d
+	i.setMultiPortAddrs()
+}
+
+func (i *HostInfo) setMultiPortAddrs() {
+	if addrs := i.multiPort.addrs(i.remote); addrs != nil {
+		i.multiPortAddrs.Store(&addrs)
+	} else {
+		i.multiPortAddrs.Store(nil)
 	}
 }
 
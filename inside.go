@@ -9,7 +9,9 @@ import (
 	"github.com/slackhq/nebula/udp"
 )
 
-func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache firewall.ConntrackCache) {
+// consumeInsidePacket sends a packet read from the tun to its tunnel. If batch is not nil packets going directly to a
+// remote are queued on it instead of written, out must then come from batch.next().
+func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache firewall.ConntrackCache, batch *sendBatch) {
 	err := newPacket(packet, false, fwPacket)
 	if err != nil {
 		if f.l.Level >= logrus.DebugLevel {
@@ -64,7 +66,10 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 
 	dropReason := f.firewall.Drop(packet, *fwPacket, false, hostinfo, f.pki.GetCAPool(), localCache)
 	if dropReason == nil {
-		f.sendNoMetrics(header.Message, 0, hostinfo.ConnectionState, hostinfo, nil, packet, nb, out, q)
+		if f.tooBig(hostinfo, packet, out, q) {
+			return
+		}
+		f.sendNoMetrics(header.Message, 0, hostinfo.ConnectionState, hostinfo, nil, packet, nb, out, q, batch)
 
 	} else {
 		f.rejectInside(packet, out, q)
@@ -113,7 +118,7 @@ func (f *Interface) rejectOutside(packet []byte, ci *ConnectionState, hostinfo *
 		return
 	}
 
-	f.sendNoMetrics(header.Message, 0, ci, hostinfo, nil, out, nb, packet, q)
+	f.sendNoMetrics(header.Message, 0, ci, hostinfo, nil, out, nb, packet, q, nil)
 }
 
 func (f *Interface) Handshake(vpnIp iputil.VpnIp) {
@@ -152,7 +157,7 @@ func (f *Interface) sendMessageNow(t header.MessageType, st header.MessageSubTyp
 		return
 	}
 
-	f.sendNoMetrics(header.Message, st, hostinfo.ConnectionState, hostinfo, nil, p, nb, out, 0)
+	f.sendNoMetrics(header.Message, st, hostinfo.ConnectionState, hostinfo, nil, p, nb, out, 0, nil)
 }
 
 // SendMessageToVpnIp handles real ip:port lookup and sends to the current best known address for vpnIp
@@ -182,12 +187,12 @@ func (f *Interface) SendMessageToHostInfo(t header.MessageType, st header.Messag
 
 func (f *Interface) send(t header.MessageType, st header.MessageSubType, ci *ConnectionState, hostinfo *HostInfo, p, nb, out []byte) {
 	f.messageMetrics.Tx(t, st, 1)
-	f.sendNoMetrics(t, st, ci, hostinfo, nil, p, nb, out, 0)
+	f.sendNoMetrics(t, st, ci, hostinfo, nil, p, nb, out, 0, nil)
 }
 
 func (f *Interface) sendTo(t header.MessageType, st header.MessageSubType, ci *ConnectionState, hostinfo *HostInfo, remote *udp.Addr, p, nb, out []byte) {
 	f.messageMetrics.Tx(t, st, 1)
-	f.sendNoMetrics(t, st, ci, hostinfo, remote, p, nb, out, 0)
+	f.sendNoMetrics(t, st, ci, hostinfo, remote, p, nb, out, 0, nil)
 }
 
 // SendVia sends a payload through a Relay tunnel. No authentication or encryption is done
@@ -210,6 +215,13 @@ func (f *Interface) SendVia(via *HostInfo,
 		via.ConnectionState.writeLock.Lock()
 	}
 	c := via.ConnectionState.messageCounter.Add(1)
+	if c > maxMessageCounter {
+		if noiseutil.EncryptLockNeeded {
+			via.ConnectionState.writeLock.Unlock()
+		}
+		f.messageCounterExhausted(via, via.ConnectionState, c)
+		return
+	}
 
 	out = header.Encode(out, header.Version, header.Message, header.MessageRelay, relay.RemoteIndex, c)
 	f.connectionManager.Out(via.localIndexId)
@@ -255,7 +267,19 @@ func (f *Interface) SendVia(via *HostInfo,
 	f.connectionManager.RelayUsed(relay.LocalIndex)
 }
 
-func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType, ci *ConnectionState, hostinfo *HostInfo, remote *udp.Addr, p, nb, out []byte, q int) {
+// messageCounterExhausted drops a message that would have gone past maxMessageCounter. The first drop for a set of keys
+// logs and starts the rehandshake that replaces them, the rest are dropped quietly until the new keys are in place.
+func (f *Interface) messageCounterExhausted(hostinfo *HostInfo, ci *ConnectionState, c uint64) {
+	if !ci.counterExhausted.CompareAndSwap(false, true) {
+		return
+	}
+
+	hostinfo.logger(f.l).WithField("counter", c).
+		Error("Message counter exhausted, dropping packets until the tunnel is rekeyed")
+	f.handshakeManager.StartHandshake(hostinfo.vpnIp, nil)
+}
+
+func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType, ci *ConnectionState, hostinfo *HostInfo, remote *udp.Addr, p, nb, out []byte, q int, batch *sendBatch) {
 	if ci.eKey == nil {
 		//TODO: log warning
 		return
@@ -278,6 +302,13 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 		ci.writeLock.Lock()
 	}
 	c := ci.messageCounter.Add(1)
+	if c > maxMessageCounter {
+		if noiseutil.EncryptLockNeeded {
+			ci.writeLock.Unlock()
+		}
+		f.messageCounterExhausted(hostinfo, ci, c)
+		return
+	}
 
 	//l.WithField("trace", string(debug.Stack())).Error("out Header ", &Header{Version, t, st, 0, hostinfo.remoteIndexId, c}, p)
 	out = header.Encode(out, header.Version, t, st, hostinfo.remoteIndexId, c)
@@ -309,16 +340,27 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 	}
 
 	if remote != nil {
-		err = f.writers[q].WriteTo(out, remote)
+		if t == header.Test && st == header.TestMtuRequest {
+			// Path mtu probes must not be fragmented on the way, or every size would look like it fits
+			err = udp.WriteToDontFragment(f.writers[q], out, remote)
+		} else {
+			err = f.writers[q].WriteTo(out, remote)
+		}
 		if err != nil {
 			hostinfo.logger(f.l).WithError(err).
 				WithField("udpAddr", remote).Error("Failed to write outgoing packet")
 		}
 	} else if hostinfo.remote != nil {
-		err = f.writers[q].WriteTo(out, hostinfo.remote)
+		writer, dst := f.multiPortWriter(t, hostinfo, p, q)
+		if batch != nil {
+			batch.add(writer, dst, out)
+			return
+		}
+
+		err = writer.WriteTo(out, dst)
 		if err != nil {
 			hostinfo.logger(f.l).WithError(err).
-				WithField("udpAddr", remote).Error("Failed to write outgoing packet")
+				WithField("udpAddr", dst).Error("Failed to write outgoing packet")
 		}
 	} else {
 		// Try to send via a relay
@@ -18,6 +18,7 @@ import (
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
 	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/stream"
 	"github.com/slackhq/nebula/udp"
 )
 
@@ -29,6 +30,9 @@ type InterfaceConfig struct {
 	Inside                  overlay.Device
 	pki                     *PKI
 	Cipher                  string
+	Ciphers                 []string
+	psk                     *Psk
+	hybridKem               HybridKemMode
 	Firewall                *Firewall
 	ServeDns                bool
 	HandshakeManager        *HandshakeManager
@@ -46,6 +50,17 @@ type InterfaceConfig struct {
 	tryPromoteEvery uint32
 	reQueryEvery    uint32
 	reQueryWait     time.Duration
+	rekeyInterval   time.Duration
+	rekeyBytes      uint64
+	replayWindow    uint64
+	probeInterval   time.Duration
+	probeCandidates bool
+	probeFailover   bool
+	pmtuEnabled     bool
+	pmtuMin         int
+	pmtuMax         int
+	pmtuInterval    time.Duration
+	tunBatch        int
 
 	ConntrackCacheTimeout time.Duration
 	l                     *logrus.Logger
@@ -57,6 +72,9 @@ type Interface struct {
 	inside             overlay.Device
 	pki                *PKI
 	cipher             string
+	ciphers            []string
+	psk                atomic.Pointer[Psk]
+	hybridKem          HybridKemMode
 	firewall           *Firewall
 	connectionManager  *connectionManager
 	handshakeManager   *HandshakeManager
@@ -68,6 +86,7 @@ type Interface struct {
 	dropLocalBroadcast bool
 	dropMulticast      bool
 	routines           int
+	tunBatch           int
 	disconnectInvalid  atomic.Bool
 	closed             atomic.Bool
 	relayManager       *relayManager
@@ -75,6 +94,16 @@ type Interface struct {
 	tryPromoteEvery atomic.Uint32
 	reQueryEvery    atomic.Uint32
 	reQueryWait     atomic.Int64
+	rekeyInterval   atomic.Int64
+	rekeyBytes      atomic.Uint64
+	replayWindow    atomic.Uint64
+	probeInterval   atomic.Int64
+	probeCandidates atomic.Bool
+	probeFailover   atomic.Bool
+	pmtuEnabled     atomic.Bool
+	pmtuMin         atomic.Int64
+	pmtuMax         atomic.Int64
+	pmtuInterval    atomic.Int64
 
 	sendRecvErrorConfig sendRecvErrorConfig
 
@@ -86,10 +115,16 @@ type Interface struct {
 
 	writers []udp.Conn
 	readers []io.ReadWriteCloser
+	// groWriters holds the readers that can merge the tcp segments we decrypt, nil for those that can't
+	groWriters []overlay.GroWriter
+	multiPort  *multiPort
+	stream     *stream.Conn
 
 	metricHandshakes    metrics.Histogram
 	messageMetrics      *MessageMetrics
 	cachedPacketMetrics *cachedPacketMetrics
+	probeMetrics        *probeMetrics
+	pmtuMetrics         *pathMtuMetrics
 
 	l *logrus.Logger
 }
@@ -163,6 +198,8 @@ func NewInterface(ctx context.Context, c *InterfaceConfig) (*Interface, error) {
 		outside:            c.Outside,
 		inside:             c.Inside,
 		cipher:             c.Cipher,
+		ciphers:            c.Ciphers,
+		hybridKem:          c.hybridKem,
 		firewall:           c.Firewall,
 		serveDns:           c.ServeDns,
 		handshakeManager:   c.HandshakeManager,
@@ -172,9 +209,11 @@ func NewInterface(ctx context.Context, c *InterfaceConfig) (*Interface, error) {
 		dropLocalBroadcast: c.DropLocalBroadcast,
 		dropMulticast:      c.DropMulticast,
 		routines:           c.routines,
+		tunBatch:           c.tunBatch,
 		version:            c.version,
 		writers:            make([]udp.Conn, c.routines),
 		readers:            make([]io.ReadWriteCloser, c.routines),
+		groWriters:         make([]overlay.GroWriter, c.routines),
 		myVpnIp:            myVpnIp,
 		relayManager:       c.relayManager,
 
@@ -186,13 +225,34 @@ func NewInterface(ctx context.Context, c *InterfaceConfig) (*Interface, error) {
 			sent:    metrics.GetOrRegisterCounter("hostinfo.cached_packets.sent", nil),
 			dropped: metrics.GetOrRegisterCounter("hostinfo.cached_packets.dropped", nil),
 		},
+		probeMetrics: &probeMetrics{
+			sent:      metrics.GetOrRegisterCounter("network.probes.sent", nil),
+			lost:      metrics.GetOrRegisterCounter("network.probes.lost", nil),
+			failovers: metrics.GetOrRegisterCounter("network.probes.failovers", nil),
+			rtt:       metrics.GetOrRegisterHistogram("network.probes.rtt", nil, metrics.NewExpDecaySample(1028, 0.015)),
+		},
+		pmtuMetrics: &pathMtuMetrics{
+			sent:   metrics.GetOrRegisterCounter("network.pmtu.probes", nil),
+			tooBig: metrics.GetOrRegisterCounter("network.pmtu.too_big", nil),
+		},
 
 		l: c.l,
 	}
 
+	ifce.psk.Store(c.psk)
 	ifce.tryPromoteEvery.Store(c.tryPromoteEvery)
 	ifce.reQueryEvery.Store(c.reQueryEvery)
 	ifce.reQueryWait.Store(int64(c.reQueryWait))
+	ifce.rekeyInterval.Store(int64(c.rekeyInterval))
+	ifce.rekeyBytes.Store(c.rekeyBytes)
+	ifce.replayWindow.Store(c.replayWindow)
+	ifce.probeInterval.Store(int64(c.probeInterval))
+	ifce.probeCandidates.Store(c.probeCandidates)
+	ifce.probeFailover.Store(c.probeFailover)
+	ifce.pmtuEnabled.Store(c.pmtuEnabled)
+	ifce.pmtuMin.Store(int64(c.pmtuMin))
+	ifce.pmtuMax.Store(int64(c.pmtuMax))
+	ifce.pmtuInterval.Store(int64(c.pmtuInterval))
 
 	ifce.connectionManager = newConnectionManager(ctx, c.l, ifce, c.checkInterval, c.pendingDeletionInterval, c.punchy)
 
@@ -205,13 +265,13 @@ func NewInterface(ctx context.Context, c *InterfaceConfig) (*Interface, error) {
 func (f *Interface) activate() {
 	// actually turn on tun dev
 
-	addr, err := f.outside.LocalAddr()
+	addrs, err := f.outside.LocalAddrs()
 	if err != nil {
 		f.l.WithError(err).Error("Failed to get udp listen address")
 	}
 
 	f.l.WithField("interface", f.inside.Name()).WithField("network", f.inside.Cidr().String()).
-		WithField("build", f.version).WithField("udpAddr", addr).
+		WithField("build", f.version).WithField("udpAddrs", addrs).
 		WithField("boringcrypto", boringEnabled()).
 		Info("Nebula interface is active")
 
@@ -227,6 +287,9 @@ func (f *Interface) activate() {
 			}
 		}
 		f.readers[i] = reader
+		if gw, ok := reader.(overlay.GroWriter); ok {
+			f.groWriters[i] = gw
+		}
 	}
 
 	if err := f.inside.Activate(); err != nil {
@@ -241,6 +304,16 @@ func (f *Interface) run() {
 		go f.listenOut(i)
 	}
 
+	// Launch a reader for each extra multiport socket, they share the tun queues with the routines above
+	for i, conn := range f.multiPort.Conns() {
+		go f.listenOutConn(conn, i%f.routines, readMultiPortPackets(f))
+	}
+
+	// Streams are read on their own and share the first tun queue
+	if f.stream != nil {
+		go f.listenOutConn(f.stream, 0, readStreamPackets(f))
+	}
+
 	// Launch n queues to read packets from tun dev
 	for i := 0; i < f.routines; i++ {
 		go f.listenIn(f.readers[i], i)
@@ -248,8 +321,6 @@ func (f *Interface) run() {
 }
 
 func (f *Interface) listenOut(i int) {
-	runtime.LockOSThread()
-
 	var li udp.Conn
 	// TODO clean this up with a coherent interface for each outside connection
 	if i > 0 {
@@ -258,14 +329,39 @@ func (f *Interface) listenOut(i int) {
 		li = f.outside
 	}
 
+	f.listenOutConn(li, i, readOutsidePackets(f))
+}
+
+func (f *Interface) listenOutConn(li udp.Conn, i int, r udp.EncReader) {
+	runtime.LockOSThread()
+
 	lhh := f.lightHouse.NewRequestHandler()
 	conntrackCache := firewall.NewConntrackCacheTicker(f.conntrackCacheTimeout)
-	li.ListenOut(readOutsidePackets(f), lhHandleRequest(lhh, f), conntrackCache, i)
+	li.ListenOut(r, lhHandleRequest(lhh, f), f.flushTun(i), conntrackCache, i)
+}
+
+// flushTun returns the function that writes out the packets held for merging on tun queue i
+func (f *Interface) flushTun(i int) func() {
+	gw := f.groWriters[i]
+	if gw == nil {
+		return func() {}
+	}
+
+	return func() {
+		if err := gw.Flush(); err != nil {
+			f.l.WithError(err).Error("Failed to write to tun")
+		}
+	}
 }
 
 func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
 	runtime.LockOSThread()
 
+	if br, ok := reader.(overlay.BatchReader); ok && f.tunBatch > 1 {
+		f.listenInBatch(br, i)
+		return
+	}
+
 	packet := make([]byte, mtu)
 	out := make([]byte, mtu)
 	fwPacket := &firewall.Packet{}
@@ -285,7 +381,41 @@ func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
 			os.Exit(2)
 		}
 
-		f.consumeInsidePacket(packet[:n], fwPacket, nb, out, i, conntrackCache.Get(f.l))
+		f.consumeInsidePacket(packet[:n], fwPacket, nb, out, i, conntrackCache.Get(f.l), nil)
+	}
+}
+
+// listenInBatch is listenIn for devices that can read several packets at once, the packets are encrypted one by one and
+// then sent together
+func (f *Interface) listenInBatch(reader overlay.BatchReader, i int) {
+	packets := make([][]byte, f.tunBatch)
+	for j := range packets {
+		packets[j] = make([]byte, mtu)
+	}
+	sizes := make([]int, f.tunBatch)
+	batch := newSendBatch(f.tunBatch)
+	fwPacket := &firewall.Packet{}
+	nb := make([]byte, 12, 12)
+
+	conntrackCache := firewall.NewConntrackCacheTicker(f.conntrackCacheTimeout)
+
+	for {
+		n, err := reader.ReadBatch(packets, sizes)
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) && f.closed.Load() {
+				return
+			}
+
+			f.l.WithError(err).Error("Error while reading outbound packet")
+			// This only seems to happen when something fatal happens to the fd, so exit.
+			os.Exit(2)
+		}
+
+		cache := conntrackCache.Get(f.l)
+		for j := 0; j < n; j++ {
+			f.consumeInsidePacket(packets[j][:sizes[j]], fwPacket, nb, batch.next(), i, cache, batch)
+		}
+		f.flushSendBatch(batch)
 	}
 }
 
@@ -293,11 +423,15 @@ func (f *Interface) RegisterConfigChangeCallbacks(c *config.C) {
 	c.RegisterReloadCallback(f.reloadFirewall)
 	c.RegisterReloadCallback(f.reloadSendRecvError)
 	c.RegisterReloadCallback(f.reloadDisconnectInvalid)
+	c.RegisterReloadCallback(f.reloadPsk)
 	c.RegisterReloadCallback(f.reloadMisc)
 
 	for _, udpConn := range f.writers {
 		c.RegisterReloadCallback(udpConn.ReloadConfig)
 	}
+	for _, udpConn := range f.multiPort.Conns() {
+		c.RegisterReloadCallback(udpConn.ReloadConfig)
+	}
 }
 
 func (f *Interface) reloadDisconnectInvalid(c *config.C) {
@@ -310,6 +444,21 @@ func (f *Interface) reloadDisconnectInvalid(c *config.C) {
 	}
 }
 
+func (f *Interface) reloadPsk(c *config.C) {
+	if !c.HasChanged("psk") {
+		return
+	}
+
+	psk, err := NewPskFromConfig(c)
+	if err != nil {
+		f.l.WithError(err).Error("Error while loading psk during reload")
+		return
+	}
+
+	f.psk.Store(psk)
+	f.l.WithField("mode", psk.mode).WithField("keys", len(psk.keys)).Info("psk has changed")
+}
+
 func (f *Interface) reloadFirewall(c *config.C) {
 	//TODO: need to trigger/detect if the certificate changed too
 	if c.HasChanged("firewall") == false {
@@ -340,6 +489,10 @@ func (f *Interface) reloadFirewall(c *config.C) {
 		fw.Conntrack = conntrack
 	}
 
+	if fw.Fragments != nil && oldFw.Fragments != nil {
+		fw.Fragments.carry(oldFw.Fragments)
+	}
+
 	f.firewall = fw
 
 	oldFw.Destroy()
@@ -391,13 +544,72 @@ func (f *Interface) reloadMisc(c *config.C) {
 		f.reQueryWait.Store(int64(n))
 		f.l.Info("timers.requery_wait_duration has changed")
 	}
+
+	if c.HasChanged("handshakes.rekey_interval") {
+		n := c.GetDuration("handshakes.rekey_interval", 0)
+		f.rekeyInterval.Store(int64(n))
+		f.l.Info("handshakes.rekey_interval has changed")
+	}
+
+	if c.HasChanged("handshakes.rekey_bytes") {
+		n := uint64(max(c.GetInt("handshakes.rekey_bytes", 0), 0))
+		f.rekeyBytes.Store(n)
+		f.l.Info("handshakes.rekey_bytes has changed")
+	}
+
+	if c.HasChanged("replay_window") {
+		n, err := replayWindowFromConfig(c)
+		if err != nil {
+			f.l.WithError(err).Error("Failed to reload replay_window")
+		} else {
+			f.replayWindow.Store(n)
+			f.l.WithField("replayWindow", n).Info("replay_window has changed")
+		}
+	}
+
+	if c.HasChanged("probes.interval") {
+		n := c.GetDuration("probes.interval", 0)
+		f.probeInterval.Store(int64(n))
+		f.l.Info("probes.interval has changed")
+	}
+
+	if c.HasChanged("probes.candidates") {
+		f.probeCandidates.Store(c.GetBool("probes.candidates", false))
+		f.l.Info("probes.candidates has changed")
+	}
+
+	if c.HasChanged("probes.failover") {
+		f.probeFailover.Store(c.GetBool("probes.failover", false))
+		f.l.Info("probes.failover has changed")
+	}
+
+	if c.HasChanged("pmtu.enabled") {
+		f.pmtuEnabled.Store(c.GetBool("pmtu.enabled", false))
+		f.l.Info("pmtu.enabled has changed")
+	}
+
+	if c.HasChanged("pmtu.min") {
+		n := pathMtuMinFromConfig(c)
+		f.pmtuMin.Store(int64(n))
+		f.l.WithField("min", n).Info("pmtu.min has changed")
+	}
+
+	if c.HasChanged("tun.mtu") {
+		f.pmtuMax.Store(int64(c.GetInt("tun.mtu", overlay.DefaultMTU)))
+	}
+
+	if c.HasChanged("pmtu.interval") {
+		n := c.GetDuration("pmtu.interval", DefaultPathMtuInterval)
+		f.pmtuInterval.Store(int64(n))
+		f.l.WithField("interval", n).Info("pmtu.interval has changed")
+	}
 }
 
 func (f *Interface) emitStats(ctx context.Context, i time.Duration) {
 	ticker := time.NewTicker(i)
 	defer ticker.Stop()
 
-	udpStats := udp.NewUDPStatsEmitter(f.writers)
+	udpStats := udp.NewUDPStatsEmitter(append(unwrapConns(f.writers), unwrapConns(f.multiPort.Conns())...))
 
 	certExpirationGauge := metrics.GetOrRegisterGauge("certificate.ttl_seconds", nil)
 
@@ -408,6 +620,7 @@ func (f *Interface) emitStats(ctx context.Context, i time.Duration) {
 		case <-ticker.C:
 			f.firewall.EmitStats()
 			f.handshakeManager.EmitStats()
+			f.relayManager.EmitStats()
 			udpStats()
 			certExpirationGauge.Update(int64(f.pki.GetCertState().Certificate.Details.NotAfter.Sub(time.Now()) / time.Second))
 		}
@@ -423,6 +636,17 @@ func (f *Interface) Close() error {
 			f.l.WithError(err).Error("Error while closing udp socket")
 		}
 	}
+	for _, u := range f.multiPort.Conns() {
+		err := u.Close()
+		if err != nil {
+			f.l.WithError(err).Error("Error while closing multiport udp socket")
+		}
+	}
+	if f.stream != nil {
+		if err := f.stream.Close(); err != nil {
+			f.l.WithError(err).Error("Error while closing tcp streams")
+		}
+	}
 
 	// Release the tun device
 	return f.inside.Close()
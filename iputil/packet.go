@@ -27,7 +27,33 @@ func CreateRejectPacket(packet []byte, out []byte) []byte {
 	}
 }
 
+// CreateFragmentationNeededPacket builds the icmp fragmentation needed error for an ipv4 packet that has the don't
+// fragment bit set and does not fit in mtu, so the sender can lower its path mtu. nil is returned for any other packet.
+func CreateFragmentationNeededPacket(packet []byte, out []byte, mtu int) []byte {
+	if len(packet) < ipv4.HeaderLen || int(packet[0]>>4) != ipv4.Version || len(packet) <= mtu {
+		return nil
+	}
+
+	if packet[6]&0x40 == 0 {
+		// Don't fragment is not set, the sender is not doing path mtu discovery
+		return nil
+	}
+
+	ihl := int(packet[0]&0x0f) << 2
+	if packet[9] == 1 && len(packet) > ihl && packet[ihl] != 0 && packet[ihl] != 8 {
+		// Only echo is answered, never send an icmp error about an icmp error
+		return nil
+	}
+
+	return ipv4CreateICMPPacket(packet, out, 4, uint16(mtu))
+}
+
 func ipv4CreateRejectICMPPacket(packet []byte, out []byte) []byte {
+	return ipv4CreateICMPPacket(packet, out, 3, 0)
+}
+
+// ipv4CreateICMPPacket builds an icmp destination unreachable error for packet with the given code and next hop mtu
+func ipv4CreateICMPPacket(packet []byte, out []byte, code byte, mtu uint16) []byte {
 	ihl := int(packet[0]&0x0f) << 2
 
 	if len(packet) < ihl {
@@ -71,14 +97,13 @@ func ipv4CreateRejectICMPPacket(packet []byte, out []byte) []byte {
 
 	// ICMP Destination Unreachable
 	icmpOut := out[ipv4.HeaderLen:]
-	icmpOut[0] = 3 // type (Destination unreachable)
-	icmpOut[1] = 3 // code (Port unreachable error)
-	icmpOut[2] = 0 // checksum
-	icmpOut[3] = 0 //  .
-	icmpOut[4] = 0 // unused
-	icmpOut[5] = 0 //  .
-	icmpOut[6] = 0 //  .
-	icmpOut[7] = 0 //  .
+	icmpOut[0] = 3                               // type (Destination unreachable)
+	icmpOut[1] = code                            // code (Port unreachable error or fragmentation needed)
+	icmpOut[2] = 0                               // checksum
+	icmpOut[3] = 0                               //  .
+	icmpOut[4] = 0                               // unused
+	icmpOut[5] = 0                               //  .
+	binary.BigEndian.PutUint16(icmpOut[6:], mtu) // next hop mtu
 
 	// Copy original IP header and first 8 bytes as body
 	copy(icmpOut[8:], packet[:packetLen])
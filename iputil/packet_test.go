@@ -71,3 +71,53 @@ func Test_CreateRejectPacket(t *testing.T) {
 	assert.NotNil(t, rejectPacket)
 	assert.Len(t, rejectPacket, expectedLen)
 }
+
+func Test_CreateFragmentationNeededPacket(t *testing.T) {
+	h := ipv4.Header{
+		Len:      20,
+		TotalLen: 1400,
+		Flags:    ipv4.DontFragment,
+		TTL:      64,
+		Src:      net.IPv4(10, 0, 0, 1),
+		Dst:      net.IPv4(10, 0, 0, 2),
+		Protocol: 17, // UDP
+	}
+
+	b, err := h.Marshal()
+	if err != nil {
+		t.Fatalf("h.Marhshal: %v", err)
+	}
+	b = append(b, make([]byte, 1380)...)
+
+	out := make([]byte, MaxRejectPacketSize)
+	p := CreateFragmentationNeededPacket(b, out, 1300)
+	assert.Len(t, p, ipv4.HeaderLen+8+h.Len+8)
+
+	reply, err := ipv4.ParseHeader(p)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, reply.Protocol)
+	assert.True(t, reply.Src.Equal(h.Dst))
+	assert.True(t, reply.Dst.Equal(h.Src))
+
+	icmp := p[ipv4.HeaderLen:]
+	assert.Equal(t, byte(3), icmp[0])
+	assert.Equal(t, byte(4), icmp[1])
+	assert.Equal(t, []byte{0x05, 0x14}, icmp[6:8])
+	assert.Equal(t, uint16(0), tcpipChecksum(icmp, 0))
+	assert.Equal(t, b[:h.Len+8], icmp[8:])
+
+	// Packets that fit get through
+	assert.Nil(t, CreateFragmentationNeededPacket(b, out, 1400))
+
+	// The sender is not doing path mtu discovery, the packet will be fragmented
+	b[6] = 0
+	assert.Nil(t, CreateFragmentationNeededPacket(b, out, 1300))
+
+	// No errors about errors
+	b[6] = 0x40
+	b[9] = 1
+	b[20] = 3
+	assert.Nil(t, CreateFragmentationNeededPacket(b, out, 1300))
+	b[20] = 8
+	assert.NotNil(t, CreateFragmentationNeededPacket(b, out, 1300))
+}
@@ -0,0 +1,69 @@
+package nebula
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/slackhq/nebula/config"
+	"golang.org/x/crypto/hkdf"
+)
+
+type HybridKemMode int
+
+const (
+	// HybridKemNone runs classic handshakes and ignores kem keys offered by peers
+	HybridKemNone HybridKemMode = iota
+	// HybridKemPreferred offers a kem key in the handshakes we send and uses one when offered, but falls back to a
+	// classic handshake with peers that do not support it
+	HybridKemPreferred
+	// HybridKemRequired refuses any handshake that does not include a kem exchange
+	HybridKemRequired
+)
+
+func NewHybridKemMode(m string) (HybridKemMode, error) {
+	switch m {
+	case "none":
+		return HybridKemNone, nil
+	case "preferred":
+		return HybridKemPreferred, nil
+	case "required":
+		return HybridKemRequired, nil
+	}
+	return HybridKemNone, fmt.Errorf("unknown handshakes.hybrid_kem mode: %v", m)
+}
+
+func (m HybridKemMode) String() string {
+	switch m {
+	case HybridKemNone:
+		return "none"
+	case HybridKemPreferred:
+		return "preferred"
+	case HybridKemRequired:
+		return "required"
+	}
+	return "unknown"
+}
+
+func NewHybridKemModeFromConfig(c *config.C) (HybridKemMode, error) {
+	mode, err := NewHybridKemMode(c.GetString("handshakes.hybrid_kem", "none"))
+	if err != nil {
+		return HybridKemNone, err
+	}
+	if mode != HybridKemNone && !kemSupported {
+		return HybridKemNone, errors.New("handshakes.hybrid_kem requires nebula to be built with go 1.24 or newer")
+	}
+	return mode, nil
+}
+
+// hybridKey mixes a kem shared secret into a key from the noise handshake, the result is safe as long as either
+// key exchange holds up
+func hybridKey(k [32]byte, secret []byte) ([32]byte, error) {
+	var out [32]byte
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, k[:], []byte("NEBULA HYBRID KEM")), out[:])
+	if err != nil {
+		return out, errors.New("failed to derive hybrid key")
+	}
+	return out, nil
+}
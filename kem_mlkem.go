@@ -0,0 +1,58 @@
+//go:build go1.24
+// +build go1.24
+
+package nebula
+
+import (
+	"crypto/mlkem"
+	"errors"
+)
+
+// kemSupported is true when the toolchain ships crypto/mlkem, see kem_unsupported.go
+const kemSupported = true
+
+type kemDecapsulationKey = mlkem.DecapsulationKey768
+
+// newKemKey generates the ML-KEM-768 key an initiator offers in its handshake, nil if we run classic handshakes
+func newKemKey(mode HybridKemMode) (*kemDecapsulationKey, error) {
+	if mode == HybridKemNone {
+		return nil, nil
+	}
+	return mlkem.GenerateKey768()
+}
+
+// kemEncapsulate creates the shared secret for the encapsulation key an initiator offered and the ciphertext to send
+// back. It returns a nil secret if there was nothing to use.
+func kemEncapsulate(mode HybridKemMode, encapsulationKey []byte) (secret []byte, ciphertext []byte, err error) {
+	if mode == HybridKemNone || len(encapsulationKey) == 0 {
+		return nil, nil, nil
+	}
+
+	ek, err := mlkem.NewEncapsulationKey768(encapsulationKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret, ciphertext = ek.Encapsulate()
+	return secret, ciphertext, nil
+}
+
+// kemDecapsulate recovers the shared secret from the ciphertext a responder sent back. It returns a nil secret if
+// the responder did not take part, which is only an error if we sent a key and the responder sent a ciphertext
+// anyway.
+func kemDecapsulate(dk *kemDecapsulationKey, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 {
+		return nil, nil
+	}
+
+	if dk == nil {
+		return nil, errors.New("received a kem ciphertext without offering a kem key")
+	}
+
+	return dk.Decapsulate(ciphertext)
+}
+
+// kemEncapsulationKey is the key an initiator puts in its handshake for dk
+func kemEncapsulationKey(dk *kemDecapsulationKey) []byte {
+	return dk.EncapsulationKey().Bytes()
+}
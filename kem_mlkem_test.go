@@ -0,0 +1,57 @@
+//go:build go1.24
+// +build go1.24
+
+package nebula
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKemExchange(t *testing.T) {
+	// Classic handshakes do not offer a key
+	dk, err := newKemKey(HybridKemNone)
+	assert.NoError(t, err)
+	assert.Nil(t, dk)
+
+	dk, err = newKemKey(HybridKemPreferred)
+	require.NoError(t, err)
+	ek := dk.EncapsulationKey().Bytes()
+
+	// A responder running classic handshakes ignores the key
+	secret, ct, err := kemEncapsulate(HybridKemNone, ek)
+	assert.NoError(t, err)
+	assert.Nil(t, secret)
+	assert.Nil(t, ct)
+
+	// As does one that was not offered a key
+	secret, ct, err = kemEncapsulate(HybridKemRequired, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, secret)
+	assert.Nil(t, ct)
+
+	_, _, err = kemEncapsulate(HybridKemPreferred, []byte("not a key"))
+	assert.Error(t, err)
+
+	secret, ct, err = kemEncapsulate(HybridKemPreferred, ek)
+	require.NoError(t, err)
+	assert.Len(t, secret, 32)
+
+	// Both sides arrive at the same secret
+	initiatorSecret, err := kemDecapsulate(dk, ct)
+	require.NoError(t, err)
+	assert.Equal(t, secret, initiatorSecret)
+
+	// A responder that did not take part leaves us with a classic handshake
+	initiatorSecret, err = kemDecapsulate(dk, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, initiatorSecret)
+
+	_, err = kemDecapsulate(nil, ct)
+	assert.EqualError(t, err, "received a kem ciphertext without offering a kem key")
+
+	_, err = kemDecapsulate(dk, []byte("not a ciphertext"))
+	assert.Error(t, err)
+}
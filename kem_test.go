@@ -0,0 +1,48 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHybridKemModeFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	mode, err := NewHybridKemModeFromConfig(c)
+	assert.NoError(t, err)
+	assert.Equal(t, HybridKemNone, mode)
+
+	for _, m := range []HybridKemMode{HybridKemNone, HybridKemPreferred, HybridKemRequired} {
+		c.Settings["handshakes"] = map[interface{}]interface{}{"hybrid_kem": m.String()}
+		mode, err = NewHybridKemModeFromConfig(c)
+		if m != HybridKemNone && !kemSupported {
+			assert.EqualError(t, err, "handshakes.hybrid_kem requires nebula to be built with go 1.24 or newer")
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, m, mode)
+	}
+
+	c.Settings["handshakes"] = map[interface{}]interface{}{"hybrid_kem": "sometimes"}
+	_, err = NewHybridKemModeFromConfig(c)
+	assert.EqualError(t, err, "unknown handshakes.hybrid_kem mode: sometimes")
+}
+
+func TestHybridKey(t *testing.T) {
+	k := [32]byte{1, 2, 3}
+	a, err := hybridKey(k, []byte("secret a"))
+	require.NoError(t, err)
+	again, err := hybridKey(k, []byte("secret a"))
+	require.NoError(t, err)
+	b, err := hybridKey(k, []byte("secret b"))
+	require.NoError(t, err)
+
+	assert.Equal(t, a, again)
+	assert.NotEqual(t, a, b)
+	assert.NotEqual(t, k, a)
+}
@@ -0,0 +1,39 @@
+//go:build !go1.24
+// +build !go1.24
+
+package nebula
+
+import "errors"
+
+// kemSupported is false when the toolchain is too old for crypto/mlkem, NewHybridKemModeFromConfig then only accepts
+// classic handshakes
+const kemSupported = false
+
+var errKemUnsupported = errors.New("the hybrid kem exchange requires nebula to be built with go 1.24 or newer")
+
+type kemDecapsulationKey struct{}
+
+func newKemKey(mode HybridKemMode) (*kemDecapsulationKey, error) {
+	if mode == HybridKemNone {
+		return nil, nil
+	}
+	return nil, errKemUnsupported
+}
+
+func kemEncapsulate(mode HybridKemMode, encapsulationKey []byte) (secret []byte, ciphertext []byte, err error) {
+	if mode == HybridKemNone || len(encapsulationKey) == 0 {
+		return nil, nil, nil
+	}
+	return nil, nil, errKemUnsupported
+}
+
+func kemDecapsulate(dk *kemDecapsulationKey, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 {
+		return nil, nil
+	}
+	return nil, errKemUnsupported
+}
+
+func kemEncapsulationKey(dk *kemDecapsulationKey) []byte {
+	return nil
+}
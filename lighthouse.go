@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,6 +19,7 @@ import (
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/stream"
 	"github.com/slackhq/nebula/udp"
 	"github.com/slackhq/nebula/util"
 )
@@ -42,6 +45,11 @@ type LightHouse struct {
 	punchConn    udp.Conn
 	punchy       *Punchy
 
+	// noIPv4 and noIPv6 are set when our udp socket can't use that address family, we neither advertise nor try
+	// addresses in it
+	noIPv4 bool
+	noIPv6 bool
+
 	// Local cache of answers from light houses
 	// map of vpn Ip to answers
 	addrMap map[iputil.VpnIp]*RemoteList
@@ -71,6 +79,16 @@ type LightHouse struct {
 
 	advertiseAddrs atomic.Pointer[[]netIpAndPort]
 
+	// streamPort is where we accept tcp or tls streams, 0 when we don't. streamTLS tells peers to dial it with tls and
+	// streamPath, when set, to speak websocket on that path so they can reach us through http proxies.
+	streamPort   uint32
+	streamTLS    bool
+	streamPath   string
+	streamNoIPv4 bool
+	streamNoIPv6 bool
+
+	streamAdvertiseAddrs atomic.Pointer[[]netIpAndPort]
+
 	// IP's of relays that can be used by peers to access me
 	relaysForMe atomic.Pointer[[]iputil.VpnIp]
 
@@ -101,6 +119,40 @@ func NewLightHouseFromConfig(ctx context.Context, l *logrus.Logger, c *config.C,
 		nebulaPort = uint32(uPort.Port)
 	}
 
+	noIPv4, noIPv6 := false, false
+	if pc != nil {
+		addrs, err := pc.LocalAddrs()
+		if err != nil {
+			return nil, util.NewContextualError("Failed to get listening addresses", nil, err)
+		}
+
+		noIPv4, noIPv6 = true, true
+		for _, a := range addrs {
+			if a.IP.To4() != nil {
+				noIPv4 = false
+			} else {
+				noIPv6 = false
+			}
+		}
+	}
+
+	var streamPort uint32
+	var streamPath string
+	if c.GetBool("tcp.advertise_websocket", false) {
+		streamPath = c.GetString("tcp.websocket_path", stream.DefaultWebSocketPath)
+	}
+	streamNoIPv4, streamNoIPv6 := false, false
+	if mux, ok := pc.(*stream.Mux); ok {
+		if sAddr, err := mux.Stream().LocalAddr(); err == nil {
+			streamPort = uint32(sAddr.Port)
+			// Go listens dual stack on any unspecified address
+			if !sAddr.IP.IsUnspecified() {
+				streamNoIPv4 = sAddr.IP.To4() == nil
+				streamNoIPv6 = !streamNoIPv4
+			}
+		}
+	}
+
 	ones, _ := myVpnNet.Mask.Size()
 	h := LightHouse{
 		ctx:          ctx,
@@ -112,6 +164,13 @@ func NewLightHouseFromConfig(ctx context.Context, l *logrus.Logger, c *config.C,
 		nebulaPort:   nebulaPort,
 		punchConn:    pc,
 		punchy:       p,
+		noIPv4:       noIPv4,
+		noIPv6:       noIPv6,
+		streamPort:   streamPort,
+		streamTLS:    c.GetBool("tcp.tls", true),
+		streamPath:   streamPath,
+		streamNoIPv4: streamNoIPv4,
+		streamNoIPv6: streamNoIPv6,
 		queryChan:    make(chan iputil.VpnIp, c.GetUint32("handshakes.query_buffer", 64)),
 		l:            l,
 	}
@@ -167,6 +226,10 @@ func (lh *LightHouse) GetAdvertiseAddrs() []netIpAndPort {
 	return *lh.advertiseAddrs.Load()
 }
 
+func (lh *LightHouse) GetStreamAdvertiseAddrs() []netIpAndPort {
+	return *lh.streamAdvertiseAddrs.Load()
+}
+
 func (lh *LightHouse) GetRelaysForMe() []iputil.VpnIp {
 	return *lh.relaysForMe.Load()
 }
@@ -210,6 +273,30 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 		}
 	}
 
+	if initial || c.HasChanged("tcp.advertise_addrs") {
+		rawAdvAddrs := c.GetStringSlice("tcp.advertise_addrs", []string{})
+		advAddrs := make([]netIpAndPort, 0)
+
+		for i, rawAddr := range rawAdvAddrs {
+			fIp, fPort, err := udp.ParseIPAndPort(rawAddr)
+			if err != nil {
+				return util.NewContextualError("Unable to parse tcp.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, err)
+			}
+
+			if fPort == 0 {
+				fPort = uint16(lh.streamPort)
+			}
+
+			advAddrs = append(advAddrs, netIpAndPort{ip: fIp, port: fPort})
+		}
+
+		lh.streamAdvertiseAddrs.Store(&advAddrs)
+
+		if !initial {
+			lh.l.Info("tcp.advertise_addrs has changed")
+		}
+	}
+
 	if initial || c.HasChanged("lighthouse.interval") {
 		lh.interval.Store(int64(c.GetInt("lighthouse.interval", 10)))
 
@@ -273,6 +360,7 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 			for staticVpnIp := range *existingStaticList {
 				if am, ok := lh.addrMap[staticVpnIp]; ok && am != nil {
 					am.hr.Cancel()
+					am.unlockedSetStreamHostnames(nil)
 				}
 			}
 			lh.RUnlock()
@@ -434,14 +522,25 @@ func (lh *LightHouse) loadStaticMap(c *config.C, tunCidr *net.IPNet, staticList
 			vals = []interface{}{v}
 		}
 		remoteAddrs := []string{}
+		var streamAddrs []string
 		for _, v := range vals {
-			remoteAddrs = append(remoteAddrs, fmt.Sprintf("%v", v))
+			addr := fmt.Sprintf("%v", v)
+			if strings.Contains(addr, "://") {
+				streamAddrs = append(streamAddrs, addr)
+			} else {
+				remoteAddrs = append(remoteAddrs, addr)
+			}
 		}
 
 		err := lh.addStaticRemotes(i, d, network, lookup_timeout, vpnIp, remoteAddrs, staticList)
 		if err != nil {
 			return err
 		}
+
+		err = lh.addStaticStreams(i, d, network, lookup_timeout, vpnIp, streamAddrs)
+		if err != nil {
+			return err
+		}
 		i++
 	}
 
@@ -575,6 +674,90 @@ func (lh *LightHouse) addStaticRemotes(i int, d time.Duration, network string, t
 	return nil
 }
 
+// addStaticStreams sets the static_host_map entries for vpnIp that are dialed over a stream, they look like
+// tcp://host:port, tls://host:port, ws://host:port/path or wss://host:port/path
+func (lh *LightHouse) addStaticStreams(i int, d time.Duration, network string, timeout time.Duration, vpnIp iputil.VpnIp, addrs []string) error {
+	lh.Lock()
+	am := lh.unlockedGetRemoteList(vpnIp)
+	am.Lock()
+	defer am.Unlock()
+	ctx := lh.ctx
+	lh.Unlock()
+
+	onUpdate := func() {
+		am.Lock()
+		defer am.Unlock()
+		am.shouldRebuild = true
+	}
+
+	shs := make([]*streamHostnames, 0, len(addrs))
+	cancel := func() {
+		for _, sh := range shs {
+			sh.hr.Cancel()
+		}
+	}
+
+	for _, addr := range addrs {
+		r, hostPort, err := parseStaticStream(addr)
+		if err != nil {
+			cancel()
+			return util.NewContextualError("Static host stream address could not be parsed", m{"vpnIp": vpnIp, "entry": i + 1, "addr": addr}, err)
+		}
+
+		hr, err := NewHostnameResults(ctx, lh.l, d, network, timeout, []string{hostPort}, onUpdate)
+		if err != nil {
+			cancel()
+			return util.NewContextualError("Static host stream address could not be parsed", m{"vpnIp": vpnIp, "entry": i + 1, "addr": addr}, err)
+		}
+		shs = append(shs, &streamHostnames{remote: r, hr: hr})
+	}
+
+	am.unlockedSetStreamHostnames(shs)
+	return nil
+}
+
+// parseStaticStream returns how to dial a static_host_map stream address, without its address, and the host and port
+// to resolve
+func parseStaticStream(addr string) (stream.Remote, string, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return stream.Remote{}, "", err
+	}
+
+	r := stream.Remote{}
+	defaultPort := ""
+	switch u.Scheme {
+	case "tcp":
+	case "tls":
+		r.TLS = true
+	case "ws":
+		r.Path, defaultPort = u.Path, "80"
+	case "wss":
+		r.TLS = true
+		r.Path, defaultPort = u.Path, "443"
+	default:
+		return stream.Remote{}, "", fmt.Errorf("unknown stream scheme %q", u.Scheme)
+	}
+
+	if r.Path == "" && defaultPort != "" {
+		r.Path = stream.DefaultWebSocketPath
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	if u.Hostname() == "" || port == "" {
+		return stream.Remote{}, "", fmt.Errorf("stream address needs a host and port")
+	}
+
+	if _, err := netip.ParseAddr(u.Hostname()); err != nil {
+		// Keep the name, proxies and http servers may want it rather than an ip
+		r.Host = u.Hostname()
+	}
+	return r, net.JoinHostPort(u.Hostname(), port), nil
+}
+
 // addCalculatedRemotes adds any calculated remotes based on the
 // lighthouse.calculated_remotes configuration. It returns true if any
 // calculated remotes were added
@@ -618,6 +801,10 @@ func (lh *LightHouse) unlockedGetRemoteList(vpnIp iputil.VpnIp) *RemoteList {
 }
 
 func (lh *LightHouse) shouldAdd(vpnIp iputil.VpnIp, to netip.Addr) bool {
+	if !lh.canUse(to.Is4() || to.Is4In6()) {
+		return false
+	}
+
 	switch {
 	case to.Is4():
 		ipBytes := to.As4()
@@ -649,6 +836,10 @@ func (lh *LightHouse) shouldAdd(vpnIp iputil.VpnIp, to netip.Addr) bool {
 
 // unlockedShouldAddV4 checks if to is allowed by our allow list
 func (lh *LightHouse) unlockedShouldAddV4(vpnIp iputil.VpnIp, to *Ip4AndPort) bool {
+	if !lh.canUse(true) {
+		return false
+	}
+
 	allow := lh.GetRemoteAllowList().AllowIpV4(vpnIp, iputil.VpnIp(to.Ip))
 	if lh.l.Level >= logrus.TraceLevel {
 		lh.l.WithField("remoteIp", vpnIp).WithField("allow", allow).Trace("remoteAllowList.Allow")
@@ -663,6 +854,10 @@ func (lh *LightHouse) unlockedShouldAddV4(vpnIp iputil.VpnIp, to *Ip4AndPort) bo
 
 // unlockedShouldAddV6 checks if to is allowed by our allow list
 func (lh *LightHouse) unlockedShouldAddV6(vpnIp iputil.VpnIp, to *Ip6AndPort) bool {
+	if !lh.canUse(false) {
+		return false
+	}
+
 	allow := lh.GetRemoteAllowList().AllowIpV6(vpnIp, to.Hi, to.Lo)
 	if lh.l.Level >= logrus.TraceLevel {
 		lh.l.WithField("remoteIp", lhIp6ToIp(to)).WithField("allow", allow).Trace("remoteAllowList.Allow")
@@ -676,6 +871,32 @@ func (lh *LightHouse) unlockedShouldAddV6(vpnIp iputil.VpnIp, to *Ip6AndPort) bo
 	return true
 }
 
+// unlockedShouldAddStream checks if to is allowed by our allow list. Streams are dialed on their own so they don't
+// depend on the address families our udp socket can use.
+func (lh *LightHouse) unlockedShouldAddStream(vpnIp iputil.VpnIp, to *StreamAddr) bool {
+	switch {
+	case to.Ip4AndPort != nil:
+		ip := iputil.VpnIp(to.Ip4AndPort.Ip)
+		return lh.GetRemoteAllowList().AllowIpV4(vpnIp, ip) && !ipMaskContains(lh.myVpnIp, lh.myVpnZeros, ip)
+	case to.Ip6AndPort != nil:
+		return lh.GetRemoteAllowList().AllowIpV6(vpnIp, to.Ip6AndPort.Hi, to.Ip6AndPort.Lo)
+	}
+	return false
+}
+
+// canUse reports if we can reach a peer at an ipv4, or ipv6, address. A lighthouse keeps every address since it hands
+// them out to hosts that may be able to.
+func (lh *LightHouse) canUse(v4 bool) bool {
+	if lh.amLighthouse {
+		return true
+	}
+
+	if v4 {
+		return !lh.noIPv4
+	}
+	return !lh.noIPv6
+}
+
 func lhIp6ToIp(v *Ip6AndPort) net.IP {
 	ip := make(net.IP, 16)
 	binary.BigEndian.PutUint64(ip[:8], v.Hi)
@@ -741,6 +962,31 @@ func NewUDPAddrFromLH6(ipp *Ip6AndPort) *udp.Addr {
 	return udp.NewAddr(lhIp6ToIp(ipp), uint16(ipp.Port))
 }
 
+func NewStreamAddr(ip net.IP, port uint32, tls bool) *StreamAddr {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &StreamAddr{Ip4AndPort: NewIp4AndPort(ip4, port), Tls: tls}
+	}
+	return &StreamAddr{Ip6AndPort: NewIp6AndPort(ip, port), Tls: tls}
+}
+
+// newStreamAddr returns a StreamAddr telling peers how to dial our stream listener at ip and port
+func (lh *LightHouse) newStreamAddr(ip net.IP, port uint32) *StreamAddr {
+	sa := NewStreamAddr(ip, port, lh.streamTLS)
+	sa.Path = lh.streamPath
+	return sa
+}
+
+// NewUDPAddrFromStreamAddr returns the address of a StreamAddr, or nil if it has none
+func NewUDPAddrFromStreamAddr(sa *StreamAddr) *udp.Addr {
+	switch {
+	case sa.Ip4AndPort != nil:
+		return NewUDPAddrFromLH4(sa.Ip4AndPort)
+	case sa.Ip6AndPort != nil:
+		return NewUDPAddrFromLH6(sa.Ip6AndPort)
+	}
+	return nil
+}
+
 func (lh *LightHouse) startQueryWorker() {
 	if lh.amLighthouse {
 		return
@@ -819,17 +1065,34 @@ func (lh *LightHouse) SendUpdate() {
 		}
 	}
 
+	var streams []*StreamAddr
+	if lh.streamPort != 0 {
+		for _, e := range lh.GetStreamAdvertiseAddrs() {
+			streams = append(streams, lh.newStreamAddr(e.ip, uint32(e.port)))
+		}
+	}
+
 	lal := lh.GetLocalAllowList()
 	for _, e := range *localIps(lh.l, lal) {
 		if ip4 := e.To4(); ip4 != nil && ipMaskContains(lh.myVpnIp, lh.myVpnZeros, iputil.Ip2VpnIp(ip4)) {
 			continue
 		}
 
-		// Only add IPs that aren't my VPN/tun IP
+		// Only add IPs that aren't my VPN/tun IP, in the families we listen on
 		if ip := e.To4(); ip != nil {
-			v4 = append(v4, NewIp4AndPort(e, lh.nebulaPort))
+			if !lh.noIPv4 {
+				v4 = append(v4, NewIp4AndPort(e, lh.nebulaPort))
+			}
+			if lh.streamPort != 0 && !lh.streamNoIPv4 {
+				streams = append(streams, lh.newStreamAddr(e, lh.streamPort))
+			}
 		} else {
-			v6 = append(v6, NewIp6AndPort(e, lh.nebulaPort))
+			if !lh.noIPv6 {
+				v6 = append(v6, NewIp6AndPort(e, lh.nebulaPort))
+			}
+			if lh.streamPort != 0 && !lh.streamNoIPv6 {
+				streams = append(streams, lh.newStreamAddr(e, lh.streamPort))
+			}
 		}
 	}
 
@@ -845,6 +1108,7 @@ func (lh *LightHouse) SendUpdate() {
 			Ip4AndPorts: v4,
 			Ip6AndPorts: v6,
 			RelayVpnIp:  relays,
+			StreamAddrs: streams,
 		},
 	}
 
@@ -907,6 +1171,7 @@ func (lhh *LightHouseHandler) resetMeta() *NebulaMeta {
 	details.Ip4AndPorts = details.Ip4AndPorts[:0]
 	details.Ip6AndPorts = details.Ip6AndPorts[:0]
 	details.RelayVpnIp = details.RelayVpnIp[:0]
+	details.StreamAddrs = details.StreamAddrs[:0]
 	lhh.meta.Details = details
 
 	return lhh.meta
@@ -1036,6 +1301,10 @@ func (lhh *LightHouseHandler) coalesceAnswers(c *cache, n *NebulaMeta) {
 	if c.relay != nil {
 		n.Details.RelayVpnIp = append(n.Details.RelayVpnIp, c.relay.relay...)
 	}
+
+	if c.stream != nil {
+		n.Details.StreamAddrs = append(n.Details.StreamAddrs, c.stream.reported...)
+	}
 }
 
 func (lhh *LightHouseHandler) handleHostQueryReply(n *NebulaMeta, vpnIp iputil.VpnIp) {
@@ -1052,6 +1321,7 @@ func (lhh *LightHouseHandler) handleHostQueryReply(n *NebulaMeta, vpnIp iputil.V
 	am.unlockedSetV4(vpnIp, certVpnIp, n.Details.Ip4AndPorts, lhh.lh.unlockedShouldAddV4)
 	am.unlockedSetV6(vpnIp, certVpnIp, n.Details.Ip6AndPorts, lhh.lh.unlockedShouldAddV6)
 	am.unlockedSetRelay(vpnIp, certVpnIp, n.Details.RelayVpnIp)
+	am.unlockedSetStream(vpnIp, certVpnIp, n.Details.StreamAddrs, lhh.lh.unlockedShouldAddStream)
 	am.Unlock()
 
 	// Non-blocking attempt to trigger, skip if it would block
@@ -1086,6 +1356,7 @@ func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, vpnIp
 	am.unlockedSetV4(vpnIp, certVpnIp, n.Details.Ip4AndPorts, lhh.lh.unlockedShouldAddV4)
 	am.unlockedSetV6(vpnIp, certVpnIp, n.Details.Ip6AndPorts, lhh.lh.unlockedShouldAddV6)
 	am.unlockedSetRelay(vpnIp, certVpnIp, n.Details.RelayVpnIp)
+	am.unlockedSetStream(vpnIp, certVpnIp, n.Details.StreamAddrs, lhh.lh.unlockedShouldAddStream)
 	am.Unlock()
 
 	n = lhh.resetMeta()
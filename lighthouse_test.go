@@ -4,11 +4,14 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/stream"
 	"github.com/slackhq/nebula/test"
 	"github.com/slackhq/nebula/udp"
 	"github.com/stretchr/testify/assert"
@@ -66,6 +69,119 @@ func Test_lhStaticMapping(t *testing.T) {
 	assert.EqualError(t, err, "lighthouse 10.128.0.3 does not have a static_host_map entry")
 }
 
+func TestLighthouse_addressFamilies(t *testing.T) {
+	l := test.NewLogger()
+	_, myVpnNet, _ := net.ParseCIDR("10.128.0.1/16")
+	pc, err := udp.NewListener(l, net.IPv4(127, 0, 0, 1), 0, false, 64)
+	assert.NoError(t, err)
+	defer pc.Close()
+
+	v4 := &Ip4AndPort{Ip: uint32(iputil.Ip2VpnIp(net.IPv4(1, 2, 3, 4))), Port: 4242}
+	v6 := NewIp6AndPort(net.ParseIP("2001::1"), 4242)
+
+	// We can't reach ipv6 peers from an ipv4 socket so we don't keep their ipv6 addresses
+	lh, err := NewLightHouseFromConfig(context.Background(), l, config.NewC(l), myVpnNet, pc, nil)
+	assert.NoError(t, err)
+	assert.True(t, lh.unlockedShouldAddV4(1, v4))
+	assert.False(t, lh.unlockedShouldAddV6(1, v6))
+	assert.False(t, lh.shouldAdd(1, netip.MustParseAddr("2001::1")))
+	assert.True(t, lh.shouldAdd(1, netip.MustParseAddr("::ffff:1.2.3.4")))
+
+	// A lighthouse keeps them for the hosts that can
+	c := config.NewC(l)
+	assert.NoError(t, c.LoadString("lighthouse: {am_lighthouse: true}\nlisten: {port: 4242}"))
+	lh, err = NewLightHouseFromConfig(context.Background(), l, c, myVpnNet, pc, nil)
+	assert.NoError(t, err)
+	assert.True(t, lh.unlockedShouldAddV6(1, v6))
+}
+
+func TestLighthouse_streams(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}
+	theirVpnIp := iputil.Ip2VpnIp(net.ParseIP("10.128.0.3"))
+	theirAddr := &udp.Addr{IP: net.ParseIP("10.0.0.3"), Port: 4242}
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"am_lighthouse": true}
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, myVpnNet, nil, nil)
+	assert.NoError(t, err)
+	lhh := lh.NewRequestHandler()
+
+	// Stream addresses are stored and handed out alongside the udp ones, except those in our vpn network
+	good4 := NewStreamAddr(net.ParseIP("1.2.3.4"), 443, true)
+	good6 := NewStreamAddr(net.ParseIP("2001::1"), 8443, false)
+	bad := NewStreamAddr(net.ParseIP("10.128.0.99"), 443, true)
+	req := &NebulaMeta{
+		Type: NebulaMeta_HostUpdateNotification,
+		Details: &NebulaMetaDetails{
+			VpnIp:       uint32(theirVpnIp),
+			StreamAddrs: []*StreamAddr{good4, bad, good6},
+		},
+	}
+	b, err := req.Marshal()
+	assert.NoError(t, err)
+	lhh.HandleRequest(theirAddr, theirVpnIp, b, &testEncWriter{})
+
+	r := newLHHostRequest(theirAddr, theirVpnIp, theirVpnIp, lhh)
+	assert.Equal(t, []*StreamAddr{good4, good6}, r.msg.Details.StreamAddrs)
+
+	cm := *lh.Query(theirVpnIp).CopyCache()
+	assert.Equal(t, []*udp.Addr{
+		udp.NewAddr(net.ParseIP("1.2.3.4"), 443),
+		udp.NewAddr(net.ParseIP("2001::1"), 8443),
+	}, cm[theirVpnIp.String()].Stream)
+
+	// Static hosts can say which of their addresses are dialed over tcp or tls
+	c = config.NewC(l)
+	c.Settings["static_host_map"] = map[interface{}]interface{}{
+		"10.128.0.3": []interface{}{"1.1.1.1:4242", "tcp://1.1.1.1:4243", "tls://1.1.1.1:443", "tls://1.1.1.1:443"},
+	}
+	lh, err = NewLightHouseFromConfig(context.Background(), l, c, myVpnNet, nil, nil)
+	assert.NoError(t, err)
+
+	rl := lh.Query(theirVpnIp)
+	assert.Equal(t, []*udp.Addr{udp.NewAddr(net.ParseIP("1.1.1.1"), 4242)}, rl.CopyAddrs(nil))
+	assert.Equal(t, []stream.Remote{
+		{Addr: udp.NewAddr(net.ParseIP("1.1.1.1"), 4243), TLS: false},
+		{Addr: udp.NewAddr(net.ParseIP("1.1.1.1"), 443), TLS: true},
+	}, rl.CopyStreams(nil))
+
+	// Or that they are reached with websockets, names are kept for proxies and tls
+	c = config.NewC(l)
+	c.Settings["static_host_map"] = map[interface{}]interface{}{
+		"10.128.0.3": []interface{}{"ws://1.1.1.1", "wss://localhost:8443/tunnel", "ws://[2001::1]:8080/"},
+	}
+	lh, err = NewLightHouseFromConfig(context.Background(), l, c, myVpnNet, nil, nil)
+	assert.NoError(t, err)
+
+	rl = lh.Query(theirVpnIp)
+	streams := rl.CopyStreams(nil)
+	assert.Contains(t, streams, stream.Remote{Addr: udp.NewAddr(net.ParseIP("1.1.1.1"), 80), Path: stream.DefaultWebSocketPath})
+	assert.Contains(t, streams, stream.Remote{Addr: udp.NewAddr(net.ParseIP("2001::1"), 8080), Path: "/"})
+
+	// Names resolve in the background
+	named := stream.Remote{Addr: udp.NewAddr(net.ParseIP("127.0.0.1"), 8443), TLS: true, Path: "/tunnel", Host: "localhost"}
+	assert.Eventually(t, func() bool {
+		rl.Rebuild(nil)
+		return containsRemote(rl.CopyStreams(nil), named)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, bad := range []string{"udp://1.1.1.1:4242", "tcp://1.1.1.1", "tls://:443"} {
+		c = config.NewC(l)
+		c.Settings["static_host_map"] = map[interface{}]interface{}{"10.128.0.3": []interface{}{bad}}
+		_, err = NewLightHouseFromConfig(context.Background(), l, c, myVpnNet, nil, nil)
+		assert.Error(t, err, bad)
+	}
+
+	// We tell peers to speak websocket to us when asked to
+	c = config.NewC(l)
+	c.Settings["tcp"] = map[interface{}]interface{}{"advertise_websocket": true, "websocket_path": "/tunnel"}
+	lh, err = NewLightHouseFromConfig(context.Background(), l, c, myVpnNet, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "/tunnel", lh.newStreamAddr(net.ParseIP("1.2.3.4"), 443).Path)
+}
+
 func TestReloadLighthouseInterval(t *testing.T) {
 	l := test.NewLogger()
 	_, myVpnNet, _ := net.ParseCIDR("10.128.0.1/16")
@@ -484,3 +600,12 @@ func translateV4toUdpAddr(ips []*Ip4AndPort) []*udp.Addr {
 	}
 	return addrs
 }
+
+func containsRemote(streams []stream.Remote, r stream.Remote) bool {
+	for _, v := range streams {
+		if v.Addr.Equals(r.Addr) && v.TLS == r.TLS && v.Path == r.Path && v.Host == r.Host {
+			return true
+		}
+	}
+	return false
+}
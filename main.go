@@ -2,7 +2,6 @@ package nebula
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
 	"net"
 	"time"
@@ -11,6 +10,7 @@ import (
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/overlay"
 	"github.com/slackhq/nebula/sshd"
+	"github.com/slackhq/nebula/stream"
 	"github.com/slackhq/nebula/udp"
 	"github.com/slackhq/nebula/util"
 	"gopkg.in/yaml.v2"
@@ -146,6 +146,8 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 
 	// set up our UDP listener
 	udpConns := make([]udp.Conn, routines)
+	var multiPortConns []udp.Conn
+	var streamConn *stream.Conn
 	port := c.GetInt("listen.port", 0)
 
 	if !configTest {
@@ -181,6 +183,22 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 				port = int(uPort.Port)
 			}
 		}
+
+		multiPortConns, err = newMultiPortListeners(l, c, listenHost.IP, port)
+		if err != nil {
+			return nil, err
+		}
+
+		// Obfuscation goes under the stream mux, streams are left alone
+		err = newObfsFromConfig(l, c, udpConns, multiPortConns)
+		if err != nil {
+			return nil, err
+		}
+
+		streamConn, err = newStreamFromConfig(l, c, udpConns)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Set up my internal host map
@@ -250,7 +268,10 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		triggerBuffer: c.GetInt("handshakes.trigger_buffer", DefaultHandshakeTriggerBuffer),
 		useRelays:     useRelays,
 
+		streamFallbackAfter: c.GetInt("tcp.fallback_after", DefaultStreamFallbackAfter),
+
 		messageMetrics: messageMetrics,
+		guard:          newHandshakeGuardFromConfig(l, c),
 	}
 
 	handshakeManager := NewHandshakeManager(l, hostMap, lightHouse, udpConns[0], handshakeConfig)
@@ -268,6 +289,11 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 	checkInterval := c.GetInt("timers.connection_alive_interval", 5)
 	pendingDeletionInterval := c.GetInt("timers.pending_deletion_interval", 10)
 
+	relayManager, err := NewRelayManager(ctx, l, hostMap, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to configure relays", err)
+	}
+
 	ifConfig := &InterfaceConfig{
 		HostMap:                 hostMap,
 		Inside:                  tun,
@@ -283,25 +309,46 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		tryPromoteEvery:         c.GetUint32("counters.try_promote", defaultPromoteEvery),
 		reQueryEvery:            c.GetUint32("counters.requery_every_packets", defaultReQueryEvery),
 		reQueryWait:             c.GetDuration("timers.requery_wait_duration", defaultReQueryWait),
+		rekeyInterval:           c.GetDuration("handshakes.rekey_interval", 0),
+		rekeyBytes:              uint64(max(c.GetInt("handshakes.rekey_bytes", 0), 0)),
+		probeInterval:           c.GetDuration("probes.interval", 0),
+		probeCandidates:         c.GetBool("probes.candidates", false),
+		probeFailover:           c.GetBool("probes.failover", false),
+		pmtuEnabled:             c.GetBool("pmtu.enabled", false),
+		pmtuMin:                 pathMtuMinFromConfig(c),
+		pmtuMax:                 c.GetInt("tun.mtu", overlay.DefaultMTU),
+		pmtuInterval:            c.GetDuration("pmtu.interval", DefaultPathMtuInterval),
+		tunBatch:                max(c.GetInt("tun.batch", 1), 1),
 		DropLocalBroadcast:      c.GetBool("tun.drop_local_broadcast", false),
 		DropMulticast:           c.GetBool("tun.drop_multicast", false),
 		routines:                routines,
 		MessageMetrics:          messageMetrics,
 		version:                 buildVersion,
-		relayManager:            NewRelayManager(ctx, l, hostMap, c),
+		relayManager:            relayManager,
 		punchy:                  punchy,
 
 		ConntrackCacheTimeout: conntrackCacheTimeout,
 		l:                     l,
 	}
 
-	switch ifConfig.Cipher {
-	case "aes":
-		noiseEndianness = binary.BigEndian
-	case "chachapoly":
-		noiseEndianness = binary.LittleEndian
-	default:
-		return nil, fmt.Errorf("unknown cipher: %v", ifConfig.Cipher)
+	ifConfig.Ciphers, err = ciphersFromConfig(c, ifConfig.Cipher)
+	if err != nil {
+		return nil, err
+	}
+
+	ifConfig.replayWindow, err = replayWindowFromConfig(c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load replay_window", err)
+	}
+
+	ifConfig.psk, err = NewPskFromConfig(c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load psk", err)
+	}
+
+	ifConfig.hybridKem, err = NewHybridKemModeFromConfig(c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load handshakes.hybrid_kem", err)
 	}
 
 	var ifce *Interface
@@ -314,6 +361,8 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		// TODO: Better way to attach these, probably want a new interface in InterfaceConfig
 		// I don't want to make this initial commit too far-reaching though
 		ifce.writers = udpConns
+		ifce.multiPort = newMultiPort(port, multiPortConns)
+		ifce.stream = streamConn
 		lightHouse.ifce = ifce
 
 		ifce.RegisterConfigChangeCallbacks(c)
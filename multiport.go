@@ -0,0 +1,201 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+	"github.com/slackhq/nebula/util"
+	"golang.org/x/net/ipv4"
+)
+
+// multiPortDetails is the range of udp ports a host listens on and sends from, starting at basePort.
+// A zero value means the host does not know about multiport and will only accept traffic from the port it learned.
+type multiPortDetails struct {
+	basePort   uint32
+	totalPorts uint32
+}
+
+func newMultiPortDetails(d *MultiPortDetails) multiPortDetails {
+	if d == nil || d.TotalPorts == 0 {
+		return multiPortDetails{}
+	}
+	return multiPortDetails{basePort: d.BasePort, totalPorts: d.TotalPorts}
+}
+
+func (d multiPortDetails) proto() *MultiPortDetails {
+	if d.totalPorts == 0 {
+		return nil
+	}
+	return &MultiPortDetails{BasePort: d.basePort, TotalPorts: d.totalPorts}
+}
+
+// usable reports if remote reaches the host on its base port, which means the rest of its ports are reachable at the
+// same ip. A remote on any other port has been translated along the way and we can't guess the other ports.
+func (d multiPortDetails) usable(remote *udp.Addr) bool {
+	return d.totalPorts > 1 && remote != nil && uint32(remote.Port) == d.basePort
+}
+
+// contains reports if addr is one of the ports of a host we know at remote
+func (d multiPortDetails) contains(remote, addr *udp.Addr) bool {
+	if !d.usable(remote) || !remote.IP.Equal(addr.IP) {
+		return false
+	}
+	return uint32(addr.Port) >= d.basePort && uint32(addr.Port) < d.basePort+d.totalPorts
+}
+
+// addrs returns every port of a host we know at remote, or nil if they can't be used
+func (d multiPortDetails) addrs(remote *udp.Addr) []*udp.Addr {
+	if !d.usable(remote) {
+		return nil
+	}
+
+	addrs := make([]*udp.Addr, d.totalPorts)
+	for i := range addrs {
+		addrs[i] = udp.NewAddr(remote.IP, uint16(d.basePort+uint32(i)))
+	}
+	return addrs
+}
+
+// multiPort holds the extra sockets we listen on and send from when listen.multiport.ports is more than 1.
+// The base port sockets are the interface writers, conns are listening on basePort+1 and up.
+type multiPort struct {
+	basePort uint32
+	conns    []udp.Conn
+}
+
+// newMultiPortListeners opens a socket for every port after basePort when listen.multiport.ports is more than 1
+func newMultiPortListeners(l *logrus.Logger, c *config.C, ip net.IP, basePort int) ([]udp.Conn, error) {
+	ports := c.GetInt("listen.multiport.ports", 1)
+	if ports <= 1 {
+		return nil, nil
+	}
+
+	if c.GetInt("listen.port", 0) == 0 {
+		return nil, fmt.Errorf("listen.multiport.ports requires listen.port to be set")
+	}
+
+	if basePort+ports-1 > 65535 {
+		return nil, fmt.Errorf("listen.multiport.ports %d from listen.port %d goes beyond port 65535", ports, basePort)
+	}
+
+	conns := make([]udp.Conn, 0, ports-1)
+	for i := 1; i < ports; i++ {
+		port := basePort + i
+		conn, err := udp.NewListener(l, ip, port, false, c.GetInt("listen.batch", 64))
+		if err != nil {
+			for _, opened := range conns {
+				_ = opened.Close()
+			}
+			return nil, util.NewContextualError("Failed to open multiport udp listener", m{"port": port}, err)
+		}
+		conn.ReloadConfig(c)
+		conns = append(conns, conn)
+	}
+
+	l.WithField("basePort", basePort).WithField("ports", ports).Info("Listening on multiple ports")
+	return conns, nil
+}
+
+func newMultiPort(basePort int, conns []udp.Conn) *multiPort {
+	return &multiPort{basePort: uint32(basePort), conns: conns}
+}
+
+// details returns what we advertise to peers in the handshake
+func (mp *multiPort) details() multiPortDetails {
+	if mp == nil || mp.basePort == 0 {
+		return multiPortDetails{}
+	}
+	return multiPortDetails{basePort: mp.basePort, totalPorts: uint32(len(mp.conns)) + 1}
+}
+
+// Conns returns the extra sockets, not including the base port
+func (mp *multiPort) Conns() []udp.Conn {
+	if mp == nil {
+		return nil
+	}
+	return mp.conns
+}
+
+// readMultiPortPackets is readOutsidePackets for our extra multiport sockets
+func readMultiPortPackets(f *Interface) udp.EncReader {
+	return func(
+		addr *udp.Addr,
+		out []byte,
+		packet []byte,
+		header *header.H,
+		fwPacket *firewall.Packet,
+		lhh udp.LightHouseHandlerFunc,
+		nb []byte,
+		q int,
+		localCache firewall.ConntrackCache,
+	) {
+		f.readOutsidePackets(addr, nil, originMultiPort, out, packet, header, fwPacket, lhh, nb, q, localCache)
+	}
+}
+
+// multiPortWriter picks the socket and destination for a message to hostinfo. Data messages are spread across the
+// ports of the peer by flow so packets within a flow are not reordered, everything else uses the base ports. Our own
+// ports are only spread once the peer has confirmed it accepts them, until then and for peers that did not tell us
+// about their ports, the peer only ever sees our base port.
+func (f *Interface) multiPortWriter(t header.MessageType, hostinfo *HostInfo, p []byte, q int) (udp.Conn, *udp.Addr) {
+	w, dst := f.writers[q], hostinfo.remote
+	if t != header.Message || hostinfo.multiPort.totalPorts == 0 {
+		return w, dst
+	}
+
+	var conns []udp.Conn
+	if hostinfo.multiPortConfirmed.Load() {
+		conns = f.multiPort.Conns()
+	}
+	var addrs []*udp.Addr
+	if a := hostinfo.multiPortAddrs.Load(); a != nil {
+		addrs = *a
+	}
+	if len(conns) == 0 && len(addrs) == 0 {
+		return w, dst
+	}
+
+	// A peer we reach over a stream only has the one address
+	if f.stream != nil && f.stream.Has(dst) {
+		return w, dst
+	}
+
+	flow := multiPortFlowHash(p)
+	if i := flow % uint32(len(conns)+1); i > 0 {
+		w = conns[i-1]
+	}
+	if len(addrs) > 0 {
+		dst = addrs[flow%uint32(len(addrs))]
+	}
+	return w, dst
+}
+
+// multiPortFlowHash hashes the addresses, protocol and ports of an ipv4 packet. Fragments skip the ports since only
+// the first fragment carries them.
+func multiPortFlowHash(p []byte) uint32 {
+	if len(p) < ipv4.HeaderLen {
+		return 0
+	}
+
+	h := binary.BigEndian.Uint32(p[12:16]) ^ binary.BigEndian.Uint32(p[16:20]) ^ uint32(p[9])
+	ihl := int(p[0]&0x0f) << 2
+	fragmented := binary.BigEndian.Uint16(p[6:8])&0x3fff != 0
+	if !fragmented && len(p) >= ihl+4 {
+		switch p[9] {
+		case firewall.ProtoTCP, firewall.ProtoUDP:
+			h ^= binary.BigEndian.Uint32(p[ihl : ihl+4])
+		}
+	}
+
+	// Mix the bits so the low bits used to pick a port depend on the whole tuple
+	h ^= h >> 16
+	h *= 0x45d9f3b
+	h ^= h >> 16
+	return h
+}
@@ -0,0 +1,167 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+)
+
+type multiPortTestConn struct {
+	udp.NoopConn
+	port int
+}
+
+func TestMultiPortDetails(t *testing.T) {
+	assert.Equal(t, multiPortDetails{}, newMultiPortDetails(nil))
+	assert.Equal(t, multiPortDetails{}, newMultiPortDetails(&MultiPortDetails{BasePort: 4242}))
+	assert.Nil(t, multiPortDetails{}.proto())
+
+	d := newMultiPortDetails(&MultiPortDetails{BasePort: 4242, TotalPorts: 3})
+	assert.Equal(t, multiPortDetails{basePort: 4242, totalPorts: 3}, d)
+	assert.Equal(t, &MultiPortDetails{BasePort: 4242, TotalPorts: 3}, d.proto())
+
+	remote := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+	assert.True(t, d.contains(remote, udp.NewAddr(net.ParseIP("1.2.3.4"), 4243)))
+	assert.True(t, d.contains(remote, udp.NewAddr(net.ParseIP("1.2.3.4"), 4244)))
+	assert.False(t, d.contains(remote, udp.NewAddr(net.ParseIP("1.2.3.4"), 4245)))
+	assert.False(t, d.contains(remote, udp.NewAddr(net.ParseIP("1.2.3.5"), 4243)))
+	assert.Equal(t, []*udp.Addr{
+		udp.NewAddr(net.ParseIP("1.2.3.4"), 4242),
+		udp.NewAddr(net.ParseIP("1.2.3.4"), 4243),
+		udp.NewAddr(net.ParseIP("1.2.3.4"), 4244),
+	}, d.addrs(remote))
+
+	// A remote that is not the base port has been translated, none of the other ports can be trusted
+	natted := udp.NewAddr(net.ParseIP("1.2.3.4"), 50000)
+	assert.False(t, d.contains(natted, udp.NewAddr(net.ParseIP("1.2.3.4"), 4243)))
+	assert.Nil(t, d.addrs(natted))
+
+	// A single port is nothing to spread over
+	assert.Nil(t, multiPortDetails{basePort: 4242, totalPorts: 1}.addrs(remote))
+}
+
+func TestMultiPort_Details(t *testing.T) {
+	var mp *multiPort
+	assert.Equal(t, multiPortDetails{}, mp.details())
+	assert.Nil(t, mp.Conns())
+
+	mp = newMultiPort(4242, nil)
+	assert.Equal(t, multiPortDetails{basePort: 4242, totalPorts: 1}, mp.details())
+
+	mp = newMultiPort(4242, []udp.Conn{&multiPortTestConn{port: 4243}})
+	assert.Equal(t, multiPortDetails{basePort: 4242, totalPorts: 2}, mp.details())
+}
+
+func TestMultiPortFlowHash(t *testing.T) {
+	newPacket := func(proto byte, srcPort, dstPort uint16, fragOff uint16) []byte {
+		p := make([]byte, 28)
+		p[0] = 0x45
+		p[6] = byte(fragOff >> 8)
+		p[7] = byte(fragOff)
+		p[9] = proto
+		copy(p[12:16], net.IPv4(10, 0, 0, 1).To4())
+		copy(p[16:20], net.IPv4(10, 0, 0, 2).To4())
+		p[20], p[21] = byte(srcPort>>8), byte(srcPort)
+		p[22], p[23] = byte(dstPort>>8), byte(dstPort)
+		return p
+	}
+
+	a := multiPortFlowHash(newPacket(6, 1000, 80, 0))
+	assert.Equal(t, a, multiPortFlowHash(newPacket(6, 1000, 80, 0)))
+	assert.NotEqual(t, a, multiPortFlowHash(newPacket(6, 1001, 80, 0)))
+	assert.NotEqual(t, a, multiPortFlowHash(newPacket(17, 1000, 80, 0)))
+
+	// Fragments of a flow land on the same port no matter what follows the header
+	assert.Equal(t, multiPortFlowHash(newPacket(17, 1000, 80, 0x2000)), multiPortFlowHash(newPacket(17, 5, 6, 0x00b9)))
+
+	// Protocols without ports only use the addresses
+	assert.Equal(t, multiPortFlowHash(newPacket(1, 1000, 80, 0)), multiPortFlowHash(newPacket(1, 1, 2, 0)))
+
+	assert.Equal(t, uint32(0), multiPortFlowHash([]byte{1, 2, 3}))
+}
+
+func TestInterface_multiPortWriter(t *testing.T) {
+	base := &multiPortTestConn{port: 4242}
+	f := &Interface{
+		writers: []udp.Conn{base},
+		multiPort: newMultiPort(4242, []udp.Conn{
+			&multiPortTestConn{port: 4243},
+			&multiPortTestConn{port: 4244},
+			&multiPortTestConn{port: 4245},
+		}),
+	}
+
+	remote := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+	hostinfo := &HostInfo{}
+	hostinfo.SetMultiPort(multiPortDetails{basePort: 4242, totalPorts: 4})
+	hostinfo.remote = remote
+	hostinfo.setMultiPortAddrs()
+
+	packet := func(srcPort uint16) []byte {
+		p := make([]byte, 28)
+		p[0] = 0x45
+		p[9] = 17
+		copy(p[12:16], net.IPv4(10, 0, 0, 1).To4())
+		copy(p[16:20], net.IPv4(10, 0, 0, 2).To4())
+		p[20], p[21] = byte(srcPort>>8), byte(srcPort)
+		return p
+	}
+
+	// Control traffic always uses the base ports
+	w, dst := f.multiPortWriter(header.Test, hostinfo, packet(1), 0)
+	assert.Equal(t, base, w)
+	assert.Equal(t, remote, dst)
+
+	// Until the peer sends to one of our extra ports only its ports are spread, it may not accept ours
+	usedDsts := map[uint16]struct{}{}
+	for i := uint16(0); i < 100; i++ {
+		w, dst = f.multiPortWriter(header.Message, hostinfo, packet(i), 0)
+		assert.Equal(t, base, w)
+		usedDsts[dst.Port] = struct{}{}
+	}
+	assert.Len(t, usedDsts, 4)
+
+	// Data is spread across every port and stays put for a flow
+	hostinfo.multiPortConfirmed.Store(true)
+	usedConns := map[int]struct{}{}
+	usedDsts = map[uint16]struct{}{}
+	for i := uint16(0); i < 100; i++ {
+		w, dst = f.multiPortWriter(header.Message, hostinfo, packet(i), 0)
+		usedConns[w.(*multiPortTestConn).port] = struct{}{}
+		usedDsts[dst.Port] = struct{}{}
+
+		w2, dst2 := f.multiPortWriter(header.Message, hostinfo, packet(i), 0)
+		assert.Equal(t, w, w2)
+		assert.Equal(t, dst, dst2)
+	}
+	assert.Len(t, usedConns, 4)
+	assert.Len(t, usedDsts, 4)
+
+	// The peer has to confirm again once it moves
+	hostinfo.remotes = NewRemoteList(nil)
+	hostinfo.SetRemote(udp.NewAddr(net.ParseIP("1.2.3.5"), 4242))
+	assert.False(t, hostinfo.multiPortConfirmed.Load())
+
+	// A peer that never told us about its ports only sees our base port
+	hostinfo = &HostInfo{remote: remote}
+	for i := uint16(0); i < 100; i++ {
+		w, dst = f.multiPortWriter(header.Message, hostinfo, packet(i), 0)
+		assert.Equal(t, base, w)
+		assert.Equal(t, remote, dst)
+	}
+}
+
+func TestInterface_handleHostRoaming_multiPort(t *testing.T) {
+	f := &Interface{}
+	remote := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+	hostinfo := &HostInfo{remote: remote}
+	hostinfo.SetMultiPort(multiPortDetails{basePort: 4242, totalPorts: 4})
+
+	// Traffic from the peer's other ports is not a roam
+	f.handleHostRoaming(hostinfo, udp.NewAddr(net.ParseIP("1.2.3.4"), 4245))
+	assert.Equal(t, remote, hostinfo.remote)
+	assert.True(t, hostinfo.lastRoam.IsZero())
+}
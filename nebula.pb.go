@@ -96,7 +96,7 @@ func (x NebulaPing_MessageType) String() string {
 }
 
 func (NebulaPing_MessageType) EnumDescriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{4, 0}
+	return fileDescriptor_2d65afa7693df5ef, []int{5, 0}
 }
 
 type NebulaControl_MessageType int32
@@ -105,18 +105,21 @@ const (
 	NebulaControl_None                NebulaControl_MessageType = 0
 	NebulaControl_CreateRelayRequest  NebulaControl_MessageType = 1
 	NebulaControl_CreateRelayResponse NebulaControl_MessageType = 2
+	NebulaControl_CreateRelayDenied   NebulaControl_MessageType = 3
 )
 
 var NebulaControl_MessageType_name = map[int32]string{
 	0: "None",
 	1: "CreateRelayRequest",
 	2: "CreateRelayResponse",
+	3: "CreateRelayDenied",
 }
 
 var NebulaControl_MessageType_value = map[string]int32{
 	"None":                0,
 	"CreateRelayRequest":  1,
 	"CreateRelayResponse": 2,
+	"CreateRelayDenied":   3,
 }
 
 func (x NebulaControl_MessageType) String() string {
@@ -124,7 +127,7 @@ func (x NebulaControl_MessageType) String() string {
 }
 
 func (NebulaControl_MessageType) EnumDescriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{7, 0}
+	return fileDescriptor_2d65afa7693df5ef, []int{9, 0}
 }
 
 type NebulaMeta struct {
@@ -185,6 +188,7 @@ type NebulaMetaDetails struct {
 	Ip6AndPorts []*Ip6AndPort `protobuf:"bytes,4,rep,name=Ip6AndPorts,proto3" json:"Ip6AndPorts,omitempty"`
 	RelayVpnIp  []uint32      `protobuf:"varint,5,rep,packed,name=RelayVpnIp,proto3" json:"RelayVpnIp,omitempty"`
 	Counter     uint32        `protobuf:"varint,3,opt,name=counter,proto3" json:"counter,omitempty"`
+	StreamAddrs []*StreamAddr `protobuf:"bytes,6,rep,name=StreamAddrs,proto3" json:"StreamAddrs,omitempty"`
 }
 
 func (m *NebulaMetaDetails) Reset()         { *m = NebulaMetaDetails{} }
@@ -255,6 +259,13 @@ func (m *NebulaMetaDetails) GetCounter() uint32 {
 	return 0
 }
 
+func (m *NebulaMetaDetails) GetStreamAddrs() []*StreamAddr {
+	if m != nil {
+		return m.StreamAddrs
+	}
+	return nil
+}
+
 type Ip4AndPort struct {
 	Ip   uint32 `protobuf:"varint,1,opt,name=Ip,proto3" json:"Ip,omitempty"`
 	Port uint32 `protobuf:"varint,2,opt,name=Port,proto3" json:"Port,omitempty"`
@@ -367,6 +378,74 @@ func (m *Ip6AndPort) GetPort() uint32 {
 	return 0
 }
 
+type StreamAddr struct {
+	Ip4AndPort *Ip4AndPort `protobuf:"bytes,1,opt,name=Ip4AndPort,proto3" json:"Ip4AndPort,omitempty"`
+	Ip6AndPort *Ip6AndPort `protobuf:"bytes,2,opt,name=Ip6AndPort,proto3" json:"Ip6AndPort,omitempty"`
+	Tls        bool        `protobuf:"varint,3,opt,name=Tls,proto3" json:"Tls,omitempty"`
+	Path       string      `protobuf:"bytes,4,opt,name=Path,proto3" json:"Path,omitempty"`
+}
+
+func (m *StreamAddr) Reset()         { *m = StreamAddr{} }
+func (m *StreamAddr) String() string { return proto.CompactTextString(m) }
+func (*StreamAddr) ProtoMessage()    {}
+func (*StreamAddr) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2d65afa7693df5ef, []int{4}
+}
+func (m *StreamAddr) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *StreamAddr) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_StreamAddr.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *StreamAddr) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StreamAddr.Merge(m, src)
+}
+func (m *StreamAddr) XXX_Size() int {
+	return m.Size()
+}
+func (m *StreamAddr) XXX_DiscardUnknown() {
+	xxx_messageInfo_StreamAddr.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StreamAddr proto.InternalMessageInfo
+
+func (m *StreamAddr) GetIp4AndPort() *Ip4AndPort {
+	if m != nil {
+		return m.Ip4AndPort
+	}
+	return nil
+}
+
+func (m *StreamAddr) GetIp6AndPort() *Ip6AndPort {
+	if m != nil {
+		return m.Ip6AndPort
+	}
+	return nil
+}
+
+func (m *StreamAddr) GetTls() bool {
+	if m != nil {
+		return m.Tls
+	}
+	return false
+}
+
+func (m *StreamAddr) GetPath() string {
+	if m != nil {
+		return m.Path
+	}
+	return ""
+}
+
 type NebulaPing struct {
 	Type NebulaPing_MessageType `protobuf:"varint,1,opt,name=Type,proto3,enum=nebula.NebulaPing_MessageType" json:"Type,omitempty"`
 	Time uint64                 `protobuf:"varint,2,opt,name=Time,proto3" json:"Time,omitempty"`
@@ -376,7 +455,7 @@ func (m *NebulaPing) Reset()         { *m = NebulaPing{} }
 func (m *NebulaPing) String() string { return proto.CompactTextString(m) }
 func (*NebulaPing) ProtoMessage()    {}
 func (*NebulaPing) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{4}
+	return fileDescriptor_2d65afa7693df5ef, []int{5}
 }
 func (m *NebulaPing) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -428,7 +507,7 @@ func (m *NebulaHandshake) Reset()         { *m = NebulaHandshake{} }
 func (m *NebulaHandshake) String() string { return proto.CompactTextString(m) }
 func (*NebulaHandshake) ProtoMessage()    {}
 func (*NebulaHandshake) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{5}
+	return fileDescriptor_2d65afa7693df5ef, []int{6}
 }
 func (m *NebulaHandshake) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -472,18 +551,24 @@ func (m *NebulaHandshake) GetHmac() []byte {
 }
 
 type NebulaHandshakeDetails struct {
-	Cert           []byte `protobuf:"bytes,1,opt,name=Cert,proto3" json:"Cert,omitempty"`
-	InitiatorIndex uint32 `protobuf:"varint,2,opt,name=InitiatorIndex,proto3" json:"InitiatorIndex,omitempty"`
-	ResponderIndex uint32 `protobuf:"varint,3,opt,name=ResponderIndex,proto3" json:"ResponderIndex,omitempty"`
-	Cookie         uint64 `protobuf:"varint,4,opt,name=Cookie,proto3" json:"Cookie,omitempty"`
-	Time           uint64 `protobuf:"varint,5,opt,name=Time,proto3" json:"Time,omitempty"`
+	Cert                []byte            `protobuf:"bytes,1,opt,name=Cert,proto3" json:"Cert,omitempty"`
+	InitiatorIndex      uint32            `protobuf:"varint,2,opt,name=InitiatorIndex,proto3" json:"InitiatorIndex,omitempty"`
+	ResponderIndex      uint32            `protobuf:"varint,3,opt,name=ResponderIndex,proto3" json:"ResponderIndex,omitempty"`
+	Cookie              uint64            `protobuf:"varint,4,opt,name=Cookie,proto3" json:"Cookie,omitempty"`
+	Time                uint64            `protobuf:"varint,5,opt,name=Time,proto3" json:"Time,omitempty"`
+	InitiatorMultiPort  *MultiPortDetails `protobuf:"bytes,6,opt,name=InitiatorMultiPort,proto3" json:"InitiatorMultiPort,omitempty"`
+	ResponderMultiPort  *MultiPortDetails `protobuf:"bytes,7,opt,name=ResponderMultiPort,proto3" json:"ResponderMultiPort,omitempty"`
+	Cipher              string            `protobuf:"bytes,8,opt,name=Cipher,proto3" json:"Cipher,omitempty"`
+	Ciphers             []string          `protobuf:"bytes,9,rep,name=Ciphers,proto3" json:"Ciphers,omitempty"`
+	KemEncapsulationKey []byte            `protobuf:"bytes,10,opt,name=KemEncapsulationKey,proto3" json:"KemEncapsulationKey,omitempty"`
+	KemCiphertext       []byte            `protobuf:"bytes,11,opt,name=KemCiphertext,proto3" json:"KemCiphertext,omitempty"`
 }
 
 func (m *NebulaHandshakeDetails) Reset()         { *m = NebulaHandshakeDetails{} }
 func (m *NebulaHandshakeDetails) String() string { return proto.CompactTextString(m) }
 func (*NebulaHandshakeDetails) ProtoMessage()    {}
 func (*NebulaHandshakeDetails) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{6}
+	return fileDescriptor_2d65afa7693df5ef, []int{7}
 }
 func (m *NebulaHandshakeDetails) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -547,19 +632,115 @@ func (m *NebulaHandshakeDetails) GetTime() uint64 {
 	return 0
 }
 
+func (m *NebulaHandshakeDetails) GetInitiatorMultiPort() *MultiPortDetails {
+	if m != nil {
+		return m.InitiatorMultiPort
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetResponderMultiPort() *MultiPortDetails {
+	if m != nil {
+		return m.ResponderMultiPort
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetCipher() string {
+	if m != nil {
+		return m.Cipher
+	}
+	return ""
+}
+
+func (m *NebulaHandshakeDetails) GetCiphers() []string {
+	if m != nil {
+		return m.Ciphers
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetKemEncapsulationKey() []byte {
+	if m != nil {
+		return m.KemEncapsulationKey
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetKemCiphertext() []byte {
+	if m != nil {
+		return m.KemCiphertext
+	}
+	return nil
+}
+
+type MultiPortDetails struct {
+	BasePort   uint32 `protobuf:"varint,1,opt,name=BasePort,proto3" json:"BasePort,omitempty"`
+	TotalPorts uint32 `protobuf:"varint,2,opt,name=TotalPorts,proto3" json:"TotalPorts,omitempty"`
+}
+
+func (m *MultiPortDetails) Reset()         { *m = MultiPortDetails{} }
+func (m *MultiPortDetails) String() string { return proto.CompactTextString(m) }
+func (*MultiPortDetails) ProtoMessage()    {}
+func (*MultiPortDetails) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2d65afa7693df5ef, []int{8}
+}
+func (m *MultiPortDetails) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *MultiPortDetails) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_MultiPortDetails.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *MultiPortDetails) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MultiPortDetails.Merge(m, src)
+}
+func (m *MultiPortDetails) XXX_Size() int {
+	return m.Size()
+}
+func (m *MultiPortDetails) XXX_DiscardUnknown() {
+	xxx_messageInfo_MultiPortDetails.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MultiPortDetails proto.InternalMessageInfo
+
+func (m *MultiPortDetails) GetBasePort() uint32 {
+	if m != nil {
+		return m.BasePort
+	}
+	return 0
+}
+
+func (m *MultiPortDetails) GetTotalPorts() uint32 {
+	if m != nil {
+		return m.TotalPorts
+	}
+	return 0
+}
+
 type NebulaControl struct {
 	Type                NebulaControl_MessageType `protobuf:"varint,1,opt,name=Type,proto3,enum=nebula.NebulaControl_MessageType" json:"Type,omitempty"`
 	InitiatorRelayIndex uint32                    `protobuf:"varint,2,opt,name=InitiatorRelayIndex,proto3" json:"InitiatorRelayIndex,omitempty"`
 	ResponderRelayIndex uint32                    `protobuf:"varint,3,opt,name=ResponderRelayIndex,proto3" json:"ResponderRelayIndex,omitempty"`
 	RelayToIp           uint32                    `protobuf:"varint,4,opt,name=RelayToIp,proto3" json:"RelayToIp,omitempty"`
 	RelayFromIp         uint32                    `protobuf:"varint,5,opt,name=RelayFromIp,proto3" json:"RelayFromIp,omitempty"`
+	MaxHops             uint32                    `protobuf:"varint,6,opt,name=MaxHops,proto3" json:"MaxHops,omitempty"`
+	RelayPath           []uint32                  `protobuf:"varint,7,rep,packed,name=RelayPath,proto3" json:"RelayPath,omitempty"`
 }
 
 func (m *NebulaControl) Reset()         { *m = NebulaControl{} }
 func (m *NebulaControl) String() string { return proto.CompactTextString(m) }
 func (*NebulaControl) ProtoMessage()    {}
 func (*NebulaControl) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{7}
+	return fileDescriptor_2d65afa7693df5ef, []int{9}
 }
 func (m *NebulaControl) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -623,6 +804,20 @@ func (m *NebulaControl) GetRelayFromIp() uint32 {
 	return 0
 }
 
+func (m *NebulaControl) GetMaxHops() uint32 {
+	if m != nil {
+		return m.MaxHops
+	}
+	return 0
+}
+
+func (m *NebulaControl) GetRelayPath() []uint32 {
+	if m != nil {
+		return m.RelayPath
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterEnum("nebula.NebulaMeta_MessageType", NebulaMeta_MessageType_name, NebulaMeta_MessageType_value)
 	proto.RegisterEnum("nebula.NebulaPing_MessageType", NebulaPing_MessageType_name, NebulaPing_MessageType_value)
@@ -631,61 +826,76 @@ func init() {
 	proto.RegisterType((*NebulaMetaDetails)(nil), "nebula.NebulaMetaDetails")
 	proto.RegisterType((*Ip4AndPort)(nil), "nebula.Ip4AndPort")
 	proto.RegisterType((*Ip6AndPort)(nil), "nebula.Ip6AndPort")
+	proto.RegisterType((*StreamAddr)(nil), "nebula.StreamAddr")
 	proto.RegisterType((*NebulaPing)(nil), "nebula.NebulaPing")
 	proto.RegisterType((*NebulaHandshake)(nil), "nebula.NebulaHandshake")
 	proto.RegisterType((*NebulaHandshakeDetails)(nil), "nebula.NebulaHandshakeDetails")
+	proto.RegisterType((*MultiPortDetails)(nil), "nebula.MultiPortDetails")
 	proto.RegisterType((*NebulaControl)(nil), "nebula.NebulaControl")
 }
 
 func init() { proto.RegisterFile("nebula.proto", fileDescriptor_2d65afa7693df5ef) }
 
 var fileDescriptor_2d65afa7693df5ef = []byte{
-	// 707 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x54, 0x4d, 0x6f, 0xda, 0x4a,
-	0x14, 0xc5, 0xc6, 0x7c, 0x5d, 0x02, 0xf1, 0xbb, 0x79, 0x8f, 0x07, 0x4f, 0xaf, 0x16, 0xf5, 0xa2,
-	0x62, 0x45, 0x22, 0x92, 0x46, 0x5d, 0x36, 0xa5, 0xaa, 0x20, 0x4a, 0x22, 0x3a, 0x4a, 0x5b, 0xa9,
-	0x9b, 0x6a, 0x62, 0xa6, 0xc1, 0x02, 0x3c, 0x8e, 0x3d, 0x54, 0xe1, 0x5f, 0xf4, 0xc7, 0xe4, 0x47,
-	0x74, 0xd7, 0x2c, 0xbb, 0xac, 0x92, 0x65, 0x97, 0xfd, 0x03, 0xd5, 0x8c, 0xc1, 0x36, 0x84, 0x76,
-	0x37, 0xe7, 0xde, 0x73, 0x66, 0xce, 0x9c, 0xb9, 0x36, 0x6c, 0x79, 0xec, 0x62, 0x36, 0xa1, 0x6d,
-	0x3f, 0xe0, 0x82, 0x63, 0x3e, 0x42, 0xf6, 0x0f, 0x1d, 0xe0, 0x4c, 0x2d, 0x4f, 0x99, 0xa0, 0xd8,
-	0x01, 0xe3, 0x7c, 0xee, 0xb3, 0xba, 0xd6, 0xd4, 0x5a, 0xd5, 0x8e, 0xd5, 0x5e, 0x68, 0x12, 0x46,
-	0xfb, 0x94, 0x85, 0x21, 0xbd, 0x64, 0x92, 0x45, 0x14, 0x17, 0xf7, 0xa1, 0xf0, 0x92, 0x09, 0xea,
-	0x4e, 0xc2, 0xba, 0xde, 0xd4, 0x5a, 0xe5, 0x4e, 0xe3, 0xa1, 0x6c, 0x41, 0x20, 0x4b, 0xa6, 0xfd,
-	0x53, 0x83, 0x72, 0x6a, 0x2b, 0x2c, 0x82, 0x71, 0xc6, 0x3d, 0x66, 0x66, 0xb0, 0x02, 0xa5, 0x1e,
-	0x0f, 0xc5, 0xeb, 0x19, 0x0b, 0xe6, 0xa6, 0x86, 0x08, 0xd5, 0x18, 0x12, 0xe6, 0x4f, 0xe6, 0xa6,
-	0x8e, 0xff, 0x41, 0x4d, 0xd6, 0xde, 0xf8, 0x43, 0x2a, 0xd8, 0x19, 0x17, 0xee, 0x47, 0xd7, 0xa1,
-	0xc2, 0xe5, 0x9e, 0x99, 0xc5, 0x06, 0xfc, 0x23, 0x7b, 0xa7, 0xfc, 0x13, 0x1b, 0xae, 0xb4, 0x8c,
-	0x65, 0x6b, 0x30, 0xf3, 0x9c, 0xd1, 0x4a, 0x2b, 0x87, 0x55, 0x00, 0xd9, 0x7a, 0x37, 0xe2, 0x74,
-	0xea, 0x9a, 0x79, 0xdc, 0x81, 0xed, 0x04, 0x47, 0xc7, 0x16, 0xa4, 0xb3, 0x01, 0x15, 0xa3, 0xee,
-	0x88, 0x39, 0x63, 0xb3, 0x28, 0x9d, 0xc5, 0x30, 0xa2, 0x94, 0xf0, 0x11, 0x34, 0x36, 0x3b, 0x3b,
-	0x72, 0xc6, 0x26, 0xd8, 0x5f, 0x35, 0xf8, 0xeb, 0x41, 0x28, 0xf8, 0x37, 0xe4, 0xde, 0xfa, 0x5e,
-	0xdf, 0x57, 0xa9, 0x57, 0x48, 0x04, 0xf0, 0x00, 0xca, 0x7d, 0xff, 0xe0, 0xc8, 0x1b, 0x0e, 0x78,
-	0x20, 0x64, 0xb4, 0xd9, 0x56, 0xb9, 0x83, 0xcb, 0x68, 0x93, 0x16, 0x49, 0xd3, 0x22, 0xd5, 0x61,
-	0xac, 0x32, 0xd6, 0x55, 0x87, 0x29, 0x55, 0x4c, 0x43, 0x0b, 0x80, 0xb0, 0x09, 0x9d, 0x47, 0x36,
-	0x72, 0xcd, 0x6c, 0xab, 0x42, 0x52, 0x15, 0xac, 0x43, 0xc1, 0xe1, 0x33, 0x4f, 0xb0, 0xa0, 0x9e,
-	0x55, 0x1e, 0x97, 0xd0, 0xde, 0x03, 0x48, 0x8e, 0xc7, 0x2a, 0xe8, 0xf1, 0x35, 0xf4, 0xbe, 0x8f,
-	0x08, 0x86, 0xac, 0xab, 0xb9, 0xa8, 0x10, 0xb5, 0xb6, 0x9f, 0x4b, 0xc5, 0x61, 0x4a, 0xd1, 0x73,
-	0x95, 0xc2, 0x20, 0x7a, 0xcf, 0x95, 0xf8, 0x84, 0x2b, 0xbe, 0x41, 0xf4, 0x13, 0x1e, 0xef, 0x90,
-	0x4d, 0xed, 0x70, 0xbd, 0x1c, 0xd9, 0x81, 0xeb, 0x5d, 0xfe, 0x79, 0x64, 0x25, 0x63, 0xc3, 0xc8,
-	0x22, 0x18, 0xe7, 0xee, 0x94, 0x2d, 0xce, 0x51, 0x6b, 0xdb, 0x7e, 0x30, 0x90, 0x52, 0x6c, 0x66,
-	0xb0, 0x04, 0xb9, 0xe8, 0x79, 0x35, 0xfb, 0x03, 0x6c, 0x47, 0xfb, 0xf6, 0xa8, 0x37, 0x0c, 0x47,
-	0x74, 0xcc, 0xf0, 0x59, 0x32, 0xfd, 0x9a, 0x9a, 0xfe, 0x35, 0x07, 0x31, 0x73, 0xfd, 0x13, 0x90,
-	0x26, 0x7a, 0x53, 0xea, 0x28, 0x13, 0x5b, 0x44, 0xad, 0xed, 0x1b, 0x0d, 0x6a, 0x9b, 0x75, 0x92,
-	0xde, 0x65, 0x81, 0x50, 0xa7, 0x6c, 0x11, 0xb5, 0xc6, 0x27, 0x50, 0xed, 0x7b, 0xae, 0x70, 0xa9,
-	0xe0, 0x41, 0xdf, 0x1b, 0xb2, 0xeb, 0x45, 0xd2, 0x6b, 0x55, 0xc9, 0x23, 0x2c, 0xf4, 0xb9, 0x37,
-	0x64, 0x0b, 0x5e, 0x94, 0xe7, 0x5a, 0x15, 0x6b, 0x90, 0xef, 0x72, 0x3e, 0x76, 0x59, 0xdd, 0x50,
-	0xc9, 0x2c, 0x50, 0x9c, 0x57, 0x2e, 0xc9, 0xeb, 0xd8, 0x28, 0xe6, 0xcd, 0xc2, 0xb1, 0x51, 0x2c,
-	0x98, 0x45, 0xfb, 0x46, 0x87, 0x4a, 0x64, 0xbb, 0xcb, 0x3d, 0x11, 0xf0, 0x09, 0x3e, 0x5d, 0x79,
-	0x95, 0xc7, 0xab, 0x99, 0x2c, 0x48, 0x1b, 0x1e, 0x66, 0x0f, 0x76, 0x62, 0xeb, 0x6a, 0xfe, 0xd2,
-	0xb7, 0xda, 0xd4, 0x92, 0x8a, 0xf8, 0x12, 0x29, 0x45, 0x74, 0xbf, 0x4d, 0x2d, 0xfc, 0x1f, 0x4a,
-	0x0a, 0x9d, 0xf3, 0xbe, 0xaf, 0xee, 0x59, 0x21, 0x49, 0x01, 0x9b, 0x50, 0x56, 0xe0, 0x55, 0xc0,
-	0xa7, 0xea, 0x5b, 0x90, 0xfd, 0x74, 0xc9, 0xee, 0xfd, 0xee, 0xcf, 0x55, 0x03, 0xec, 0x06, 0x8c,
-	0x0a, 0xa6, 0xd8, 0x84, 0x5d, 0xcd, 0x58, 0x28, 0x4c, 0x0d, 0xff, 0x85, 0x9d, 0x95, 0xba, 0xb4,
-	0x14, 0x32, 0x53, 0x7f, 0xb1, 0xff, 0xe5, 0xce, 0xd2, 0x6e, 0xef, 0x2c, 0xed, 0xfb, 0x9d, 0xa5,
-	0x7d, 0xbe, 0xb7, 0x32, 0xb7, 0xf7, 0x56, 0xe6, 0xdb, 0xbd, 0x95, 0x79, 0xdf, 0xb8, 0x74, 0xc5,
-	0x68, 0x76, 0xd1, 0x76, 0xf8, 0x74, 0x37, 0x9c, 0x50, 0x67, 0x3c, 0xba, 0xda, 0x8d, 0x22, 0xbc,
-	0xc8, 0xab, 0x1f, 0xf8, 0xfe, 0xaf, 0x00, 0x00, 0x00, 0xff, 0xff, 0x17, 0x56, 0x28, 0x74, 0xd0,
-	0x05, 0x00, 0x00,
+	// 918 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x56, 0x4b, 0x6f, 0x23, 0x45,
+	0x10, 0xf6, 0x3c, 0xfc, 0x2a, 0xaf, 0xbd, 0xb3, 0x15, 0x36, 0x4c, 0x56, 0x60, 0x99, 0x11, 0x42,
+	0x3e, 0x65, 0x23, 0x67, 0x89, 0x38, 0x92, 0xf5, 0x82, 0x6c, 0x65, 0x1d, 0x85, 0xc6, 0x80, 0xc4,
+	0x65, 0xd5, 0xb1, 0x9b, 0xcc, 0xc8, 0xe3, 0xe9, 0xd9, 0x99, 0x36, 0x8a, 0xcf, 0x88, 0x3b, 0x67,
+	0x7e, 0x10, 0xe2, 0xb8, 0x47, 0x8e, 0x28, 0x39, 0x72, 0xe4, 0x0f, 0xa0, 0xee, 0x79, 0xda, 0x19,
+	0xe0, 0x56, 0x8f, 0xef, 0xab, 0xfe, 0xa6, 0xba, 0xaa, 0x6d, 0x78, 0x14, 0xb0, 0xeb, 0x8d, 0x4f,
+	0x8f, 0xc3, 0x88, 0x0b, 0x8e, 0x8d, 0xc4, 0x73, 0xfe, 0xd2, 0x01, 0x2e, 0x95, 0x39, 0x63, 0x82,
+	0xe2, 0x08, 0xcc, 0xf9, 0x36, 0x64, 0xb6, 0x36, 0xd0, 0x86, 0xbd, 0x51, 0xff, 0x38, 0xe5, 0x14,
+	0x88, 0xe3, 0x19, 0x8b, 0x63, 0x7a, 0xc3, 0x24, 0x8a, 0x28, 0x2c, 0x9e, 0x42, 0xf3, 0x15, 0x13,
+	0xd4, 0xf3, 0x63, 0x5b, 0x1f, 0x68, 0xc3, 0xce, 0xe8, 0xe8, 0x21, 0x2d, 0x05, 0x90, 0x0c, 0xe9,
+	0xfc, 0xad, 0x41, 0xa7, 0x54, 0x0a, 0x5b, 0x60, 0x5e, 0xf2, 0x80, 0x59, 0x35, 0xec, 0x42, 0x7b,
+	0xc2, 0x63, 0xf1, 0xd5, 0x86, 0x45, 0x5b, 0x4b, 0x43, 0x84, 0x5e, 0xee, 0x12, 0x16, 0xfa, 0x5b,
+	0x4b, 0xc7, 0x67, 0x70, 0x28, 0x63, 0xdf, 0x84, 0x4b, 0x2a, 0xd8, 0x25, 0x17, 0xde, 0x0f, 0xde,
+	0x82, 0x0a, 0x8f, 0x07, 0x96, 0x81, 0x47, 0xf0, 0x54, 0xe6, 0x66, 0xfc, 0x47, 0xb6, 0xdc, 0x49,
+	0x99, 0x59, 0xea, 0x6a, 0x13, 0x2c, 0xdc, 0x9d, 0x54, 0x1d, 0x7b, 0x00, 0x32, 0xf5, 0x9d, 0xcb,
+	0xe9, 0xda, 0xb3, 0x1a, 0x78, 0x00, 0x8f, 0x0b, 0x3f, 0x39, 0xb6, 0x29, 0x95, 0x5d, 0x51, 0xe1,
+	0x8e, 0x5d, 0xb6, 0x58, 0x59, 0x2d, 0xa9, 0x2c, 0x77, 0x13, 0x48, 0x1b, 0x3f, 0x84, 0xa3, 0x6a,
+	0x65, 0xe7, 0x8b, 0x95, 0x05, 0xce, 0xcf, 0x3a, 0x3c, 0x79, 0xd0, 0x14, 0x7c, 0x0f, 0xea, 0xdf,
+	0x86, 0xc1, 0x34, 0x54, 0x5d, 0xef, 0x92, 0xc4, 0xc1, 0x17, 0xd0, 0x99, 0x86, 0x2f, 0xce, 0x83,
+	0xe5, 0x15, 0x8f, 0x84, 0x6c, 0xad, 0x31, 0xec, 0x8c, 0x30, 0x6b, 0x6d, 0x91, 0x22, 0x65, 0x58,
+	0xc2, 0x3a, 0xcb, 0x59, 0xe6, 0x3e, 0xeb, 0xac, 0xc4, 0xca, 0x61, 0xd8, 0x07, 0x20, 0xcc, 0xa7,
+	0xdb, 0x44, 0x46, 0x7d, 0x60, 0x0c, 0xbb, 0xa4, 0x14, 0x41, 0x1b, 0x9a, 0x0b, 0xbe, 0x09, 0x04,
+	0x8b, 0x6c, 0x43, 0x69, 0xcc, 0x5c, 0x79, 0xde, 0xd7, 0x22, 0x62, 0x74, 0x7d, 0xbe, 0x5c, 0x46,
+	0xb1, 0xdd, 0xd8, 0x3d, 0xaf, 0x48, 0x91, 0x32, 0xcc, 0x39, 0x01, 0x28, 0x44, 0x63, 0x0f, 0xf4,
+	0xfc, 0xe3, 0xf5, 0x69, 0x88, 0x08, 0xa6, 0x8c, 0xab, 0x69, 0xea, 0x12, 0x65, 0x3b, 0x9f, 0x03,
+	0x14, 0x82, 0x25, 0x63, 0xe2, 0x29, 0x86, 0x49, 0xf4, 0x89, 0x27, 0xfd, 0xd7, 0x5c, 0xe1, 0x4d,
+	0xa2, 0xbf, 0xe6, 0x79, 0x05, 0xa3, 0x54, 0xe1, 0x57, 0x0d, 0xa0, 0xd0, 0x80, 0xa3, 0xb2, 0x04,
+	0x55, 0xaa, 0xba, 0xbb, 0x65, 0xa1, 0xa3, 0xb2, 0x08, 0x5b, 0xdf, 0xe7, 0x9c, 0x95, 0x38, 0xb9,
+	0x54, 0x0b, 0x8c, 0xb9, 0x1f, 0x2b, 0x25, 0x2d, 0x22, 0x4d, 0x25, 0x8e, 0x0a, 0xd7, 0x36, 0x07,
+	0xda, 0xb0, 0x4d, 0x94, 0xed, 0xdc, 0x66, 0x5b, 0x78, 0xe5, 0x05, 0x37, 0xff, 0xbd, 0x85, 0x12,
+	0x51, 0xb1, 0x85, 0x08, 0xe6, 0xdc, 0x5b, 0xb3, 0xb4, 0x09, 0xca, 0x76, 0x9c, 0x07, 0x3b, 0x26,
+	0xc9, 0x56, 0x0d, 0xdb, 0x50, 0x4f, 0x26, 0x56, 0x73, 0xde, 0xc0, 0xe3, 0xa4, 0xee, 0x84, 0x06,
+	0xcb, 0xd8, 0xa5, 0x2b, 0x86, 0x9f, 0x15, 0x0b, 0x9d, 0xf4, 0x65, 0x4f, 0x41, 0x8e, 0xdc, 0xdf,
+	0x6a, 0x29, 0x62, 0xb2, 0xa6, 0x0b, 0x25, 0xe2, 0x11, 0x51, 0xb6, 0xf3, 0x9b, 0x01, 0x87, 0xd5,
+	0x3c, 0x09, 0x1f, 0xb3, 0xb4, 0xfb, 0x8f, 0x88, 0xb2, 0xf1, 0x13, 0xe8, 0x4d, 0x03, 0x4f, 0x78,
+	0x54, 0xf0, 0x68, 0x1a, 0x2c, 0xd9, 0x6d, 0x3a, 0x06, 0x7b, 0x51, 0x89, 0x23, 0x2c, 0x0e, 0x79,
+	0xb0, 0x64, 0x29, 0x2e, 0xb9, 0xec, 0xbd, 0x28, 0x1e, 0x42, 0x63, 0xcc, 0xf9, 0xca, 0x63, 0xaa,
+	0xdf, 0x26, 0x49, 0xbd, 0xbc, 0x5f, 0xf5, 0xa2, 0x5f, 0x38, 0x01, 0xcc, 0x4f, 0x99, 0x6d, 0x7c,
+	0xe1, 0xa9, 0x7b, 0x6e, 0xa8, 0x1e, 0xd8, 0x59, 0x0f, 0xf2, 0x44, 0xf6, 0xf5, 0x15, 0x1c, 0x59,
+	0x29, 0xd7, 0x51, 0x54, 0x6a, 0xfe, 0x5f, 0xa5, 0x87, 0x1c, 0xa5, 0xdf, 0x0b, 0x5d, 0x16, 0xd9,
+	0x2d, 0x35, 0x2f, 0xa9, 0x27, 0x57, 0x32, 0xb1, 0x62, 0xbb, 0x3d, 0x30, 0x86, 0x6d, 0x92, 0xb9,
+	0x78, 0x02, 0x07, 0x17, 0x6c, 0xfd, 0x45, 0xb0, 0xa0, 0x61, 0xbc, 0xf1, 0xd5, 0xeb, 0x73, 0xc1,
+	0xb6, 0x36, 0xa8, 0x26, 0x57, 0xa5, 0xf0, 0x63, 0xe8, 0x5e, 0xb0, 0x75, 0xc2, 0x17, 0xec, 0x56,
+	0xd8, 0x1d, 0x85, 0xdd, 0x0d, 0x3a, 0x97, 0x60, 0xed, 0x2b, 0xc6, 0x67, 0xd0, 0x7a, 0x49, 0x63,
+	0x96, 0xef, 0x50, 0x97, 0xe4, 0xbe, 0x7c, 0x54, 0xe6, 0x5c, 0x50, 0x3f, 0x7b, 0xbf, 0x64, 0xb6,
+	0x14, 0x71, 0x7e, 0x32, 0xa0, 0x9b, 0x0c, 0xc6, 0x98, 0x07, 0x22, 0xe2, 0x3e, 0x7e, 0xba, 0x33,
+	0xf7, 0x1f, 0xed, 0x4e, 0x5d, 0x0a, 0xaa, 0x18, 0xfd, 0x13, 0x38, 0xc8, 0xaf, 0x40, 0x3d, 0x5a,
+	0xe5, 0xb9, 0xa9, 0x4a, 0x49, 0x46, 0xde, 0xea, 0x12, 0x23, 0x99, 0xa0, 0xaa, 0x14, 0x7e, 0x00,
+	0x6d, 0xe5, 0xcd, 0xf9, 0x34, 0x54, 0x93, 0xd4, 0x25, 0x45, 0x00, 0x07, 0xd0, 0x51, 0xce, 0x97,
+	0x11, 0x5f, 0xab, 0x07, 0x54, 0xe6, 0xcb, 0x21, 0x79, 0x5d, 0x33, 0x7a, 0x3b, 0xe1, 0x61, 0xac,
+	0xe6, 0xa9, 0x4b, 0x32, 0x37, 0xaf, 0xac, 0xde, 0x84, 0xa6, 0x7a, 0x7a, 0x8b, 0x80, 0xf3, 0xe6,
+	0xdf, 0x7e, 0x26, 0x0f, 0x01, 0xc7, 0x11, 0xa3, 0x82, 0x29, 0x2c, 0x61, 0x6f, 0x37, 0x2c, 0x16,
+	0x96, 0x86, 0xef, 0xc3, 0xc1, 0x4e, 0x5c, 0x7e, 0x4a, 0xcc, 0x2c, 0x1d, 0x9f, 0xc2, 0x93, 0x52,
+	0xe2, 0x15, 0x0b, 0x3c, 0xb6, 0xb4, 0x8c, 0x97, 0xa7, 0xbf, 0xdf, 0xf5, 0xb5, 0x77, 0x77, 0x7d,
+	0xed, 0xcf, 0xbb, 0xbe, 0xf6, 0xcb, 0x7d, 0xbf, 0xf6, 0xee, 0xbe, 0x5f, 0xfb, 0xe3, 0xbe, 0x5f,
+	0xfb, 0xfe, 0xe8, 0xc6, 0x13, 0xee, 0xe6, 0xfa, 0x78, 0xc1, 0xd7, 0xcf, 0x63, 0x9f, 0x2e, 0x56,
+	0xee, 0xdb, 0xe7, 0xc9, 0x8d, 0x5c, 0x37, 0xd4, 0x9f, 0x88, 0xd3, 0x7f, 0x06, 0x00, 0xfe, 0x67,
+	0xbd, 0x79, 0x54, 0x08, 0x00, 0x00,
 }
 
 func (m *NebulaMeta) Marshal() (dAtA []byte, err error) {
@@ -748,6 +958,20 @@ func (m *NebulaMetaDetails) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.StreamAddrs) > 0 {
+		for iNdEx := len(m.StreamAddrs) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.StreamAddrs[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x32
+		}
+	}
 	if len(m.RelayVpnIp) > 0 {
 		dAtA3 := make([]byte, len(m.RelayVpnIp)*10)
 		var j2 int
@@ -878,6 +1102,70 @@ func (m *Ip6AndPort) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *StreamAddr) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *StreamAddr) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *StreamAddr) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if len(m.Path) > 0 {
+		i -= len(m.Path)
+		copy(dAtA[i:], m.Path)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.Path)))
+		i--
+		dAtA[i] = 0x22
+	}
+	if m.Tls {
+		i--
+		if m.Tls {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x18
+	}
+	if m.Ip6AndPort != nil {
+		{
+			size, err := m.Ip6AndPort.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintNebula(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x12
+	}
+	if m.Ip4AndPort != nil {
+		{
+			size, err := m.Ip4AndPort.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintNebula(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
+}
+
 func (m *NebulaPing) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
@@ -973,6 +1261,60 @@ func (m *NebulaHandshakeDetails) MarshalToSizedBuffer(dAtA []byte) (int, error)
 	_ = i
 	var l int
 	_ = l
+	if len(m.KemCiphertext) > 0 {
+		i -= len(m.KemCiphertext)
+		copy(dAtA[i:], m.KemCiphertext)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.KemCiphertext)))
+		i--
+		dAtA[i] = 0x5a
+	}
+	if len(m.KemEncapsulationKey) > 0 {
+		i -= len(m.KemEncapsulationKey)
+		copy(dAtA[i:], m.KemEncapsulationKey)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.KemEncapsulationKey)))
+		i--
+		dAtA[i] = 0x52
+	}
+	if len(m.Ciphers) > 0 {
+		for iNdEx := len(m.Ciphers) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.Ciphers[iNdEx])
+			copy(dAtA[i:], m.Ciphers[iNdEx])
+			i = encodeVarintNebula(dAtA, i, uint64(len(m.Ciphers[iNdEx])))
+			i--
+			dAtA[i] = 0x4a
+		}
+	}
+	if len(m.Cipher) > 0 {
+		i -= len(m.Cipher)
+		copy(dAtA[i:], m.Cipher)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.Cipher)))
+		i--
+		dAtA[i] = 0x42
+	}
+	if m.ResponderMultiPort != nil {
+		{
+			size, err := m.ResponderMultiPort.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintNebula(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x3a
+	}
+	if m.InitiatorMultiPort != nil {
+		{
+			size, err := m.InitiatorMultiPort.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintNebula(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x32
+	}
 	if m.Time != 0 {
 		i = encodeVarintNebula(dAtA, i, uint64(m.Time))
 		i--
@@ -1003,6 +1345,39 @@ func (m *NebulaHandshakeDetails) MarshalToSizedBuffer(dAtA []byte) (int, error)
 	return len(dAtA) - i, nil
 }
 
+func (m *MultiPortDetails) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *MultiPortDetails) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *MultiPortDetails) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.TotalPorts != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.TotalPorts))
+		i--
+		dAtA[i] = 0x10
+	}
+	if m.BasePort != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.BasePort))
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
 func (m *NebulaControl) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
@@ -1023,6 +1398,29 @@ func (m *NebulaControl) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.RelayPath) > 0 {
+		dAtA10 := make([]byte, len(m.RelayPath)*10)
+		var j9 int
+		for _, num := range m.RelayPath {
+			for num >= 1<<7 {
+				dAtA10[j9] = uint8(uint64(num)&0x7f | 0x80)
+				num >>= 7
+				j9++
+			}
+			dAtA10[j9] = uint8(num)
+			j9++
+		}
+		i -= j9
+		copy(dAtA[i:], dAtA10[:j9])
+		i = encodeVarintNebula(dAtA, i, uint64(j9))
+		i--
+		dAtA[i] = 0x3a
+	}
+	if m.MaxHops != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.MaxHops))
+		i--
+		dAtA[i] = 0x30
+	}
 	if m.RelayFromIp != 0 {
 		i = encodeVarintNebula(dAtA, i, uint64(m.RelayFromIp))
 		i--
@@ -1109,6 +1507,12 @@ func (m *NebulaMetaDetails) Size() (n int) {
 		}
 		n += 1 + sovNebula(uint64(l)) + l
 	}
+	if len(m.StreamAddrs) > 0 {
+		for _, e := range m.StreamAddrs {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
 	return n
 }
 
@@ -1145,22 +1549,46 @@ func (m *Ip6AndPort) Size() (n int) {
 	return n
 }
 
-func (m *NebulaPing) Size() (n int) {
+func (m *StreamAddr) Size() (n int) {
 	if m == nil {
 		return 0
 	}
 	var l int
 	_ = l
-	if m.Type != 0 {
-		n += 1 + sovNebula(uint64(m.Type))
+	if m.Ip4AndPort != nil {
+		l = m.Ip4AndPort.Size()
+		n += 1 + l + sovNebula(uint64(l))
 	}
-	if m.Time != 0 {
-		n += 1 + sovNebula(uint64(m.Time))
+	if m.Ip6AndPort != nil {
+		l = m.Ip6AndPort.Size()
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if m.Tls {
+		n += 2
+	}
+	l = len(m.Path)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
 	}
 	return n
 }
 
-func (m *NebulaHandshake) Size() (n int) {
+func (m *NebulaPing) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.Type != 0 {
+		n += 1 + sovNebula(uint64(m.Type))
+	}
+	if m.Time != 0 {
+		n += 1 + sovNebula(uint64(m.Time))
+	}
+	return n
+}
+
+func (m *NebulaHandshake) Size() (n int) {
 	if m == nil {
 		return 0
 	}
@@ -1199,6 +1627,47 @@ func (m *NebulaHandshakeDetails) Size() (n int) {
 	if m.Time != 0 {
 		n += 1 + sovNebula(uint64(m.Time))
 	}
+	if m.InitiatorMultiPort != nil {
+		l = m.InitiatorMultiPort.Size()
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if m.ResponderMultiPort != nil {
+		l = m.ResponderMultiPort.Size()
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	l = len(m.Cipher)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if len(m.Ciphers) > 0 {
+		for _, s := range m.Ciphers {
+			l = len(s)
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	l = len(m.KemEncapsulationKey)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	l = len(m.KemCiphertext)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	return n
+}
+
+func (m *MultiPortDetails) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.BasePort != 0 {
+		n += 1 + sovNebula(uint64(m.BasePort))
+	}
+	if m.TotalPorts != 0 {
+		n += 1 + sovNebula(uint64(m.TotalPorts))
+	}
 	return n
 }
 
@@ -1223,6 +1692,16 @@ func (m *NebulaControl) Size() (n int) {
 	if m.RelayFromIp != 0 {
 		n += 1 + sovNebula(uint64(m.RelayFromIp))
 	}
+	if m.MaxHops != 0 {
+		n += 1 + sovNebula(uint64(m.MaxHops))
+	}
+	if len(m.RelayPath) > 0 {
+		l = 0
+		for _, e := range m.RelayPath {
+			l += sovNebula(uint64(e))
+		}
+		n += 1 + sovNebula(uint64(l)) + l
+	}
 	return n
 }
 
@@ -1548,6 +2027,40 @@ func (m *NebulaMetaDetails) Unmarshal(dAtA []byte) error {
 			} else {
 				return fmt.Errorf("proto: wrong wireType = %d for field RelayVpnIp", wireType)
 			}
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field StreamAddrs", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.StreamAddrs = append(m.StreamAddrs, &StreamAddr{})
+			if err := m.StreamAddrs[len(m.StreamAddrs)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -1764,6 +2277,180 @@ func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
+func (m *StreamAddr) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowNebula
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: StreamAddr: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: StreamAddr: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Ip4AndPort", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Ip4AndPort == nil {
+				m.Ip4AndPort = &Ip4AndPort{}
+			}
+			if err := m.Ip4AndPort.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Ip6AndPort", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Ip6AndPort == nil {
+				m.Ip6AndPort = &Ip6AndPort{}
+			}
+			if err := m.Ip6AndPort.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Tls", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Tls = bool(v != 0)
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Path", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Path = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipNebula(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func (m *NebulaPing) Unmarshal(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
@@ -2111,17 +2798,309 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
-		default:
-			iNdEx = preIndex
-			skippy, err := skipNebula(dAtA[iNdEx:])
-			if err != nil {
-				return err
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field InitiatorMultiPort", wireType)
 			}
-			if (skippy < 0) || (iNdEx+skippy) < 0 {
-				return ErrInvalidLengthNebula
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
 			}
-			if (iNdEx + skippy) > l {
-				return io.ErrUnexpectedEOF
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.InitiatorMultiPort == nil {
+				m.InitiatorMultiPort = &MultiPortDetails{}
+			}
+			if err := m.InitiatorMultiPort.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ResponderMultiPort", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.ResponderMultiPort == nil {
+				m.ResponderMultiPort = &MultiPortDetails{}
+			}
+			if err := m.ResponderMultiPort.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cipher", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Cipher = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Ciphers", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Ciphers = append(m.Ciphers, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		case 10:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field KemEncapsulationKey", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.KemEncapsulationKey = append(m.KemEncapsulationKey[:0], dAtA[iNdEx:postIndex]...)
+			if m.KemEncapsulationKey == nil {
+				m.KemEncapsulationKey = []byte{}
+			}
+			iNdEx = postIndex
+		case 11:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field KemCiphertext", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.KemCiphertext = append(m.KemCiphertext[:0], dAtA[iNdEx:postIndex]...)
+			if m.KemCiphertext == nil {
+				m.KemCiphertext = []byte{}
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipNebula(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *MultiPortDetails) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowNebula
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: MultiPortDetails: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: MultiPortDetails: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field BasePort", wireType)
+			}
+			m.BasePort = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.BasePort |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TotalPorts", wireType)
+			}
+			m.TotalPorts = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.TotalPorts |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipNebula(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
 			}
 			iNdEx += skippy
 		}
@@ -2256,6 +3235,101 @@ func (m *NebulaControl) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MaxHops", wireType)
+			}
+			m.MaxHops = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.MaxHops |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 7:
+			if wireType == 0 {
+				var v uint32
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowNebula
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					v |= uint32(b&0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				m.RelayPath = append(m.RelayPath, v)
+			} else if wireType == 2 {
+				var packedLen int
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowNebula
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					packedLen |= int(b&0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				if packedLen < 0 {
+					return ErrInvalidLengthNebula
+				}
+				postIndex := iNdEx + packedLen
+				if postIndex < 0 {
+					return ErrInvalidLengthNebula
+				}
+				if postIndex > l {
+					return io.ErrUnexpectedEOF
+				}
+				var elementCount int
+				var count int
+				for _, integer := range dAtA[iNdEx:postIndex] {
+					if integer < 128 {
+						count++
+					}
+				}
+				elementCount = count
+				if elementCount != 0 && len(m.RelayPath) == 0 {
+					m.RelayPath = make([]uint32, 0, elementCount)
+				}
+				for iNdEx < postIndex {
+					var v uint32
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowNebula
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						v |= uint32(b&0x7F) << shift
+						if b < 0x80 {
+							break
+						}
+					}
+					m.RelayPath = append(m.RelayPath, v)
+				}
+			} else {
+				return fmt.Errorf("proto: wrong wireType = %d for field RelayPath", wireType)
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
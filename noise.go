@@ -4,25 +4,109 @@ import (
 	"crypto/cipher"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
 
 	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/noiseutil"
 )
 
 type endianness interface {
 	PutUint64(b []byte, v uint64)
 }
 
-var noiseEndianness endianness = binary.BigEndian
+// noiseCipherFunc returns the noise CipherFunc for a cipher name and the byte order it expects the nonce in
+func noiseCipherFunc(name string) (noise.CipherFunc, endianness, error) {
+	switch name {
+	case "aes":
+		return noiseutil.CipherAESGCM, binary.BigEndian, nil
+	case "chachapoly":
+		return noise.CipherChaChaPoly, binary.LittleEndian, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown cipher: %v", name)
+	}
+}
+
+// ciphersFromConfig returns the ciphers we accept for tunnels in order of preference. cipher is the one we run the
+// handshakes we initiate with, so it must be accepted as well.
+func ciphersFromConfig(c *config.C, cipher string) ([]string, error) {
+	if _, _, err := noiseCipherFunc(cipher); err != nil {
+		return nil, err
+	}
+
+	ciphers := c.GetStringSlice("ciphers", []string{cipher})
+	for _, name := range ciphers {
+		if _, _, err := noiseCipherFunc(name); err != nil {
+			return nil, fmt.Errorf("ciphers: %w", err)
+		}
+	}
+
+	if !slices.Contains(ciphers, cipher) {
+		return nil, fmt.Errorf("cipher %v must also be listed in ciphers", cipher)
+	}
+
+	return ciphers, nil
+}
+
+// negotiateCipher returns the first of our ciphers that the peer also supports, or an empty string if there are none
+func negotiateCipher(ours, theirs []string) string {
+	for _, c := range ours {
+		if slices.Contains(theirs, c) {
+			return c
+		}
+	}
+	return ""
+}
+
+// keyedCipherFunc wraps a noise.CipherFunc to hold on to the key of every cipher it creates, which allows the keys
+// from the handshake to be used with a cipher other than the one the handshake ran with. The name is not changed so
+// the noise protocol is identical to using the wrapped CipherFunc.
+type keyedCipherFunc struct {
+	noise.CipherFunc
+}
+
+func (f keyedCipherFunc) Cipher(k [32]byte) noise.Cipher {
+	return keyedCipher{Cipher: f.CipherFunc.Cipher(k), k: k}
+}
+
+type keyedCipher struct {
+	noise.Cipher
+	k [32]byte
+}
 
 type NebulaCipherState struct {
-	c noise.Cipher
+	c          noise.Cipher
+	endianness endianness
+	// bytes counts everything sealed or opened with this key, which decides when the tunnel is rekeyed
+	bytes atomic.Uint64
 	//k [32]byte
 	//n uint64
 }
 
-func NewNebulaCipherState(s *noise.CipherState) *NebulaCipherState {
-	return &NebulaCipherState{c: s.Cipher()}
+// NewNebulaCipherState creates the tunnel cipher from a cipher state produced by a ConnectionState handshake.
+// A non nil kemSecret is mixed into the key when the handshake included a kem exchange.
+func NewNebulaCipherState(s *noise.CipherState, cipherName string, kemSecret []byte) (*NebulaCipherState, error) {
+	kc, ok := s.Cipher().(keyedCipher)
+	if !ok {
+		return nil, errors.New("cipher state did not come from a nebula handshake")
+	}
+
+	cf, e, err := noiseCipherFunc(cipherName)
+	if err != nil {
+		return nil, err
+	}
+
+	k := kc.k
+	if kemSecret != nil {
+		k, err = hybridKey(k, kemSecret)
+		if err != nil {
+			return nil, err
+		}
+	}
 
+	return &NebulaCipherState{c: cf.Cipher(k), endianness: e}, nil
 }
 
 // EncryptDanger encrypts and authenticates a given payload.
@@ -45,8 +129,9 @@ func (s *NebulaCipherState) EncryptDanger(out, ad, plaintext []byte, n uint64, n
 		nb[1] = 0
 		nb[2] = 0
 		nb[3] = 0
-		noiseEndianness.PutUint64(nb[4:], n)
+		s.endianness.PutUint64(nb[4:], n)
 		out = s.c.(cipher.AEAD).Seal(out, nb, plaintext, ad)
+		s.bytes.Add(uint64(len(ad) + len(plaintext)))
 		//l.Debugf("Encryption: outlen: %d, nonce: %d, ad: %s, plainlen %d", len(out), n, ad, len(plaintext))
 		return out, nil
 	} else {
@@ -60,13 +145,26 @@ func (s *NebulaCipherState) DecryptDanger(out, ad, ciphertext []byte, n uint64,
 		nb[1] = 0
 		nb[2] = 0
 		nb[3] = 0
-		noiseEndianness.PutUint64(nb[4:], n)
-		return s.c.(cipher.AEAD).Open(out, nb, ciphertext, ad)
+		s.endianness.PutUint64(nb[4:], n)
+		start := len(out)
+		out, err := s.c.(cipher.AEAD).Open(out, nb, ciphertext, ad)
+		if err == nil {
+			s.bytes.Add(uint64(len(ad) + len(out) - start))
+		}
+		return out, err
 	} else {
 		return []byte{}, nil
 	}
 }
 
+// Bytes returns how many bytes have been sealed or opened with this key
+func (s *NebulaCipherState) Bytes() uint64 {
+	if s != nil {
+		return s.bytes.Load()
+	}
+	return 0
+}
+
 func (s *NebulaCipherState) Overhead() int {
 	if s != nil {
 		return s.c.(cipher.AEAD).Overhead()
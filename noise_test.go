@@ -0,0 +1,138 @@
+package nebula
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateCipher(t *testing.T) {
+	assert.Equal(t, "aes", negotiateCipher([]string{"aes", "chachapoly"}, []string{"chachapoly", "aes"}))
+	assert.Equal(t, "chachapoly", negotiateCipher([]string{"chachapoly", "aes"}, []string{"aes", "chachapoly"}))
+	assert.Equal(t, "aes", negotiateCipher([]string{"chachapoly", "aes"}, []string{"aes"}))
+	assert.Equal(t, "", negotiateCipher([]string{"chachapoly"}, []string{"aes"}))
+}
+
+func TestCiphersFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	ciphers, err := ciphersFromConfig(c, "aes")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"aes"}, ciphers)
+
+	_, err = ciphersFromConfig(c, "rot13")
+	assert.EqualError(t, err, "unknown cipher: rot13")
+
+	c.Settings["ciphers"] = []interface{}{"chachapoly", "aes"}
+	ciphers, err = ciphersFromConfig(c, "aes")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"chachapoly", "aes"}, ciphers)
+
+	c.Settings["ciphers"] = []interface{}{"chachapoly", "rot13"}
+	_, err = ciphersFromConfig(c, "chachapoly")
+	assert.EqualError(t, err, "ciphers: unknown cipher: rot13")
+
+	c.Settings["ciphers"] = []interface{}{"chachapoly"}
+	_, err = ciphersFromConfig(c, "aes")
+	assert.EqualError(t, err, "cipher aes must also be listed in ciphers")
+}
+
+func TestNewNebulaCipherState(t *testing.T) {
+	l := test.NewLogger()
+	newCertState := func() *CertState {
+		kp, err := noise.DH25519.GenerateKeypair(rand.Reader)
+		require.NoError(t, err)
+		return &CertState{
+			Certificate: &cert.NebulaCertificate{},
+			PrivateKey:  kp.Private,
+			PublicKey:   kp.Public,
+		}
+	}
+
+	// Run the handshake with aes, the keys it produces can be used with any cipher
+	initiator := NewConnectionState(l, "aes", newCertState(), true, noise.HandshakeIX, []byte{}, 0)
+	responder := NewConnectionState(l, "aes", newCertState(), false, noise.HandshakeIX, []byte{}, 0)
+
+	msg, _, _, err := initiator.H.WriteMessage(nil, nil)
+	require.NoError(t, err)
+	_, _, _, err = responder.H.ReadMessage(nil, msg)
+	require.NoError(t, err)
+	msg, rDKey, rEKey, err := responder.H.WriteMessage(nil, nil)
+	require.NoError(t, err)
+	_, iEKey, iDKey, err := initiator.H.ReadMessage(nil, msg)
+	require.NoError(t, err)
+
+	for _, name := range []string{"aes", "chachapoly"} {
+		eKey, err := NewNebulaCipherState(iEKey, name, nil)
+		require.NoError(t, err)
+		dKey, err := NewNebulaCipherState(rDKey, name, nil)
+		require.NoError(t, err)
+
+		nb := make([]byte, 12)
+		out, err := eKey.EncryptDanger(nil, []byte("ad"), []byte("hello"), 5, nb)
+		require.NoError(t, err)
+		plain, err := dKey.DecryptDanger(nil, []byte("ad"), out, 5, nb)
+		require.NoError(t, err, name)
+		assert.Equal(t, []byte("hello"), plain)
+		assert.Equal(t, uint64(7), eKey.Bytes())
+		assert.Equal(t, uint64(7), dKey.Bytes())
+
+		// The other direction uses its own key
+		wrongKey, err := NewNebulaCipherState(iDKey, name, nil)
+		require.NoError(t, err)
+		_, err = wrongKey.DecryptDanger(nil, []byte("ad"), out, 5, nb)
+		assert.Error(t, err)
+		assert.Equal(t, uint64(0), wrongKey.Bytes())
+	}
+
+	// Different ciphers do not understand each other
+	aesKey, err := NewNebulaCipherState(iEKey, "aes", nil)
+	require.NoError(t, err)
+	chachaKey, err := NewNebulaCipherState(rDKey, "chachapoly", nil)
+	require.NoError(t, err)
+	nb := make([]byte, 12)
+	out, err := aesKey.EncryptDanger(nil, nil, []byte("hello"), 1, nb)
+	require.NoError(t, err)
+	_, err = chachaKey.DecryptDanger(nil, nil, out, 1, nb)
+	assert.Error(t, err)
+
+	// A kem secret must be mixed in on both sides
+	secret := []byte("kem secret")
+	hybridE, err := NewNebulaCipherState(iEKey, "aes", secret)
+	require.NoError(t, err)
+	hybridD, err := NewNebulaCipherState(rDKey, "aes", secret)
+	require.NoError(t, err)
+	out, err = hybridE.EncryptDanger(nil, nil, []byte("hello"), 2, nb)
+	require.NoError(t, err)
+	plain, err := hybridD.DecryptDanger(nil, nil, out, 2, nb)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), plain)
+
+	_, err = aesKey.DecryptDanger(nil, nil, out, 2, nb)
+	assert.Error(t, err)
+
+	_, err = NewNebulaCipherState(rEKey, "rot13", nil)
+	assert.EqualError(t, err, "unknown cipher: rot13")
+
+	// Cipher states from outside of a nebula handshake are not accepted
+	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherAESGCM, noise.HashSHA256)
+	plainInitiator, err := noise.NewHandshakeState(noise.Config{CipherSuite: cs, Pattern: noise.HandshakeNN, Initiator: true, Random: rand.Reader})
+	require.NoError(t, err)
+	plainResponder, err := noise.NewHandshakeState(noise.Config{CipherSuite: cs, Pattern: noise.HandshakeNN, Random: rand.Reader})
+	require.NoError(t, err)
+	msg, _, _, err = plainInitiator.WriteMessage(nil, nil)
+	require.NoError(t, err)
+	_, _, _, err = plainResponder.ReadMessage(nil, msg)
+	require.NoError(t, err)
+	_, plainKey, _, err := plainResponder.WriteMessage(nil, nil)
+	require.NoError(t, err)
+	_, err = NewNebulaCipherState(plainKey, "aes", nil)
+	assert.EqualError(t, err, "cipher state did not come from a nebula handshake")
+}
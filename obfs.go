@@ -0,0 +1,34 @@
+package nebula
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/obfs"
+	"github.com/slackhq/nebula/udp"
+	"github.com/slackhq/nebula/util"
+)
+
+const defaultObfuscationPadTo = 64
+
+// newObfsFromConfig wraps every udp socket so the packets on it are obfuscated when obfuscation.key is set
+func newObfsFromConfig(l *logrus.Logger, c *config.C, conns ...[]udp.Conn) error {
+	secret := c.GetString("obfuscation.key", "")
+	if secret == "" {
+		return nil
+	}
+
+	padTo := c.GetInt("obfuscation.pad_to", defaultObfuscationPadTo)
+	k, err := obfs.NewKey(secret, padTo)
+	if err != nil {
+		return util.NewContextualError("Failed to load obfuscation", m{"padTo": padTo}, err)
+	}
+
+	for _, cs := range conns {
+		for i := range cs {
+			cs[i] = obfs.NewConn(cs[i], k)
+		}
+	}
+
+	l.WithField("padTo", padTo).Info("Obfuscating packets")
+	return nil
+}
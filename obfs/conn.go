@@ -0,0 +1,104 @@
+package obfs
+
+import (
+	"sync"
+
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+)
+
+// Conn obfuscates every packet written to the udp socket it wraps and reveals every packet read from it, packets that
+// were not obfuscated with the same key are dropped
+type Conn struct {
+	udp.Conn
+	k *Key
+}
+
+type buffer struct {
+	b []byte
+	s scratch
+}
+
+var buffers = sync.Pool{
+	New: func() any {
+		return &buffer{b: make([]byte, udp.MTU)}
+	},
+}
+
+func NewConn(u udp.Conn, k *Key) *Conn {
+	return &Conn{Conn: u, k: k}
+}
+
+// Unwrap returns the udp socket
+func (c *Conn) Unwrap() udp.Conn {
+	return c.Conn
+}
+
+func (c *Conn) WriteTo(b []byte, addr *udp.Addr) error {
+	buf := buffers.Get().(*buffer)
+	defer buffers.Put(buf)
+
+	out, err := c.k.mask(&buf.s, buf.b, b)
+	if err != nil {
+		return err
+	}
+	return c.Conn.WriteTo(out, addr)
+}
+
+// WriteToDontFragment obfuscates b and sends it with the don't fragment bit set if the udp socket supports it
+func (c *Conn) WriteToDontFragment(b []byte, addr *udp.Addr) error {
+	buf := buffers.Get().(*buffer)
+	defer buffers.Put(buf)
+
+	out, err := c.k.mask(&buf.s, buf.b, b)
+	if err != nil {
+		return err
+	}
+	return udp.WriteToDontFragment(c.Conn, out, addr)
+}
+
+func (c *Conn) WriteBatch(b [][]byte, addrs []*udp.Addr) (int, error) {
+	bufs := make([]*buffer, 0, len(b))
+	out := make([][]byte, 0, len(b))
+	defer func() {
+		for _, buf := range bufs {
+			buffers.Put(buf)
+		}
+	}()
+
+	// Everything before a packet that is too long still goes out, the caller learns how far we got from n
+	var maskErr error
+	for i := range b {
+		buf := buffers.Get().(*buffer)
+		bufs = append(bufs, buf)
+		p, err := c.k.mask(&buf.s, buf.b, b[i])
+		if err != nil {
+			maskErr = err
+			break
+		}
+		out = append(out, p)
+	}
+
+	if len(out) == 0 {
+		return 0, maskErr
+	}
+	n, err := c.Conn.WriteBatch(out, addrs[:len(out)])
+	if err != nil {
+		return n, err
+	}
+	return n, maskErr
+}
+
+func (c *Conn) ListenOut(r udp.EncReader, lhf udp.LightHouseHandlerFunc, flush func(), cache *firewall.ConntrackCacheTicker, q int) {
+	s := &scratch{}
+	reveal := func(addr *udp.Addr, out []byte, packet []byte, h *header.H, fwPacket *firewall.Packet, lhh udp.LightHouseHandlerFunc, nb []byte, q int, localCache firewall.ConntrackCache) {
+		packet = c.k.unmask(s, packet)
+		if packet == nil {
+			return
+		}
+		r(addr, out, packet, h, fwPacket, lhh, nb, q, localCache)
+	}
+
+	c.Conn.ListenOut(reveal, lhf, flush, cache, q)
+}
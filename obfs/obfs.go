@@ -0,0 +1,152 @@
+package obfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+	"golang.org/x/crypto/hkdf"
+)
+
+//Obfuscated packet:
+// |-----------------------------------------------------------------------|
+// |                    Masked nebula header (16 bytes)                    |
+// |-----------------------------------------------------------------------|
+// |                              payload...                               |
+// |-----------------------------------------------------------------------|
+// |                         Random padding...                             |
+// |-----------------------------------------------------------------------|
+// |                     Masked padding length (uint16)                    |
+// |-----------------------------------------------------------------------|
+//
+// The masks come from encrypting the 16 bytes after the header with keys derived from the network secret, the same
+// way QUIC protects its headers. Those bytes are the start of the aead output or a noise ephemeral key for every
+// packet nebula sends, or random padding for the few packets that are shorter, so every packet gets its own mask.
+
+const (
+	sampleLen  = aes.BlockSize
+	trailerLen = 2
+
+	// MinLen is the smallest obfuscated packet, enough for the header, a full sample and the padding length
+	MinLen = header.Len + sampleLen + trailerLen
+
+	// MaxLen is the largest packet that can be obfuscated without going over what we are able to read
+	MaxLen = udp.MTU - trailerLen
+
+	// MaxPadTo is the largest multiple packets can be padded to
+	MaxPadTo = 1024
+)
+
+// ErrTooLong is returned for packets longer than MaxLen, there is no room left for the padding length
+var ErrTooLong = fmt.Errorf("packet is too long to obfuscate, the limit is %d bytes", MaxLen)
+
+// Key masks nebula headers and pads packets for everyone that knows the same network secret
+type Key struct {
+	header  cipher.Block
+	trailer cipher.Block
+	padTo   int
+}
+
+// scratch holds the masks of one packet, callers keep one around so masking doesn't allocate
+type scratch struct {
+	sample [sampleLen]byte
+	mask   [aes.BlockSize]byte
+}
+
+// NewKey derives the masking keys from secret. Packets are padded to a multiple of padTo bytes, 0 or 1 only pads the
+// few packets smaller than MinLen.
+func NewKey(secret string, padTo int) (*Key, error) {
+	if secret == "" {
+		return nil, errors.New("obfuscation key is empty")
+	}
+	if padTo < 0 || padTo > MaxPadTo {
+		return nil, fmt.Errorf("obfuscation padding must be between 0 and %d", MaxPadTo)
+	}
+
+	keys := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte("NEBULA OBFUSCATION")), keys)
+	if err != nil {
+		return nil, errors.New("failed to derive obfuscation keys")
+	}
+
+	k := &Key{padTo: max(padTo, 1)}
+	if k.header, err = aes.NewCipher(keys[:16]); err != nil {
+		return nil, err
+	}
+	if k.trailer, err = aes.NewCipher(keys[16:]); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// PaddedLen is how long a packet of n bytes is once obfuscated, padding is cut short so it never goes over udp.MTU.
+// n must be no more than MaxLen.
+func (k *Key) PaddedLen(n int) int {
+	l := max(n+trailerLen, MinLen)
+	l = (l + k.padTo - 1) / k.padTo * k.padTo
+	return min(l, udp.MTU)
+}
+
+// mask writes p obfuscated into out, which must be able to hold udp.MTU bytes, and returns it
+func (k *Key) mask(s *scratch, out, p []byte) ([]byte, error) {
+	if len(p) > MaxLen {
+		return nil, ErrTooLong
+	}
+
+	l := k.PaddedLen(len(p))
+	out = out[:l]
+	copy(out, p)
+
+	pad := out[len(p) : l-trailerLen]
+	for i := 0; i < len(pad); i += 8 {
+		var r [8]byte
+		binary.LittleEndian.PutUint64(r[:], rand.Uint64())
+		copy(pad[i:], r[:])
+	}
+
+	binary.BigEndian.PutUint16(out[l-trailerLen:], uint16(len(pad)))
+	k.xor(s, out)
+	return out, nil
+}
+
+// unmask reveals the packet obfuscated in b, in place, or returns nil if b could not have come from mask
+func (k *Key) unmask(s *scratch, b []byte) []byte {
+	if len(b) < MinLen {
+		return nil
+	}
+
+	k.xor(s, b)
+	padLen := int(binary.BigEndian.Uint16(b[len(b)-trailerLen:]))
+	n := len(b) - trailerLen - padLen
+	if n < 0 {
+		return nil
+	}
+
+	// A wrong key is likely to show up here, anything shorter than a header is dropped by the reader anyway
+	if n >= header.Len && b[0]>>4 != header.Version {
+		return nil
+	}
+	return b[:n]
+}
+
+// xor flips the header and padding length of b with the masks for its sample, doing it twice undoes it
+func (k *Key) xor(s *scratch, b []byte) {
+	copy(s.sample[:], b[header.Len:header.Len+sampleLen])
+
+	k.header.Encrypt(s.mask[:], s.sample[:])
+	for i := 0; i < header.Len; i++ {
+		b[i] ^= s.mask[i]
+	}
+
+	k.trailer.Encrypt(s.mask[:], s.sample[:])
+	t := b[len(b)-trailerLen:]
+	t[0] ^= s.mask[0]
+	t[1] ^= s.mask[1]
+}
@@ -0,0 +1,172 @@
+package obfs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func packet(t header.MessageType, n int) []byte {
+	p := make([]byte, n)
+	if n >= header.Len {
+		header.Encode(p, header.Version, t, 0, 1234, 5678)
+	}
+	for i := header.Len; i < n; i++ {
+		p[i] = byte(i * 7)
+	}
+	return p
+}
+
+func TestKey(t *testing.T) {
+	_, err := NewKey("", 64)
+	assert.Error(t, err)
+	_, err = NewKey("secret", MaxPadTo+1)
+	assert.Error(t, err)
+
+	k, err := NewKey("secret", 64)
+	require.NoError(t, err)
+	s := &scratch{}
+	out := make([]byte, udp.MTU)
+
+	for _, n := range []int{0, 1, header.Len, header.Len + 1, 31, 62, 63, 1300, MaxLen - 1, MaxLen} {
+		p := packet(header.Message, n)
+		b, err := k.mask(s, out, p)
+		require.NoError(t, err)
+		assert.Len(t, b, k.PaddedLen(n))
+		if n < 8900 {
+			assert.Zero(t, len(b)%64, n)
+		}
+		assert.LessOrEqual(t, len(b), udp.MTU)
+		assert.Equal(t, p, k.unmask(s, b), n)
+	}
+
+	// The same header looks different on every packet
+	p := packet(header.Message, 100)
+	a, err := k.mask(s, out, p)
+	require.NoError(t, err)
+	a = bytes.Clone(a[:header.Len])
+	p[header.Len] ^= 1
+	b, err := k.mask(s, out, p)
+	require.NoError(t, err)
+	b = b[:header.Len]
+	assert.NotEqual(t, a, b)
+	assert.NotEqual(t, packet(header.Message, 100)[:header.Len], a)
+
+	// Only padding below the minimum
+	k, err = NewKey("secret", 0)
+	require.NoError(t, err)
+	assert.Equal(t, MinLen, k.PaddedLen(0))
+	assert.Equal(t, 1302, k.PaddedLen(1300))
+
+	// Padding is cut short at the mtu and packets with no room for the padding length are refused
+	k, err = NewKey("secret", MaxPadTo)
+	require.NoError(t, err)
+	assert.Equal(t, udp.MTU, k.PaddedLen(udp.MTU-100))
+	assert.Equal(t, udp.MTU, k.PaddedLen(MaxLen-1))
+	assert.Equal(t, udp.MTU, k.PaddedLen(MaxLen))
+	for _, n := range []int{MaxLen - 1, MaxLen} {
+		p = packet(header.Message, n)
+		b, err = k.mask(s, out, p)
+		require.NoError(t, err)
+		assert.Len(t, b, udp.MTU)
+		assert.Equal(t, p, k.unmask(s, b), n)
+	}
+	for _, n := range []int{MaxLen + 1, udp.MTU} {
+		_, err = k.mask(s, out, packet(header.Message, n))
+		assert.ErrorIs(t, err, ErrTooLong)
+	}
+
+	// Someone without the key can't get a packet through, nor can someone without obfuscation
+	other, err := NewKey("other secret", 64)
+	require.NoError(t, err)
+	dropped := 0
+	for i := 0; i < 100; i++ {
+		p = packet(header.Message, 100)
+		p[50] = byte(i)
+		b, err = k.mask(s, out, p)
+		require.NoError(t, err)
+		if other.unmask(s, b) == nil {
+			dropped++
+		}
+	}
+	assert.Greater(t, dropped, 80)
+	assert.Nil(t, k.unmask(s, packet(header.Message, 1)))
+}
+
+type loopbackConn struct {
+	udp.NoopConn
+	sent [][]byte
+	df   int
+}
+
+func (c *loopbackConn) WriteToDontFragment(b []byte, addr *udp.Addr) error {
+	c.df++
+	return c.WriteTo(b, addr)
+}
+
+func (c *loopbackConn) WriteTo(b []byte, _ *udp.Addr) error {
+	c.sent = append(c.sent, bytes.Clone(b))
+	return nil
+}
+
+func (c *loopbackConn) WriteBatch(b [][]byte, addrs []*udp.Addr) (int, error) {
+	for i := range b {
+		_ = c.WriteTo(b[i], addrs[i])
+	}
+	return len(b), nil
+}
+
+func (c *loopbackConn) ListenOut(r udp.EncReader, lhf udp.LightHouseHandlerFunc, flush func(), _ *firewall.ConntrackCacheTicker, q int) {
+	for _, p := range c.sent {
+		r(nil, nil, p, nil, nil, lhf, nil, q, nil)
+	}
+	flush()
+}
+
+func TestConn(t *testing.T) {
+	k, err := NewKey("secret", 64)
+	require.NoError(t, err)
+	u := &loopbackConn{}
+	c := NewConn(u, k)
+	assert.Equal(t, udp.Conn(u), c.Unwrap())
+
+	sent := [][]byte{packet(header.Handshake, 200), packet(header.Message, 1000), packet(header.RecvError, header.Len)}
+	require.NoError(t, c.WriteTo(sent[0], nil))
+	n, err := c.WriteBatch(sent[1:], []*udp.Addr{nil, nil})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Zero(t, u.df)
+
+	// Path mtu probes keep the don't fragment bit through the obfuscation
+	sent = append(sent, packet(header.Test, 300))
+	require.NoError(t, udp.WriteToDontFragment(c, sent[3], nil))
+	assert.Equal(t, 1, u.df)
+
+	// Nothing goes out that looks like a nebula header
+	for _, b := range u.sent {
+		assert.NotEqual(t, sent[0][:4], b[:4])
+		assert.Zero(t, len(b)%64)
+	}
+
+	// Junk and packets from hosts without the key are dropped
+	u.sent = append(u.sent, []byte{1}, packet(header.Message, 100))
+
+	var got [][]byte
+	c.ListenOut(func(_ *udp.Addr, _ []byte, p []byte, _ *header.H, _ *firewall.Packet, _ udp.LightHouseHandlerFunc, _ []byte, _ int, _ firewall.ConntrackCache) {
+		got = append(got, bytes.Clone(p))
+	}, nil, func() {}, nil, 0)
+	assert.Equal(t, sent, got)
+
+	// A packet too long to obfuscate stops the batch, everything before it still goes out
+	u.sent = nil
+	assert.ErrorIs(t, c.WriteTo(packet(header.Message, udp.MTU), nil), ErrTooLong)
+	n, err = c.WriteBatch([][]byte{packet(header.Message, 100), packet(header.Message, MaxLen+1), packet(header.Message, 100)}, []*udp.Addr{nil, nil, nil})
+	assert.ErrorIs(t, err, ErrTooLong)
+	assert.Equal(t, 1, n)
+	assert.Len(t, u.sent, 1)
+}
@@ -21,6 +21,18 @@ const (
 	minFwPacketLen = 4
 )
 
+// packetOrigin is how a packet from the outside reached us
+type packetOrigin uint8
+
+const (
+	// originUdp is one of our base port udp sockets, or a relay
+	originUdp packetOrigin = iota
+	// originMultiPort is one of our extra multiport sockets
+	originMultiPort
+	// originStream is a tcp stream
+	originStream
+)
+
 func readOutsidePackets(f *Interface) udp.EncReader {
 	return func(
 		addr *udp.Addr,
@@ -33,11 +45,12 @@ func readOutsidePackets(f *Interface) udp.EncReader {
 		q int,
 		localCache firewall.ConntrackCache,
 	) {
-		f.readOutsidePackets(addr, nil, out, packet, header, fwPacket, lhh, nb, q, localCache)
+		f.readOutsidePackets(addr, nil, originUdp, out, packet, header, fwPacket, lhh, nb, q, localCache)
 	}
 }
 
-func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byte, packet []byte, h *header.H, fwPacket *firewall.Packet, lhf udp.LightHouseHandlerFunc, nb []byte, q int, localCache firewall.ConntrackCache) {
+// readOutsidePackets handles a packet from the outside, origin is the socket or stream it arrived on
+func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, origin packetOrigin, out []byte, packet []byte, h *header.H, fwPacket *firewall.Packet, lhf udp.LightHouseHandlerFunc, nb []byte, q int, localCache firewall.ConntrackCache) {
 	err := h.Parse(packet)
 	if err != nil {
 		// TODO: best if we return this and let caller log
@@ -86,6 +99,9 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 			if !f.decryptToTun(hostinfo, h.MessageCounter, out, packet, fwPacket, nb, q, localCache) {
 				return
 			}
+			if origin == originMultiPort {
+				hostinfo.multiPortConfirmed.Store(true)
+			}
 		case header.MessageRelay:
 			// The entire body is sent as AD, not encrypted.
 			// The packet consists of a 16-byte parsed Nebula header, Associated Data-protected payload, and a trailing 16-byte AEAD signature value.
@@ -118,13 +134,13 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 			case TerminalType:
 				// If I am the target of this relay, process the unwrapped packet
 				// From this recursive point, all these variables are 'burned'. We shouldn't rely on them again.
-				f.readOutsidePackets(nil, &ViaSender{relayHI: hostinfo, remoteIdx: relay.RemoteIndex, relay: relay}, out[:0], signedPayload, h, fwPacket, lhf, nb, q, localCache)
+				f.readOutsidePackets(nil, &ViaSender{relayHI: hostinfo, remoteIdx: relay.RemoteIndex, relay: relay}, originUdp, out[:0], signedPayload, h, fwPacket, lhf, nb, q, localCache)
 				return
 			case ForwardingType:
 				// Find the target HostInfo relay object
-				targetHI, targetRelay, err := f.hostMap.QueryVpnIpRelayFor(hostinfo.vpnIp, relay.PeerIp)
+				targetHI, targetRelay, err := f.hostMap.QueryVpnIpRelayFor(relay.Origin(hostinfo), relay.NextHop())
 				if err != nil {
-					hostinfo.logger(f.l).WithField("relayTo", relay.PeerIp).WithError(err).Info("Failed to find target host info by ip")
+					hostinfo.logger(f.l).WithField("relayTo", relay.NextHop()).WithError(err).Info("Failed to find target host info by ip")
 					return
 				}
 
@@ -132,6 +148,12 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 				if targetRelay.State == Established {
 					switch targetRelay.Type {
 					case ForwardingType:
+						if !f.relayManager.AllowForward(hostinfo, len(signedPayload)) {
+							if f.l.Level >= logrus.DebugLevel {
+								hostinfo.logger(f.l).WithField("relayTo", relay.NextHop()).Debug("Dropping relayed packet over quota")
+							}
+							return
+						}
 						// Forward this packet through the relay tunnel
 						// Find the target HostInfo
 						f.SendVia(targetHI, targetRelay, signedPayload, nb, out, false)
@@ -140,7 +162,7 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 						hostinfo.logger(f.l).Error("Unexpected Relay Type of Terminal")
 					}
 				} else {
-					hostinfo.logger(f.l).WithFields(logrus.Fields{"relayTo": relay.PeerIp, "relayFrom": hostinfo.vpnIp, "targetRelayState": targetRelay.State}).Info("Unexpected target relay state")
+					hostinfo.logger(f.l).WithFields(logrus.Fields{"relayTo": relay.NextHop(), "relayFrom": relay.Origin(hostinfo), "targetRelayState": targetRelay.State}).Info("Unexpected target relay state")
 					return
 				}
 			}
@@ -188,7 +210,17 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 			// This testRequest might be from TryPromoteBest, so we should roam
 			// to the new IP address before responding
 			f.handleHostRoaming(hostinfo, addr)
-			f.send(header.Test, header.TestReply, ci, hostinfo, d, nb, out)
+			// d lives in out so the reply is built in packet, which we are done with, to echo the payload intact
+			f.send(header.Test, header.TestReply, ci, hostinfo, d, nb, packet)
+		} else if h.Subtype == header.TestReply {
+			f.handleProbeReply(hostinfo, d)
+		} else if h.Subtype == header.TestMtuRequest {
+			// Only the probe id comes back, the size made it here which is all the sender needs to know
+			if len(d) >= 8 {
+				f.send(header.Test, header.TestMtuReply, ci, hostinfo, d[:8], nb, packet)
+			}
+		} else if h.Subtype == header.TestMtuReply {
+			f.handlePathMtuReply(hostinfo, d)
 		}
 
 		// Fallthrough to the bottom to record incoming traffic
@@ -198,7 +230,7 @@ func (f *Interface) readOutsidePackets(addr *udp.Addr, via *ViaSender, out []byt
 
 	case header.Handshake:
 		f.messageMetrics.Rx(h.Type, h.Subtype, 1)
-		f.handshakeManager.HandleIncoming(addr, via, packet, h)
+		f.handshakeManager.HandleIncoming(addr, via, origin == originStream, packet, h)
 		return
 
 	case header.RecvError:
@@ -266,6 +298,14 @@ func (f *Interface) sendCloseTunnel(h *HostInfo) {
 
 func (f *Interface) handleHostRoaming(hostinfo *HostInfo, addr *udp.Addr) {
 	if addr != nil && !hostinfo.remote.Equals(addr) {
+		if hostinfo.multiPort.contains(hostinfo.remote, addr) {
+			// The peer is sending from another one of its ports, this is not a roam
+			return
+		}
+		if hostinfo.paths.holdRemote(hostinfo.remote, addr) {
+			// We picked the current remote because probes found it faster than addr
+			return
+		}
 		if !f.lightHouse.GetRemoteAllowList().Allow(hostinfo.vpnIp, addr.IP) {
 			hostinfo.logger(f.l).WithField("newAddr", addr).Debug("lighthouse.remote_allow_list denied roaming")
 			return
@@ -418,7 +458,11 @@ func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out
 	}
 
 	f.connectionManager.In(hostinfo.localIndexId)
-	_, err = f.readers[q].Write(out)
+	if gw := f.groWriters[q]; gw != nil {
+		err = gw.WriteGro(out)
+	} else {
+		_, err = f.readers[q].Write(out)
+	}
 	if err != nil {
 		f.l.WithError(err).Error("Failed to write to tun")
 	}
@@ -15,3 +15,19 @@ type Device interface {
 	RouteFor(iputil.VpnIp) iputil.VpnIp
 	NewMultiQueueReader() (io.ReadWriteCloser, error)
 }
+
+// BatchReader is implemented by devices, and their multiqueue readers, that can hand over more than one packet per call
+type BatchReader interface {
+	// ReadBatch waits for a packet and then reads every packet already waiting behind it, up to len(bufs). The size
+	// of each packet read is stored in sizes.
+	ReadBatch(bufs [][]byte, sizes []int) (int, error)
+}
+
+// GroWriter is implemented by devices, and their multiqueue readers, that can merge the tcp segments written to them
+// into fewer, larger packets
+type GroWriter interface {
+	// WriteGro queues a copy of b to be written to the device, it may be held until the next Flush
+	WriteGro(b []byte) error
+	// Flush writes every packet queued by WriteGro
+	Flush() error
+}
@@ -0,0 +1,504 @@
+//go:build !android && !e2e_testing
+// +build !android,!e2e_testing
+
+package overlay
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// virtioNetHdrLen is the size of the virtio_net_hdr that prefixes every packet on a tun opened with IFF_VNET_HDR
+	virtioNetHdrLen = 10
+
+	virtioNetHdrFNeedsCsum = 1
+	virtioNetHdrGsoNone    = 0
+	virtioNetHdrGsoTcpV4   = 1
+	virtioNetHdrGsoEcn     = 0x80
+
+	// maxOffloadPacket is the largest packet the kernel will hand us, or take from us, with offloads enabled
+	maxOffloadPacket = 65535
+	// maxGroPackets is how many packets are held for coalescing before they are written out regardless
+	maxGroPackets = 64
+
+	tcpFlagFin = 0x01
+	tcpFlagPsh = 0x08
+	tcpFlagAck = 0x10
+	tcpFlagCwr = 0x80
+)
+
+var errBadOffloadPacket = errors.New("malformed offloaded packet")
+
+// virtioNetHdr is the header linux puts in front of packets on a tun with IFF_VNET_HDR, it describes how the packet
+// should be segmented and checksummed
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+// decode reads the header from b, legacy virtio headers are in host byte order
+func (h *virtioNetHdr) decode(b []byte) error {
+	if len(b) < virtioNetHdrLen {
+		return io.ErrShortBuffer
+	}
+
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = binary.NativeEndian.Uint16(b[2:4])
+	h.gsoSize = binary.NativeEndian.Uint16(b[4:6])
+	h.csumStart = binary.NativeEndian.Uint16(b[6:8])
+	h.csumOffset = binary.NativeEndian.Uint16(b[8:10])
+	return nil
+}
+
+func (h *virtioNetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.NativeEndian.PutUint16(b[2:4], h.hdrLen)
+	binary.NativeEndian.PutUint16(b[4:6], h.gsoSize)
+	binary.NativeEndian.PutUint16(b[6:8], h.csumStart)
+	binary.NativeEndian.PutUint16(b[8:10], h.csumOffset)
+}
+
+// checksum adds b to the running ones' complement sum csum
+func checksum(b []byte, csum uint32) uint32 {
+	for len(b) > 1 {
+		csum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		csum += uint32(b[0]) << 8
+	}
+	return csum
+}
+
+// foldChecksum folds csum into 16 bits, it is not complemented
+func foldChecksum(csum uint32) uint16 {
+	for csum > 0xffff {
+		csum = (csum >> 16) + (csum & 0xffff)
+	}
+	return uint16(csum)
+}
+
+// tcpPseudoChecksum is the sum of the ipv4 pseudo header for a tcp segment of length bytes
+func tcpPseudoChecksum(ip []byte, length int) uint32 {
+	csum := checksum(ip[12:20], 0)
+	return csum + unix.IPPROTO_TCP + uint32(length)
+}
+
+// setIPv4Checksum recalculates the checksum of the ipv4 header at the start of p
+func setIPv4Checksum(p []byte, ihl int) {
+	p[10], p[11] = 0, 0
+	binary.BigEndian.PutUint16(p[10:12], ^foldChecksum(checksum(p[:ihl], 0)))
+}
+
+// tcpHeaderLens returns the ipv4 and tcp header lengths of p, ok is false if p is not a well formed ipv4 tcp packet
+func tcpHeaderLens(p []byte) (ihl int, thl int, ok bool) {
+	if len(p) < 20 || p[0]>>4 != 4 || p[9] != unix.IPPROTO_TCP {
+		return 0, 0, false
+	}
+
+	ihl = int(p[0]&0x0f) << 2
+	if ihl < 20 || len(p) < ihl+20 {
+		return 0, 0, false
+	}
+
+	thl = int(p[ihl+12]>>4) << 2
+	if thl < 20 || len(p) < ihl+thl {
+		return 0, 0, false
+	}
+
+	return ihl, thl, true
+}
+
+// finishChecksum completes a checksum the kernel left for us, the field already holds the sum of the pseudo header
+func finishChecksum(p []byte, h *virtioNetHdr) error {
+	at := int(h.csumStart) + int(h.csumOffset)
+	if at+2 > len(p) {
+		return errBadOffloadPacket
+	}
+
+	initial := uint32(binary.BigEndian.Uint16(p[at:]))
+	p[at], p[at+1] = 0, 0
+	binary.BigEndian.PutUint16(p[at:], ^foldChecksum(checksum(p[h.csumStart:], initial)))
+	return nil
+}
+
+// tsoSegmenter cuts a tcp packet the kernel handed us with tso into segments of at most gsoSize bytes of payload, the
+// same way the nic would have
+type tsoSegmenter struct {
+	pkt     []byte
+	ihl     int
+	hdrLen  int
+	gsoSize int
+
+	// off is where the payload of the next segment starts, i is its index
+	off int
+	i   int
+}
+
+func (s *tsoSegmenter) reset(pkt []byte, h *virtioNetHdr) error {
+	s.pkt = nil
+	ihl, thl, ok := tcpHeaderLens(pkt)
+	if !ok || h.gsoSize == 0 {
+		return errBadOffloadPacket
+	}
+
+	s.pkt = pkt
+	s.ihl = ihl
+	s.hdrLen = ihl + thl
+	s.gsoSize = int(h.gsoSize)
+	s.off = s.hdrLen
+	s.i = 0
+	return nil
+}
+
+// more reports if there are segments left to take with next
+func (s *tsoSegmenter) more() bool {
+	return s.pkt != nil && s.off < len(s.pkt)
+}
+
+// next writes the next segment to dst and returns its length
+func (s *tsoSegmenter) next(dst []byte) (int, error) {
+	end := min(s.off+s.gsoSize, len(s.pkt))
+	n := s.hdrLen + end - s.off
+	if n > len(dst) {
+		s.pkt = nil
+		return 0, io.ErrShortBuffer
+	}
+
+	copy(dst, s.pkt[:s.hdrLen])
+	copy(dst[s.hdrLen:], s.pkt[s.off:end])
+
+	ip := dst[:s.ihl]
+	binary.BigEndian.PutUint16(ip[2:4], uint16(n))
+	binary.BigEndian.PutUint16(ip[4:6], binary.BigEndian.Uint16(s.pkt[4:6])+uint16(s.i))
+	setIPv4Checksum(ip, s.ihl)
+
+	tcp := dst[s.ihl:n]
+	binary.BigEndian.PutUint32(tcp[4:8], binary.BigEndian.Uint32(s.pkt[s.ihl+4:])+uint32(s.off-s.hdrLen))
+	if end < len(s.pkt) {
+		// Only the last segment finishes the data
+		tcp[13] &^= tcpFlagFin | tcpFlagPsh
+	}
+	if s.i > 0 {
+		// Only the first segment reduced the congestion window
+		tcp[13] &^= tcpFlagCwr
+	}
+	tcp[16], tcp[17] = 0, 0
+	binary.BigEndian.PutUint16(tcp[16:18], ^foldChecksum(checksum(tcp, tcpPseudoChecksum(ip, len(tcp)))))
+
+	s.off = end
+	s.i++
+	return n, nil
+}
+
+// groPacket is a packet held by a groTable, buf has room for a virtio net header in front of the packet
+type groPacket struct {
+	buf []byte
+
+	// ihl and thl are the header lengths of tcp packets, ihl is 0 for anything else
+	ihl int
+	thl int
+
+	// mergeable is true while more segments of the flow can be appended to the packet
+	mergeable bool
+	segments  int
+	gsoSize   int
+	nextSeq   uint32
+}
+
+func (g *groPacket) packet() []byte {
+	return g.buf[virtioNetHdrLen:]
+}
+
+// canMerge reports if p, a tcp segment with headers ihl and thl long, carries on where g left off
+func (g *groPacket) canMerge(p []byte, ihl, thl int) bool {
+	if !g.mergeable || ihl != g.ihl || thl != g.thl {
+		return false
+	}
+
+	payload := len(p) - ihl - thl
+	if payload > g.gsoSize || len(g.buf)+payload > virtioNetHdrLen+maxOffloadPacket {
+		return false
+	}
+
+	o := g.packet()
+	// The flow, tos, ttl and fragment flags must match
+	if o[1] != p[1] || o[8] != p[8] || o[6] != p[6] || string(o[12:20]) != string(p[12:20]) {
+		return false
+	}
+
+	ot, pt := o[ihl:], p[ihl:]
+	// Ports and ack must match and the segment has to come right after ours
+	if string(ot[0:4]) != string(pt[0:4]) || string(ot[8:12]) != string(pt[8:12]) ||
+		binary.BigEndian.Uint32(pt[4:8]) != g.nextSeq {
+		return false
+	}
+
+	// As must the window and options, only the push flag may differ
+	return ot[12] == pt[12] && ot[13]|tcpFlagPsh == pt[13]|tcpFlagPsh &&
+		string(ot[14:16]) == string(pt[14:16]) && string(ot[20:thl]) == string(pt[20:thl])
+}
+
+// groTable merges the tcp segments written to the tun back into larger packets that the kernel takes in a single
+// write, the reverse of what tsoSegmenter does. Packets are written out in the order they were added.
+type groTable struct {
+	packets []groPacket
+	free    [][]byte
+}
+
+// add copies p into the table, appending it to an earlier segment of its flow if it can
+func (t *groTable) add(p []byte) {
+	ihl, thl, isTCP := tcpHeaderLens(p)
+	payload := len(p) - ihl - thl
+	ok := isTCP && ihl == 20 && payload > 0 && binary.BigEndian.Uint16(p[6:8])&0x3fff == 0 &&
+		p[ihl+13]&^tcpFlagPsh == tcpFlagAck
+
+	if ok {
+		// Only the latest packet of the flow can be extended, later segments can't overtake earlier ones
+		for i := len(t.packets) - 1; i >= 0; i-- {
+			g := &t.packets[i]
+			o := g.packet()
+			if g.ihl == 0 || string(o[12:20]) != string(p[12:20]) || string(o[g.ihl:g.ihl+4]) != string(p[ihl:ihl+4]) {
+				continue
+			}
+
+			if g.canMerge(p, ihl, thl) {
+				g.buf = append(g.buf, p[ihl+thl:]...)
+				g.segments++
+				g.nextSeq += uint32(payload)
+				o = g.packet()
+				o[ihl+13] |= p[ihl+13] & tcpFlagPsh
+				g.mergeable = payload == g.gsoSize && o[ihl+13]&tcpFlagPsh == 0
+				return
+			}
+			break
+		}
+	}
+
+	var buf []byte
+	if l := len(t.free); l > 0 {
+		buf = t.free[l-1][:0]
+		t.free = t.free[:l-1]
+	} else {
+		buf = make([]byte, 0, virtioNetHdrLen+maxOffloadPacket)
+	}
+
+	buf = append(buf[:virtioNetHdrLen], p...)
+	g := groPacket{buf: buf, segments: 1}
+	if isTCP {
+		g.ihl, g.thl = ihl, thl
+	}
+	if ok {
+		g.gsoSize = payload
+		g.nextSeq = binary.BigEndian.Uint32(p[ihl+4:]) + uint32(payload)
+		g.mergeable = p[ihl+13]&tcpFlagPsh == 0
+	}
+	t.packets = append(t.packets, g)
+}
+
+// full reports if the table should be flushed before anything else is added
+func (t *groTable) full() bool {
+	return len(t.packets) >= maxGroPackets
+}
+
+// flush hands every packet to write, with its virtio net header in front, and empties the table
+func (t *groTable) flush(write func([]byte) error) error {
+	var firstErr error
+	for i := range t.packets {
+		g := &t.packets[i]
+		h := virtioNetHdr{}
+		if g.segments > 1 {
+			p := g.packet()
+			binary.BigEndian.PutUint16(p[2:4], uint16(len(p)))
+			setIPv4Checksum(p, g.ihl)
+
+			// The kernel finishes the tcp checksum, it only wants the pseudo header from us
+			tcp := p[g.ihl:]
+			binary.BigEndian.PutUint16(tcp[16:18], foldChecksum(tcpPseudoChecksum(p, len(tcp))))
+			h = virtioNetHdr{
+				flags:      virtioNetHdrFNeedsCsum,
+				gsoType:    virtioNetHdrGsoTcpV4,
+				hdrLen:     uint16(g.ihl + g.thl),
+				gsoSize:    uint16(g.gsoSize),
+				csumStart:  uint16(g.ihl),
+				csumOffset: 16,
+			}
+		}
+
+		h.encode(g.buf)
+		if err := write(g.buf); err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		t.free = append(t.free, g.buf)
+		g.buf = nil
+	}
+
+	t.packets = t.packets[:0]
+	return firstErr
+}
+
+// offloadQueue is a tun queue opened with IFF_VNET_HDR. Large tcp packets the kernel hands us are cut into segments
+// that fit the tun mtu and segments written with WriteGro are merged back together before they reach the kernel.
+type offloadQueue struct {
+	*os.File
+	fd   int
+	poll []unix.PollFd
+
+	readBuf []byte
+	readHdr virtioNetHdr
+	tso     tsoSegmenter
+
+	writeLock sync.Mutex
+	gro       groTable
+
+	l *logrus.Logger
+}
+
+func newOffloadQueue(file *os.File, fd int, l *logrus.Logger) *offloadQueue {
+	return &offloadQueue{
+		File:    file,
+		fd:      fd,
+		readBuf: make([]byte, virtioNetHdrLen+maxOffloadPacket),
+		l:       l,
+	}
+}
+
+func (q *offloadQueue) Read(p []byte) (int, error) {
+	for {
+		n, err := q.readPacket(p)
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// readPacket returns the next segment of the last tso packet or reads a new packet from the tun. 0 is returned if the
+// packet was dropped.
+func (q *offloadQueue) readPacket(p []byte) (int, error) {
+	if q.tso.more() {
+		return q.drop(q.tso.next(p))
+	}
+
+	n, err := q.File.Read(q.readBuf)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = q.readHdr.decode(q.readBuf[:n]); err != nil {
+		return q.drop(0, err)
+	}
+	pkt := q.readBuf[virtioNetHdrLen:n]
+
+	switch q.readHdr.gsoType &^ virtioNetHdrGsoEcn {
+	case virtioNetHdrGsoNone:
+		if q.readHdr.flags&virtioNetHdrFNeedsCsum != 0 {
+			if err = finishChecksum(pkt, &q.readHdr); err != nil {
+				return q.drop(0, err)
+			}
+		}
+
+		if len(pkt) > len(p) {
+			return q.drop(0, io.ErrShortBuffer)
+		}
+		return copy(p, pkt), nil
+
+	case virtioNetHdrGsoTcpV4:
+		if err = q.tso.reset(pkt, &q.readHdr); err != nil {
+			return q.drop(0, err)
+		}
+		return q.drop(q.tso.next(p))
+
+	default:
+		return q.drop(0, errBadOffloadPacket)
+	}
+}
+
+// drop logs err, if there is one, so the read loop carries on without the packet
+func (q *offloadQueue) drop(n int, err error) (int, error) {
+	if err != nil {
+		if q.l.Level >= logrus.DebugLevel {
+			q.l.WithError(err).WithField("gsoType", q.readHdr.gsoType).Debug("Dropping packet read from tun")
+		}
+		return 0, nil
+	}
+	return n, nil
+}
+
+func (q *offloadQueue) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	n, err := q.Read(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+
+	if q.poll == nil {
+		q.poll = []unix.PollFd{{Fd: int32(q.fd), Events: unix.POLLIN}}
+	}
+
+	for i := 1; i < len(bufs); {
+		if !q.tso.more() {
+			ready, err := unix.Poll(q.poll, 0)
+			if err != nil || ready == 0 {
+				return i, nil
+			}
+		}
+
+		n, err = q.readPacket(bufs[i])
+		if err != nil {
+			// The error will come up again on the next read
+			return i, nil
+		}
+
+		if n > 0 {
+			sizes[i] = n
+			i++
+		}
+	}
+
+	return len(bufs), nil
+}
+
+// Write writes a single packet with an empty virtio net header
+func (q *offloadQueue) Write(p []byte) (int, error) {
+	var h [virtioNetHdrLen]byte
+	n, err := unix.Writev(q.fd, [][]byte{h[:], p})
+	return max(n-virtioNetHdrLen, 0), err
+}
+
+func (q *offloadQueue) WriteGro(p []byte) error {
+	q.writeLock.Lock()
+	defer q.writeLock.Unlock()
+
+	var err error
+	if q.gro.full() {
+		err = q.gro.flush(q.writeRaw)
+	}
+	q.gro.add(p)
+	return err
+}
+
+func (q *offloadQueue) Flush() error {
+	q.writeLock.Lock()
+	defer q.writeLock.Unlock()
+	return q.gro.flush(q.writeRaw)
+}
+
+// writeRaw writes b, which already starts with a virtio net header
+func (q *offloadQueue) writeRaw(b []byte) error {
+	_, err := unix.Write(q.fd, b)
+	return err
+}
@@ -0,0 +1,174 @@
+//go:build !android && !e2e_testing
+// +build !android,!e2e_testing
+
+package overlay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTCPPacket builds an ipv4 tcp packet from 10.0.0.1:sport to 10.0.0.2:80 with a timestamp option
+func newTCPPacket(sport uint16, seq uint32, flags byte, payload []byte) []byte {
+	p := make([]byte, 20+32+len(payload))
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[2:4], uint16(len(p)))
+	binary.BigEndian.PutUint16(p[4:6], 1000)
+	p[6] = 0x40
+	p[8] = 64
+	p[9] = 6
+	copy(p[12:16], []byte{10, 0, 0, 1})
+	copy(p[16:20], []byte{10, 0, 0, 2})
+	setIPv4Checksum(p, 20)
+
+	tcp := p[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], sport)
+	binary.BigEndian.PutUint16(tcp[2:4], 80)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	binary.BigEndian.PutUint32(tcp[8:12], 99)
+	tcp[12] = 8 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:16], 512)
+	copy(tcp[20:32], []byte{1, 1, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2})
+	copy(tcp[32:], payload)
+	binary.BigEndian.PutUint16(tcp[16:18], ^foldChecksum(checksum(tcp, tcpPseudoChecksum(p, len(tcp)))))
+	return p
+}
+
+func assertChecksums(t *testing.T, p []byte) {
+	assert.Equal(t, uint16(0xffff), foldChecksum(checksum(p[:20], 0)), "ip checksum")
+	assert.Equal(t, uint16(0xffff), foldChecksum(checksum(p[20:], tcpPseudoChecksum(p, len(p)-20))), "tcp checksum")
+}
+
+func TestTsoSegmenter(t *testing.T) {
+	payload := make([]byte, 5000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	// The kernel leaves the pseudo header sum in the checksum field of a tso packet
+	p := newTCPPacket(1234, 5000, tcpFlagAck|tcpFlagPsh|tcpFlagCwr, payload)
+	binary.BigEndian.PutUint16(p[36:38], foldChecksum(tcpPseudoChecksum(p, len(p)-20)))
+	h := virtioNetHdr{
+		flags:      virtioNetHdrFNeedsCsum,
+		gsoType:    virtioNetHdrGsoTcpV4,
+		hdrLen:     52,
+		gsoSize:    1400,
+		csumStart:  20,
+		csumOffset: 16,
+	}
+
+	s := tsoSegmenter{}
+	require.NoError(t, s.reset(p, &h))
+
+	var got []byte
+	dst := make([]byte, 1500)
+	for i := 0; s.more(); i++ {
+		n, err := s.next(dst)
+		require.NoError(t, err)
+		seg := dst[:n]
+		assertChecksums(t, seg)
+
+		assert.Equal(t, n, int(binary.BigEndian.Uint16(seg[2:4])))
+		assert.Equal(t, uint16(1000+i), binary.BigEndian.Uint16(seg[4:6]))
+		assert.Equal(t, uint32(5000+len(got)), binary.BigEndian.Uint32(seg[24:28]))
+		if i < 3 {
+			assert.Equal(t, 52+1400, n)
+		} else {
+			assert.Equal(t, 52+800, n)
+		}
+
+		flags := byte(tcpFlagAck)
+		if i == 0 {
+			flags |= tcpFlagCwr
+		}
+		if i == 3 {
+			flags |= tcpFlagPsh
+		}
+		assert.Equal(t, flags, seg[33])
+		got = append(got, seg[52:]...)
+	}
+	assert.Equal(t, payload, got)
+
+	// Segments have to fit in the buffer given to us
+	require.NoError(t, s.reset(p, &h))
+	_, err := s.next(make([]byte, 1000))
+	assert.Error(t, err)
+	assert.False(t, s.more())
+}
+
+func TestFinishChecksum(t *testing.T) {
+	p := newTCPPacket(1234, 1, tcpFlagAck, []byte("hello"))
+	binary.BigEndian.PutUint16(p[36:38], foldChecksum(tcpPseudoChecksum(p, len(p)-20)))
+	require.NoError(t, finishChecksum(p, &virtioNetHdr{flags: virtioNetHdrFNeedsCsum, csumStart: 20, csumOffset: 16}))
+	assertChecksums(t, p)
+
+	assert.Error(t, finishChecksum(p, &virtioNetHdr{csumStart: 20, csumOffset: uint16(len(p))}))
+}
+
+func TestGroTable(t *testing.T) {
+	payload := bytes.Repeat([]byte{'a'}, 1000)
+	g := groTable{}
+
+	// Three full segments and a short one that pushes merge into one packet, another flow goes alongside
+	g.add(newTCPPacket(1234, 0, tcpFlagAck, payload))
+	g.add(newTCPPacket(4321, 0, tcpFlagAck, payload))
+	g.add(newTCPPacket(1234, 1000, tcpFlagAck, payload))
+	g.add(newTCPPacket(1234, 2000, tcpFlagAck, payload))
+	g.add(newTCPPacket(1234, 3000, tcpFlagAck|tcpFlagPsh, payload[:500]))
+
+	// Nothing follows a push, a fin is never merged and nothing can be merged past it
+	g.add(newTCPPacket(1234, 3500, tcpFlagAck, payload))
+	g.add(newTCPPacket(1234, 4500, tcpFlagAck|tcpFlagFin, payload))
+	g.add(newTCPPacket(1234, 5500, tcpFlagAck, payload))
+
+	// Out of order segments are left alone
+	g.add(newTCPPacket(4321, 5000, tcpFlagAck, payload))
+
+	var written [][]byte
+	require.NoError(t, g.flush(func(b []byte) error {
+		written = append(written, append([]byte{}, b...))
+		return nil
+	}))
+	require.Len(t, written, 6)
+	assert.Empty(t, g.packets)
+
+	h := virtioNetHdr{}
+	require.NoError(t, h.decode(written[0]))
+	assert.Equal(t, virtioNetHdr{
+		flags:      virtioNetHdrFNeedsCsum,
+		gsoType:    virtioNetHdrGsoTcpV4,
+		hdrLen:     52,
+		gsoSize:    1000,
+		csumStart:  20,
+		csumOffset: 16,
+	}, h)
+
+	p := written[0][virtioNetHdrLen:]
+	assert.Len(t, p, 52+3500)
+	assert.Equal(t, len(p), int(binary.BigEndian.Uint16(p[2:4])))
+	assert.Equal(t, uint16(0xffff), foldChecksum(checksum(p[:20], 0)))
+	assert.Equal(t, foldChecksum(tcpPseudoChecksum(p, len(p)-20)), binary.BigEndian.Uint16(p[36:38]))
+	assert.Equal(t, byte(tcpFlagAck|tcpFlagPsh), p[33])
+
+	// Everything else goes as it came, in order
+	for i, want := range []struct {
+		sport uint16
+		seq   uint32
+	}{{4321, 0}, {1234, 3500}, {1234, 4500}, {1234, 5500}, {4321, 5000}} {
+		w := written[i+1]
+		require.NoError(t, h.decode(w))
+		assert.Equal(t, virtioNetHdr{}, h)
+		assertChecksums(t, w[virtioNetHdrLen:])
+		assert.Equal(t, want.sport, binary.BigEndian.Uint16(w[virtioNetHdrLen+20:]))
+		assert.Equal(t, want.seq, binary.BigEndian.Uint32(w[virtioNetHdrLen+24:]))
+	}
+
+	// Buffers are reused
+	g.add(newTCPPacket(1234, 0, tcpFlagAck, payload))
+	assert.Len(t, g.free, 5)
+}
@@ -38,6 +38,12 @@ type tun struct {
 	routeChan       chan struct{}
 	useSystemRoutes bool
 
+	// poll is used by ReadBatch to check for more packets without blocking
+	poll []unix.PollFd
+
+	// offload is set when the device was opened with IFF_VNET_HDR, all reads and writes go through it
+	offload *offloadQueue
+
 	l *logrus.Logger
 }
 
@@ -84,17 +90,29 @@ func newTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, multiqueue bool) (*t
 		return nil, err
 	}
 
+	offload := c.GetBool("tun.offload", false)
+
 	var req ifReq
 	req.Flags = uint16(unix.IFF_TUN | unix.IFF_NO_PI)
 	if multiqueue {
 		req.Flags |= unix.IFF_MULTI_QUEUE
 	}
+	if offload {
+		req.Flags |= unix.IFF_VNET_HDR
+	}
 	copy(req.Name[:], c.GetString("tun.dev", ""))
 	if err = ioctl(uintptr(fd), uintptr(unix.TUNSETIFF), uintptr(unsafe.Pointer(&req))); err != nil {
 		return nil, err
 	}
 	name := strings.Trim(string(req.Name[:]), "\x00")
 
+	if offload {
+		// Ask for large tcp packets and unfinished checksums, we finish both ourselves
+		if err = ioctl(uintptr(fd), uintptr(unix.TUNSETOFFLOAD), uintptr(unix.TUN_F_CSUM|unix.TUN_F_TSO4)); err != nil {
+			return nil, fmt.Errorf("failed to enable tun offloads: %w", err)
+		}
+	}
+
 	file := os.NewFile(uintptr(fd), "/dev/net/tun")
 	t, err := newTunGeneric(c, l, file, cidr)
 	if err != nil {
@@ -102,6 +120,10 @@ func newTun(c *config.C, l *logrus.Logger, cidr *net.IPNet, multiqueue bool) (*t
 	}
 
 	t.Device = name
+	if offload {
+		t.offload = newOffloadQueue(file, t.fd, l)
+		t.ReadWriteCloser = t.offload
+	}
 
 	return t, nil
 }
@@ -204,14 +226,67 @@ func (t *tun) NewMultiQueueReader() (io.ReadWriteCloser, error) {
 
 	var req ifReq
 	req.Flags = uint16(unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_MULTI_QUEUE)
+	if t.offload != nil {
+		req.Flags |= unix.IFF_VNET_HDR
+	}
 	copy(req.Name[:], t.Device)
 	if err = ioctl(uintptr(fd), uintptr(unix.TUNSETIFF), uintptr(unsafe.Pointer(&req))); err != nil {
 		return nil, err
 	}
 
 	file := os.NewFile(uintptr(fd), "/dev/net/tun")
+	if t.offload != nil {
+		return newOffloadQueue(file, fd, t.l), nil
+	}
+
+	return &tunQueue{File: file, fd: fd}, nil
+}
+
+// tunQueue is an extra queue of a multiqueue tun device
+type tunQueue struct {
+	*os.File
+	fd   int
+	poll []unix.PollFd
+}
+
+func (q *tunQueue) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	return readBatch(q.File, q.fd, &q.poll, bufs, sizes)
+}
+
+func (t *tun) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	if t.offload != nil {
+		return t.offload.ReadBatch(bufs, sizes)
+	}
+	return readBatch(t.ReadWriteCloser, t.fd, &t.poll, bufs, sizes)
+}
+
+// readBatch blocks for one packet from fd and then keeps reading for as long as poll says another one is waiting
+func readBatch(r io.Reader, fd int, poll *[]unix.PollFd, bufs [][]byte, sizes []int) (int, error) {
+	n, err := r.Read(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+
+	if *poll == nil {
+		*poll = []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	}
+
+	for i := 1; i < len(bufs); i++ {
+		ready, err := unix.Poll(*poll, 0)
+		if err != nil || ready == 0 {
+			return i, nil
+		}
+
+		n, err = r.Read(bufs[i])
+		if err != nil {
+			// The error will come up again on the next read
+			return i, nil
+		}
+		sizes[i] = n
+	}
 
-	return file, nil
+	return len(bufs), nil
 }
 
 func (t *tun) RouteFor(ip iputil.VpnIp) iputil.VpnIp {
@@ -219,7 +294,29 @@ func (t *tun) RouteFor(ip iputil.VpnIp) iputil.VpnIp {
 	return r
 }
 
+// WriteGro queues b to be merged with other tcp segments of its flow when offloads are enabled, otherwise it is written
+// right away
+func (t *tun) WriteGro(b []byte) error {
+	if t.offload != nil {
+		return t.offload.WriteGro(b)
+	}
+
+	_, err := t.Write(b)
+	return err
+}
+
+func (t *tun) Flush() error {
+	if t.offload != nil {
+		return t.offload.Flush()
+	}
+	return nil
+}
+
 func (t *tun) Write(b []byte) (int, error) {
+	if t.offload != nil {
+		return t.offload.Write(b)
+	}
+
 	var nn int
 	max := len(b)
 
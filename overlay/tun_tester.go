@@ -132,6 +132,28 @@ func (t *TestTun) Read(b []byte) (int, error) {
 	return len(p), nil
 }
 
+func (t *TestTun) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	n, err := t.Read(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+
+	for i := 1; i < len(bufs); i++ {
+		select {
+		case p, ok := <-t.rxPackets:
+			if !ok {
+				return i, nil
+			}
+			sizes[i] = copy(bufs[i], p)
+		default:
+			return i, nil
+		}
+	}
+
+	return len(bufs), nil
+}
+
 func (t *TestTun) NewMultiQueueReader() (io.ReadWriteCloser, error) {
 	return nil, fmt.Errorf("TODO: multiqueue not implemented")
 }
@@ -3,6 +3,7 @@ package overlay
 import (
 	"io"
 	"net"
+	"os"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
@@ -57,7 +58,7 @@ func (d *UserDevice) Write(p []byte) (n int, err error) {
 	return d.inboundWriter.Write(p)
 }
 func (d *UserDevice) Close() error {
-	d.inboundWriter.Close()
-	d.outboundWriter.Close()
+	d.inboundWriter.CloseWithError(os.ErrClosed)
+	d.outboundWriter.CloseWithError(os.ErrClosed)
 	return nil
 }
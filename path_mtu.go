@@ -0,0 +1,224 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/udp"
+)
+
+const (
+	// DefaultPathMtuInterval is how long a tunnel waits after finding its path mtu before searching again
+	DefaultPathMtuInterval = 10 * time.Minute
+	// MinPathMtu is the smallest pmtu.min allowed, the smallest packet every ipv4 host has to accept
+	MinPathMtu = 576
+	// MaxPathMtu is the biggest inner packet that fits in our buffers once nebula has added its header and aead tag
+	MaxPathMtu = udp.MTU - header.Len - 16
+
+	// pathMtuGranularity is how close the search gets to the real path mtu before it stops
+	pathMtuGranularity = 16
+	// pathMtuAttempts is how many times a probe is sent before its size is considered too big for the path
+	pathMtuAttempts = 2
+)
+
+type pathMtuMetrics struct {
+	sent   metrics.Counter
+	tooBig metrics.Counter
+}
+
+// pathMtuMinFromConfig returns pmtu.min, the size every path is assumed to fit
+func pathMtuMinFromConfig(c *config.C) int {
+	return max(c.GetInt("pmtu.min", overlay.DefaultMTU), MinPathMtu)
+}
+
+// pathMtu searches for the biggest inner packet that makes it across the underlay to the current remote of a tunnel.
+// The search is a binary search between pmtu.min, which is assumed to always fit, and tun.mtu. Every time the
+// connection manager checks the tunnel it sends a TestMtuRequest padded to the size being tried, a reply means the size
+// fits and a probe that is still unanswered at the next check, twice, means it does not. Older versions of nebula
+// ignore the request so the path mtu to them stays at pmtu.min.
+type pathMtu struct {
+	// mtu is the largest inner packet known to fit, or 0 if we don't know yet
+	mtu atomic.Int64
+
+	sync.Mutex
+	remote    *udp.Addr
+	min, max  int
+	low, high int
+	searching bool
+	next      time.Time
+
+	// probing is the size of the outstanding probe, 0 if there is none
+	probing  int
+	attempts int
+	id       uint64
+}
+
+// step moves the search along and returns the size and id of the probe to send now, size is 0 if there is nothing to
+// send. found is true when a search has just finished.
+func (p *pathMtu) step(remote *udp.Addr, now time.Time, lo, hi int, interval time.Duration) (size int, id uint64, found bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if remote == nil {
+		// Relayed, the path is not ours to measure
+		p.remote = nil
+		p.probing = 0
+		p.mtu.Store(0)
+		return 0, 0, false
+	}
+
+	hi = min(hi, MaxPathMtu)
+	lo = min(lo, hi)
+
+	if p.remote == nil || !p.remote.Equals(remote) || p.min != lo || p.max != hi {
+		// Start from scratch on a new path
+		p.remote = remote.Copy()
+		p.min, p.max = lo, hi
+		p.low, p.high = lo, hi
+		p.searching = true
+		p.probing = 0
+		p.mtu.Store(int64(lo))
+	}
+
+	if p.probing != 0 {
+		if p.attempts < pathMtuAttempts {
+			p.attempts++
+			return p.probing, p.id, false
+		}
+		p.tooBig()
+	}
+
+	if !p.searching {
+		if now.Before(p.next) {
+			return 0, 0, false
+		}
+
+		p.searching = true
+		p.high = p.max
+		if p.low > p.min {
+			// Make sure what we found still fits before looking for more
+			return p.probe(p.low), p.id, false
+		}
+	}
+
+	if p.high-p.low < pathMtuGranularity {
+		p.searching = false
+		p.next = now.Add(interval)
+		return 0, 0, true
+	}
+
+	return p.probe((p.low + p.high + 1) / 2), p.id, false
+}
+
+func (p *pathMtu) probe(size int) int {
+	p.id++
+	p.probing = size
+	p.attempts = 1
+	return size
+}
+
+// tooBig records that the outstanding probe never made it
+func (p *pathMtu) tooBig() {
+	if p.probing <= p.low {
+		// The path shrank, fall all the way back and search down from here
+		p.low = p.min
+		p.mtu.Store(int64(p.min))
+	}
+
+	p.high = p.probing - 1
+	p.probing = 0
+}
+
+// reply records the answer to a probe and returns the size that made it, or 0 if id is not the outstanding probe
+func (p *pathMtu) reply(id uint64) int {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.probing == 0 || id != p.id {
+		return 0
+	}
+
+	size := p.probing
+	p.probing = 0
+	if size > p.low {
+		p.low = size
+		p.mtu.Store(int64(size))
+	}
+
+	return size
+}
+
+// probePathMtu moves the path mtu search for an active tunnel along, sending a probe if one is due
+func (f *Interface) probePathMtu(hostinfo *HostInfo, now time.Time, nb, out []byte) {
+	if !f.pmtuEnabled.Load() {
+		return
+	}
+
+	remote := hostinfo.remote
+	size, id, found := hostinfo.pmtu.step(
+		remote,
+		now,
+		int(f.pmtuMin.Load()),
+		int(f.pmtuMax.Load()),
+		time.Duration(f.pmtuInterval.Load()),
+	)
+
+	if found {
+		hostinfo.logger(f.l).WithField("udpAddr", remote).WithField("pathMtu", hostinfo.pmtu.mtu.Load()).
+			Debug("Found the path mtu")
+	}
+
+	if size == 0 {
+		return
+	}
+
+	p := make([]byte, size)
+	binary.BigEndian.PutUint64(p, id)
+	f.pmtuMetrics.sent.Inc(1)
+	f.sendTo(header.Test, header.TestMtuRequest, hostinfo.ConnectionState, hostinfo, remote, p, nb, out)
+}
+
+// handlePathMtuReply records the answer to one of our path mtu probes
+func (f *Interface) handlePathMtuReply(hostinfo *HostInfo, d []byte) {
+	if len(d) < 8 {
+		return
+	}
+
+	size := hostinfo.pmtu.reply(binary.BigEndian.Uint64(d))
+	if size > 0 && f.l.Level >= logrus.DebugLevel {
+		hostinfo.logger(f.l).WithField("size", size).Debug("Path mtu probe was answered")
+	}
+}
+
+// tooBig reports if packet is bigger than the path mtu of the tunnel and the sender asked us not to fragment it, in
+// which case an icmp fragmentation needed error is written back to the tun so the sender can send smaller packets
+func (f *Interface) tooBig(hostinfo *HostInfo, packet, out []byte, q int) bool {
+	if !f.pmtuEnabled.Load() {
+		return false
+	}
+
+	mtu := int(hostinfo.pmtu.mtu.Load())
+	if mtu == 0 || len(packet) <= mtu {
+		return false
+	}
+
+	out = iputil.CreateFragmentationNeededPacket(packet, out, mtu)
+	if len(out) == 0 {
+		return false
+	}
+
+	f.pmtuMetrics.tooBig.Inc(1)
+	_, err := f.readers[q].Write(out)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to write to tun")
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+)
+
+// searchPathMtu steps p until a search finishes, answering every probe that fits in fits, and returns how many probes
+// were sent
+func searchPathMtu(t *testing.T, p *pathMtu, remote *udp.Addr, now time.Time, fits int) int {
+	sent := 0
+	for i := 0; i < 100; i++ {
+		size, id, found := p.step(remote, now, 1300, 9000, time.Minute)
+		if found {
+			return sent
+		}
+
+		assert.NotZero(t, size)
+		sent++
+		if size <= fits {
+			assert.Equal(t, size, p.reply(id))
+		}
+	}
+
+	t.Fatal("The search never finished")
+	return 0
+}
+
+func TestPathMtu_search(t *testing.T) {
+	p := &pathMtu{}
+	remote := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+	now := time.Now()
+
+	// Nothing is known about relayed tunnels
+	size, _, _ := p.step(nil, now, 1300, 9000, time.Minute)
+	assert.Zero(t, size)
+	assert.Zero(t, p.mtu.Load())
+
+	// A 1500 byte underlay, less the ip, udp and nebula overhead
+	sent := searchPathMtu(t, p, remote, now, 1440)
+	mtu := p.mtu.Load()
+	assert.LessOrEqual(t, mtu, int64(1440))
+	assert.Greater(t, mtu, int64(1440-pathMtuGranularity))
+	assert.Less(t, sent, 30)
+
+	// Nothing to do until the interval has passed
+	size, _, found := p.step(remote, now.Add(time.Second), 1300, 9000, time.Minute)
+	assert.Zero(t, size)
+	assert.False(t, found)
+
+	// The next search makes sure the old answer still fits first
+	now = now.Add(time.Minute)
+	size, id, _ := p.step(remote, now, 1300, 9000, time.Minute)
+	assert.Equal(t, int(mtu), size)
+	assert.Equal(t, size, p.reply(id))
+	searchPathMtu(t, p, remote, now, 1440)
+	assert.Equal(t, mtu, p.mtu.Load())
+
+	// Replies that are late or not ours are ignored
+	assert.Zero(t, p.reply(id))
+	assert.Zero(t, p.reply(id+100))
+}
+
+func TestPathMtu_shrink(t *testing.T) {
+	p := &pathMtu{}
+	remote := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+	now := time.Now()
+
+	searchPathMtu(t, p, remote, now, 8000)
+	assert.Greater(t, p.mtu.Load(), int64(8000-pathMtuGranularity))
+
+	// The path got smaller, the old mtu goes unanswered and the search starts again from the bottom
+	now = now.Add(time.Minute)
+	for i := 0; i < pathMtuAttempts; i++ {
+		size, _, _ := p.step(remote, now, 1300, 9000, time.Minute)
+		assert.Equal(t, int(p.mtu.Load()), size)
+	}
+
+	searchPathMtu(t, p, remote, now, 1400)
+	assert.LessOrEqual(t, p.mtu.Load(), int64(1400))
+	assert.Greater(t, p.mtu.Load(), int64(1400-pathMtuGranularity))
+}
+
+func TestPathMtu_reset(t *testing.T) {
+	p := &pathMtu{}
+	remote := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+	now := time.Now()
+
+	// Peers that never answer stay at the minimum
+	searchPathMtu(t, p, remote, now, 0)
+	assert.Equal(t, int64(1300), p.mtu.Load())
+
+	// A new remote is a new path, never probe more than fits in our buffers
+	searchPathMtu(t, p, udp.NewAddr(net.ParseIP("1.2.3.5"), 4242), now, udp.MTU)
+	assert.LessOrEqual(t, p.mtu.Load(), int64(MaxPathMtu))
+	assert.Greater(t, p.mtu.Load(), int64(MaxPathMtu-pathMtuGranularity))
+
+	// As is a change in the limits
+	size, _, _ := p.step(remote, now, 1300, 1400, time.Minute)
+	assert.Equal(t, int64(1300), p.mtu.Load())
+	assert.Equal(t, 1350, size)
+}
@@ -0,0 +1,348 @@
+package nebula
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+)
+
+const (
+	// probeTimeout is how long we wait for the reply to a probe before counting it as lost
+	probeTimeout = 5 * time.Second
+	// probeMaxPending bounds the probes waiting for a reply on a single tunnel
+	probeMaxPending = 64
+	// probeMinReplies is how many replies a remote needs before its rtt is trusted to pick the primary remote
+	probeMinReplies = 3
+	// probeStale is how long the stats for a remote are trusted after its last reply
+	probeStale = time.Minute
+	// probePromoteRatio is how much faster than the current remote a candidate has to be to replace it
+	probePromoteRatio = 0.8
+	// probeFailoverLosses is how many probes in a row the current remote has to lose before we fail over, a single
+	// lost probe is not enough to give up on a remote
+	probeFailoverLosses = 2
+)
+
+type probeMetrics struct {
+	sent      metrics.Counter
+	lost      metrics.Counter
+	failovers metrics.Counter
+	rtt       metrics.Histogram
+}
+
+// PathStats describes the quality of the path to a single remote of a tunnel, as measured by probes
+type PathStats struct {
+	Addr *udp.Addr `json:"addr"`
+	// Rtt is the smoothed round trip time
+	Rtt time.Duration `json:"rtt"`
+	// Jitter is the mean deviation of the round trip time
+	Jitter time.Duration `json:"jitter"`
+	// Loss is the fraction of probes that were never answered
+	Loss     float64 `json:"loss"`
+	Sent     uint64  `json:"sent"`
+	Received uint64  `json:"received"`
+	// Unanswered is the number of probes sent since the last reply
+	Unanswered uint64 `json:"unanswered"`
+}
+
+// pathProbes tracks the probes sent over a tunnel and the rtt, jitter and loss of each remote they were sent to.
+// Probes are Test packets carrying a NebulaPing with the time they were sent, which the remote echoes back. Older
+// versions of nebula mangle the first 16 bytes of the echo, so their replies are never matched and probes to them look
+// lost. The ping must stay under 16 bytes, anything longer would overlap with the reply being encrypted over it.
+type pathProbes struct {
+	sync.Mutex
+	paths   map[string]*pathStat
+	pending map[uint64]*pathStat
+	last    time.Time
+
+	// promoted is the remote picked for its rtt, roaming between probed remotes is ignored while it is in use
+	promoted *pathStat
+}
+
+type pathStat struct {
+	addr      *udp.Addr
+	srtt      time.Duration
+	rttvar    time.Duration
+	sent      uint64
+	received  uint64
+	lost      uint64
+	lastReply time.Time
+
+	// unanswered is the number of probes sent since the last reply
+	unanswered uint64
+	// missed is the number of probes lost in a row since the last reply, a probe is only lost after probeTimeout
+	missed uint64
+}
+
+func (p *pathStat) loss() float64 {
+	if p.received+p.lost == 0 {
+		return 0
+	}
+	return float64(p.lost) / float64(p.received+p.lost)
+}
+
+// usable reports if there are enough recent replies to trust the stats for this remote
+func (p *pathStat) usable(now time.Time) bool {
+	return p.received >= probeMinReplies && now.Sub(p.lastReply) < probeStale
+}
+
+// due reports if it has been at least interval since the last probes were sent, and if so records that they are
+// being sent now
+func (pp *pathProbes) due(now time.Time, interval time.Duration) bool {
+	pp.Lock()
+	defer pp.Unlock()
+	if now.Sub(pp.last) < interval {
+		return false
+	}
+	pp.last = now
+	return true
+}
+
+// ping records a probe being sent to addr and returns the payload to send
+func (pp *pathProbes) ping(addr *udp.Addr, now time.Time) ([]byte, error) {
+	pp.Lock()
+	defer pp.Unlock()
+
+	if pp.paths == nil {
+		pp.paths = map[string]*pathStat{}
+		pp.pending = map[uint64]*pathStat{}
+	}
+
+	key := addr.String()
+	path := pp.paths[key]
+	if path == nil {
+		path = &pathStat{addr: addr.Copy()}
+		pp.paths[key] = path
+	}
+
+	// The send time identifies the probe, make sure it is unique
+	id := uint64(now.UnixNano())
+	for pp.pending[id] != nil {
+		id++
+	}
+
+	if len(pp.pending) >= probeMaxPending {
+		pp.unlockedExpire(now, true)
+	}
+
+	path.sent++
+	path.unanswered++
+	pp.pending[id] = path
+
+	return (&NebulaPing{Type: NebulaPing_Ping, Time: id}).Marshal()
+}
+
+// pong records the reply to a probe and returns the round trip time, or false if the reply was not for a probe we are
+// waiting on
+func (pp *pathProbes) pong(d []byte, now time.Time) (time.Duration, bool) {
+	ping := &NebulaPing{}
+	if err := ping.Unmarshal(d); err != nil || ping.Time == 0 {
+		return 0, false
+	}
+
+	pp.Lock()
+	defer pp.Unlock()
+
+	path := pp.pending[ping.Time]
+	if path == nil {
+		return 0, false
+	}
+	delete(pp.pending, ping.Time)
+
+	rtt := now.Sub(time.Unix(0, int64(ping.Time)))
+	if rtt < 0 {
+		rtt = 0
+	}
+
+	// Smooth the same way tcp does, rfc 6298
+	if path.received == 0 {
+		path.srtt = rtt
+		path.rttvar = rtt / 2
+	} else {
+		delta := path.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		path.rttvar = (3*path.rttvar + delta) / 4
+		path.srtt = (7*path.srtt + rtt) / 8
+	}
+
+	path.received++
+	path.unanswered = 0
+	path.missed = 0
+	path.lastReply = now
+	return rtt, true
+}
+
+// expire counts the probes that have waited longer than probeTimeout as lost and returns how many there were
+func (pp *pathProbes) expire(now time.Time) uint64 {
+	pp.Lock()
+	defer pp.Unlock()
+	return pp.unlockedExpire(now, false)
+}
+
+// unlockedExpire counts the probes that have waited longer than probeTimeout as lost, or the oldest probe if there are
+// none and force is true
+func (pp *pathProbes) unlockedExpire(now time.Time, force bool) uint64 {
+	var lost, oldest uint64
+	deadline := uint64(now.Add(-probeTimeout).UnixNano())
+	for id, path := range pp.pending {
+		if id < deadline {
+			path.lost++
+			path.missed++
+			lost++
+			delete(pp.pending, id)
+		} else if oldest == 0 || id < oldest {
+			oldest = id
+		}
+	}
+
+	if force && lost == 0 && oldest != 0 {
+		pp.pending[oldest].lost++
+		pp.pending[oldest].missed++
+		delete(pp.pending, oldest)
+		lost++
+	}
+
+	return lost
+}
+
+// best returns a remote that is clearly faster than current without losing more probes, or nil if current should stay
+func (pp *pathProbes) best(current *udp.Addr, now time.Time) *udp.Addr {
+	pp.Lock()
+	defer pp.Unlock()
+
+	if current == nil {
+		return nil
+	}
+
+	cur := pp.paths[current.String()]
+	if cur == nil || !cur.usable(now) {
+		if cur == pp.promoted {
+			// The remote we picked stopped answering, let roaming decide again
+			pp.promoted = nil
+		}
+		return nil
+	}
+
+	var best *pathStat
+	for _, path := range pp.paths {
+		if path == cur || !path.usable(now) || path.loss() > cur.loss() {
+			continue
+		}
+
+		if float64(path.srtt) >= float64(cur.srtt)*probePromoteRatio {
+			continue
+		}
+
+		if best == nil || path.srtt < best.srtt {
+			best = path
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	pp.promoted = best
+	return best.addr
+}
+
+// failover returns the fastest remote that answered its last probe if current lost probeFailoverLosses probes in a
+// row, or nil if current is fine or there is nowhere better to go. Probes still waiting on a reply are not lost yet, a
+// slow reply is not a reason to move.
+func (pp *pathProbes) failover(current *udp.Addr, now time.Time) *udp.Addr {
+	pp.Lock()
+	defer pp.Unlock()
+
+	if current == nil {
+		return nil
+	}
+
+	cur := pp.paths[current.String()]
+	if cur == nil || cur.missed < probeFailoverLosses {
+		return nil
+	}
+
+	var best *pathStat
+	for _, path := range pp.paths {
+		if path == cur || path.unanswered > 0 || path.received == 0 || now.Sub(path.lastReply) >= probeStale {
+			continue
+		}
+
+		if best == nil || path.srtt < best.srtt {
+			best = path
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	pp.promoted = best
+	return best.addr
+}
+
+// holdRemote reports if a roam from current to addr should be ignored because current was picked for its rtt and addr
+// is a remote we already know to be slower
+func (pp *pathProbes) holdRemote(current, addr *udp.Addr) bool {
+	pp.Lock()
+	defer pp.Unlock()
+
+	if pp.promoted == nil || current == nil || !pp.promoted.addr.Equals(current) {
+		return false
+	}
+
+	_, known := pp.paths[addr.String()]
+	return known
+}
+
+// stats returns the stats for each remote that has been probed, ordered by address
+func (pp *pathProbes) stats() []PathStats {
+	pp.Lock()
+	defer pp.Unlock()
+
+	stats := make([]PathStats, 0, len(pp.paths))
+	for _, path := range pp.paths {
+		stats = append(stats, PathStats{
+			Addr:       path.addr.Copy(),
+			Rtt:        path.srtt,
+			Jitter:     path.rttvar,
+			Loss:       path.loss(),
+			Sent:       path.sent,
+			Received:   path.received,
+			Unanswered: path.unanswered,
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Addr.String() < stats[j].Addr.String()
+	})
+	return stats
+}
+
+// sendProbe sends a probe over the tunnel to addr, the reply measures the path to that remote
+func (f *Interface) sendProbe(hostinfo *HostInfo, addr *udp.Addr, nb, out []byte) {
+	now := time.Now()
+	f.probeMetrics.lost.Inc(int64(hostinfo.paths.expire(now)))
+
+	p, err := hostinfo.paths.ping(addr, now)
+	if err != nil {
+		hostinfo.logger(f.l).WithError(err).Error("Failed to marshal probe")
+		return
+	}
+
+	f.probeMetrics.sent.Inc(1)
+	f.sendTo(header.Test, header.TestRequest, hostinfo.ConnectionState, hostinfo, addr, p, nb, out)
+}
+
+// handleProbeReply records the rtt if d is the reply to one of our probes
+func (f *Interface) handleProbeReply(hostinfo *HostInfo, d []byte) {
+	rtt, ok := hostinfo.paths.pong(d, time.Now())
+	if ok {
+		f.probeMetrics.rtt.Update(int64(rtt))
+	}
+}
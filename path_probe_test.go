@@ -0,0 +1,215 @@
+package nebula
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+)
+
+// probeReplies sends n probes to addr and answers each of them after rtt
+func probeReplies(t *testing.T, pp *pathProbes, addr *udp.Addr, now time.Time, rtt time.Duration, n int) time.Time {
+	for i := 0; i < n; i++ {
+		p, err := pp.ping(addr, now)
+		assert.NoError(t, err)
+		now = now.Add(rtt)
+		got, ok := pp.pong(p, now)
+		assert.True(t, ok)
+		assert.Equal(t, rtt, got)
+	}
+	return now
+}
+
+func TestPathProbes_rtt(t *testing.T) {
+	pp := &pathProbes{}
+	addr := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+	now := time.Now()
+
+	now = probeReplies(t, pp, addr, now, 100*time.Millisecond, 1)
+	stats := pp.stats()
+	assert.Len(t, stats, 1)
+	assert.Equal(t, addr, stats[0].Addr)
+	assert.Equal(t, 100*time.Millisecond, stats[0].Rtt)
+	assert.Equal(t, 50*time.Millisecond, stats[0].Jitter)
+
+	// Smoothed like tcp
+	probeReplies(t, pp, addr, now, 20*time.Millisecond, 1)
+	stats = pp.stats()
+	assert.Equal(t, 90*time.Millisecond, stats[0].Rtt)
+	assert.Equal(t, 57500*time.Microsecond, stats[0].Jitter)
+	assert.Equal(t, uint64(2), stats[0].Sent)
+	assert.Equal(t, uint64(2), stats[0].Received)
+	assert.Equal(t, float64(0), stats[0].Loss)
+
+	// Replies that are not for a probe we sent are ignored
+	_, ok := pp.pong([]byte{}, now)
+	assert.False(t, ok)
+	p, _ := (&NebulaPing{Time: 1234}).Marshal()
+	_, ok = pp.pong(p, now)
+	assert.False(t, ok)
+	p, _ = pp.ping(addr, now)
+	_, ok = pp.pong(p, now)
+	assert.True(t, ok)
+	_, ok = pp.pong(p, now)
+	assert.False(t, ok)
+}
+
+func TestPathProbes_pingSize(t *testing.T) {
+	// Older versions can not safely echo more than 16 bytes, see pathProbes
+	p, err := (&NebulaPing{Type: NebulaPing_Ping, Time: math.MaxUint64}).Marshal()
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, len(p), 16)
+}
+
+func TestPathProbes_loss(t *testing.T) {
+	pp := &pathProbes{}
+	addr := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+	now := time.Now()
+
+	now = probeReplies(t, pp, addr, now, time.Millisecond, 3)
+	_, err := pp.ping(addr, now)
+	assert.NoError(t, err)
+
+	// Not lost until it has waited long enough
+	assert.Equal(t, uint64(0), pp.expire(now.Add(probeTimeout/2)))
+	assert.Equal(t, uint64(1), pp.expire(now.Add(probeTimeout+time.Millisecond)))
+	assert.Equal(t, 0.25, pp.stats()[0].Loss)
+
+	// Too many outstanding probes push out the oldest
+	for i := 0; i < probeMaxPending+1; i++ {
+		_, err = pp.ping(addr, now)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, pp.pending, probeMaxPending)
+	assert.Equal(t, uint64(2), pp.paths[addr.String()].lost)
+}
+
+func TestPathProbes_best(t *testing.T) {
+	pp := &pathProbes{}
+	current := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+	fast := udp.NewAddr(net.ParseIP("10.0.0.4"), 4242)
+	slow := udp.NewAddr(net.ParseIP("5.6.7.8"), 4242)
+	now := time.Now()
+
+	assert.Nil(t, pp.best(nil, now))
+	assert.Nil(t, pp.best(current, now))
+
+	now = probeReplies(t, pp, current, now, 50*time.Millisecond, probeMinReplies)
+	now = probeReplies(t, pp, slow, now, 100*time.Millisecond, probeMinReplies)
+
+	// Not enough replies to trust it yet
+	now = probeReplies(t, pp, fast, now, 10*time.Millisecond, probeMinReplies-1)
+	assert.Nil(t, pp.best(current, now))
+
+	now = probeReplies(t, pp, fast, now, 10*time.Millisecond, 1)
+	assert.Equal(t, fast, pp.best(current, now))
+
+	// Roaming back to a slower remote we know about is held off, a new remote is still a roam
+	assert.True(t, pp.holdRemote(fast, current))
+	assert.True(t, pp.holdRemote(fast, slow))
+	assert.False(t, pp.holdRemote(fast, udp.NewAddr(net.ParseIP("9.9.9.9"), 4242)))
+	assert.False(t, pp.holdRemote(current, fast))
+
+	// Nothing is faster than the fastest
+	assert.Nil(t, pp.best(fast, now))
+
+	// A remote that loses more probes is not better no matter how fast it is
+	_, _ = pp.ping(fast, now)
+	pp.expire(now.Add(probeTimeout * 2))
+	assert.Nil(t, pp.best(current, now))
+
+	// Once the picked remote goes quiet roaming is in charge again
+	now = now.Add(probeStale)
+	assert.Nil(t, pp.best(fast, now))
+	assert.False(t, pp.holdRemote(fast, current))
+}
+
+func TestPathProbes_due(t *testing.T) {
+	pp := &pathProbes{}
+	now := time.Now()
+
+	assert.True(t, pp.due(now, time.Second))
+	assert.False(t, pp.due(now.Add(time.Second/2), time.Second))
+	assert.True(t, pp.due(now.Add(time.Second), time.Second))
+}
+
+func TestPathProbes_failover(t *testing.T) {
+	pp := &pathProbes{}
+	current := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+	lan := udp.NewAddr(net.ParseIP("10.0.0.4"), 4242)
+	wan := udp.NewAddr(net.ParseIP("5.6.7.8"), 4242)
+	cold := udp.NewAddr(net.ParseIP("9.9.9.9"), 4242)
+	now := time.Now()
+
+	assert.Nil(t, pp.failover(nil, now))
+	assert.Nil(t, pp.failover(current, now))
+
+	now = probeReplies(t, pp, current, now, 10*time.Millisecond, 1)
+	now = probeReplies(t, pp, lan, now, 30*time.Millisecond, 1)
+	now = probeReplies(t, pp, wan, now, 20*time.Millisecond, 1)
+	_, _ = pp.ping(cold, now)
+
+	// The current remote answered its last probe
+	assert.Nil(t, pp.failover(current, now))
+
+	// It stopped answering, a late probe or a single lost one is not enough to move
+	_, _ = pp.ping(current, now)
+	assert.Nil(t, pp.failover(current, now))
+	now = now.Add(probeTimeout + time.Millisecond)
+	pp.expire(now)
+	assert.Nil(t, pp.failover(current, now))
+
+	// Losing a second probe in a row moves to the fastest remote that still answers
+	_, _ = pp.ping(current, now)
+	now = now.Add(probeTimeout + time.Millisecond)
+	assert.Equal(t, uint64(1), pp.expire(now))
+	assert.Equal(t, wan, pp.failover(current, now))
+	assert.Equal(t, uint64(2), pp.stats()[0].Unanswered)
+
+	// Hold on to the new remote when the old one shows up again
+	assert.True(t, pp.holdRemote(wan, current))
+
+	// Nothing answers, stay put
+	_, _ = pp.ping(lan, now)
+	_, _ = pp.ping(wan, now)
+	assert.Nil(t, pp.failover(current, now))
+
+	// A remote that has not answered in a long time is not warm
+	p, _ := pp.ping(lan, now)
+	_, ok := pp.pong(p, now)
+	assert.True(t, ok)
+	assert.Nil(t, pp.failover(current, now.Add(probeStale)))
+}
+
+func TestPathProbes_failoverDroppedProbe(t *testing.T) {
+	pp := &pathProbes{}
+	current := udp.NewAddr(net.ParseIP("1.2.3.4"), 4242)
+	wan := udp.NewAddr(net.ParseIP("5.6.7.8"), 4242)
+	now := time.Now()
+
+	now = probeReplies(t, pp, current, now, 10*time.Millisecond, 3)
+	now = probeReplies(t, pp, wan, now, 20*time.Millisecond, 3)
+
+	// The reply to a probe takes longer than the probe interval
+	p, _ := pp.ping(current, now)
+	now = now.Add(time.Second)
+	assert.Nil(t, pp.failover(current, now))
+	_, ok := pp.pong(p, now)
+	assert.True(t, ok)
+
+	// A single probe is dropped and the next one is answered
+	_, _ = pp.ping(current, now)
+	now = now.Add(probeTimeout + time.Millisecond)
+	assert.Equal(t, uint64(1), pp.expire(now))
+	assert.Nil(t, pp.failover(current, now))
+	now = probeReplies(t, pp, current, now, 10*time.Millisecond, 1)
+
+	// Another dropped probe starts counting from scratch
+	_, _ = pp.ping(current, now)
+	now = now.Add(probeTimeout + time.Millisecond)
+	assert.Equal(t, uint64(1), pp.expire(now))
+	assert.Nil(t, pp.failover(current, now))
+}
@@ -0,0 +1,124 @@
+package nebula
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/slackhq/nebula/config"
+	"golang.org/x/crypto/hkdf"
+)
+
+type PskMode int
+
+const (
+	// PskNone sends and accepts handshakes without a psk
+	PskNone PskMode = iota
+	// PskTransitionalAccepting sends handshakes without a psk but accepts handshakes with or without one
+	PskTransitionalAccepting
+	// PskTransitionalSending sends handshakes with a psk and accepts handshakes with or without one
+	PskTransitionalSending
+	// PskEnforced sends handshakes with a psk and only accepts handshakes with one
+	PskEnforced
+)
+
+func NewPskMode(m string) (PskMode, error) {
+	switch m {
+	case "none":
+		return PskNone, nil
+	case "transitional-accepting":
+		return PskTransitionalAccepting, nil
+	case "transitional-sending":
+		return PskTransitionalSending, nil
+	case "enforced":
+		return PskEnforced, nil
+	}
+	return PskNone, fmt.Errorf("unknown psk mode: %v", m)
+}
+
+func (p PskMode) String() string {
+	switch p {
+	case PskNone:
+		return "none"
+	case PskTransitionalAccepting:
+		return "transitional-accepting"
+	case PskTransitionalSending:
+		return "transitional-sending"
+	case PskEnforced:
+		return "enforced"
+	}
+	return "unknown"
+}
+
+// Psk holds the pre-shared keys mixed into our handshakes. The first key is used for the handshakes we send and
+// every key is accepted, which allows the key to be rotated without downtime.
+type Psk struct {
+	mode PskMode
+	keys [][]byte
+}
+
+func NewPskFromConfig(c *config.C) (*Psk, error) {
+	mode, err := NewPskMode(c.GetString("psk.mode", "none"))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPsk(mode, c.GetStringSlice("psk.keys", nil))
+}
+
+func NewPsk(mode PskMode, keys []string) (*Psk, error) {
+	p := &Psk{mode: mode}
+	if mode == PskNone {
+		return p, nil
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("psk.keys must contain at least one key when psk.mode is %s", mode)
+	}
+
+	for i, k := range keys {
+		if k == "" {
+			return nil, fmt.Errorf("psk.keys entry #%v is empty", i)
+		}
+
+		key, err := derivePsk(k)
+		if err != nil {
+			return nil, err
+		}
+		p.keys = append(p.keys, key)
+	}
+
+	return p, nil
+}
+
+// derivePsk stretches a configured key into the 32 bytes noise requires
+func derivePsk(secret string) ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte("NEBULA PSK")), key)
+	if err != nil {
+		return nil, errors.New("failed to derive psk")
+	}
+	return key, nil
+}
+
+// Primary returns the key to use for the handshakes we send, nil means no psk
+func (p *Psk) Primary() []byte {
+	if p == nil || p.mode < PskTransitionalSending {
+		return nil
+	}
+	return p.keys[0]
+}
+
+// Keys returns every key a handshake we receive may be using
+func (p *Psk) Keys() [][]byte {
+	if p == nil {
+		return nil
+	}
+	return p.keys
+}
+
+// AllowNone reports if we accept handshakes without a psk
+func (p *Psk) AllowNone() bool {
+	return p == nil || p.mode != PskEnforced
+}
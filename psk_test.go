@@ -0,0 +1,85 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPskFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// The default is no psk
+	p, err := NewPskFromConfig(c)
+	assert.NoError(t, err)
+	assert.Equal(t, PskNone, p.mode)
+	assert.Nil(t, p.Primary())
+	assert.Nil(t, p.Keys())
+	assert.True(t, p.AllowNone())
+
+	c.Settings["psk"] = map[interface{}]interface{}{"mode": "nope"}
+	_, err = NewPskFromConfig(c)
+	assert.EqualError(t, err, "unknown psk mode: nope")
+
+	c.Settings["psk"] = map[interface{}]interface{}{"mode": "enforced"}
+	_, err = NewPskFromConfig(c)
+	assert.EqualError(t, err, "psk.keys must contain at least one key when psk.mode is enforced")
+
+	c.Settings["psk"] = map[interface{}]interface{}{"mode": "enforced", "keys": []interface{}{"a", ""}}
+	_, err = NewPskFromConfig(c)
+	assert.EqualError(t, err, "psk.keys entry #1 is empty")
+
+	c.Settings["psk"] = map[interface{}]interface{}{"mode": "enforced", "keys": []interface{}{"new", "old"}}
+	p, err = NewPskFromConfig(c)
+	assert.NoError(t, err)
+	assert.Len(t, p.keys, 2)
+	assert.Len(t, p.keys[0], 32)
+	assert.NotEqual(t, p.keys[0], p.keys[1])
+}
+
+func TestPsk_Modes(t *testing.T) {
+	newKey, err := derivePsk("new")
+	assert.NoError(t, err)
+	oldKey, err := derivePsk("old")
+	assert.NoError(t, err)
+
+	// The same secret always derives the same key
+	again, err := derivePsk("new")
+	assert.NoError(t, err)
+	assert.Equal(t, newKey, again)
+
+	keys := []string{"new", "old"}
+
+	p, err := NewPsk(PskNone, keys)
+	assert.NoError(t, err)
+	assert.Nil(t, p.Primary())
+	assert.Nil(t, p.Keys())
+	assert.True(t, p.AllowNone())
+
+	p, err = NewPsk(PskTransitionalAccepting, keys)
+	assert.NoError(t, err)
+	assert.Nil(t, p.Primary())
+	assert.Equal(t, [][]byte{newKey, oldKey}, p.Keys())
+	assert.True(t, p.AllowNone())
+
+	p, err = NewPsk(PskTransitionalSending, keys)
+	assert.NoError(t, err)
+	assert.Equal(t, newKey, p.Primary())
+	assert.Equal(t, [][]byte{newKey, oldKey}, p.Keys())
+	assert.True(t, p.AllowNone())
+
+	p, err = NewPsk(PskEnforced, keys)
+	assert.NoError(t, err)
+	assert.Equal(t, newKey, p.Primary())
+	assert.Equal(t, [][]byte{newKey, oldKey}, p.Keys())
+	assert.False(t, p.AllowNone())
+
+	// A nil psk behaves like none
+	p = nil
+	assert.Nil(t, p.Primary())
+	assert.Nil(t, p.Keys())
+	assert.True(t, p.AllowNone())
+}
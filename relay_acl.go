@@ -0,0 +1,128 @@
+package nebula
+
+import (
+	"fmt"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+)
+
+// relayACLRule matches when the initiating host has any of fromGroups and the target host has any of toGroups.
+// An empty list matches any host.
+type relayACLRule struct {
+	fromGroups []string
+	toGroups   []string
+}
+
+// relayACL decides which hosts may be relayed through us, a nil relayACL allows everything
+type relayACL struct {
+	rules []relayACLRule
+}
+
+func newRelayACLFromConfig(c *config.C) (*relayACL, error) {
+	raw := c.Get("relay.acl")
+	if raw == nil {
+		return nil, nil
+	}
+
+	rs, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("relay.acl must be a list of rules, got %T", raw)
+	}
+
+	acl := &relayACL{}
+	for i, r := range rs {
+		rm, ok := r.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("relay.acl rule #%v must be a map, got %T", i, r)
+		}
+
+		var rule relayACLRule
+		for k, v := range rm {
+			groups, err := relayACLGroups(v)
+			if err != nil {
+				return nil, fmt.Errorf("relay.acl rule #%v %v %w", i, k, err)
+			}
+
+			switch k {
+			case "from_groups":
+				rule.fromGroups = groups
+			case "to_groups":
+				rule.toGroups = groups
+			default:
+				return nil, fmt.Errorf("relay.acl rule #%v has unknown key %v", i, k)
+			}
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+
+	return acl, nil
+}
+
+func relayACLGroups(raw interface{}) ([]string, error) {
+	switch v := raw.(type) {
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		groups := make([]string, len(v))
+		for i, g := range v {
+			groups[i] = fmt.Sprintf("%v", g)
+		}
+		return groups, nil
+	default:
+		return nil, fmt.Errorf("must be a group or list of groups, got %T", raw)
+	}
+}
+
+// Allow reports if a relay from the owner of fromCert to the owner of toCert is permitted. A nil certificate means
+// we could not learn the hosts identity, which is only permitted when there are no rules.
+func (a *relayACL) Allow(fromCert, toCert *cert.NebulaCertificate) bool {
+	if a == nil {
+		return true
+	}
+
+	if fromCert == nil || toCert == nil {
+		return false
+	}
+
+	for _, r := range a.rules {
+		if relayACLGroupsMatch(r.fromGroups, fromCert) && relayACLGroupsMatch(r.toGroups, toCert) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowFrom reports if any rule could permit a relay from the owner of fromCert, before we know who the target is
+func (a *relayACL) AllowFrom(fromCert *cert.NebulaCertificate) bool {
+	if a == nil {
+		return true
+	}
+
+	if fromCert == nil {
+		return false
+	}
+
+	for _, r := range a.rules {
+		if relayACLGroupsMatch(r.fromGroups, fromCert) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func relayACLGroupsMatch(groups []string, c *cert.NebulaCertificate) bool {
+	if len(groups) == 0 {
+		return true
+	}
+
+	for _, g := range groups {
+		if _, ok := c.Details.InvertedGroups[g]; ok {
+			return true
+		}
+	}
+
+	return false
+}
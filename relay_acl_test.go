@@ -0,0 +1,100 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRelayACLFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	acl, err := newRelayACLFromConfig(c)
+	assert.NoError(t, err)
+	assert.Nil(t, acl)
+
+	c.Settings["relay"] = map[interface{}]interface{}{"acl": "nope"}
+	_, err = newRelayACLFromConfig(c)
+	assert.EqualError(t, err, "relay.acl must be a list of rules, got string")
+
+	c.Settings["relay"] = map[interface{}]interface{}{"acl": []interface{}{"nope"}}
+	_, err = newRelayACLFromConfig(c)
+	assert.EqualError(t, err, "relay.acl rule #0 must be a map, got string")
+
+	c.Settings["relay"] = map[interface{}]interface{}{"acl": []interface{}{
+		map[interface{}]interface{}{"groups": "a"},
+	}}
+	_, err = newRelayACLFromConfig(c)
+	assert.EqualError(t, err, "relay.acl rule #0 has unknown key groups")
+
+	c.Settings["relay"] = map[interface{}]interface{}{"acl": []interface{}{
+		map[interface{}]interface{}{"from_groups": 1},
+	}}
+	_, err = newRelayACLFromConfig(c)
+	assert.EqualError(t, err, "relay.acl rule #0 from_groups must be a group or list of groups, got int")
+
+	c.Settings["relay"] = map[interface{}]interface{}{"acl": []interface{}{
+		map[interface{}]interface{}{"from_groups": []interface{}{"contractors"}, "to_groups": "jumpbox"},
+		map[interface{}]interface{}{"from_groups": "ops"},
+	}}
+	acl, err = newRelayACLFromConfig(c)
+	assert.NoError(t, err)
+	assert.Equal(t, []relayACLRule{
+		{fromGroups: []string{"contractors"}, toGroups: []string{"jumpbox"}},
+		{fromGroups: []string{"ops"}},
+	}, acl.rules)
+}
+
+func TestRelayACL_Allow(t *testing.T) {
+	newCert := func(groups ...string) *cert.NebulaCertificate {
+		c := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+			Groups:         groups,
+			InvertedGroups: map[string]struct{}{},
+		}}
+		for _, g := range groups {
+			c.Details.InvertedGroups[g] = struct{}{}
+		}
+		return c
+	}
+
+	contractor := newCert("contractors")
+	jumpbox := newCert("jumpbox", "servers")
+	server := newCert("servers")
+	ops := newCert("ops")
+
+	// No acl allows everything, even hosts we know nothing about
+	var acl *relayACL
+	assert.True(t, acl.Allow(contractor, server))
+	assert.True(t, acl.Allow(nil, nil))
+	assert.True(t, acl.AllowFrom(nil))
+
+	acl = &relayACL{rules: []relayACLRule{
+		{fromGroups: []string{"contractors"}, toGroups: []string{"jumpbox"}},
+		{fromGroups: []string{"ops"}},
+	}}
+
+	assert.True(t, acl.Allow(contractor, jumpbox))
+	assert.False(t, acl.Allow(contractor, server))
+	assert.False(t, acl.Allow(jumpbox, contractor))
+	assert.True(t, acl.Allow(ops, server))
+	assert.True(t, acl.Allow(ops, contractor))
+
+	// Unknown hosts are denied once there are rules
+	assert.False(t, acl.Allow(nil, jumpbox))
+	assert.False(t, acl.Allow(ops, nil))
+
+	// Only the from side is known before the target is
+	assert.True(t, acl.AllowFrom(contractor))
+	assert.True(t, acl.AllowFrom(ops))
+	assert.False(t, acl.AllowFrom(server))
+	assert.False(t, acl.AllowFrom(nil))
+
+	// An acl without rules denies everything
+	acl = &relayACL{}
+	assert.False(t, acl.Allow(ops, server))
+	assert.False(t, acl.AllowFrom(ops))
+}
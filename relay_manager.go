@@ -4,42 +4,137 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/iputil"
 )
 
+// DefaultRelayMaxHops only allows a single relay between two hosts
+const DefaultRelayMaxHops = 1
+
+// DefaultRelayUpgradeInterval is how often a relayed tunnel looks for a direct path
+const DefaultRelayUpgradeInterval = time.Minute
+
 type relayManager struct {
 	l       *logrus.Logger
 	hostmap *HostMap
 	amRelay atomic.Bool
+	maxHops atomic.Uint32
+	quotas  *relayQuotas
+	acl     atomic.Pointer[relayACL]
+
+	// chainPeers are the relays that may ask us to extend a relay chain on behalf of another host
+	chainPeers atomic.Pointer[map[iputil.VpnIp]struct{}]
+
+	upgradeInterval atomic.Int64
 }
 
-func NewRelayManager(ctx context.Context, l *logrus.Logger, hostmap *HostMap, c *config.C) *relayManager {
+func NewRelayManager(ctx context.Context, l *logrus.Logger, hostmap *HostMap, c *config.C) (*relayManager, error) {
 	rm := &relayManager{
 		l:       l,
 		hostmap: hostmap,
+		quotas:  newRelayQuotas(),
+	}
+	if err := rm.reload(c, true); err != nil {
+		return nil, err
 	}
-	rm.reload(c, true)
 	c.RegisterReloadCallback(func(c *config.C) {
 		err := rm.reload(c, false)
 		if err != nil {
 			l.WithError(err).Error("Failed to reload relay_manager")
 		}
 	})
-	return rm
+	return rm, nil
 }
 
+// reload checks every relay setting before applying any of them, so a bad value leaves the previous config in place
+// instead of a relay with some of its limits missing
 func (rm *relayManager) reload(c *config.C, initial bool) error {
+	maxHopsChanged := initial || c.HasChanged("relay.max_hops")
+	maxHops := DefaultRelayMaxHops
+	if c.IsSet("relay.max_hops") {
+		maxHops = c.GetInt("relay.max_hops", 0)
+	}
+	if maxHopsChanged && maxHops < 1 {
+		return fmt.Errorf("relay.max_hops must be at least 1, got %v", c.Get("relay.max_hops"))
+	}
+
+	upgradeIntervalChanged := initial || c.HasChanged("relay.upgrade_interval")
+	upgradeInterval := DefaultRelayUpgradeInterval
+	if c.IsSet("relay.upgrade_interval") {
+		upgradeInterval = c.GetDuration("relay.upgrade_interval", -1)
+	}
+	if upgradeIntervalChanged && upgradeInterval < 0 {
+		return fmt.Errorf("relay.upgrade_interval must be a positive duration, got %v", c.Get("relay.upgrade_interval"))
+	}
+
+	aclChanged := initial || c.HasChanged("relay.acl")
+	var acl *relayACL
+	if aclChanged {
+		var err error
+		if acl, err = newRelayACLFromConfig(c); err != nil {
+			return err
+		}
+	}
+
+	chainPeersChanged := initial || c.HasChanged("relay.chain_peers")
+	var chainPeers map[iputil.VpnIp]struct{}
+	if chainPeersChanged {
+		var err error
+		if chainPeers, err = newRelayChainPeersFromConfig(c); err != nil {
+			return err
+		}
+	}
+
+	quotasChanged := initial || c.HasChanged("relay.quota")
+	var quotas *relayQuotaConfig
+	if quotasChanged {
+		var err error
+		if quotas, err = newRelayQuotaConfig(c); err != nil {
+			return err
+		}
+	}
+
 	if initial || c.HasChanged("relay.am_relay") {
 		rm.setAmRelay(c.GetBool("relay.am_relay", false))
 	}
+	if maxHopsChanged {
+		rm.maxHops.Store(uint32(maxHops))
+	}
+	if upgradeIntervalChanged {
+		rm.upgradeInterval.Store(int64(upgradeInterval))
+	}
+	if aclChanged {
+		rm.acl.Store(acl)
+	}
+	if chainPeersChanged {
+		rm.chainPeers.Store(&chainPeers)
+	}
+	if quotasChanged {
+		rm.quotas.apply(quotas)
+	}
 	return nil
 }
 
+// newRelayChainPeersFromConfig reads relay.chain_peers, the nebula ips of relays that may extend a chain through us
+func newRelayChainPeersFromConfig(c *config.C) (map[iputil.VpnIp]struct{}, error) {
+	peers := map[iputil.VpnIp]struct{}{}
+	for _, v := range c.GetStringSlice("relay.chain_peers", nil) {
+		ip := net.ParseIP(v)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("relay.chain_peers entry %q is not a nebula ip", v)
+		}
+		peers[iputil.Ip2VpnIp(ip)] = struct{}{}
+	}
+	return peers, nil
+}
+
 func (rm *relayManager) GetAmRelay() bool {
 	return rm.amRelay.Load()
 }
@@ -48,9 +143,34 @@ func (rm *relayManager) setAmRelay(v bool) {
 	rm.amRelay.Store(v)
 }
 
+// GetMaxHops returns the maximum number of relays a relay chain this node initiates or takes part in may traverse
+func (rm *relayManager) GetMaxHops() uint32 {
+	return rm.maxHops.Load()
+}
+
+// GetUpgradeInterval returns how often relayed tunnels should look for a direct path, 0 means never
+func (rm *relayManager) GetUpgradeInterval() time.Duration {
+	return time.Duration(rm.upgradeInterval.Load())
+}
+
+// AllowForward records n bytes being forwarded on behalf of hostinfo and reports if the relay quotas permit it
+func (rm *relayManager) AllowForward(hostinfo *HostInfo, n int) bool {
+	return rm.quotas.Allow(hostinfo, n)
+}
+
+func (rm *relayManager) EmitStats() {
+	rm.quotas.EmitStats(rm.hostmap)
+}
+
 // AddRelay finds an available relay index on the hostmap, and associates the relay info with it.
 // relayHostInfo is the Nebula peer which can be used as a relay to access the target vpnIp.
 func AddRelay(l *logrus.Logger, relayHostInfo *HostInfo, hm *HostMap, vpnIp iputil.VpnIp, remoteIdx *uint32, relayType int, state int) (uint32, error) {
+	return addChainRelay(l, relayHostInfo, hm, vpnIp, 0, 0, remoteIdx, relayType, state)
+}
+
+// addChainRelay is AddRelay for forwarding relays that are a link in a relay chain. nextHopIp is the relay packets
+// should be handed to when it is not vpnIp, and originIp is the far end of the chain when it is not relayHostInfo.
+func addChainRelay(l *logrus.Logger, relayHostInfo *HostInfo, hm *HostMap, vpnIp, nextHopIp, originIp iputil.VpnIp, remoteIdx *uint32, relayType int, state int) (uint32, error) {
 	hm.Lock()
 	defer hm.Unlock()
 	for i := 0; i < 32; i++ {
@@ -72,6 +192,8 @@ func AddRelay(l *logrus.Logger, relayHostInfo *HostInfo, hm *HostMap, vpnIp iput
 				State:      state,
 				LocalIndex: index,
 				PeerIp:     vpnIp,
+				NextHopIp:  nextHopIp,
+				OriginIp:   originIp,
 			}
 
 			if remoteIdx != nil {
@@ -107,6 +229,8 @@ func (rm *relayManager) HandleControlMsg(h *HostInfo, m *NebulaControl, f *Inter
 		rm.handleCreateRelayRequest(h, f, m)
 	case NebulaControl_CreateRelayResponse:
 		rm.handleCreateRelayResponse(h, f, m)
+	case NebulaControl_CreateRelayDenied:
+		rm.handleCreateRelayDenied(h, f, m)
 	}
 
 }
@@ -131,9 +255,9 @@ func (rm *relayManager) handleCreateRelayResponse(h *HostInfo, f *Interface, m *
 		return
 	}
 	// I'm the middle man. Let the initiator know that the I've established the relay they requested.
-	peerHostInfo := rm.hostmap.QueryVpnIp(relay.PeerIp)
+	peerHostInfo := rm.hostmap.QueryVpnIp(relay.NextHop())
 	if peerHostInfo == nil {
-		rm.l.WithField("relayTo", relay.PeerIp).Error("Can't find a HostInfo for peer")
+		rm.l.WithField("relayTo", relay.NextHop()).Error("Can't find a HostInfo for peer")
 		return
 	}
 	peerRelay, ok := peerHostInfo.relayState.QueryRelayForByIp(target)
@@ -147,7 +271,7 @@ func (rm *relayManager) handleCreateRelayResponse(h *HostInfo, f *Interface, m *
 			Type:                NebulaControl_CreateRelayResponse,
 			ResponderRelayIndex: peerRelay.LocalIndex,
 			InitiatorRelayIndex: peerRelay.RemoteIndex,
-			RelayFromIp:         uint32(peerHostInfo.vpnIp),
+			RelayFromIp:         uint32(relay.PeerIp),
 			RelayToIp:           uint32(target),
 		}
 		msg, err := resp.Marshal()
@@ -246,29 +370,66 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 		if !rm.GetAmRelay() {
 			return
 		}
-		peer := rm.hostmap.QueryVpnIp(target)
+		if !rm.relayRequestFromPeer(h, m) {
+			// Only a relay in relay.chain_peers may ask on behalf of someone else
+			logMsg.WithField("relayPath", relayPathIps(m.RelayPath)).Error("Discarding relay request for a host other than the sender")
+			return
+		}
+		for _, hop := range m.RelayPath {
+			if iputil.VpnIp(hop) == f.myVpnIp {
+				logMsg.WithField("relayPath", relayPathIps(m.RelayPath)).Error("Discarding relay request that has already passed through me")
+				return
+			}
+		}
+
+		// Turn away requesters the acl can never allow before we open any tunnels on their behalf
+		if !rm.allowRelayFrom(h, m) {
+			logMsg.Info("Relay request denied by relay.acl")
+			rm.sendCreateRelayDenied(f, h, m)
+			return
+		}
+
+		peer := rm.nextHopFor(f, m, from, target)
 		if peer == nil {
-			// Try to establish a connection to this host. If we get a future relay request,
-			// we'll be ready!
-			f.Handshake(target)
 			return
 		}
-		if peer.remote == nil {
-			// Only create relays to peers for whom I have a direct connection
+
+		if !rm.allowRelay(h, m, target) {
+			logMsg.Info("Relay request denied by relay.acl")
+			rm.sendCreateRelayDenied(f, h, m)
 			return
 		}
+
+		// When either side is not an endpoint of the relay we are a link in a relay chain, and need to remember
+		// which relay to hand packets to and who the endpoint behind that relay is
+		var peerNextHop, peerOrigin, hNextHop, hOrigin iputil.VpnIp
+		if peer.vpnIp != target {
+			hNextHop = peer.vpnIp
+			peerOrigin = target
+		}
+		if h.vpnIp != from {
+			peerNextHop = h.vpnIp
+			hOrigin = from
+		}
+
 		sendCreateRequest := false
 		var index uint32
 		var err error
 		targetRelay, ok := peer.relayState.QueryRelayForByIp(from)
 		if ok {
+			if targetRelay.Origin(peer) != target {
+				// The next hop is already carrying a relay for this source to a different target
+				logMsg.WithFields(logrus.Fields{"nextHop": peer.vpnIp, "existingRelayTo": targetRelay.Origin(peer)}).
+					Error("Existing relay on next hop conflicts with CreateRelayRequest")
+				return
+			}
 			index = targetRelay.LocalIndex
 			if targetRelay.State == Requested {
 				sendCreateRequest = true
 			}
 		} else {
 			// Allocate an index in the hostMap for this relay peer
-			index, err = AddRelay(rm.l, peer, f.hostMap, from, nil, ForwardingType, Requested)
+			index, err = addChainRelay(rm.l, peer, f.hostMap, from, peerNextHop, peerOrigin, nil, ForwardingType, Requested)
 			if err != nil {
 				return
 			}
@@ -279,9 +440,13 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 			req := NebulaControl{
 				Type:                NebulaControl_CreateRelayRequest,
 				InitiatorRelayIndex: index,
-				RelayFromIp:         uint32(h.vpnIp),
+				RelayFromIp:         uint32(from),
 				RelayToIp:           uint32(target),
 			}
+			if hNextHop != 0 {
+				req.MaxHops = m.MaxHops
+				req.RelayPath = append(append([]uint32{}, m.RelayPath...), uint32(f.myVpnIp))
+			}
 			msg, err := req.Marshal()
 			if err != nil {
 				logMsg.
@@ -293,7 +458,7 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 					"relayTo":             iputil.VpnIp(req.RelayToIp),
 					"initiatorRelayIndex": req.InitiatorRelayIndex,
 					"responderRelayIndex": req.ResponderRelayIndex,
-					"vpnIp":               target}).
+					"vpnIp":               peer.vpnIp}).
 					Info("send CreateRelayRequest")
 			}
 		}
@@ -305,7 +470,7 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 			if targetRelay != nil && targetRelay.State == Established {
 				state = Established
 			}
-			_, err := AddRelay(rm.l, h, f.hostMap, target, &m.InitiatorRelayIndex, ForwardingType, state)
+			_, err := addChainRelay(rm.l, h, f.hostMap, target, hNextHop, hOrigin, &m.InitiatorRelayIndex, ForwardingType, state)
 			if err != nil {
 				logMsg.
 					WithError(err).Error("relayManager Failed to allocate a local index for relay")
@@ -325,7 +490,7 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 					Type:                NebulaControl_CreateRelayResponse,
 					ResponderRelayIndex: relay.LocalIndex,
 					InitiatorRelayIndex: relay.RemoteIndex,
-					RelayFromIp:         uint32(h.vpnIp),
+					RelayFromIp:         uint32(from),
 					RelayToIp:           uint32(target),
 				}
 				msg, err := resp.Marshal()
@@ -350,6 +515,233 @@ func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f *Interface, m *N
 	}
 }
 
+func (rm *relayManager) handleCreateRelayDenied(h *HostInfo, f *Interface, m *NebulaControl) {
+	target := iputil.VpnIp(m.RelayToIp)
+	logMsg := rm.l.WithFields(logrus.Fields{
+		"relayFrom":           iputil.VpnIp(m.RelayFromIp),
+		"relayTo":             target,
+		"initiatorRelayIndex": m.InitiatorRelayIndex,
+		"vpnIp":               h.vpnIp})
+
+	relay, ok := h.relayState.QueryRelayForByIdx(m.InitiatorRelayIndex)
+	if !ok || relay.State != Requested {
+		logMsg.Info("Ignoring CreateRelayDenied for an unknown relay")
+		return
+	}
+
+	switch relay.Type {
+	case TerminalType:
+		if relay.PeerIp != target {
+			logMsg.WithField("existingRelayTo", relay.PeerIp).Error("CreateRelayDenied does not match the requested relay")
+			return
+		}
+		logMsg.Info("Relay request was denied")
+		rm.removeRelay(h, relay)
+		f.handshakeManager.RelayDenied(target, h.vpnIp)
+
+	case ForwardingType:
+		if relay.Origin(h) != target {
+			logMsg.WithField("existingRelayTo", relay.Origin(h)).Error("CreateRelayDenied does not match the requested relay")
+			return
+		}
+		// I'm the middle man, the relay can not be completed so let the requester know
+		rm.removeRelay(h, relay)
+		peerHostInfo := rm.hostmap.QueryVpnIp(relay.NextHop())
+		if peerHostInfo == nil {
+			return
+		}
+		peerRelay, ok := peerHostInfo.relayState.QueryRelayForByIp(target)
+		if !ok || peerRelay.State != PeerRequested {
+			return
+		}
+		rm.removeRelay(peerHostInfo, peerRelay)
+		rm.sendCreateRelayDenied(f, peerHostInfo, &NebulaControl{
+			InitiatorRelayIndex: peerRelay.RemoteIndex,
+			RelayFromIp:         uint32(relay.PeerIp),
+			RelayToIp:           m.RelayToIp,
+		})
+	}
+}
+
+// allowRelay checks relay.acl to see if the request m may be relayed to target. h is the host that sent us the request
+// and is always checked, since it is the only host we know sent it. When h asks on behalf of someone else it must be
+// one of our relay.chain_peers, and the host that started the chain must be allowed as well.
+func (rm *relayManager) allowRelay(h *HostInfo, m *NebulaControl, target iputil.VpnIp) bool {
+	acl := rm.acl.Load()
+	if acl == nil {
+		return true
+	}
+
+	var toCert *cert.NebulaCertificate
+	if toHostInfo := rm.hostmap.QueryVpnIp(target); toHostInfo != nil {
+		toCert = toHostInfo.GetCert()
+	}
+	if !acl.Allow(h.GetCert(), toCert) {
+		return false
+	}
+
+	from := iputil.VpnIp(m.RelayFromIp)
+	if from == h.vpnIp {
+		return true
+	}
+	if !rm.relayRequestFromPeer(h, m) {
+		return false
+	}
+
+	return acl.Allow(rm.certOf(from), toCert)
+}
+
+// allowRelayFrom is the half of allowRelay that does not need the target, it fails when no rule could ever allow h or
+// the host that started the chain
+func (rm *relayManager) allowRelayFrom(h *HostInfo, m *NebulaControl) bool {
+	acl := rm.acl.Load()
+	if acl == nil {
+		return true
+	}
+
+	if !acl.AllowFrom(h.GetCert()) {
+		return false
+	}
+
+	from := iputil.VpnIp(m.RelayFromIp)
+	if from == h.vpnIp {
+		return true
+	}
+	if !rm.relayRequestFromPeer(h, m) {
+		return false
+	}
+
+	return acl.AllowFrom(rm.certOf(from))
+}
+
+// certOf returns the certificate of vpnIp if we have a tunnel with it
+func (rm *relayManager) certOf(vpnIp iputil.VpnIp) *cert.NebulaCertificate {
+	if hostInfo := rm.hostmap.QueryVpnIp(vpnIp); hostInfo != nil {
+		return hostInfo.GetCert()
+	}
+	return nil
+}
+
+// sendCreateRelayDenied tells h that the relay request m will not be fulfilled
+func (rm *relayManager) sendCreateRelayDenied(f *Interface, h *HostInfo, m *NebulaControl) {
+	resp := NebulaControl{
+		Type:                NebulaControl_CreateRelayDenied,
+		InitiatorRelayIndex: m.InitiatorRelayIndex,
+		RelayFromIp:         m.RelayFromIp,
+		RelayToIp:           m.RelayToIp,
+	}
+	msg, err := resp.Marshal()
+	if err != nil {
+		rm.l.WithError(err).Error("relayManager Failed to marshal Control CreateRelayDenied message")
+		return
+	}
+
+	f.SendMessageToHostInfo(header.Control, 0, h, msg, make([]byte, 12), make([]byte, mtu))
+	rm.l.WithFields(logrus.Fields{
+		"relayFrom":           iputil.VpnIp(resp.RelayFromIp),
+		"relayTo":             iputil.VpnIp(resp.RelayToIp),
+		"initiatorRelayIndex": resp.InitiatorRelayIndex,
+		"vpnIp":               h.vpnIp}).
+		Info("send CreateRelayDenied")
+}
+
+// removeRelay forgets about a relay that was never established
+func (rm *relayManager) removeRelay(h *HostInfo, relay *Relay) {
+	h.relayState.RemoveRelay(relay.LocalIndex)
+	rm.RemoveRelay(relay.LocalIndex)
+}
+
+// nextHopFor returns the HostInfo a relay request from -> target should be sent to. This is the target itself when we
+// have a direct tunnel to it, otherwise another relay for the target if the request allows the relay chain to grow.
+// nil is returned when no usable next hop exists yet.
+func (rm *relayManager) nextHopFor(f *Interface, m *NebulaControl, from, target iputil.VpnIp) *HostInfo {
+	peer := rm.hostmap.QueryVpnIp(target)
+	if peer != nil && peer.remote != nil {
+		return peer
+	}
+
+	if peer == nil {
+		// Try to establish a connection to this host. If we get a future relay request,
+		// we'll be ready!
+		f.Handshake(target)
+	}
+
+	// Only create relays to peers for whom I have a direct connection, unless the chain may be extended.
+	// A request without MaxHops came from a host that only understands single relays.
+	maxHops := m.MaxHops
+	if maxHops == 0 {
+		maxHops = DefaultRelayMaxHops
+	}
+	if ours := rm.GetMaxHops(); ours < maxHops {
+		maxHops = ours
+	}
+	// The chain would contain every relay in RelayPath, me, and the next relay
+	if uint32(len(m.RelayPath))+2 > maxHops {
+		return nil
+	}
+
+	skip := map[iputil.VpnIp]struct{}{f.myVpnIp: {}, from: {}, target: {}}
+	for _, hop := range m.RelayPath {
+		skip[iputil.VpnIp(hop)] = struct{}{}
+	}
+
+	var candidates []iputil.VpnIp
+	if peer != nil {
+		candidates = peer.relayState.CopyRelayIps()
+	}
+	candidates = append(candidates, f.lightHouse.QueryCache(target).CopyRelays(rm.hostmap.GetPreferredRanges())...)
+
+	for _, relayIp := range candidates {
+		if _, ok := skip[relayIp]; ok {
+			continue
+		}
+		skip[relayIp] = struct{}{}
+
+		relayHostInfo := rm.hostmap.QueryVpnIp(relayIp)
+		if relayHostInfo == nil {
+			// We may be able to use this relay on the next attempt
+			f.Handshake(relayIp)
+			continue
+		}
+		if relayHostInfo.remote == nil {
+			continue
+		}
+
+		return relayHostInfo
+	}
+
+	return nil
+}
+
+// relayRequestFromPeer reports if h may ask us to relay on behalf of m.RelayFromIp. Anyone may ask for themselves.
+// RelayPath is written by the sender, so asking for someone else is only trusted from a relay in relay.chain_peers, and
+// only as the last relay in the chain the request has taken so far.
+func (rm *relayManager) relayRequestFromPeer(h *HostInfo, m *NebulaControl) bool {
+	if iputil.VpnIp(m.RelayFromIp) == h.vpnIp {
+		return true
+	}
+
+	if len(m.RelayPath) == 0 || iputil.VpnIp(m.RelayPath[len(m.RelayPath)-1]) != h.vpnIp {
+		return false
+	}
+
+	peers := rm.chainPeers.Load()
+	if peers == nil {
+		return false
+	}
+	_, ok := (*peers)[h.vpnIp]
+	return ok
+}
+
+// relayPathIps converts the RelayPath of a control message into VpnIps for logging
+func relayPathIps(path []uint32) []iputil.VpnIp {
+	ips := make([]iputil.VpnIp, len(path))
+	for i, ip := range path {
+		ips[i] = iputil.VpnIp(ip)
+	}
+	return ips
+}
+
 func (rm *relayManager) RemoveRelay(localIdx uint32) {
 	rm.hostmap.RemoveRelay(localIdx)
 }
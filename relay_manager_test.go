@@ -0,0 +1,155 @@
+package nebula
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelayManager_relayRequestFromPeer(t *testing.T) {
+	l := test.NewLogger()
+	_, vpncidr, _ := net.ParseCIDR("10.0.0.0/24")
+	hm := NewHostMap(l, vpncidr, nil)
+	c := config.NewC(l)
+	assert.NoError(t, c.LoadString("relay:\n  chain_peers: [10.0.0.1]\n"))
+	rm, err := NewRelayManager(context.Background(), l, hm, c)
+	assert.NoError(t, err)
+
+	h := &HostInfo{vpnIp: iputil.Ip2VpnIp([]byte{10, 0, 0, 1})}
+	spoofer := &HostInfo{vpnIp: iputil.Ip2VpnIp([]byte{10, 0, 0, 4})}
+	other := uint32(iputil.Ip2VpnIp([]byte{10, 0, 0, 2}))
+	relay := uint32(iputil.Ip2VpnIp([]byte{10, 0, 0, 3}))
+
+	assert.True(t, rm.relayRequestFromPeer(h, &NebulaControl{RelayFromIp: uint32(h.vpnIp)}))
+	assert.True(t, rm.relayRequestFromPeer(spoofer, &NebulaControl{RelayFromIp: uint32(spoofer.vpnIp)}))
+
+	// A peer can't ask for a relay on behalf of someone else
+	assert.False(t, rm.relayRequestFromPeer(h, &NebulaControl{RelayFromIp: other}))
+	assert.False(t, rm.relayRequestFromPeer(h, &NebulaControl{RelayFromIp: other, RelayPath: []uint32{uint32(h.vpnIp), relay}}))
+
+	// Unless it is one of our chain peers and the last relay in the chain so far
+	assert.True(t, rm.relayRequestFromPeer(h, &NebulaControl{RelayFromIp: other, RelayPath: []uint32{uint32(h.vpnIp)}}))
+	assert.True(t, rm.relayRequestFromPeer(h, &NebulaControl{RelayFromIp: other, RelayPath: []uint32{relay, uint32(h.vpnIp)}}))
+
+	// Anyone else putting themselves in the path is still turned away
+	assert.False(t, rm.relayRequestFromPeer(spoofer, &NebulaControl{RelayFromIp: other, RelayPath: []uint32{uint32(spoofer.vpnIp)}}))
+	assert.False(t, rm.relayRequestFromPeer(spoofer, &NebulaControl{RelayFromIp: other, RelayPath: []uint32{uint32(h.vpnIp), uint32(spoofer.vpnIp)}}))
+
+	// Chain peers are reloadable
+	assert.NoError(t, c.ReloadConfigString("relay:\n  chain_peers: []\n"))
+	assert.False(t, rm.relayRequestFromPeer(h, &NebulaControl{RelayFromIp: other, RelayPath: []uint32{uint32(h.vpnIp)}}))
+}
+
+func TestRelayManager_allowRelay(t *testing.T) {
+	l := test.NewLogger()
+	_, vpncidr, _ := net.ParseCIDR("10.0.0.0/24")
+	hm := NewHostMap(l, vpncidr, nil)
+
+	addHost := func(ip byte, groups ...string) *HostInfo {
+		c := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{
+			Groups:         groups,
+			InvertedGroups: map[string]struct{}{},
+		}}
+		for _, g := range groups {
+			c.Details.InvertedGroups[g] = struct{}{}
+		}
+		h := &HostInfo{
+			vpnIp:           iputil.Ip2VpnIp([]byte{10, 0, 0, ip}),
+			ConnectionState: &ConnectionState{peerCert: c},
+			relayState: RelayState{
+				relays:        map[iputil.VpnIp]struct{}{},
+				relayForByIp:  map[iputil.VpnIp]*Relay{},
+				relayForByIdx: map[uint32]*Relay{},
+			},
+		}
+		hm.unlockedAddHostInfo(h, &Interface{})
+		return h
+	}
+
+	ops := addHost(1, "ops")
+	contractor := addHost(2, "contractors")
+	relay := addHost(3, "relays")
+	target := addHost(4, "servers")
+
+	c := config.NewC(l)
+	c.Settings["relay"] = map[interface{}]interface{}{
+		"acl": []interface{}{
+			map[interface{}]interface{}{"from_groups": []interface{}{"ops", "relays"}},
+		},
+		"chain_peers": []interface{}{"10.0.0.3"},
+	}
+	rm, err := NewRelayManager(context.Background(), l, hm, c)
+	assert.NoError(t, err)
+
+	request := func(from *HostInfo, path ...*HostInfo) *NebulaControl {
+		m := &NebulaControl{RelayFromIp: uint32(from.vpnIp), RelayToIp: uint32(target.vpnIp)}
+		for _, hop := range path {
+			m.RelayPath = append(m.RelayPath, uint32(hop.vpnIp))
+		}
+		return m
+	}
+
+	assert.True(t, rm.allowRelay(ops, request(ops), target.vpnIp))
+	assert.False(t, rm.allowRelay(contractor, request(contractor), target.vpnIp))
+
+	// Claiming to ask on behalf of an allowed host doesn't help a host that is not allowed
+	assert.False(t, rm.allowRelay(contractor, request(ops), target.vpnIp))
+	assert.False(t, rm.allowRelay(contractor, request(ops, contractor), target.vpnIp))
+
+	// An allowed relay may only ask on behalf of someone else as the previous hop of a chain the origin is allowed in
+	assert.False(t, rm.allowRelay(relay, request(ops), target.vpnIp))
+	assert.True(t, rm.allowRelay(relay, request(ops, relay), target.vpnIp))
+	assert.False(t, rm.allowRelay(relay, request(contractor, relay), target.vpnIp))
+
+	// The requester half is checked before we know the target
+	assert.True(t, rm.allowRelayFrom(ops, request(ops)))
+	assert.False(t, rm.allowRelayFrom(contractor, request(contractor)))
+	assert.False(t, rm.allowRelayFrom(contractor, request(ops, contractor)))
+	assert.True(t, rm.allowRelayFrom(relay, request(ops, relay)))
+	assert.False(t, rm.allowRelayFrom(relay, request(contractor, relay)))
+
+	// A host outside chain_peers is not trusted to speak for the origin, even if it could relay for itself
+	other := addHost(5, "relays")
+	assert.True(t, rm.allowRelayFrom(other, request(other)))
+	assert.False(t, rm.allowRelayFrom(other, request(ops, other)))
+	assert.False(t, rm.allowRelay(other, request(ops, other), target.vpnIp))
+}
+
+func TestRelayManager_reload(t *testing.T) {
+	l := test.NewLogger()
+	_, vpncidr, _ := net.ParseCIDR("10.0.0.0/24")
+	hm := NewHostMap(l, vpncidr, nil)
+
+	// A bad value anywhere fails startup instead of leaving the relay without limits
+	for _, relay := range []map[interface{}]interface{}{
+		{"max_hops": 0},
+		{"max_hops": "lots"},
+		{"upgrade_interval": "soon"},
+		{"acl": "nope"},
+		{"chain_peers": []interface{}{"relay1"}},
+		{"quota": map[interface{}]interface{}{"peer": map[interface{}]interface{}{"window_bytes": 1.5}}},
+	} {
+		c := config.NewC(l)
+		c.Settings["relay"] = relay
+		_, err := NewRelayManager(context.Background(), l, hm, c)
+		assert.Error(t, err, "%v", relay)
+	}
+
+	c := config.NewC(l)
+	assert.NoError(t, c.LoadString("relay:\n  max_hops: 2\n  acl:\n    - from_groups: [ops]\n"))
+	rm, err := NewRelayManager(context.Background(), l, hm, c)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), rm.GetMaxHops())
+	assert.NotNil(t, rm.acl.Load())
+
+	// A bad reload applies nothing, not even the keys that were fine
+	assert.NoError(t, c.ReloadConfigString("relay:\n  max_hops: 3\n  quota:\n    peer: nope\n"))
+	assert.Equal(t, uint32(2), rm.GetMaxHops())
+	assert.NotNil(t, rm.acl.Load())
+}
@@ -0,0 +1,386 @@
+package nebula
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// relayQuotaBurst is how much traffic the rate limit lets through at once, as time at the sustained rate
+const relayQuotaBurst = time.Second
+
+// relayQuotaLimit describes how much relayed traffic is allowed, a zero value in any field disables that limit
+type relayQuotaLimit struct {
+	bytesPerSec uint64
+	window      time.Duration
+	windowBytes uint64
+}
+
+func (l relayQuotaLimit) unlimited() bool {
+	return l.bytesPerSec == 0 && !l.windowed()
+}
+
+func (l relayQuotaLimit) windowed() bool {
+	return l.window > 0 && l.windowBytes > 0
+}
+
+// relayQuota enforces a relayQuotaLimit without locking. The rate is a token bucket that can burst up to
+// relayQuotaBurst of traffic, kept as the time the bucket will be full again. The total is a fixed window that is
+// replaced once window has passed.
+type relayQuota struct {
+	limit relayQuotaLimit
+
+	full   atomic.Int64
+	window atomic.Pointer[relayQuotaWindow]
+}
+
+type relayQuotaWindow struct {
+	start int64
+	used  atomic.Uint64
+}
+
+// newRelayQuota returns nil if limit does not restrict anything
+func newRelayQuota(limit relayQuotaLimit, now time.Time) *relayQuota {
+	if limit.unlimited() {
+		return nil
+	}
+	q := &relayQuota{limit: limit}
+	q.full.Store(now.UnixNano())
+	q.window.Store(&relayQuotaWindow{start: now.UnixNano()})
+	return q
+}
+
+// relimit returns a quota enforcing limit that carries over what q has already let through, so changing the config
+// doesn't hand out a fresh allowance. q is returned as is when the limit did not change.
+func (q *relayQuota) relimit(limit relayQuotaLimit, now time.Time) *relayQuota {
+	if q != nil && q.limit == limit {
+		return q
+	}
+
+	nq := newRelayQuota(limit, now)
+	if nq == nil || q == nil {
+		return nq
+	}
+
+	if limit.bytesPerSec > 0 && q.limit.bytesPerSec > 0 {
+		nq.full.Store(q.full.Load())
+	}
+	if limit.windowed() && q.limit.windowed() {
+		nq.window.Store(q.window.Load())
+	}
+	return nq
+}
+
+// cost is how long the rate limit needs to allow n bytes
+func (q *relayQuota) cost(n uint64) int64 {
+	return int64(n * uint64(time.Second) / q.limit.bytesPerSec)
+}
+
+// take consumes n bytes if they can be sent right now, and reports if they could
+func (q *relayQuota) take(now time.Time, n uint64) bool {
+	t := now.UnixNano()
+
+	if q.limit.bytesPerSec > 0 {
+		cost := q.cost(n)
+		for {
+			full := q.full.Load()
+			// Allow a packet to overdraw the bucket so packets larger than the rate still get through eventually
+			if full-t >= int64(relayQuotaBurst) {
+				return false
+			}
+			if q.full.CompareAndSwap(full, max(full, t)+cost) {
+				break
+			}
+		}
+	}
+
+	if q.limit.windowed() {
+		w := q.window.Load()
+		for t-w.start >= int64(q.limit.window) {
+			if q.window.CompareAndSwap(w, &relayQuotaWindow{start: t}) {
+				break
+			}
+			w = q.window.Load()
+		}
+		w = q.window.Load()
+
+		if w.used.Add(n) > q.limit.windowBytes {
+			w.used.Add(^(n - 1))
+			if q.limit.bytesPerSec > 0 {
+				q.full.Add(-q.cost(n))
+			}
+			return false
+		}
+	}
+
+	return true
+}
+
+// give returns n bytes that were taken for a packet that ended up being dropped
+func (q *relayQuota) give(n uint64) {
+	if q.limit.bytesPerSec > 0 {
+		q.full.Add(-q.cost(n))
+	}
+
+	if q.limit.windowed() {
+		w := q.window.Load()
+		for {
+			used := w.used.Load()
+			if w.used.CompareAndSwap(used, used-min(used, n)) {
+				return
+			}
+		}
+	}
+}
+
+// relayPeerStats is the relay accounting for a single host whose traffic we forward
+type relayPeerStats struct {
+	forwarded atomic.Uint64
+	dropped   atomic.Uint64
+
+	// quotas are the quotas this host is held to, resolved for a config generation and certificate
+	quotas atomic.Pointer[relayPeerQuotas]
+	// quota is this hosts own quota, guarded by the relayQuotas lock
+	quota *relayQuota
+}
+
+type relayPeerQuotas struct {
+	gen  uint64
+	cert *cert.NebulaCertificate
+	list []*relayQuota
+}
+
+// relayQuotas tracks relayed traffic by the host that sent it into this relay and enforces the configured limits.
+// Forwarding a packet only touches atomics, the lock is taken when a host is first seen, the config changes or a host
+// presents a new certificate.
+type relayQuotas struct {
+	gen atomic.Uint64
+
+	sync.Mutex
+	peerLimit   relayQuotaLimit
+	groupLimits map[string]relayQuotaLimit
+	peers       map[iputil.VpnIp]*relayPeerStats
+	groups      map[string]*relayQuota
+}
+
+// relayQuotaConfig is a parsed relay.quota
+type relayQuotaConfig struct {
+	peerLimit   relayQuotaLimit
+	groupLimits map[string]relayQuotaLimit
+}
+
+func newRelayQuotas() *relayQuotas {
+	return &relayQuotas{
+		groupLimits: map[string]relayQuotaLimit{},
+		peers:       map[iputil.VpnIp]*relayPeerStats{},
+		groups:      map[string]*relayQuota{},
+	}
+}
+
+func newRelayQuotaConfig(c *config.C) (*relayQuotaConfig, error) {
+	peerLimit, err := parseRelayQuotaLimit(c.Get("relay.quota.peer"))
+	if err != nil {
+		return nil, fmt.Errorf("relay.quota.peer %w", err)
+	}
+
+	raw := c.Get("relay.quota.groups")
+	groups, ok := raw.(map[interface{}]interface{})
+	if raw != nil && !ok {
+		return nil, fmt.Errorf("relay.quota.groups must be a map, got %T", raw)
+	}
+
+	rc := &relayQuotaConfig{peerLimit: peerLimit, groupLimits: map[string]relayQuotaLimit{}}
+	for k, v := range groups {
+		group := fmt.Sprintf("%v", k)
+		limit, err := parseRelayQuotaLimit(v)
+		if err != nil {
+			return nil, fmt.Errorf("relay.quota.groups.%s %w", group, err)
+		}
+		if !limit.unlimited() {
+			rc.groupLimits[group] = limit
+		}
+	}
+
+	return rc, nil
+}
+
+// apply switches to the limits in rc. Quotas keep what they already let through, hosts pick up the new limits the
+// next time they forward a packet.
+func (rq *relayQuotas) apply(rc *relayQuotaConfig) {
+	now := time.Now()
+	rq.Lock()
+	defer rq.Unlock()
+
+	groups := map[string]*relayQuota{}
+	for g, limit := range rc.groupLimits {
+		groups[g] = rq.groups[g].relimit(limit, now)
+	}
+
+	rq.peerLimit = rc.peerLimit
+	rq.groupLimits = rc.groupLimits
+	rq.groups = groups
+	rq.gen.Add(1)
+}
+
+func parseRelayQuotaLimit(raw interface{}) (relayQuotaLimit, error) {
+	var limit relayQuotaLimit
+	if raw == nil {
+		return limit, nil
+	}
+
+	rm, ok := raw.(map[interface{}]interface{})
+	if !ok {
+		return limit, fmt.Errorf("must be a map, got %T", raw)
+	}
+
+	for k := range rm {
+		switch k {
+		case "bytes_per_sec", "window", "window_bytes":
+		default:
+			return limit, fmt.Errorf("unknown key %v", k)
+		}
+	}
+
+	c := config.NewC(nil)
+	c.Settings = rm
+
+	var err error
+	if limit.bytesPerSec, err = getRelayQuotaBytes(c, "bytes_per_sec"); err != nil {
+		return limit, err
+	}
+	if limit.windowBytes, err = getRelayQuotaBytes(c, "window_bytes"); err != nil {
+		return limit, err
+	}
+	if c.IsSet("window") {
+		limit.window = c.GetDuration("window", -1)
+		if limit.window < 0 {
+			return limit, fmt.Errorf("window must be a positive duration, got %v", c.Get("window"))
+		}
+	}
+
+	return limit, nil
+}
+
+func getRelayQuotaBytes(c *config.C, k string) (uint64, error) {
+	if !c.IsSet(k) {
+		return 0, nil
+	}
+	i := c.GetInt(k, -1)
+	if i < 0 {
+		return 0, fmt.Errorf("%v must be a positive integer, got %v", k, c.Get(k))
+	}
+	return uint64(i), nil
+}
+
+// getPeer returns the accounting for hostinfo, creating it if needed. The result is cached on the hostinfo.
+func (rq *relayQuotas) getPeer(hostinfo *HostInfo) *relayPeerStats {
+	if p := hostinfo.relayStats.Load(); p != nil {
+		return p
+	}
+
+	rq.Lock()
+	p, ok := rq.peers[hostinfo.vpnIp]
+	if !ok {
+		p = &relayPeerStats{}
+		rq.peers[hostinfo.vpnIp] = p
+	}
+	rq.Unlock()
+
+	hostinfo.relayStats.Store(p)
+	return p
+}
+
+// getQuotas returns the quotas that apply to p when it presents the provided cert
+func (rq *relayQuotas) getQuotas(p *relayPeerStats, c *cert.NebulaCertificate) []*relayQuota {
+	if pq := p.quotas.Load(); pq != nil && pq.gen == rq.gen.Load() && pq.cert == c {
+		return pq.list
+	}
+
+	rq.Lock()
+	defer rq.Unlock()
+
+	now := time.Now()
+	pq := &relayPeerQuotas{gen: rq.gen.Load(), cert: c}
+	p.quota = p.quota.relimit(rq.peerLimit, now)
+	if p.quota != nil {
+		pq.list = append(pq.list, p.quota)
+	}
+
+	if c != nil {
+		for _, g := range c.Details.Groups {
+			limit, ok := rq.groupLimits[g]
+			if !ok {
+				continue
+			}
+			q, ok := rq.groups[g]
+			if !ok {
+				q = newRelayQuota(limit, now)
+				rq.groups[g] = q
+			}
+			pq.list = append(pq.list, q)
+		}
+	}
+
+	p.quotas.Store(pq)
+	return pq.list
+}
+
+// Allow checks and records n bytes being relayed on behalf of hostinfo. false means the packet must be dropped.
+func (rq *relayQuotas) Allow(hostinfo *HostInfo, n int) bool {
+	p := rq.getPeer(hostinfo)
+	quotas := rq.getQuotas(p, hostinfo.GetCert())
+
+	size := uint64(n)
+	if len(quotas) > 0 {
+		now := time.Now()
+		for i, q := range quotas {
+			if !q.take(now, size) {
+				for _, taken := range quotas[:i] {
+					taken.give(size)
+				}
+				p.dropped.Add(size)
+				return false
+			}
+		}
+	}
+
+	p.forwarded.Add(size)
+	return true
+}
+
+// GetPeerBytes returns the bytes forwarded and dropped on behalf of vpnIp
+func (rq *relayQuotas) GetPeerBytes(vpnIp iputil.VpnIp) (forwarded uint64, dropped uint64) {
+	rq.Lock()
+	p, ok := rq.peers[vpnIp]
+	rq.Unlock()
+	if !ok {
+		return 0, 0
+	}
+	return p.forwarded.Load(), p.dropped.Load()
+}
+
+// EmitStats updates the per peer relay metrics and forgets about peers that no longer have a tunnel with us
+func (rq *relayQuotas) EmitStats(hm *HostMap) {
+	rq.Lock()
+	defer rq.Unlock()
+
+	for vpnIp, p := range rq.peers {
+		forwardedName := fmt.Sprintf("relay.peer.%s.forwarded_bytes", vpnIp)
+		droppedName := fmt.Sprintf("relay.peer.%s.dropped_bytes", vpnIp)
+		if hm.QueryVpnIp(vpnIp) == nil {
+			delete(rq.peers, vpnIp)
+			metrics.Unregister(forwardedName)
+			metrics.Unregister(droppedName)
+			continue
+		}
+
+		metrics.GetOrRegisterGauge(forwardedName, nil).Update(int64(p.forwarded.Load()))
+		metrics.GetOrRegisterGauge(droppedName, nil).Update(int64(p.dropped.Load()))
+	}
+}
@@ -0,0 +1,236 @@
+package nebula
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelayQuota_Rate(t *testing.T) {
+	now := time.Now()
+	q := newRelayQuota(relayQuotaLimit{bytesPerSec: 1000}, now)
+
+	// A full bucket allows a second worth of traffic
+	assert.True(t, q.take(now, 600))
+	assert.True(t, q.take(now, 600))
+
+	// The bucket is now overdrawn
+	assert.False(t, q.take(now, 1))
+
+	// Half a second refills 500 bytes which pays the debt and leaves some room
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, q.take(now, 1))
+
+	// The bucket never holds more than a second worth
+	now = now.Add(time.Hour)
+	assert.True(t, q.take(now, 1000))
+	assert.False(t, q.take(now, 1))
+
+	// Giving back a dropped packet makes room again
+	q.give(1000)
+	assert.True(t, q.take(now, 1))
+}
+
+func TestRelayQuota_Window(t *testing.T) {
+	now := time.Now()
+	q := newRelayQuota(relayQuotaLimit{window: time.Minute, windowBytes: 1000}, now)
+
+	assert.True(t, q.take(now, 1000))
+	assert.False(t, q.take(now, 1))
+
+	now = now.Add(59 * time.Second)
+	assert.False(t, q.take(now, 1))
+
+	// A new window starts
+	now = now.Add(time.Second)
+	assert.True(t, q.take(now, 1000))
+}
+
+func TestRelayQuota_Concurrent(t *testing.T) {
+	now := time.Now()
+	q := newRelayQuota(relayQuotaLimit{window: time.Hour, windowBytes: 100_000}, now)
+
+	var wg sync.WaitGroup
+	var allowed atomic.Uint64
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if q.take(now, 100) {
+					allowed.Add(100)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Racing routines must never let more than the quota through
+	assert.Equal(t, uint64(100_000), allowed.Load())
+}
+
+func TestRelayQuota_Relimit(t *testing.T) {
+	now := time.Now()
+	limit := relayQuotaLimit{window: time.Hour, windowBytes: 1000}
+	q := newRelayQuota(limit, now)
+	assert.True(t, q.take(now, 1000))
+
+	// The same limit keeps the same quota
+	assert.Same(t, q, q.relimit(limit, now))
+
+	// A larger limit only allows the difference in this window
+	q = q.relimit(relayQuotaLimit{window: time.Hour, windowBytes: 1500}, now)
+	assert.True(t, q.take(now, 500))
+	assert.False(t, q.take(now, 1))
+
+	assert.Nil(t, q.relimit(relayQuotaLimit{}, now))
+}
+
+func TestRelayQuota_Unlimited(t *testing.T) {
+	assert.Nil(t, newRelayQuota(relayQuotaLimit{}, time.Now()))
+	assert.Nil(t, newRelayQuota(relayQuotaLimit{window: time.Minute}, time.Now()))
+}
+
+func TestRelayQuotas_Allow(t *testing.T) {
+	l := test.NewLogger()
+	_, vpncidr, _ := net.ParseCIDR("10.0.0.0/24")
+	c := config.NewC(l)
+	assert.NoError(t, c.LoadString(`
+relay:
+  quota:
+    peer:
+      window: 1h
+      window_bytes: 1000
+    groups:
+      contractors:
+        window: 1h
+        window_bytes: 1500
+`))
+
+	// Go through the relay manager so the tests cover the same validate then apply path reloads take
+	rm, err := NewRelayManager(context.Background(), l, NewHostMap(l, vpncidr, nil), c)
+	assert.NoError(t, err)
+	rq := rm.quotas
+
+	newHostInfo := func(ip iputil.VpnIp, groups ...string) *HostInfo {
+		return &HostInfo{
+			vpnIp: ip,
+			ConnectionState: &ConnectionState{
+				peerCert: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Groups: groups}},
+			},
+		}
+	}
+
+	a := newHostInfo(1, "contractors")
+	b := newHostInfo(2, "contractors")
+	other := newHostInfo(3, "employees")
+
+	// Each host gets its own peer quota
+	assert.True(t, rq.Allow(a, 1000))
+	assert.False(t, rq.Allow(a, 1))
+
+	// But contractors share 1500 bytes between them
+	assert.True(t, rq.Allow(b, 500))
+	assert.False(t, rq.Allow(b, 1))
+
+	// Hosts without a limited group only have the peer quota
+	assert.True(t, rq.Allow(other, 1000))
+
+	forwarded, dropped := rq.GetPeerBytes(a.vpnIp)
+	assert.Equal(t, uint64(1000), forwarded)
+	assert.Equal(t, uint64(1), dropped)
+
+	forwarded, dropped = rq.GetPeerBytes(b.vpnIp)
+	assert.Equal(t, uint64(500), forwarded)
+	assert.Equal(t, uint64(1), dropped)
+
+	// A packet that fits the peer quota but not the group quota leaves the peer quota untouched
+	c2 := newHostInfo(4, "contractors")
+	assert.False(t, rq.Allow(c2, 1000))
+	assert.Equal(t, uint64(0), c2.relayStats.Load().quota.window.Load().used.Load())
+
+	// Reloading keeps the quotas and the counters
+	assert.NoError(t, c.ReloadConfigString(`
+relay:
+  quota:
+    peer:
+      window: 1h
+      window_bytes: 1000
+    groups:
+      contractors:
+        window: 1h
+        window_bytes: 1500
+      employees:
+        window: 1h
+        window_bytes: 5000
+`))
+	assert.False(t, rq.Allow(a, 1))
+	forwarded, dropped = rq.GetPeerBytes(a.vpnIp)
+	assert.Equal(t, uint64(1000), forwarded)
+	assert.Equal(t, uint64(2), dropped)
+
+	// Raising the peer limit lets a host use the difference right away
+	assert.NoError(t, c.ReloadConfigString(`
+relay:
+  quota:
+    peer:
+      window: 1h
+      window_bytes: 2000
+    groups:
+      contractors:
+        window: 1h
+        window_bytes: 1500
+`))
+	assert.True(t, rq.Allow(other, 1000))
+	assert.False(t, rq.Allow(other, 1))
+
+	// A bad reload leaves the limits alone
+	assert.NoError(t, c.ReloadConfigString("relay:\n  quota:\n    peer: nope\n"))
+	assert.False(t, rq.Allow(other, 1))
+	assert.True(t, rq.Allow(newHostInfo(5), 2000))
+}
+
+func TestParseRelayQuotaLimit(t *testing.T) {
+	limit, err := parseRelayQuotaLimit(nil)
+	assert.NoError(t, err)
+	assert.True(t, limit.unlimited())
+
+	limit, err = parseRelayQuotaLimit(map[interface{}]interface{}{"bytes_per_sec": 10, "window": "5m", "window_bytes": 20})
+	assert.NoError(t, err)
+	assert.Equal(t, relayQuotaLimit{bytesPerSec: 10, window: 5 * time.Minute, windowBytes: 20}, limit)
+
+	// Numbers given as strings are fine
+	limit, err = parseRelayQuotaLimit(map[interface{}]interface{}{"bytes_per_sec": "10"})
+	assert.NoError(t, err)
+	assert.Equal(t, relayQuotaLimit{bytesPerSec: 10}, limit)
+
+	_, err = parseRelayQuotaLimit(map[interface{}]interface{}{"bytes_per_sec": -1})
+	assert.EqualError(t, err, "bytes_per_sec must be a positive integer, got -1")
+
+	_, err = parseRelayQuotaLimit(map[interface{}]interface{}{"window_bytes": 1.5})
+	assert.EqualError(t, err, "window_bytes must be a positive integer, got 1.5")
+
+	_, err = parseRelayQuotaLimit(map[interface{}]interface{}{"window_bytes": "lots"})
+	assert.EqualError(t, err, "window_bytes must be a positive integer, got lots")
+
+	_, err = parseRelayQuotaLimit(map[interface{}]interface{}{"window": "-1m"})
+	assert.EqualError(t, err, "window must be a positive duration, got -1m")
+
+	_, err = parseRelayQuotaLimit(map[interface{}]interface{}{"window": "nope"})
+	assert.Error(t, err)
+
+	_, err = parseRelayQuotaLimit(map[interface{}]interface{}{"burst": 1})
+	assert.EqualError(t, err, "unknown key burst")
+
+	_, err = parseRelayQuotaLimit("1000")
+	assert.EqualError(t, err, "must be a map, got string")
+}
@@ -13,6 +13,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/stream"
 	"github.com/slackhq/nebula/udp"
 )
 
@@ -22,6 +23,7 @@ type forEachFunc func(addr *udp.Addr, preferred bool)
 // The checkFuncs here are to simplify bulk importing LH query response logic into a single function (reset slice and iterate)
 type checkFuncV4 func(vpnIp iputil.VpnIp, to *Ip4AndPort) bool
 type checkFuncV6 func(vpnIp iputil.VpnIp, to *Ip6AndPort) bool
+type checkFuncStream func(vpnIp iputil.VpnIp, to *StreamAddr) bool
 
 // CacheMap is a struct that better represents the lighthouse cache for humans
 // The string key is the owners vpnIp
@@ -33,6 +35,7 @@ type Cache struct {
 	Learned  []*udp.Addr `json:"learned,omitempty"`
 	Reported []*udp.Addr `json:"reported,omitempty"`
 	Relay    []*net.IP   `json:"relay"`
+	Stream   []*udp.Addr `json:"stream,omitempty"`
 }
 
 //TODO: Seems like we should plop static host entries in here too since the are protected by the lighthouse from deletion
@@ -40,9 +43,15 @@ type Cache struct {
 
 // cache is an internal struct that splits v4 and v6 addresses inside the cache map
 type cache struct {
-	v4    *cacheV4
-	v6    *cacheV6
-	relay *cacheRelay
+	v4     *cacheV4
+	v6     *cacheV6
+	relay  *cacheRelay
+	stream *cacheStream
+}
+
+// cacheStream stores the reported addresses a host accepts tcp or tls streams on
+type cacheStream struct {
+	reported []*StreamAddr
 }
 
 type cacheRelay struct {
@@ -186,6 +195,12 @@ func (hr *hostnamesResults) GetIPs() []netip.AddrPort {
 	return retSlice
 }
 
+// streamHostnames is a static_host_map entry we dial over a stream and the addresses its name resolves to
+type streamHostnames struct {
+	remote stream.Remote
+	hr     *hostnamesResults
+}
+
 // RemoteList is a unifying concept for lighthouse servers and clients as well as hostinfos.
 // It serves as a local cache of query replies, host update notifications, and locally learned addresses
 type RemoteList struct {
@@ -206,6 +221,12 @@ type RemoteList struct {
 	hr        *hostnamesResults
 	shouldAdd func(netip.Addr) bool
 
+	// A deduplicated set of addresses the remote accepts streams on, only used when udp is not getting through
+	streams []stream.Remote
+
+	// The static_host_map entries to be dialed over a stream
+	streamHrs []*streamHostnames
+
 	// This is a list of remotes that we have tried to handshake with and have returned from the wrong vpn ip.
 	// They should not be tried again during a handshake
 	badRemotes []*udp.Addr
@@ -230,6 +251,14 @@ func (r *RemoteList) unlockedSetHostnamesResults(hr *hostnamesResults) {
 	r.hr = hr
 }
 
+func (r *RemoteList) unlockedSetStreamHostnames(shs []*streamHostnames) {
+	for _, sh := range r.streamHrs {
+		sh.hr.Cancel()
+	}
+	r.streamHrs = shs
+	r.shouldRebuild = true
+}
+
 // Len locks and reports the size of the deduplicated address list
 // The deduplication work may need to occur here, so you must pass preferredRanges
 func (r *RemoteList) Len(preferredRanges []*net.IPNet) int {
@@ -250,6 +279,42 @@ func (r *RemoteList) ForEach(preferredRanges []*net.IPNet, forEach forEachFunc)
 	r.RUnlock()
 }
 
+// CopyRelays locks and makes a deep copy of the relay vpn ips the remote has identified
+// The deduplication work may need to occur here, so you must pass preferredRanges
+func (r *RemoteList) CopyRelays(preferredRanges []*net.IPNet) []iputil.VpnIp {
+	if r == nil {
+		return nil
+	}
+
+	r.Rebuild(preferredRanges)
+
+	r.RLock()
+	defer r.RUnlock()
+	c := make([]iputil.VpnIp, len(r.relays))
+	for i, v := range r.relays {
+		c[i] = *v
+	}
+	return c
+}
+
+// CopyStreams locks and makes a deep copy of the deduplicated stream address list
+func (r *RemoteList) CopyStreams(preferredRanges []*net.IPNet) []stream.Remote {
+	if r == nil {
+		return nil
+	}
+
+	r.Rebuild(preferredRanges)
+
+	r.RLock()
+	defer r.RUnlock()
+	c := make([]stream.Remote, len(r.streams))
+	for i, v := range r.streams {
+		c[i] = v
+		c[i].Addr = v.Addr.Copy()
+	}
+	return c
+}
+
 // CopyAddrs locks and makes a deep copy of the deduplicated address list
 // The deduplication work may need to occur here, so you must pass preferredRanges
 func (r *RemoteList) CopyAddrs(preferredRanges []*net.IPNet) []*udp.Addr {
@@ -331,6 +396,14 @@ func (r *RemoteList) CopyCache() *CacheMap {
 				c.Relay = append(c.Relay, &nip)
 			}
 		}
+
+		if mc.stream != nil {
+			for _, a := range mc.stream.reported {
+				if u := NewUDPAddrFromStreamAddr(a); u != nil {
+					c.Stream = append(c.Stream, u)
+				}
+			}
+		}
 	}
 
 	return &cm
@@ -488,6 +561,40 @@ func (r *RemoteList) unlockedPrependV6(ownerVpnIp iputil.VpnIp, to *Ip6AndPort)
 	}
 }
 
+// unlockedSetStream assumes you have the write lock and resets the reported list of stream addresses for this owner
+// to the list provided and marks the deduplicated address list as dirty
+func (r *RemoteList) unlockedSetStream(ownerVpnIp iputil.VpnIp, vpnIp iputil.VpnIp, to []*StreamAddr, check checkFuncStream) {
+	if len(to) == 0 && (r.cache[ownerVpnIp] == nil || r.cache[ownerVpnIp].stream == nil) {
+		// Avoid occupying memory for stream addresses if we never have any
+		return
+	}
+
+	r.shouldRebuild = true
+	c := r.unlockedGetOrMakeStream(ownerVpnIp)
+
+	// Reset the slice
+	c.reported = c.reported[:0]
+
+	// We can't take their array but we can take their pointers
+	for _, v := range to[:minInt(len(to), MaxRemotes)] {
+		if check(vpnIp, v) {
+			c.reported = append(c.reported, v)
+		}
+	}
+}
+
+func (r *RemoteList) unlockedGetOrMakeStream(ownerVpnIp iputil.VpnIp) *cacheStream {
+	am := r.cache[ownerVpnIp]
+	if am == nil {
+		am = &cache{}
+		r.cache[ownerVpnIp] = am
+	}
+	if am.stream == nil {
+		am.stream = &cacheStream{}
+	}
+	return am.stream
+}
+
 func (r *RemoteList) unlockedGetOrMakeRelay(ownerVpnIp iputil.VpnIp) *cacheRelay {
 	am := r.cache[ownerVpnIp]
 	if am == nil {
@@ -536,6 +643,7 @@ func (r *RemoteList) unlockedGetOrMakeV6(ownerVpnIp iputil.VpnIp) *cacheV6 {
 func (r *RemoteList) unlockedCollect() {
 	addrs := r.addrs[:0]
 	relays := r.relays[:0]
+	streams := r.streams[:0]
 
 	for _, c := range r.cache {
 		if c.v4 != nil {
@@ -576,6 +684,25 @@ func (r *RemoteList) unlockedCollect() {
 				relays = append(relays, &ip)
 			}
 		}
+
+		if c.stream != nil {
+			for _, v := range c.stream.reported {
+				if u := NewUDPAddrFromStreamAddr(v); u != nil {
+					streams = append(streams, stream.Remote{Addr: u, TLS: v.Tls, Path: v.Path})
+				}
+			}
+		}
+	}
+
+	for _, sh := range r.streamHrs {
+		for _, addr := range sh.hr.GetIPs() {
+			if r.shouldAdd == nil || r.shouldAdd(addr.Addr()) {
+				v6 := addr.Addr().As16()
+				s := sh.remote
+				s.Addr = &udp.Addr{IP: v6[:], Port: addr.Port()}
+				streams = append(streams, s)
+			}
+		}
 	}
 
 	dnsAddrs := r.hr.GetIPs()
@@ -591,6 +718,7 @@ func (r *RemoteList) unlockedCollect() {
 
 	r.addrs = addrs
 	r.relays = relays
+	r.streams = dedupeStreams(streams)
 
 }
 
@@ -713,3 +841,21 @@ func isPrivateIP(ip net.IP) bool {
 	//TODO: Private for ipv6 or just let it ride?
 	return private24BitBlock.Contains(ip) || private20BitBlock.Contains(ip) || private16BitBlock.Contains(ip)
 }
+
+// dedupeStreams removes repeated stream addresses, keeping the first
+func dedupeStreams(streams []stream.Remote) []stream.Remote {
+	out := streams[:0]
+	for _, v := range streams {
+		dupe := false
+		for _, o := range out {
+			if o.Addr.Equals(v.Addr) {
+				dupe = true
+				break
+			}
+		}
+		if !dupe {
+			out = append(out, v)
+		}
+	}
+	return out
+}
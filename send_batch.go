@@ -0,0 +1,78 @@
+package nebula
+
+import (
+	"github.com/slackhq/nebula/udp"
+)
+
+// sendBatch holds the packets a listenIn routine encrypted from one batch of tun reads so they can be handed to the
+// udp sockets together, letting them use sendmmsg and gso where they can
+type sendBatch struct {
+	bufs [][]byte
+
+	conns []udp.Conn
+	out   [][]byte
+	addrs []*udp.Addr
+
+	// connOut and connAddrs hold the packets for a single conn while flushing
+	connOut   [][]byte
+	connAddrs []*udp.Addr
+}
+
+func newSendBatch(n int) *sendBatch {
+	b := &sendBatch{
+		bufs:      make([][]byte, n),
+		conns:     make([]udp.Conn, 0, n),
+		out:       make([][]byte, 0, n),
+		addrs:     make([]*udp.Addr, 0, n),
+		connOut:   make([][]byte, 0, n),
+		connAddrs: make([]*udp.Addr, 0, n),
+	}
+
+	for i := range b.bufs {
+		b.bufs[i] = make([]byte, mtu)
+	}
+
+	return b
+}
+
+// next returns the buffer to encrypt the next packet into, it is owned by the batch until the next flush if the packet
+// is added
+func (b *sendBatch) next() []byte {
+	return b.bufs[len(b.out)]
+}
+
+// add queues p, which must have been encrypted into the buffer from next, to be written to addr on conn
+func (b *sendBatch) add(conn udp.Conn, addr *udp.Addr, p []byte) {
+	b.conns = append(b.conns, conn)
+	b.out = append(b.out, p)
+	b.addrs = append(b.addrs, addr)
+}
+
+// flushSendBatch writes every queued packet, keeping the order of the packets sent on each conn
+func (f *Interface) flushSendBatch(b *sendBatch) {
+	for i, conn := range b.conns {
+		if conn == nil {
+			continue
+		}
+
+		b.connOut = b.connOut[:0]
+		b.connAddrs = b.connAddrs[:0]
+		for j := i; j < len(b.conns); j++ {
+			if b.conns[j] == conn {
+				b.connOut = append(b.connOut, b.out[j])
+				b.connAddrs = append(b.connAddrs, b.addrs[j])
+				b.conns[j] = nil
+			}
+		}
+
+		sent, err := conn.WriteBatch(b.connOut, b.connAddrs)
+		if err != nil {
+			f.l.WithError(err).WithField("sent", sent).WithField("packets", len(b.connOut)).
+				Error("Failed to write outgoing packets")
+		}
+	}
+
+	b.conns = b.conns[:0]
+	b.out = b.out[:0]
+	b.addrs = b.addrs[:0]
+}
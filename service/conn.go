@@ -0,0 +1,74 @@
+package service
+
+import (
+	"net"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/iputil"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+// Peer is implemented by the connections the service accepts and dials, it tells which host is at the other end
+type Peer interface {
+	// PeerCertificate returns the certificate the remote host had when the connection was made, or nil if there was
+	// no tunnel to its address
+	PeerCertificate() *cert.NebulaCertificate
+}
+
+// TCPConn is a tcp connection over nebula
+type TCPConn struct {
+	*gonet.TCPConn
+	cert    *cert.NebulaCertificate
+	release func()
+}
+
+func (c *TCPConn) PeerCertificate() *cert.NebulaCertificate {
+	return c.cert
+}
+
+func (c *TCPConn) Close() error {
+	err := c.TCPConn.Close()
+	c.release()
+	return err
+}
+
+// UDPConn is a udp socket over nebula, only a connected socket has a peer
+type UDPConn struct {
+	*gonet.UDPConn
+	cert    *cert.NebulaCertificate
+	release func()
+}
+
+func (c *UDPConn) PeerCertificate() *cert.NebulaCertificate {
+	return c.cert
+}
+
+func (c *UDPConn) Close() error {
+	err := c.UDPConn.Close()
+	c.release()
+	return err
+}
+
+// CertificateOf returns the certificate of the host we have a tunnel with at addr, or nil if there is none. It tells
+// who sent each packet read from a net.PacketConn.
+func (s *Service) CertificateOf(addr net.Addr) *cert.NebulaCertificate {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return s.certificateOf(a.IP)
+	case *net.UDPAddr:
+		return s.certificateOf(a.IP)
+	}
+	return nil
+}
+
+func (s *Service) certificateOf(ip net.IP) *cert.NebulaCertificate {
+	if ip.To4() == nil {
+		return nil
+	}
+
+	h := s.control.GetHostInfoByVpnIp(iputil.Ip2VpnIp(ip), false)
+	if h == nil {
+		return nil
+	}
+	return h.Cert
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+)
+
+type peerCertificateKey struct{}
+
+// Transport returns an http.Transport that makes every connection over nebula, hosts in urls may be given by the name
+// in their certificate, see Resolve.
+func (s *Service) Transport() *http.Transport {
+	return &http.Transport{
+		DialContext:           s.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// ListenAndServe serves h over http on address, a port of our nebula ip like ":80". The certificate of the host that
+// sent each request is in its context, see PeerCertificate. It returns when the listener is closed.
+func (s *Service) ListenAndServe(address string, h http.Handler) error {
+	ln, err := s.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if p, ok := c.(Peer); ok && p.PeerCertificate() != nil {
+				ctx = context.WithValue(ctx, peerCertificateKey{}, p.PeerCertificate())
+			}
+			return ctx
+		},
+	}
+	return srv.Serve(ln)
+}
+
+// PeerCertificate returns the nebula certificate of the host that sent a request served by ListenAndServe, or nil if
+// it is not known
+func PeerCertificate(ctx context.Context) *cert.NebulaCertificate {
+	crt, _ := ctx.Value(peerCertificateKey{}).(*cert.NebulaCertificate)
+	return crt
+}
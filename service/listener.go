@@ -1,31 +1,40 @@
 package service
 
 import (
-	"io"
 	"net"
+	"net/netip"
+	"sync"
 )
 
 type tcpListener struct {
-	port   uint16
+	key    netip.AddrPort
 	s      *Service
 	addr   *net.TCPAddr
 	accept chan net.Conn
+	done   chan struct{}
+	once   sync.Once
 }
 
 func (l *tcpListener) Accept() (net.Conn, error) {
-	conn, ok := <-l.accept
-	if !ok {
-		return nil, io.EOF
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
 	}
-	return conn, nil
 }
 
 func (l *tcpListener) Close() error {
-	l.s.mu.Lock()
-	defer l.s.mu.Unlock()
-	delete(l.s.mu.listeners, uint16(l.addr.Port))
+	l.once.Do(func() {
+		l.s.mu.Lock()
+		defer l.s.mu.Unlock()
+		if l.s.mu.listeners[l.key] == l {
+			delete(l.s.mu.listeners, l.key)
+			l.s.unlockedReleaseAddr(l.key.Addr())
+		}
 
-	close(l.accept)
+		close(l.done)
+	})
 
 	return nil
 }
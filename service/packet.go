@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// ListenPacket listens for udp on the provided address, the port may be 0 to pick one. Both wildcard and specific
+// addresses are supported.
+func (s *Service) ListenPacket(network, address string) (net.PacketConn, error) {
+	if network != "udp" && network != "udp4" && network != "udp6" {
+		return nil, errors.New("only udp is supported")
+	}
+
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkIPv4(network, addr.IP); err != nil {
+		return nil, err
+	}
+
+	local := localAddr(addr.IP)
+	s.mu.Lock()
+	if s.mu.closed {
+		s.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	err = s.unlockedClaimAddr(local)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	laddr := fullAddress(addr.IP, addr.Port)
+	c, err := gonet.DialUDP(s.ipstack, &laddr, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		s.mu.Lock()
+		s.unlockedReleaseAddr(local)
+		s.mu.Unlock()
+		return nil, err
+	}
+
+	conn := &UDPConn{UDPConn: c}
+	conn.release, err = s.track(conn, false, local)
+	if err != nil {
+		c.Close()
+		s.mu.Lock()
+		s.unlockedReleaseAddr(local)
+		s.mu.Unlock()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// DialUDP opens a udp socket from laddr, a local address is picked when it is nil. When raddr is set the socket is
+// connected to it and can be used as a net.Conn, otherwise it is only a net.PacketConn. Like ListenPacket laddr may be
+// a wildcard, our nebula ip or an address in one of the unsafe route subnets of our certificate.
+func (s *Service) DialUDP(laddr, raddr *net.UDPAddr) (*UDPConn, error) {
+	var la, ra *tcpip.FullAddress
+	var crt *cert.NebulaCertificate
+	var local netip.Addr
+	if laddr != nil {
+		if err := checkIPv4("udp", laddr.IP); err != nil {
+			return nil, err
+		}
+		a := fullAddress(laddr.IP, laddr.Port)
+		la = &a
+		local = localAddr(laddr.IP)
+	}
+	if raddr != nil {
+		if err := checkIPv4("udp", raddr.IP); err != nil {
+			return nil, err
+		}
+		a := fullAddress(raddr.IP, raddr.Port)
+		ra = &a
+		crt = s.certificateOf(raddr.IP)
+	}
+
+	s.mu.Lock()
+	if s.mu.closed {
+		s.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	err := s.unlockedClaimAddr(local)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := gonet.DialUDP(s.ipstack, la, ra, ipv4.ProtocolNumber)
+	if err != nil {
+		s.mu.Lock()
+		s.unlockedReleaseAddr(local)
+		s.mu.Unlock()
+		return nil, err
+	}
+
+	conn := &UDPConn{UDPConn: c, cert: crt}
+	conn.release, err = s.track(conn, raddr != nil, local)
+	if err != nil {
+		c.Close()
+		s.mu.Lock()
+		s.unlockedReleaseAddr(local)
+		s.mu.Unlock()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Ping sends an icmp echo request to address and waits for the reply until ctx is done, it returns the round trip
+// time. Echo requests sent to us are always answered by the netstack.
+func (s *Service) Ping(ctx context.Context, address string) (time.Duration, error) {
+	addr, err := net.ResolveIPAddr("ip4", address)
+	if err != nil {
+		return 0, err
+	}
+
+	var wq waiter.Queue
+	ep, tcpipErr := s.ipstack.NewEndpoint(icmp.ProtocolNumber4, ipv4.ProtocolNumber, &wq)
+	if tcpipErr != nil {
+		return 0, fmt.Errorf("could not create icmp endpoint: %v", tcpipErr)
+	}
+	if tcpipErr := ep.Connect(fullAddress(addr.IP, 0)); tcpipErr != nil {
+		ep.Close()
+		return 0, fmt.Errorf("could not connect icmp endpoint: %v", tcpipErr)
+	}
+
+	conn := gonet.NewUDPConn(&wq, ep)
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	// The netstack fills in the ident and checksum, like a linux ping socket
+	seq := uint16(rand.Intn(1 << 16))
+	req := header.ICMPv4(make([]byte, header.ICMPv4MinimumSize+8))
+	req.SetType(header.ICMPv4Echo)
+	req.SetSequence(seq)
+	copy(req.Payload(), "nebula\x00\x00")
+
+	start := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+
+	b := make([]byte, header.ICMPv4MinimumSize+len(req.Payload()))
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			return 0, err
+		}
+
+		reply := header.ICMPv4(b[:n])
+		if n >= header.ICMPv4MinimumSize && reply.Type() == header.ICMPv4EchoReply && reply.Sequence() == seq {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// fullAddress returns the netstack address for ip and port, an unspecified ip means any local address. ip must have
+// passed checkIPv4.
+func fullAddress(ip net.IP, port int) tcpip.FullAddress {
+	a := tcpip.FullAddress{NIC: nicID, Port: uint16(port)}
+	if ip == nil || ip.IsUnspecified() {
+		return a
+	}
+	a.Addr = tcpip.AddrFromSlice(ip.To4())
+	return a
+}
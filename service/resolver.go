@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Resolve returns the nebula ip for host. Ip addresses are returned as they are, names are matched against the
+// certificates of the hosts we have tunnels with, then looked up with the DNS responder of each lighthouse and finally
+// with the system resolver.
+func (s *Service) Resolve(ctx context.Context, host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+
+	name := strings.TrimSuffix(host, ".")
+	for _, h := range s.control.ListHostmapHosts(false) {
+		if h.Cert != nil && strings.EqualFold(h.Cert.Details.Name, name) {
+			return h.VpnIp, nil
+		}
+	}
+
+	for _, r := range s.resolvers {
+		ips, err := r.LookupIP(ctx, "ip4", name+".")
+		if err == nil && len(ips) > 0 {
+			return ips[0], nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses found for %q", host)
+	}
+	return ips[0], nil
+}
+
+// lighthouseResolvers returns a resolver for every lighthouse that asks its DNS responder over nebula
+func (s *Service) lighthouseResolvers(lighthouses []string, port int) []*net.Resolver {
+	var resolvers []*net.Resolver
+	for _, lh := range lighthouses {
+		if net.ParseIP(lh) == nil {
+			continue
+		}
+
+		addr := net.JoinHostPort(lh, strconv.Itoa(port))
+		resolvers = append(resolvers, &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return s.DialContext(ctx, "udp", addr)
+			},
+		})
+	}
+	return resolvers
+}
+
+// resolveAddr resolves the host in a host:port address with Resolve, an empty host returns a nil ip
+func (s *Service) resolveAddr(ctx context.Context, network, address string) (net.IP, int, error) {
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	port, err := net.DefaultResolver.LookupPort(ctx, network, p)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if host == "" {
+		return nil, port, nil
+	}
+
+	ip, err := s.Resolve(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ip, port, nil
+}
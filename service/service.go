@@ -5,19 +5,22 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"net"
+	"net/netip"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/overlay"
 	"golang.org/x/sync/errgroup"
-	"gvisor.dev/gvisor/pkg/bufferv2"
+	"gvisor.dev/gvisor/pkg/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
@@ -33,18 +36,51 @@ import (
 
 const nicID = 1
 
+const (
+	defaultQueueSize    = 512
+	defaultDrainTimeout = 5 * time.Second
+)
+
+// ErrIPv6NotSupported is returned for ipv6 networks and addresses, nebula only carries ipv4
+var ErrIPv6NotSupported = errors.New("ipv6 not supported")
+
 type Service struct {
 	eg      *errgroup.Group
 	control *nebula.Control
 	ipstack *stack.Stack
 
+	// vpnIp is our nebula ip, subnets are the unsafe route subnets in our certificate we may also listen on
+	vpnIp   netip.Addr
+	subnets []*net.IPNet
+
+	// resolvers ask the DNS responder of each lighthouse for nebula names
+	resolvers []*net.Resolver
+
+	tcpOpts      tcpOptions
+	drainTimeout time.Duration
+
 	mu struct {
 		sync.Mutex
 
-		listeners map[uint16]*tcpListener
+		// listeners are keyed by address and port, a wildcard listener has an invalid address
+		listeners map[netip.AddrPort]*tcpListener
+		// addrs counts the listeners on each address we added to the netstack for them
+		addrs map[netip.Addr]int
+		// conns are drained on Close, sockets are closed right away
+		conns   map[io.Closer]struct{}
+		sockets map[io.Closer]struct{}
+		closed  bool
 	}
 }
 
+// tcpOptions are applied to every tcp connection we accept or dial
+type tcpOptions struct {
+	keepalive bool
+	idle      time.Duration
+	interval  time.Duration
+	count     int
+}
+
 func New(config *config.C) (*Service, error) {
 	logger := logrus.New()
 	logger.Out = os.Stdout
@@ -60,8 +96,19 @@ func New(config *config.C) (*Service, error) {
 	s := Service{
 		eg:      eg,
 		control: control,
+		tcpOpts: tcpOptions{
+			keepalive: config.GetBool("service.tcp.keepalive", true),
+			idle:      config.GetDuration("service.tcp.keepalive_idle", 0),
+			interval:  config.GetDuration("service.tcp.keepalive_interval", 0),
+			count:     config.GetInt("service.tcp.keepalive_count", 0),
+		},
+		drainTimeout: config.GetDuration("service.drain_timeout", defaultDrainTimeout),
 	}
-	s.mu.listeners = map[uint16]*tcpListener{}
+	s.mu.listeners = map[netip.AddrPort]*tcpListener{}
+	s.mu.addrs = map[netip.Addr]int{}
+	s.mu.conns = map[io.Closer]struct{}{}
+	s.mu.sockets = map[io.Closer]struct{}{}
+	s.resolvers = s.lighthouseResolvers(config.GetStringSlice("lighthouse.hosts", nil), config.GetInt("lighthouse.dns.port", 53))
 
 	device, ok := control.Device().(*overlay.UserDevice)
 	if !ok {
@@ -72,16 +119,17 @@ func New(config *config.C) (*Service, error) {
 		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
 		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
 	})
-	sackEnabledOpt := tcpip.TCPSACKEnabled(true) // TCP SACK is disabled by default
-	tcpipErr := s.ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &sackEnabledOpt)
-	if tcpipErr != nil {
-		return nil, fmt.Errorf("could not enable TCP SACK: %v", tcpipErr)
+	if err := configureTCP(s.ipstack, config); err != nil {
+		return nil, err
 	}
-	linkEP := channel.New( /*size*/ 512 /*mtu*/, 1280, "")
+
+	mtu := config.GetInt("tun.mtu", overlay.DefaultMTU)
+	linkEP := channel.New(config.GetInt("service.queue_size", defaultQueueSize), uint32(mtu), "")
 	if tcpipProblem := s.ipstack.CreateNIC(nicID, linkEP); tcpipProblem != nil {
 		return nil, fmt.Errorf("could not create netstack NIC: %v", tcpipProblem)
 	}
-	ipv4Subnet, _ := tcpip.NewSubnet(tcpip.Address(strings.Repeat("\x00", 4)), tcpip.AddressMask(strings.Repeat("\x00", 4)))
+	// nebula only carries ipv4 so that is all the netstack routes
+	ipv4Subnet, _ := tcpip.NewSubnet(tcpip.AddrFrom4([4]byte{}), tcpip.MaskFromBytes(make([]byte, 4)))
 	s.ipstack.SetRouteTable([]tcpip.Route{
 		{
 			Destination: ipv4Subnet,
@@ -90,8 +138,10 @@ func New(config *config.C) (*Service, error) {
 	})
 
 	ipNet := device.Cidr()
+	s.vpnIp, _ = netip.AddrFromSlice(ipNet.IP.To4())
+	s.subnets = control.GetCertificate().Details.Subnets
 	pa := tcpip.ProtocolAddress{
-		AddressWithPrefix: tcpip.Address(ipNet.IP).WithPrefix(),
+		AddressWithPrefix: tcpip.AddrFromSlice(ipNet.IP.To4()).WithPrefix(),
 		Protocol:          ipv4.ProtocolNumber,
 	}
 	if err := s.ipstack.AddProtocolAddress(nicID, pa, stack.AddressProperties{
@@ -101,19 +151,15 @@ func New(config *config.C) (*Service, error) {
 		return nil, fmt.Errorf("error creating IP: %s", err)
 	}
 
-	const tcpReceiveBufferSize = 0
 	const maxInFlightConnectionAttempts = 1024
+	tcpReceiveBufferSize := config.GetInt("service.tcp.receive_buffer", 0)
 	tcpFwd := tcp.NewForwarder(s.ipstack, tcpReceiveBufferSize, maxInFlightConnectionAttempts, s.tcpHandler)
 	s.ipstack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpFwd.HandlePacket)
 
+	// the pipes are closed by nebula when the interface is closed, closing them here on ctx.Done would race with
+	// nebula marking itself closed and the tun reader would take the EOF as fatal
 	reader, writer := device.Pipe()
 
-	go func() {
-		<-ctx.Done()
-		reader.Close()
-		writer.Close()
-	}()
-
 	// create Goroutines to forward packets between Nebula and Gvisor
 	eg.Go(func() error {
 		buf := make([]byte, header.IPv4MaximumHeaderSize+header.IPv4MaximumPayloadSize)
@@ -123,10 +169,13 @@ func New(config *config.C) (*Service, error) {
 			if err != nil {
 				return err
 			}
-			packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
-				Payload: bufferv2.MakeWithData(bytes.Clone(buf[:n])),
-			})
-			linkEP.InjectInbound(header.IPv4ProtocolNumber, packetBuf)
+			if n > 0 && buf[0]>>4 == header.IPv4Version {
+				packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
+					Payload: buffer.MakeWithData(bytes.Clone(buf[:n])),
+				})
+				linkEP.InjectInbound(header.IPv4ProtocolNumber, packetBuf)
+				packetBuf.DecRef()
+			}
 
 			if err := ctx.Err(); err != nil {
 				return err
@@ -136,13 +185,14 @@ func New(config *config.C) (*Service, error) {
 	eg.Go(func() error {
 		for {
 			packet := linkEP.ReadContext(ctx)
-			if packet.IsNil() {
+			if packet == nil {
 				if err := ctx.Err(); err != nil {
 					return err
 				}
 				continue
 			}
 			bufView := packet.ToView()
+			packet.DecRef()
 			if _, err := bufView.WriteTo(writer); err != nil {
 				return err
 			}
@@ -153,38 +203,138 @@ func New(config *config.C) (*Service, error) {
 	return &s, nil
 }
 
-// DialContext dials the provided address. Currently only TCP is supported.
+// configureTCP applies the service.tcp settings to the netstack
+func configureTCP(ipstack *stack.Stack, c *config.C) error {
+	sackEnabledOpt := tcpip.TCPSACKEnabled(c.GetBool("service.tcp.sack", true)) // TCP SACK is disabled by default
+	if tcpipErr := ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &sackEnabledOpt); tcpipErr != nil {
+		return fmt.Errorf("could not set TCP SACK: %v", tcpipErr)
+	}
+
+	ccOpt := tcpip.CongestionControlOption(c.GetString("service.tcp.congestion_control", "reno"))
+	if tcpipErr := ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &ccOpt); tcpipErr != nil {
+		return fmt.Errorf("could not set TCP congestion control to %q: %v", ccOpt, tcpipErr)
+	}
+
+	if size := c.GetInt("service.tcp.send_buffer", 0); size > 0 {
+		var opt tcpip.TCPSendBufferSizeRangeOption
+		if tcpipErr := ipstack.TransportProtocolOption(tcp.ProtocolNumber, &opt); tcpipErr != nil {
+			return fmt.Errorf("could not get TCP send buffer size: %v", tcpipErr)
+		}
+		opt.Default, opt.Max = size, max(opt.Max, size)
+		if tcpipErr := ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); tcpipErr != nil {
+			return fmt.Errorf("could not set TCP send buffer size: %v", tcpipErr)
+		}
+	}
+
+	if size := c.GetInt("service.tcp.receive_buffer", 0); size > 0 {
+		var opt tcpip.TCPReceiveBufferSizeRangeOption
+		if tcpipErr := ipstack.TransportProtocolOption(tcp.ProtocolNumber, &opt); tcpipErr != nil {
+			return fmt.Errorf("could not get TCP receive buffer size: %v", tcpipErr)
+		}
+		opt.Default, opt.Max = size, max(opt.Max, size)
+		if tcpipErr := ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); tcpipErr != nil {
+			return fmt.Errorf("could not set TCP receive buffer size: %v", tcpipErr)
+		}
+	}
+
+	return nil
+}
+
+// apply sets the keepalive options on a tcp endpoint
+func (o tcpOptions) apply(ep tcpip.Endpoint) {
+	if !o.keepalive {
+		return
+	}
+
+	ep.SocketOptions().SetKeepAlive(true)
+	if o.idle > 0 {
+		opt := tcpip.KeepaliveIdleOption(o.idle)
+		_ = ep.SetSockOpt(&opt)
+	}
+	if o.interval > 0 {
+		opt := tcpip.KeepaliveIntervalOption(o.interval)
+		_ = ep.SetSockOpt(&opt)
+	}
+	if o.count > 0 {
+		_ = ep.SetSockOptInt(tcpip.KeepaliveCountOption, o.count)
+	}
+}
+
+// DialContext dials the provided address. Currently only TCP and UDP are supported. Hosts may be given by the name
+// in their certificate, see Resolve.
 func (s *Service) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
-	if network != "tcp" && network != "tcp4" {
-		return nil, errors.New("only tcp is supported")
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return nil, errors.New("only tcp and udp are supported")
 	}
 
-	addr, err := net.ResolveTCPAddr(network, address)
+	ip, port, err := s.resolveAddr(ctx, network, address)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkIPv4(network, ip); err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(network, "udp") {
+		return s.DialUDP(nil, &net.UDPAddr{IP: ip, Port: port})
+	}
 
-	fullAddr := tcpip.FullAddress{
-		NIC:  nicID,
-		Addr: tcpip.Address(addr.IP),
-		Port: uint16(addr.Port),
+	return s.dialTCP(ctx, network, ip, port)
+}
+
+// dialTCP connects to ip and port with our tcp options set before the handshake
+func (s *Service) dialTCP(ctx context.Context, network string, ip net.IP, port int) (*TCPConn, error) {
+	var err error
+	var wq waiter.Queue
+	ep, tcpipErr := s.ipstack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if tcpipErr != nil {
+		return nil, errors.New(tcpipErr.String())
+	}
+	s.tcpOpts.apply(ep)
+
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.WritableEvents)
+	wq.EventRegister(&waitEntry)
+	defer wq.EventUnregister(&waitEntry)
+
+	raddr := fullAddress(ip, port)
+	tcpipErr = ep.Connect(raddr)
+	if _, ok := tcpipErr.(*tcpip.ErrConnectStarted); ok {
+		select {
+		case <-ctx.Done():
+			ep.Close()
+			return nil, ctx.Err()
+		case <-notifyCh:
+		}
+		tcpipErr = ep.LastError()
+	}
+	if tcpipErr != nil {
+		ep.Close()
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: &net.TCPAddr{IP: ip, Port: port}, Err: errors.New(tcpipErr.String())}
 	}
 
-	return gonet.DialContextTCP(ctx, s.ipstack, fullAddr, ipv4.ProtocolNumber)
+	c := &TCPConn{TCPConn: gonet.NewTCPConn(&wq, ep), cert: s.certificateOf(ip)}
+	c.release, err = s.track(c, true, netip.Addr{})
+	if err != nil {
+		c.TCPConn.Close()
+		return nil, err
+	}
+	return c, nil
 }
 
-// Listen listens on the provided address. Currently only TCP with wildcard
-// addresses are supported.
+// Listen listens on the provided address. Currently only TCP is supported. The address may be a wildcard, our nebula
+// ip or an address in one of the unsafe route subnets of our certificate.
 func (s *Service) Listen(network, address string) (net.Listener, error) {
-	if network != "tcp" && network != "tcp4" {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
 		return nil, errors.New("only tcp is supported")
 	}
 	addr, err := net.ResolveTCPAddr(network, address)
 	if err != nil {
 		return nil, err
 	}
-	if addr.IP != nil && !bytes.Equal(addr.IP, []byte{0, 0, 0, 0}) {
-		return nil, fmt.Errorf("only wildcard address supported, got %q %v", address, addr.IP)
+	if err := checkIPv4(network, addr.IP); err != nil {
+		return nil, err
 	}
 	if addr.Port == 0 {
 		return nil, errors.New("specific port required, got 0")
@@ -192,22 +342,29 @@ func (s *Service) Listen(network, address string) (net.Listener, error) {
 	if addr.Port < 0 || addr.Port >= math.MaxUint16 {
 		return nil, fmt.Errorf("invalid port %d", addr.Port)
 	}
-	port := uint16(addr.Port)
 
+	key := netip.AddrPortFrom(localAddr(addr.IP), uint16(addr.Port))
 	l := &tcpListener{
-		port:   port,
+		key:    key,
 		s:      s,
 		addr:   addr,
 		accept: make(chan net.Conn),
+		done:   make(chan struct{}),
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, ok := s.mu.listeners[port]; ok {
-		return nil, fmt.Errorf("already listening on port %d", port)
+	if s.mu.closed {
+		return nil, net.ErrClosed
+	}
+	if _, ok := s.mu.listeners[key]; ok {
+		return nil, fmt.Errorf("already listening on %v", address)
 	}
-	s.mu.listeners[port] = l
+	if err := s.unlockedClaimAddr(key.Addr()); err != nil {
+		return nil, err
+	}
+	s.mu.listeners[key] = l
 
 	return l, nil
 }
@@ -216,33 +373,216 @@ func (s *Service) Wait() error {
 	return s.eg.Wait()
 }
 
+// Close stops accepting connections, waits up to service.drain_timeout for the open ones to be closed and then
+// closes what is left and stops nebula
 func (s *Service) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+
+	err := s.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown closes every listener and socket, waits for the connections we accepted or dialed to be closed until ctx
+// is done and then closes the rest and stops nebula. The error of ctx is returned if connections had to be closed.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.mu.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.closed = true
+
+	var closers []io.Closer
+	for _, l := range s.mu.listeners {
+		closers = append(closers, l)
+	}
+	for c := range s.mu.sockets {
+		closers = append(closers, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range closers {
+		_ = c.Close()
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	var err error
+	for err == nil && s.openConns() > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	if err != nil {
+		s.mu.Lock()
+		closers = closers[:0]
+		for c := range s.mu.conns {
+			closers = append(closers, c)
+		}
+		s.mu.Unlock()
+
+		for _, c := range closers {
+			_ = c.Close()
+		}
+	}
+
 	s.control.Stop()
+	s.ipstack.Close()
+	return err
+}
+
+func (s *Service) openConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.mu.conns)
+}
+
+// track remembers c until the returned release is called, conns are drained on Close and everything else is closed
+// right away. Releasing also gives up addr if it was claimed for c.
+func (s *Service) track(c io.Closer, conn bool, addr netip.Addr) (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.mu.closed {
+		return nil, net.ErrClosed
+	}
+
+	m := s.mu.sockets
+	if conn {
+		m = s.mu.conns
+	}
+	m[c] = struct{}{}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(m, c)
+			s.unlockedReleaseAddr(addr)
+		})
+	}, nil
+}
+
+// unlockedClaimAddr adds addr to the netstack if it is not our nebula ip, it must be in one of our unsafe route
+// subnets. An invalid addr is a wildcard and needs nothing.
+func (s *Service) unlockedClaimAddr(addr netip.Addr) error {
+	if !addr.IsValid() || addr == s.vpnIp {
+		return nil
+	}
+	if !addr.Is4() {
+		return ErrIPv6NotSupported
+	}
+
+	if n := s.mu.addrs[addr]; n > 0 {
+		s.mu.addrs[addr] = n + 1
+		return nil
+	}
+
+	ok := false
+	for _, subnet := range s.subnets {
+		if subnet.Contains(addr.AsSlice()) {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return fmt.Errorf("%v is not our nebula ip or in an unsafe route subnet of our certificate", addr)
+	}
+
+	pa := tcpip.ProtocolAddress{
+		AddressWithPrefix: tcpip.AddrFromSlice(addr.AsSlice()).WithPrefix(),
+		Protocol:          ipv4.ProtocolNumber,
+	}
+	if err := s.ipstack.AddProtocolAddress(nicID, pa, stack.AddressProperties{}); err != nil {
+		return fmt.Errorf("error adding IP %v: %s", addr, err)
+	}
+	s.mu.addrs[addr] = 1
 	return nil
 }
 
+// unlockedReleaseAddr removes addr from the netstack once nothing listens on it
+func (s *Service) unlockedReleaseAddr(addr netip.Addr) {
+	n, ok := s.mu.addrs[addr]
+	if !ok {
+		return
+	}
+
+	if n > 1 {
+		s.mu.addrs[addr] = n - 1
+		return
+	}
+
+	delete(s.mu.addrs, addr)
+	_ = s.ipstack.RemoveAddress(nicID, tcpip.AddrFromSlice(addr.AsSlice()))
+}
+
 func (s *Service) tcpHandler(r *tcp.ForwarderRequest) {
 	endpointID := r.ID()
+	local, _ := netip.AddrFromSlice(endpointID.LocalAddress.AsSlice())
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	l, ok := s.mu.listeners[netip.AddrPortFrom(local.Unmap(), endpointID.LocalPort)]
+	if !ok {
+		l, ok = s.mu.listeners[netip.AddrPortFrom(netip.Addr{}, endpointID.LocalPort)]
+	}
+	s.mu.Unlock()
 
-	l, ok := s.mu.listeners[endpointID.LocalPort]
 	if !ok {
 		r.Complete(true)
 		return
 	}
 
+	var err error
 	var wq waiter.Queue
-	ep, err := r.CreateEndpoint(&wq)
-	if err != nil {
-		log.Printf("got error creating endpoint %q", err)
+	ep, tcpipErr := r.CreateEndpoint(&wq)
+	if tcpipErr != nil {
+		log.Printf("got error creating endpoint %q", tcpipErr)
 		r.Complete(true)
 		return
 	}
 	r.Complete(false)
-	ep.SocketOptions().SetKeepAlive(true)
+	s.tcpOpts.apply(ep)
+
+	conn := &TCPConn{
+		TCPConn: gonet.NewTCPConn(&wq, ep),
+		cert:    s.certificateOf(net.IP(endpointID.RemoteAddress.AsSlice())),
+	}
+	conn.release, err = s.track(conn, true, netip.Addr{})
+	if err != nil {
+		conn.TCPConn.Close()
+		return
+	}
 
-	conn := gonet.NewTCPConn(&wq, ep)
-	l.accept <- conn
+	select {
+	case l.accept <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// localAddr returns addr for a listener, an invalid address when it is a wildcard
+func localAddr(ip net.IP) netip.Addr {
+	if ip == nil || ip.IsUnspecified() {
+		return netip.Addr{}
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
+}
+
+// checkIPv4 returns ErrIPv6NotSupported for an ipv6 network or ip, nebula only carries ipv4. A nil or unspecified ip is
+// a wildcard and is fine.
+func checkIPv4(network string, ip net.IP) error {
+	if strings.HasSuffix(network, "6") || (ip != nil && !ip.IsUnspecified() && ip.To4() == nil) {
+		return ErrIPv6NotSupported
+	}
+	return nil
 }
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"testing"
 	"time"
 
@@ -18,12 +21,12 @@ import (
 
 type m map[string]interface{}
 
-func newSimpleService(caCrt *cert.NebulaCertificate, caKey []byte, name string, udpIp net.IP, overrides m) *Service {
+func newSimpleService(caCrt *cert.NebulaCertificate, caKey []byte, name string, udpIp net.IP, subnets []*net.IPNet, overrides m) *Service {
 
 	vpnIpNet := &net.IPNet{IP: make([]byte, len(udpIp)), Mask: net.IPMask{255, 255, 255, 0}}
 	copy(vpnIpNet.IP, udpIp)
 
-	_, _, myPrivKey, myPEM := e2e.NewTestCert(caCrt, caKey, "a", time.Now(), time.Now().Add(5*time.Minute), vpnIpNet, nil, []string{})
+	_, _, myPrivKey, myPEM := e2e.NewTestCert(caCrt, caKey, name, time.Now(), time.Now().Add(5*time.Minute), vpnIpNet, subnets, []string{})
 	caB, err := caCrt.MarshalToPEM()
 	if err != nil {
 		panic(err)
@@ -84,7 +87,7 @@ func newSimpleService(caCrt *cert.NebulaCertificate, caKey []byte, name string,
 
 func TestService(t *testing.T) {
 	ca, _, caKey, _ := e2e.NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
-	a := newSimpleService(ca, caKey, "a", net.IP{10, 0, 0, 1}, m{
+	a := newSimpleService(ca, caKey, "a", net.IP{10, 0, 0, 1}, nil, m{
 		"static_host_map": m{},
 		"lighthouse": m{
 			"am_lighthouse": true,
@@ -94,7 +97,7 @@ func TestService(t *testing.T) {
 			"port": 4243,
 		},
 	})
-	b := newSimpleService(ca, caKey, "b", net.IP{10, 0, 0, 2}, m{
+	b := newSimpleService(ca, caKey, "b", net.IP{10, 0, 0, 2}, nil, m{
 		"static_host_map": m{
 			"10.0.0.1": []string{"localhost:4243"},
 		},
@@ -118,6 +121,10 @@ func TestService(t *testing.T) {
 
 		t.Log("accepted connection")
 
+		if crt := conn.(Peer).PeerCertificate(); crt == nil || crt.Details.Name != "b" {
+			return fmt.Errorf("accepted a connection from an unexpected peer %v", crt)
+		}
+
 		if _, err := conn.Write([]byte("server msg")); err != nil {
 			return err
 		}
@@ -141,6 +148,9 @@ func TestService(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if crt := c.(Peer).PeerCertificate(); crt == nil || crt.Details.Name != "a" {
+		t.Fatalf("dialed an unexpected peer %v", crt)
+	}
 	if _, err := c.Write([]byte("client msg")); err != nil {
 		t.Fatal(err)
 	}
@@ -163,3 +173,355 @@ func TestService(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestService_udp(t *testing.T) {
+	ca, _, caKey, _ := e2e.NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	a := newSimpleService(ca, caKey, "a", net.IP{10, 0, 0, 1}, nil, m{
+		"static_host_map": m{},
+		"lighthouse": m{
+			"am_lighthouse": true,
+		},
+		"listen": m{
+			"host": "0.0.0.0",
+			"port": 4244,
+		},
+	})
+	b := newSimpleService(ca, caKey, "b", net.IP{10, 0, 0, 2}, nil, m{
+		"static_host_map": m{
+			"10.0.0.1": []string{"localhost:4244"},
+		},
+		"lighthouse": m{
+			"hosts":    []string{"10.0.0.1"},
+			"interval": 1,
+		},
+	})
+
+	// The netstack answers pings itself, this also brings the tunnel up
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for {
+		pingCtx, pingCancel := context.WithTimeout(ctx, time.Second)
+		_, err := b.Ping(pingCtx, "10.0.0.1")
+		pingCancel()
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pc, err := a.ListenPacket("udp", ":53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	var eg errgroup.Group
+	eg.Go(func() error {
+		data := make([]byte, 100)
+		n, addr, err := pc.ReadFrom(data)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data[:n], []byte("client msg")) {
+			return errors.New("got invalid message from client")
+		}
+		if addr.(*net.UDPAddr).IP.String() != "10.0.0.2" {
+			return fmt.Errorf("got message from unexpected address %v", addr)
+		}
+		if crt := a.CertificateOf(addr); crt == nil || crt.Details.Name != "b" {
+			return fmt.Errorf("got message from an unexpected peer %v", crt)
+		}
+
+		_, err = pc.WriteTo([]byte("server msg"), addr)
+		return err
+	})
+
+	c, err := b.DialContext(context.Background(), "udp", "10.0.0.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("client msg")); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data := make([]byte, 100)
+	n, err := c.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[:n], []byte("server msg")) {
+		t.Fatal("got invalid message from server")
+	}
+
+	if err := eg.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestService_http(t *testing.T) {
+	ca, _, caKey, _ := e2e.NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	a := newSimpleService(ca, caKey, "a", net.IP{10, 0, 0, 1}, nil, m{
+		"static_host_map": m{},
+		"lighthouse": m{
+			"am_lighthouse": true,
+		},
+		"listen": m{
+			"host": "0.0.0.0",
+			"port": 4245,
+		},
+	})
+	b := newSimpleService(ca, caKey, "b", net.IP{10, 0, 0, 2}, nil, m{
+		"static_host_map": m{
+			"10.0.0.1": []string{"localhost:4245"},
+		},
+		"lighthouse": m{
+			"hosts":    []string{"10.0.0.1"},
+			"interval": 1,
+		},
+	})
+
+	go a.ListenAndServe(":80", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if crt := PeerCertificate(r.Context()); crt != nil {
+			_, _ = w.Write([]byte(crt.Details.Name))
+		}
+	}))
+
+	client := &http.Client{Transport: b.Transport(), Timeout: 5 * time.Second}
+	get := func(url string) (string, error) {
+		res, err := client.Get(url)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	// The handler knows who is asking, give the server a moment to start listening
+	var name string
+	var err error
+	for i := 0; i < 20; i++ {
+		if name, err = get("http://10.0.0.1/"); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "b" {
+		t.Fatalf("expected the request to come from b, got %q", name)
+	}
+
+	// Now that we have a tunnel to a we can ask for it by name
+	name, err = get("http://a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "b" {
+		t.Fatalf("expected the request to come from b, got %q", name)
+	}
+}
+
+func TestService_listenAddress(t *testing.T) {
+	ca, _, caKey, _ := e2e.NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	_, subnet, _ := net.ParseCIDR("192.168.100.0/24")
+	a := newSimpleService(ca, caKey, "a", net.IP{10, 0, 0, 1}, []*net.IPNet{subnet}, m{
+		"static_host_map": m{},
+		"lighthouse": m{
+			"am_lighthouse": true,
+		},
+		"listen": m{
+			"host": "0.0.0.0",
+			"port": 4246,
+		},
+	})
+	defer a.Close()
+
+	vpnLn, err := a.Listen("tcp", "10.0.0.1:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Listen("tcp", "10.0.0.1:1234"); err == nil {
+		t.Fatal("expected listening twice on the same address to fail")
+	}
+
+	// The wildcard, an address in our unsafe route subnets and the same port on another address are all fine
+	anyLn, err := a.Listen("tcp", ":1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnetLn, err := a.Listen("tcp", "192.168.100.5:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := a.ListenPacket("udp", "192.168.100.5:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Listen("tcp", "10.0.0.2:1234"); err == nil {
+		t.Fatal("expected listening on an address that is not ours to fail")
+	}
+	if _, err := a.ListenPacket("udp", "192.168.200.5:1234"); err == nil {
+		t.Fatal("expected listening on an address outside our subnets to fail")
+	}
+	if _, err := a.DialUDP(&net.UDPAddr{IP: net.IP{192, 168, 200, 5}}, nil); err == nil {
+		t.Fatal("expected dialing from an address outside our subnets to fail")
+	}
+
+	// Dialing from a subnet address shares it with the listeners, it stays ours until the last of them is closed
+	du, err := a.DialUDP(&net.UDPAddr{IP: net.IP{192, 168, 100, 5}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []io.Closer{vpnLn, anyLn, subnetLn, pc} {
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.mu.Lock()
+	addrs := len(a.mu.addrs)
+	a.mu.Unlock()
+	if addrs != 1 {
+		t.Fatalf("expected the subnet address to be kept for the dialed socket, %d addresses left", addrs)
+	}
+	if err := du.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := subnetLn.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected accept on a closed listener to fail with net.ErrClosed, got %v", err)
+	}
+
+	a.mu.Lock()
+	addrs = len(a.mu.addrs)
+	a.mu.Unlock()
+	if addrs != 0 {
+		t.Fatalf("expected the subnet address to be released, %d addresses left", addrs)
+	}
+
+	// Closing a listener frees its port for the next one
+	ln, err := a.Listen("tcp", "10.0.0.1:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	// Nebula only carries ipv4
+	for _, f := range []func() error{
+		func() error { _, err := a.Listen("tcp6", ":1234"); return err },
+		func() error { _, err := a.Listen("tcp", "[fd00::1]:1234"); return err },
+		func() error { _, err := a.ListenPacket("udp6", ":1234"); return err },
+		func() error { _, err := a.ListenPacket("udp", "[fd00::1]:1234"); return err },
+		func() error { _, err := a.DialContext(context.Background(), "tcp6", "10.0.0.2:1234"); return err },
+		func() error { _, err := a.DialContext(context.Background(), "udp", "[fd00::1]:1234"); return err },
+		func() error { _, err := a.DialUDP(&net.UDPAddr{IP: net.ParseIP("fd00::1")}, nil); return err },
+		func() error {
+			_, err := a.DialUDP(nil, &net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 1234})
+			return err
+		},
+	} {
+		if err := f(); !errors.Is(err, ErrIPv6NotSupported) {
+			t.Fatalf("expected ipv6 to fail with ErrIPv6NotSupported, got %v", err)
+		}
+	}
+}
+
+func TestService_shutdown(t *testing.T) {
+	ca, _, caKey, _ := e2e.NewTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	a := newSimpleService(ca, caKey, "a", net.IP{10, 0, 0, 1}, nil, m{
+		"static_host_map": m{},
+		"lighthouse": m{
+			"am_lighthouse": true,
+		},
+		"listen": m{
+			"host": "0.0.0.0",
+			"port": 4247,
+		},
+	})
+	b := newSimpleService(ca, caKey, "b", net.IP{10, 0, 0, 2}, nil, m{
+		"static_host_map": m{
+			"10.0.0.1": []string{"localhost:4247"},
+		},
+		"lighthouse": m{
+			"hosts":    []string{"10.0.0.1"},
+			"interval": 1,
+		},
+	})
+
+	ln, err := a.Listen("tcp", ":1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	c, err := b.DialContext(context.Background(), "tcp", "10.0.0.1:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server net.Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out accepting the connection")
+	}
+
+	// a stops listening right away but waits for the connection it accepted
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdown <- a.Shutdown(ctx)
+	}()
+
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected accept to fail with net.ErrClosed once shutting down, got %v", err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned before the connection was closed: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if _, err := server.Write([]byte("server msg")); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 100)
+	n, err := c.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[:n], []byte("server msg")) {
+		t.Fatal("got invalid message from server")
+	}
+
+	server.Close()
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for shutdown")
+	}
+
+	// b gives up on the connection it dialed once its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := b.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected shutdown to force the connection closed, got %v", err)
+	}
+	if _, err := c.Read(data); err == nil {
+		t.Fatal("expected reading from a closed connection to fail")
+	}
+}
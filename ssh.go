@@ -830,14 +830,18 @@ func sshPrintRelays(ifce *Interface, fs interface{}, a []string, w sshd.StringWr
 		Type           string
 		State          string
 		PeerIp         iputil.VpnIp
+		NextHopIp      iputil.VpnIp `json:",omitempty"`
+		OriginIp       iputil.VpnIp `json:",omitempty"`
 		LocalIndex     uint32
 		RemoteIndex    uint32
 		RelayedThrough []iputil.VpnIp
 	}
 
 	type RelayOutput struct {
-		NebulaIp    iputil.VpnIp
-		RelayForIps []RelayFor
+		NebulaIp       iputil.VpnIp
+		ForwardedBytes uint64
+		DroppedBytes   uint64
+		RelayForIps    []RelayFor
 	}
 
 	type CmdOutput struct {
@@ -854,6 +858,7 @@ func sshPrintRelays(ifce *Interface, fs interface{}, a []string, w sshd.StringWr
 
 	for k, v := range relays {
 		ro := RelayOutput{NebulaIp: v.vpnIp}
+		ro.ForwardedBytes, ro.DroppedBytes = ifce.relayManager.quotas.GetPeerBytes(v.vpnIp)
 		co.Relays = append(co.Relays, &ro)
 		relayHI := ifce.hostMap.QueryVpnIp(v.vpnIp)
 		if relayHI == nil {
@@ -887,6 +892,8 @@ func sshPrintRelays(ifce *Interface, fs interface{}, a []string, w sshd.StringWr
 				rf.LocalIndex = r.LocalIndex
 				rf.RemoteIndex = r.RemoteIndex
 				rf.PeerIp = r.PeerIp
+				rf.NextHopIp = r.NextHopIp
+				rf.OriginIp = r.OriginIp
 				rf.Type = t
 				rf.State = s
 				if rf.LocalIndex != k {
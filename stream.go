@@ -0,0 +1,106 @@
+package nebula
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/stream"
+	"github.com/slackhq/nebula/udp"
+	"github.com/slackhq/nebula/util"
+)
+
+const defaultStreamIdleTimeout = 5 * time.Minute
+
+// newStreamFromConfig opens the tcp/tls transport when tcp.enabled is set and wraps every udp socket so packets for
+// streamed peers are sent over it
+func newStreamFromConfig(l *logrus.Logger, c *config.C, udpConns []udp.Conn) (*stream.Conn, error) {
+	if !c.GetBool("tcp.enabled", false) {
+		return nil, nil
+	}
+
+	listen := c.GetString("tcp.listen", "")
+	cfg := stream.Config{
+		Listen:        listen,
+		WebSocketPath: c.GetString("tcp.websocket_path", stream.DefaultWebSocketPath),
+		IdleTimeout:   c.GetDuration("tcp.idle_timeout", defaultStreamIdleTimeout),
+		Proxy:         http.ProxyFromEnvironment,
+		MaxStreams:    c.GetInt("tcp.max_streams", stream.DefaultMaxStreams),
+	}
+	if cfg.MaxStreams <= 0 {
+		return nil, util.NewContextualError("tcp.max_streams must be greater than 0", m{"maxStreams": cfg.MaxStreams}, nil)
+	}
+
+	switch proxy := c.GetString("tcp.proxy", ""); proxy {
+	case "":
+	case "none":
+		cfg.Proxy = nil
+	default:
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return nil, util.NewContextualError("Failed to parse tcp.proxy", m{"proxy": proxy}, err)
+		}
+		cfg.Proxy = http.ProxyURL(u)
+	}
+
+	s, err := stream.NewConn(l, cfg)
+	if err != nil {
+		return nil, util.NewContextualError("Failed to open tcp listener", m{"listen": listen}, err)
+	}
+
+	for i := range udpConns {
+		udpConns[i] = stream.NewMux(udpConns[i], s)
+	}
+
+	if listen != "" {
+		addr, _ := s.LocalAddr()
+		l.WithField("addr", addr).WithField("tls", c.GetBool("tcp.tls", true)).
+			WithField("websocketPath", cfg.WebSocketPath).Info("Listening for tcp streams")
+	}
+	return s, nil
+}
+
+// readStreamPackets is readOutsidePackets for packets read from tcp streams
+func readStreamPackets(f *Interface) udp.EncReader {
+	return func(
+		addr *udp.Addr,
+		out []byte,
+		packet []byte,
+		header *header.H,
+		fwPacket *firewall.Packet,
+		lhh udp.LightHouseHandlerFunc,
+		nb []byte,
+		q int,
+		localCache firewall.ConntrackCache,
+	) {
+		f.readOutsidePackets(addr, nil, originStream, out, packet, header, fwPacket, lhh, nb, q, localCache)
+	}
+}
+
+// udpHandshakeComplete sends packets to addr over udp again after a handshake made it across over udp, even if we had
+// fallen back to a stream to the same address
+func (f *Interface) udpHandshakeComplete(addr *udp.Addr) {
+	if f.stream != nil && addr != nil {
+		f.stream.RemoveRemote(addr)
+	}
+}
+
+// unwrapConns returns the udp sockets underneath any stream muxes or obfuscation
+func unwrapConns(conns []udp.Conn) []udp.Conn {
+	out := make([]udp.Conn, len(conns))
+	for i, c := range conns {
+		for {
+			w, ok := c.(interface{ Unwrap() udp.Conn })
+			if !ok {
+				break
+			}
+			c = w.Unwrap()
+		}
+		out[i] = c
+	}
+	return out
+}
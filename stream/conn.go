@@ -0,0 +1,758 @@
+package stream
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+)
+
+const (
+	// frameHeaderLen is the big endian length that precedes every packet on a stream
+	frameHeaderLen = 2
+
+	// maxPending is how many packets are held for a stream while it is being dialed
+	maxPending = 16
+
+	// writeQueueLen is how many packets can wait for a stream to take them, more are dropped like a full socket buffer
+	// would drop them
+	writeQueueLen = 256
+
+	// DefaultMaxStreams is how many streams peers can have open to us at once
+	DefaultMaxStreams = 1024
+
+	// tlsRecordHandshake is the first byte a tls client sends, anything else is taken as a plain tcp stream
+	tlsRecordHandshake = 0x16
+
+	writeTimeout = 5 * time.Second
+)
+
+var errUnknownRemote = errors.New("no stream to remote")
+
+// Remote is an address a peer accepts streams on, TLS is set when it should be dialed with tls
+type Remote struct {
+	Addr *udp.Addr
+	TLS  bool
+
+	// Path is set when the peer takes a websocket on this http path instead of a bare stream
+	Path string
+
+	// Host is the name we dial Addr by when we know it, proxies and http servers may only accept names
+	Host string
+}
+
+// dialHost is what we ask proxies to connect to and what we send as the tls server name and http host
+func (r Remote) dialHost() string {
+	if r.Host != "" {
+		return net.JoinHostPort(r.Host, strconv.Itoa(int(r.Addr.Port)))
+	}
+	return r.Addr.String()
+}
+
+// remote is a Remote we dial and when we stop, expires is zero while a stream to it is open or without an idle timeout
+type remote struct {
+	Remote
+	expires time.Time
+}
+
+func (r remote) expired(now time.Time) bool {
+	return !r.expires.IsZero() && now.After(r.expires)
+}
+
+type packet struct {
+	addr *udp.Addr
+	data []byte
+}
+
+// Conn carries nebula packets over tcp or tls streams for networks that drop udp. Each packet is framed with its
+// length. Streams are dialed on the first write to a known Remote and accepted from peers when listening, a stream is
+// closed after idleTimeout without reading anything. A Remote is forgotten idleTimeout after its last stream closed,
+// or after it was added if it never connected, and packets to its address go back to udp.
+type Conn struct {
+	l           *logrus.Logger
+	listener    net.Listener
+	serverTLS   *tls.Config
+	idleTimeout time.Duration
+	dialTimeout time.Duration
+
+	// proxy picks the http proxy to dial a remote through, nil when we go direct
+	proxy func(*http.Request) (*url.URL, error)
+
+	// http serves websocket upgrades for accepted streams that turn out to be http, httpLog is where it logs to
+	http     *http.Server
+	httpConn *connListener
+	httpLog  *io.PipeWriter
+
+	// accepted is the number of streams and http connections peers have open to us, no more than maxStreams are taken
+	accepted   atomic.Int32
+	maxStreams int32
+
+	// bufs holds the buffers for packets read from streams until ListenOut is done with them, and for packets queued
+	// to be written
+	bufs sync.Pool
+	// dropped counts the packets a stream could not take in time
+	dropped metrics.Counter
+
+	sync.RWMutex
+	streams map[netip.AddrPort]*streamConn
+	remotes map[netip.AddrPort]remote
+	// known is the number of streams and remotes so senders can skip the lock when there are none
+	known atomic.Int32
+
+	rx     chan packet
+	done   chan struct{}
+	closed atomic.Bool
+}
+
+// streamConn is a single stream to a peer. nc is nil while it is being dialed and packets written in the meantime are
+// held in pending. Once connected packets are queued for a goroutine that writes them, so a slow stream never holds up
+// the sender.
+type streamConn struct {
+	key      netip.AddrPort
+	addr     *udp.Addr
+	accepted bool
+
+	sync.Mutex
+	nc      net.Conn
+	pending [][]byte
+
+	queue    chan []byte
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+func newStreamConn(key netip.AddrPort, addr *udp.Addr, nc net.Conn) *streamConn {
+	return &streamConn{
+		key:   key,
+		addr:  addr,
+		nc:    nc,
+		queue: make(chan []byte, writeQueueLen),
+		quit:  make(chan struct{}),
+	}
+}
+
+// Config is how a stream transport listens and dials
+type Config struct {
+	// Listen is the address to accept streams on, we only dial out when it is empty
+	Listen string
+
+	// WebSocketPath is the http path we accept websockets on, defaults to DefaultWebSocketPath
+	WebSocketPath string
+
+	// IdleTimeout closes streams we haven't read anything from for this long, 0 keeps them open
+	IdleTimeout time.Duration
+
+	// Proxy picks the http proxy to dial a remote through, nil to always dial directly. http.ProxyFromEnvironment
+	// honors the usual HTTPS_PROXY, HTTP_PROXY and NO_PROXY settings.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// MaxStreams is how many streams peers can have open to us at once, defaults to DefaultMaxStreams
+	MaxStreams int
+}
+
+// NewConn returns a stream transport for the given config
+func NewConn(l *logrus.Logger, cfg Config) (*Conn, error) {
+	c := &Conn{
+		l:           l,
+		idleTimeout: cfg.IdleTimeout,
+		dialTimeout: 10 * time.Second,
+		proxy:       cfg.Proxy,
+		streams:     map[netip.AddrPort]*streamConn{},
+		remotes:     map[netip.AddrPort]remote{},
+		rx:          make(chan packet, 64),
+		done:        make(chan struct{}),
+		maxStreams:  DefaultMaxStreams,
+		dropped:     metrics.GetOrRegisterCounter("stream.dropped", nil),
+	}
+	c.bufs.New = func() any {
+		b := make([]byte, udp.MTU)
+		return &b
+	}
+	if cfg.MaxStreams > 0 {
+		c.maxStreams = int32(cfg.MaxStreams)
+	}
+
+	wsPath := cfg.WebSocketPath
+	if wsPath == "" {
+		wsPath = DefaultWebSocketPath
+	}
+	mux := http.NewServeMux()
+	mux.Handle(wsPath, c)
+	c.httpLog = l.WriterLevel(logrus.DebugLevel)
+	c.http = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: c.dialTimeout,
+		// Peers upgrade their first request, anything else gets a 404 and shouldn't be kept around waiting for more
+		IdleTimeout: c.dialTimeout,
+		ErrorLog:    log.New(c.httpLog, "", 0),
+		ConnState:   c.httpConnState,
+	}
+	c.httpConn = newConnListener()
+	go func() {
+		_ = c.http.Serve(c.httpConn)
+	}()
+
+	if cfg.Listen == "" {
+		return c, nil
+	}
+	listen := cfg.Listen
+
+	cert, err := selfSignedCert()
+	if err != nil {
+		return nil, err
+	}
+	c.serverTLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	c.listener, err = net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	go c.accept()
+	return c, nil
+}
+
+func addrKey(addr *udp.Addr) netip.AddrPort {
+	ip, _ := netip.AddrFromSlice(addr.IP)
+	return netip.AddrPortFrom(ip.Unmap(), addr.Port)
+}
+
+// AddRemote makes writes to r.Addr go over a stream, dialing it when there isn't one already
+func (c *Conn) AddRemote(r Remote) {
+	key := addrKey(r.Addr)
+	now := time.Now()
+	c.Lock()
+	c.unlockedPruneRemotes(now)
+	if _, ok := c.remotes[key]; !ok {
+		c.known.Add(1)
+	}
+	r.Addr = r.Addr.Copy()
+	rs := remote{Remote: r}
+	if c.streams[key] == nil {
+		rs.expires = c.expires(now)
+	}
+	c.remotes[key] = rs
+	c.Unlock()
+}
+
+// RemoveRemote sends packets to addr over udp again, a stream we dialed to it is closed. Streams peers opened to us
+// are left for them to close.
+func (c *Conn) RemoveRemote(addr *udp.Addr) {
+	if c.known.Load() == 0 {
+		return
+	}
+
+	key := addrKey(addr)
+	c.Lock()
+	if _, ok := c.remotes[key]; ok {
+		delete(c.remotes, key)
+		c.known.Add(-1)
+		if sc := c.streams[key]; sc != nil && !sc.accepted {
+			c.unlockedRemoveStream(sc)
+		}
+	}
+	c.Unlock()
+}
+
+// expires is when a remote without a stream is forgotten
+func (c *Conn) expires(now time.Time) time.Time {
+	if c.idleTimeout <= 0 {
+		return time.Time{}
+	}
+	return now.Add(c.idleTimeout)
+}
+
+// unlockedPruneRemotes forgets the remotes that expired. Caller must hold the write lock!
+func (c *Conn) unlockedPruneRemotes(now time.Time) {
+	for key, r := range c.remotes {
+		if r.expired(now) {
+			delete(c.remotes, key)
+			c.known.Add(-1)
+		}
+	}
+}
+
+// Has reports whether packets to addr belong on a stream, either an open stream or a Remote that hasn't expired
+func (c *Conn) Has(addr *udp.Addr) bool {
+	if c.known.Load() == 0 {
+		return false
+	}
+
+	key := addrKey(addr)
+	c.RLock()
+	_, ok := c.streams[key]
+	if !ok {
+		var r remote
+		r, ok = c.remotes[key]
+		ok = ok && !r.expired(time.Now())
+	}
+	c.RUnlock()
+	return ok
+}
+
+func (c *Conn) WriteTo(b []byte, addr *udp.Addr) error {
+	key := addrKey(addr)
+	c.RLock()
+	sc := c.streams[key]
+	c.RUnlock()
+
+	if sc == nil {
+		var err error
+		sc, err = c.dial(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	sc.write(c, b)
+	return nil
+}
+
+func (c *Conn) WriteBatch(b [][]byte, addrs []*udp.Addr) (int, error) {
+	var sent int
+	var firstErr error
+	for i := range b {
+		err := c.WriteTo(b[i], addrs[i])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sent++
+	}
+
+	return sent, firstErr
+}
+
+// dial starts a stream to a known remote, the returned stream holds on to packets until it is connected
+func (c *Conn) dial(key netip.AddrPort) (*streamConn, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if sc := c.streams[key]; sc != nil {
+		return sc, nil
+	}
+
+	r, ok := c.remotes[key]
+	if !ok || r.expired(time.Now()) || c.closed.Load() {
+		return nil, errUnknownRemote
+	}
+
+	sc := newStreamConn(key, r.Addr, nil)
+	c.unlockedAddStream(sc)
+	go c.connect(sc, r.Remote)
+	return sc, nil
+}
+
+func (c *Conn) connect(sc *streamConn, r Remote) {
+	nc, err := c.dialRemote(r)
+	if err != nil {
+		c.l.WithError(err).WithField("udpAddr", r.Addr).WithField("tls", r.TLS).WithField("path", r.Path).
+			Info("Failed to dial stream")
+		c.removeStream(sc)
+		return
+	}
+
+	c.RLock()
+	current := c.streams[sc.key] == sc
+	c.RUnlock()
+	if !current {
+		// We were closed while dialing
+		nc.Close()
+		return
+	}
+
+	c.l.WithField("udpAddr", r.Addr).WithField("tls", r.TLS).WithField("path", r.Path).Info("Stream connected")
+	sc.Lock()
+	sc.nc = nc
+	pending := sc.pending
+	sc.pending = nil
+	for _, p := range pending {
+		sc.unlockedQueue(c, p)
+	}
+	sc.Unlock()
+
+	go c.writeLoop(sc, nc)
+	c.serve(sc, nc)
+}
+
+// dialRemote opens a stream to r, through a proxy if we have one for it, and does any tls and websocket handshakes
+func (c *Conn) dialRemote(r Remote) (net.Conn, error) {
+	deadline := time.Now().Add(c.dialTimeout)
+	nc, err := c.dialProxy(r, deadline)
+	if err != nil {
+		return nil, err
+	}
+	_ = nc.SetDeadline(deadline)
+
+	if r.TLS {
+		// The nebula handshake authenticates the peer, tls is only here to look like any other https connection
+		tc := tls.Client(nc, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS12, ServerName: r.Host})
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+
+	if r.Path != "" {
+		nc, err = dialWebSocket(nc, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_ = nc.SetDeadline(time.Time{})
+	return nc, nil
+}
+
+func (c *Conn) accept() {
+	for {
+		nc, err := c.listener.Accept()
+		if err != nil {
+			if !c.closed.Load() {
+				c.l.WithError(err).Error("Failed to accept stream")
+			}
+			return
+		}
+
+		if c.accepted.Load() >= c.maxStreams {
+			// Turn them away before spending a tls handshake on them
+			c.l.WithField("remoteAddr", nc.RemoteAddr()).Debug("Refusing stream, too many streams are open")
+			nc.Close()
+			continue
+		}
+
+		go c.handshake(nc)
+	}
+}
+
+// handshake works out if an accepted stream is tls from its first byte before serving it
+func (c *Conn) handshake(nc net.Conn) {
+	ta, ok := nc.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		nc.Close()
+		return
+	}
+
+	br := bufio.NewReader(nc)
+	_ = nc.SetReadDeadline(time.Now().Add(c.dialTimeout))
+	first, err := br.Peek(1)
+	if err != nil {
+		nc.Close()
+		return
+	}
+
+	if first[0] == tlsRecordHandshake {
+		tc := tls.Server(&peekedConn{Conn: nc, r: br}, c.serverTLS)
+		if err := tc.Handshake(); err != nil {
+			c.l.WithError(err).WithField("udpAddr", ta).Debug("Failed tls handshake on stream")
+			nc.Close()
+			return
+		}
+
+		nc, br = tc, bufio.NewReader(tc)
+		first, err = br.Peek(1)
+		if err != nil {
+			nc.Close()
+			return
+		}
+	}
+
+	// Frames never start with a letter, the longest packet we send has a length under 0x2400
+	if first[0] >= 'A' && first[0] <= 'Z' {
+		if c.accepted.Load() >= c.maxStreams {
+			c.l.WithField("udpAddr", ta).Debug("Refusing http connection, too many streams are open")
+			nc.Close()
+			return
+		}
+
+		_ = nc.SetReadDeadline(time.Time{})
+		c.httpConn.add(&peekedConn{Conn: nc, r: br})
+		return
+	}
+
+	_ = nc.SetReadDeadline(time.Time{})
+	c.serveAccepted(nc, br, udp.NewAddr(ta.IP, uint16(ta.Port)))
+}
+
+// httpConnState counts http connections toward maxStreams until they are closed, or until a websocket upgrade hands
+// them to serveAccepted which counts them as a stream
+func (c *Conn) httpConnState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		c.accepted.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		c.accepted.Add(-1)
+	}
+}
+
+// serveAccepted reads from a stream a peer opened until it is closed
+func (c *Conn) serveAccepted(nc net.Conn, r io.Reader, addr *udp.Addr) {
+	sc := newStreamConn(addrKey(addr), addr, nc)
+	sc.accepted = true
+
+	c.Lock()
+	if c.closed.Load() {
+		c.Unlock()
+		nc.Close()
+		return
+	}
+	old := c.streams[sc.key]
+	if c.accepted.Load() >= c.maxStreams && (old == nil || !old.accepted) {
+		c.Unlock()
+		c.l.WithField("udpAddr", addr).Debug("Refusing stream, too many streams are open")
+		nc.Close()
+		return
+	}
+	if old != nil {
+		c.unlockedRemoveStream(old)
+	}
+	c.unlockedAddStream(sc)
+	c.Unlock()
+
+	c.l.WithField("udpAddr", addr).Debug("Stream accepted")
+	go c.writeLoop(sc, nc)
+	c.serve(sc, r)
+}
+
+// serve reads framed packets from a stream until it fails or goes idle
+func (c *Conn) serve(sc *streamConn, r io.Reader) {
+	defer c.removeStream(sc)
+
+	hdr := make([]byte, frameHeaderLen)
+	for {
+		if c.idleTimeout > 0 {
+			_ = sc.nc.SetReadDeadline(time.Now().Add(c.idleTimeout))
+		}
+
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			c.l.WithError(err).WithField("udpAddr", sc.addr).Debug("Stream closed")
+			return
+		}
+
+		n := int(binary.BigEndian.Uint16(hdr))
+		if n > udp.MTU {
+			c.l.WithField("udpAddr", sc.addr).WithField("len", n).Info("Closing stream with an oversized packet")
+			return
+		}
+
+		// ListenOut hands the buffer back once it is done with the packet
+		buf := c.bufs.Get().(*[]byte)
+		p := packet{addr: sc.addr, data: (*buf)[:n]}
+		if _, err := io.ReadFull(r, p.data); err != nil {
+			c.bufs.Put(buf)
+			c.l.WithError(err).WithField("udpAddr", sc.addr).Debug("Stream closed")
+			return
+		}
+
+		select {
+		case c.rx <- p:
+		case <-c.done:
+			c.bufs.Put(buf)
+			return
+		}
+	}
+}
+
+// writeLoop writes the packets queued for a stream until it is removed or a write fails
+func (c *Conn) writeLoop(sc *streamConn, nc net.Conn) {
+	for {
+		select {
+		case frame := <-sc.queue:
+			_ = nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+			_, err := nc.Write(frame)
+			c.putBuf(frame)
+			if err != nil {
+				// A partial write leaves the framing broken, nothing more can be sent on this stream
+				c.l.WithError(err).WithField("udpAddr", sc.addr).Debug("Failed to write to stream")
+				c.removeStream(sc)
+				return
+			}
+		case <-sc.quit:
+			return
+		}
+	}
+}
+
+// frame returns b with its length in front, in a buffer from the pool
+func (c *Conn) frame(b []byte) []byte {
+	buf := c.bufs.Get().(*[]byte)
+	frame := binary.BigEndian.AppendUint16((*buf)[:0], uint16(len(b)))
+	return append(frame, b...)
+}
+
+// putBuf returns a buffer from frame or serve to the pool
+func (c *Conn) putBuf(b []byte) {
+	if cap(b) < udp.MTU {
+		return
+	}
+	b = b[:udp.MTU]
+	c.bufs.Put(&b)
+}
+
+func (c *Conn) unlockedAddStream(sc *streamConn) {
+	c.streams[sc.key] = sc
+	c.known.Add(1)
+	if sc.accepted {
+		c.accepted.Add(1)
+	}
+
+	// The remote lives as long as the stream does
+	if r, ok := c.remotes[sc.key]; ok {
+		r.expires = time.Time{}
+		c.remotes[sc.key] = r
+	}
+}
+
+func (c *Conn) removeStream(sc *streamConn) {
+	c.Lock()
+	c.unlockedRemoveStream(sc)
+	c.Unlock()
+}
+
+func (c *Conn) unlockedRemoveStream(sc *streamConn) {
+	if c.streams[sc.key] == sc {
+		delete(c.streams, sc.key)
+		c.known.Add(-1)
+		if sc.accepted {
+			c.accepted.Add(-1)
+		}
+
+		// Writes can dial the remote again for a while, after that they go back to udp
+		if r, ok := c.remotes[sc.key]; ok {
+			r.expires = c.expires(time.Now())
+			c.remotes[sc.key] = r
+		}
+	}
+
+	sc.quitOnce.Do(func() { close(sc.quit) })
+	sc.Lock()
+	if sc.nc != nil {
+		sc.nc.Close()
+	}
+	sc.Unlock()
+}
+
+// write queues b for the stream, it never waits on the network
+func (sc *streamConn) write(c *Conn, b []byte) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	if sc.nc == nil {
+		if len(sc.pending) < maxPending {
+			sc.pending = append(sc.pending, append([]byte{}, b...))
+		} else {
+			c.dropped.Inc(1)
+		}
+		return
+	}
+
+	sc.unlockedQueue(c, b)
+}
+
+// unlockedQueue hands b to the writer, or drops it when the stream is not keeping up. Caller must own the lock!
+func (sc *streamConn) unlockedQueue(c *Conn, b []byte) {
+	frame := c.frame(b)
+	select {
+	case sc.queue <- frame:
+	default:
+		c.putBuf(frame)
+		c.dropped.Inc(1)
+	}
+}
+
+func (c *Conn) ListenOut(r udp.EncReader, lhf udp.LightHouseHandlerFunc, flush func(), cache *firewall.ConntrackCacheTicker, q int) {
+	plaintext := make([]byte, udp.MTU)
+	h := &header.H{}
+	fwPacket := &firewall.Packet{}
+	nb := make([]byte, 12, 12)
+
+	for {
+		select {
+		case p := <-c.rx:
+			r(p.addr, plaintext[:0], p.data, h, fwPacket, lhf, nb, q, cache.Get(c.l))
+			flush()
+			c.putBuf(p.data)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Conn) LocalAddr() (*udp.Addr, error) {
+	if c.listener == nil {
+		return nil, errors.New("not listening for streams")
+	}
+
+	ta := c.listener.Addr().(*net.TCPAddr)
+	return udp.NewAddr(ta.IP, uint16(ta.Port)), nil
+}
+
+func (c *Conn) LocalAddrs() ([]*udp.Addr, error) {
+	addr, err := c.LocalAddr()
+	if err != nil {
+		return nil, err
+	}
+	return []*udp.Addr{addr}, nil
+}
+
+func (c *Conn) Rebind() error {
+	return nil
+}
+
+func (c *Conn) ReloadConfig(_ *config.C) {}
+
+// Close stops listening and closes every stream
+func (c *Conn) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	var err error
+	if c.listener != nil {
+		err = c.listener.Close()
+	}
+	_ = c.http.Close()
+	_ = c.httpLog.Close()
+
+	c.Lock()
+	for _, sc := range c.streams {
+		c.unlockedRemoveStream(sc)
+	}
+	c.Unlock()
+
+	close(c.done)
+	return err
+}
+
+// peekedConn lets the tls server read the byte we peeked at to spot it
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (p *peekedConn) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
@@ -0,0 +1,462 @@
+package stream
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type received struct {
+	addr *udp.Addr
+	data []byte
+}
+
+// listen reads everything that arrives on c into the returned channel
+func listen(c *Conn) chan received {
+	ch := make(chan received, 16)
+	r := func(addr *udp.Addr, _ []byte, packet []byte, _ *header.H, _ *firewall.Packet, _ udp.LightHouseHandlerFunc, _ []byte, _ int, _ firewall.ConntrackCache) {
+		ch <- received{addr: addr.Copy(), data: append([]byte{}, packet...)}
+	}
+	go c.ListenOut(r, nil, func() {}, nil, 0)
+	return ch
+}
+
+func recv(t *testing.T, ch chan received) received {
+	select {
+	case r := <-ch:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a packet")
+	}
+	return received{}
+}
+
+func TestConn(t *testing.T) {
+	for _, useTLS := range []bool{false, true} {
+		l := test.NewLogger()
+		server, err := NewConn(l, Config{Listen: "127.0.0.1:0", IdleTimeout: time.Minute})
+		require.NoError(t, err)
+		defer server.Close()
+		client, err := NewConn(l, Config{IdleTimeout: time.Minute})
+		require.NoError(t, err)
+		defer client.Close()
+
+		serverAddr, err := server.LocalAddr()
+		require.NoError(t, err)
+		serverRx, clientRx := listen(server), listen(client)
+
+		// Nothing goes out to an address we haven't been told takes streams
+		assert.False(t, client.Has(serverAddr))
+		assert.ErrorIs(t, client.WriteTo([]byte("nope"), serverAddr), errUnknownRemote)
+
+		// Packets written while dialing are held until the stream is up
+		client.AddRemote(Remote{Addr: serverAddr, TLS: useTLS})
+		assert.True(t, client.Has(serverAddr))
+		require.NoError(t, client.WriteTo([]byte("hello"), serverAddr))
+		require.NoError(t, client.WriteTo([]byte("world"), serverAddr))
+
+		r := recv(t, serverRx)
+		assert.Equal(t, []byte("hello"), r.data)
+		assert.Equal(t, []byte("world"), recv(t, serverRx).data)
+
+		// The server answers on the stream the client opened
+		assert.True(t, server.Has(r.addr))
+		n, err := server.WriteBatch([][]byte{[]byte("back"), {}}, []*udp.Addr{r.addr, r.addr})
+		require.NoError(t, err)
+		assert.Equal(t, 2, n)
+
+		r = recv(t, clientRx)
+		assert.Equal(t, []byte("back"), r.data)
+		assert.True(t, r.addr.Equals(serverAddr))
+		assert.Empty(t, recv(t, clientRx).data)
+	}
+}
+
+func TestConn_idle(t *testing.T) {
+	l := test.NewLogger()
+	server, err := NewConn(l, Config{Listen: "127.0.0.1:0", IdleTimeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	defer server.Close()
+	serverAddr, err := server.LocalAddr()
+	require.NoError(t, err)
+	serverRx := listen(server)
+
+	nc, err := net.Dial("tcp", serverAddr.String())
+	require.NoError(t, err)
+	defer nc.Close()
+
+	// A frame longer than we will ever send closes the stream
+	_, err = nc.Write([]byte{0, 2, 'h', 'i', 0xff, 0xff})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hi"), recv(t, serverRx).data)
+
+	_ = nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = nc.Read(make([]byte, 1))
+	assert.Error(t, err)
+
+	// A quiet stream is closed and forgotten
+	nc, err = net.Dial("tcp", serverAddr.String())
+	require.NoError(t, err)
+	defer nc.Close()
+	_, err = nc.Write([]byte{0, 0})
+	require.NoError(t, err)
+	r := recv(t, serverRx)
+	assert.True(t, server.Has(r.addr))
+
+	_ = nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = nc.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.Eventually(t, func() bool { return !server.Has(r.addr) }, time.Second, 10*time.Millisecond)
+}
+
+func TestConn_remotes(t *testing.T) {
+	l := test.NewLogger()
+	server, err := NewConn(l, Config{Listen: "127.0.0.1:0"})
+	require.NoError(t, err)
+	defer server.Close()
+	serverAddr, err := server.LocalAddr()
+	require.NoError(t, err)
+	serverRx := listen(server)
+
+	client, err := NewConn(l, Config{IdleTimeout: 200 * time.Millisecond})
+	require.NoError(t, err)
+	defer client.Close()
+
+	// A remote that never connects is forgotten after the idle timeout
+	unused := udp.NewAddr(net.ParseIP("127.0.0.1"), 1)
+	client.AddRemote(Remote{Addr: unused})
+	assert.True(t, client.Has(unused))
+	assert.Eventually(t, func() bool { return !client.Has(unused) }, 5*time.Second, 10*time.Millisecond)
+	assert.ErrorIs(t, client.WriteTo([]byte("nope"), unused), errUnknownRemote)
+
+	// The remote lives as long as its stream, the stream goes idle since the server never answers
+	client.AddRemote(Remote{Addr: serverAddr})
+	require.NoError(t, client.WriteTo([]byte("hello"), serverAddr))
+	assert.Equal(t, []byte("hello"), recv(t, serverRx).data)
+	assert.True(t, client.Has(serverAddr))
+	assert.Eventually(t, func() bool { return !client.Has(serverAddr) }, 5*time.Second, 10*time.Millisecond)
+
+	// Removing a remote closes the stream we dialed to it
+	client.AddRemote(Remote{Addr: serverAddr})
+	require.NoError(t, client.WriteTo([]byte("again"), serverAddr))
+	assert.Equal(t, []byte("again"), recv(t, serverRx).data)
+	client.RemoveRemote(serverAddr)
+	assert.False(t, client.Has(serverAddr))
+	client.RLock()
+	assert.Empty(t, client.streams)
+	assert.Empty(t, client.remotes)
+	client.RUnlock()
+	assert.Zero(t, client.known.Load())
+}
+
+func TestConn_maxStreams(t *testing.T) {
+	l := test.NewLogger()
+	server, err := NewConn(l, Config{Listen: "127.0.0.1:0", MaxStreams: 1})
+	require.NoError(t, err)
+	defer server.Close()
+	serverAddr, err := server.LocalAddr()
+	require.NoError(t, err)
+	serverRx := listen(server)
+
+	first, err := net.Dial("tcp", serverAddr.String())
+	require.NoError(t, err)
+	defer first.Close()
+	_, err = first.Write([]byte{0, 2, 'h', 'i'})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hi"), recv(t, serverRx).data)
+
+	// One stream is all we take, the next is closed without being read
+	second, err := net.Dial("tcp", serverAddr.String())
+	require.NoError(t, err)
+	defer second.Close()
+	_, _ = second.Write([]byte{0, 2, 'n', 'o'})
+	_ = second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.Error(t, err)
+
+	// Once the first goes away there is room again
+	first.Close()
+	assert.Eventually(t, func() bool { return server.accepted.Load() == 0 }, 5*time.Second, 10*time.Millisecond)
+	third, err := net.Dial("tcp", serverAddr.String())
+	require.NoError(t, err)
+	defer third.Close()
+	_, err = third.Write([]byte{0, 3, 'y', 'e', 's'})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("yes"), recv(t, serverRx).data)
+
+	// Http connections that never upgrade take up room too
+	third.Close()
+	assert.Eventually(t, func() bool { return server.accepted.Load() == 0 }, 5*time.Second, 10*time.Millisecond)
+	hc, err := net.Dial("tcp", serverAddr.String())
+	require.NoError(t, err)
+	defer hc.Close()
+	_, err = hc.Write([]byte("GET / HTTP/1.1\r\nHost: nebula\r\n\r\n"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(hc), nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	assert.Equal(t, int32(1), server.accepted.Load())
+
+	fourth, err := net.Dial("tcp", serverAddr.String())
+	require.NoError(t, err)
+	defer fourth.Close()
+	_, _ = fourth.Write([]byte{0, 2, 'n', 'o'})
+	_ = fourth.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = fourth.Read(make([]byte, 1))
+	assert.Error(t, err)
+
+	hc.Close()
+	assert.Eventually(t, func() bool { return server.accepted.Load() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConn_slowStream(t *testing.T) {
+	// A peer that accepts the stream and never reads from it
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		nc, err := ln.Accept()
+		if err == nil {
+			accepted <- nc
+		}
+	}()
+
+	client, err := NewConn(test.NewLogger(), Config{})
+	require.NoError(t, err)
+	defer client.Close()
+	ta := ln.Addr().(*net.TCPAddr)
+	addr := udp.NewAddr(ta.IP, uint16(ta.Port))
+	client.AddRemote(Remote{Addr: addr})
+
+	require.NoError(t, client.WriteTo([]byte("hello"), addr))
+	var nc net.Conn
+	select {
+	case nc = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the stream")
+	}
+	defer nc.Close()
+	assert.Eventually(t, func() bool {
+		client.RLock()
+		sc := client.streams[addrKey(addr)]
+		client.RUnlock()
+		sc.Lock()
+		defer sc.Unlock()
+		return sc.nc != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Writes never wait on the stream, once the socket buffers and the queue are full packets are dropped
+	dropped := client.dropped.Count()
+	p := make([]byte, 1200)
+	start := time.Now()
+	for i := 0; i < 10000; i++ {
+		assert.NoError(t, client.WriteTo(p, addr))
+	}
+	assert.Less(t, time.Since(start), writeTimeout)
+	assert.Greater(t, client.dropped.Count(), dropped)
+}
+
+type recordingConn struct {
+	udp.NoopConn
+	sent []*udp.Addr
+	df   []*udp.Addr
+}
+
+func (r *recordingConn) WriteToDontFragment(b []byte, addr *udp.Addr) error {
+	r.df = append(r.df, addr)
+	return r.WriteTo(b, addr)
+}
+
+func (r *recordingConn) WriteTo(_ []byte, addr *udp.Addr) error {
+	r.sent = append(r.sent, addr)
+	return nil
+}
+
+func (r *recordingConn) WriteBatch(b [][]byte, addrs []*udp.Addr) (int, error) {
+	r.sent = append(r.sent, addrs...)
+	return len(b), nil
+}
+
+func TestMux(t *testing.T) {
+	l := test.NewLogger()
+	s, err := NewConn(l, Config{IdleTimeout: time.Minute})
+	require.NoError(t, err)
+	defer s.Close()
+
+	u := &recordingConn{}
+	m := NewMux(u, s)
+	assert.Equal(t, udp.Conn(u), m.Unwrap())
+
+	plain := udp.NewAddr(net.ParseIP("127.0.0.1"), 4242)
+	streamed := udp.NewAddr(net.ParseIP("127.0.0.1"), 1)
+	require.NoError(t, m.WriteTo([]byte{1}, streamed))
+	n, err := m.WriteBatch([][]byte{{1}, {2}}, []*udp.Addr{plain, streamed})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []*udp.Addr{streamed, plain, streamed}, u.sent)
+	require.NoError(t, udp.WriteToDontFragment(m, []byte{1}, plain))
+	assert.Equal(t, []*udp.Addr{plain}, u.df)
+
+	// Once we know an address takes streams udp doesn't see it until the remote is removed or expires
+	u.sent = nil
+	s.AddRemote(Remote{Addr: streamed})
+	require.NoError(t, m.WriteTo([]byte{1}, streamed))
+	require.NoError(t, m.WriteTo([]byte{1}, plain))
+	n, err = m.WriteBatch([][]byte{{1}, {2}, {3}}, []*udp.Addr{plain, streamed, plain})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []*udp.Addr{plain, plain, plain}, u.sent)
+
+	// Probes to a streamed peer go over the stream, it has no don't fragment bit
+	u.df = nil
+	require.NoError(t, udp.WriteToDontFragment(m, []byte{1}, streamed))
+	assert.Empty(t, u.df)
+}
+
+// connectProxy is an http proxy that only does CONNECT, it returns its url and the targets it was asked for
+func connectProxy(t *testing.T, auth string) (*url.URL, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	targets := make(chan string, 16)
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer nc.Close()
+				req, err := http.ReadRequest(bufio.NewReader(nc))
+				if err != nil {
+					return
+				}
+				targets <- req.Host
+				if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != auth {
+					_, _ = nc.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+					return
+				}
+
+				up, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					_, _ = nc.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer up.Close()
+				_, _ = nc.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go func() { _, _ = io.Copy(up, nc) }()
+				_, _ = io.Copy(nc, up)
+			}()
+		}
+	}()
+
+	return &url.URL{Scheme: "http", Host: ln.Addr().String()}, targets
+}
+
+// roundTrip sends a packet from client to r and one back, they must arrive intact
+func roundTrip(t *testing.T, client, server *Conn, r Remote) {
+	serverRx, clientRx := listen(server), listen(client)
+
+	client.AddRemote(r)
+	require.NoError(t, client.WriteTo([]byte("hello"), r.Addr))
+	got := recv(t, serverRx)
+	assert.Equal(t, []byte("hello"), got.data)
+
+	require.NoError(t, server.WriteTo([]byte("back"), got.addr))
+	assert.Equal(t, []byte("back"), recv(t, clientRx).data)
+}
+
+func TestConn_webSocket(t *testing.T) {
+	for _, useTLS := range []bool{false, true} {
+		l := test.NewLogger()
+		server, err := NewConn(l, Config{Listen: "127.0.0.1:0", IdleTimeout: time.Minute})
+		require.NoError(t, err)
+		defer server.Close()
+		client, err := NewConn(l, Config{IdleTimeout: time.Minute})
+		require.NoError(t, err)
+		defer client.Close()
+
+		serverAddr, err := server.LocalAddr()
+		require.NoError(t, err)
+		roundTrip(t, client, server, Remote{Addr: serverAddr, TLS: useTLS, Path: DefaultWebSocketPath})
+		// The upgraded http connection is counted once, as a stream
+		assert.Equal(t, int32(1), server.accepted.Load())
+
+		// Anything else that looks like http is turned away
+		scheme := "http"
+		if useTLS {
+			scheme = "https"
+		}
+		hc := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		res, err := hc.Get(scheme + "://" + serverAddr.String() + "/")
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	}
+}
+
+func TestConn_proxy(t *testing.T) {
+	l := test.NewLogger()
+	server, err := NewConn(l, Config{Listen: "127.0.0.1:0", IdleTimeout: time.Minute})
+	require.NoError(t, err)
+	defer server.Close()
+	serverAddr, err := server.LocalAddr()
+	require.NoError(t, err)
+
+	proxy, targets := connectProxy(t, "Basic dXNlcjpwYXNz")
+	proxy.User = url.UserPassword("user", "pass")
+	client, err := NewConn(l, Config{IdleTimeout: time.Minute, Proxy: http.ProxyURL(proxy)})
+	require.NoError(t, err)
+	defer client.Close()
+
+	// The proxy is asked for the name when we have one, not the address it resolved to
+	r := Remote{Addr: serverAddr, TLS: true, Path: DefaultWebSocketPath, Host: "localhost"}
+	roundTrip(t, client, server, r)
+	assert.Equal(t, net.JoinHostPort("localhost", strconv.Itoa(int(serverAddr.Port))), <-targets)
+
+	// A proxy that turns us away means no stream
+	proxy.User = url.UserPassword("user", "wrong")
+	client, err = NewConn(l, Config{IdleTimeout: time.Minute, Proxy: http.ProxyURL(proxy)})
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.dialRemote(Remote{Addr: serverAddr})
+	assert.ErrorContains(t, err, "407")
+}
+
+func TestConn_ServeHTTP(t *testing.T) {
+	l := test.NewLogger()
+	server, err := NewConn(l, Config{IdleTimeout: time.Minute})
+	require.NoError(t, err)
+	defer server.Close()
+
+	// Streams can be taken on an http server we don't own
+	mux := http.NewServeMux()
+	mux.Handle("/tunnel", server)
+	hs := httptest.NewTLSServer(mux)
+	defer hs.Close()
+
+	client, err := NewConn(l, Config{IdleTimeout: time.Minute})
+	require.NoError(t, err)
+	defer client.Close()
+
+	ta := hs.Listener.Addr().(*net.TCPAddr)
+	roundTrip(t, client, server, Remote{Addr: udp.NewAddr(ta.IP, uint16(ta.Port)), TLS: true, Path: "/tunnel"})
+}
@@ -0,0 +1,78 @@
+package stream
+
+import (
+	"github.com/slackhq/nebula/udp"
+)
+
+// Mux sends packets for streamed peers over s and everything else over the udp socket it wraps. Reading is left to the
+// udp socket, s is read on its own.
+type Mux struct {
+	udp.Conn
+	s *Conn
+}
+
+func NewMux(u udp.Conn, s *Conn) *Mux {
+	return &Mux{Conn: u, s: s}
+}
+
+// Unwrap returns the udp socket
+func (m *Mux) Unwrap() udp.Conn {
+	return m.Conn
+}
+
+func (m *Mux) WriteTo(b []byte, addr *udp.Addr) error {
+	if m.s.Has(addr) {
+		return m.s.WriteTo(b, addr)
+	}
+	return m.Conn.WriteTo(b, addr)
+}
+
+// WriteToDontFragment sends b over the udp socket with the don't fragment bit set if it supports it. A stream has no
+// such bit, streamed peers get b like any other packet.
+func (m *Mux) WriteToDontFragment(b []byte, addr *udp.Addr) error {
+	if m.s.Has(addr) {
+		return m.s.WriteTo(b, addr)
+	}
+	return udp.WriteToDontFragment(m.Conn, b, addr)
+}
+
+func (m *Mux) WriteBatch(b [][]byte, addrs []*udp.Addr) (int, error) {
+	if m.s.known.Load() == 0 {
+		return m.Conn.WriteBatch(b, addrs)
+	}
+
+	// Pull out anything bound for a stream, the rest still goes in a single batch
+	var sent int
+	var firstErr error
+	ub, uaddrs := b[:0:0], addrs[:0:0]
+	for i := range b {
+		if !m.s.Has(addrs[i]) {
+			ub = append(ub, b[i])
+			uaddrs = append(uaddrs, addrs[i])
+			continue
+		}
+
+		if err := m.s.WriteTo(b[i], addrs[i]); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sent++
+	}
+
+	if len(ub) > 0 {
+		n, err := m.Conn.WriteBatch(ub, uaddrs)
+		sent += n
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return sent, firstErr
+}
+
+// Stream returns the stream transport
+func (m *Mux) Stream() *Conn {
+	return m.s
+}
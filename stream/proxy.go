@@ -0,0 +1,93 @@
+package stream
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// dialProxy opens a tcp connection to r, through an http proxy with CONNECT when c.proxy picks one for it
+func (c *Conn) dialProxy(r Remote, deadline time.Time) (net.Conn, error) {
+	d := net.Dialer{Deadline: deadline}
+	proxy, err := c.proxyFor(r)
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil {
+		return d.Dial("tcp", r.Addr.String())
+	}
+
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		if proxy.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxy.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxy.Hostname(), "80")
+		}
+	}
+
+	nc, err := d.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	_ = nc.SetDeadline(deadline)
+
+	if proxy.Scheme == "https" {
+		tc := tls.Client(nc, &tls.Config{ServerName: proxy.Hostname(), MinVersion: tls.VersionTLS12})
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+
+	target := r.dialHost()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: http.Header{},
+	}
+	if u := proxy.User; u != nil {
+		p, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+p)))
+	}
+
+	if err := req.Write(nc); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	// Nothing is sent until the proxy answers so there is nothing left buffered after the response
+	res, err := http.ReadResponse(bufio.NewReaderSize(nc, 1), req)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		nc.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", proxy.Redacted(), target, res.Status)
+	}
+
+	_ = nc.SetDeadline(time.Time{})
+	return nc, nil
+}
+
+// proxyFor returns the proxy to dial r through, or nil to dial it directly
+func (c *Conn) proxyFor(r Remote) (*url.URL, error) {
+	if c.proxy == nil {
+		return nil, nil
+	}
+
+	scheme := "http"
+	if r.TLS {
+		scheme = "https"
+	}
+	return c.proxy(&http.Request{URL: &url.URL{Scheme: scheme, Host: r.dialHost()}})
+}
@@ -0,0 +1,100 @@
+package stream
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+
+	"github.com/slackhq/nebula/udp"
+	"golang.org/x/net/websocket"
+)
+
+// DefaultWebSocketPath is where we accept websockets when no other path is configured
+const DefaultWebSocketPath = "/nebula"
+
+// dialWebSocket does the websocket handshake for r over nc, packets are then carried in binary messages
+func dialWebSocket(nc net.Conn, r Remote) (net.Conn, error) {
+	scheme := "ws"
+	if r.TLS {
+		scheme = "wss"
+	}
+	location := &url.URL{Scheme: scheme, Host: r.dialHost(), Path: r.Path}
+	origin := &url.URL{Scheme: "http", Host: r.dialHost()}
+	if r.TLS {
+		origin.Scheme = "https"
+	}
+
+	cfg := &websocket.Config{Location: location, Origin: origin, Version: websocket.ProtocolVersionHybi13}
+	ws, err := websocket.NewClient(cfg, nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// ServeHTTP accepts nebula packets over a websocket, it can be mounted on any http server to take streams there
+func (c *Conn) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s := websocket.Server{
+		// Browsers are not our clients, the nebula handshake inside authenticates the peer
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   c.serveWebSocket,
+	}
+	s.ServeHTTP(w, req)
+}
+
+func (c *Conn) serveWebSocket(ws *websocket.Conn) {
+	ap, err := netip.ParseAddrPort(ws.Request().RemoteAddr)
+	if err != nil {
+		c.l.WithError(err).WithField("remoteAddr", ws.Request().RemoteAddr).Info("Unable to parse websocket peer address")
+		return
+	}
+
+	ws.PayloadType = websocket.BinaryFrame
+	ip := ap.Addr().As16()
+	c.serveAccepted(ws, ws, udp.NewAddr(ip[:], ap.Port()))
+}
+
+var errListenerClosed = errors.New("listener closed")
+
+// connListener hands connections we accepted and found to be http to an http.Server
+type connListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *connListener) add(nc net.Conn) {
+	select {
+	case l.conns <- nc:
+	case <-l.done:
+		nc.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case nc := <-l.conns:
+		return nc, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
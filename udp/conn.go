@@ -1,6 +1,8 @@
 package udp
 
 import (
+	"net"
+
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/firewall"
 	"github.com/slackhq/nebula/header"
@@ -23,12 +25,35 @@ type EncReader func(
 type Conn interface {
 	Rebind() error
 	LocalAddr() (*Addr, error)
-	ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firewall.ConntrackCacheTicker, q int)
+	// LocalAddrs returns an address for every family the socket can send to and receive from, a dual stack socket
+	// reports both 0.0.0.0 and :: with its port
+	LocalAddrs() ([]*Addr, error)
+	// ListenOut hands every packet read from the socket to r, flush is called after each read once all of the packets
+	// it returned have been handed over
+	ListenOut(r EncReader, lhf LightHouseHandlerFunc, flush func(), cache *firewall.ConntrackCacheTicker, q int)
 	WriteTo(b []byte, addr *Addr) error
+	// WriteBatch sends each packet in b to the address at the same index in addrs. Every packet is attempted, the
+	// number that were sent and the first error are returned.
+	WriteBatch(b [][]byte, addrs []*Addr) (int, error)
 	ReloadConfig(c *config.C)
 	Close() error
 }
 
+// DontFragmentWriter is implemented by sockets that can send a single packet with the don't fragment bit set while
+// everything else they send can still be fragmented
+type DontFragmentWriter interface {
+	WriteToDontFragment(b []byte, addr *Addr) error
+}
+
+// WriteToDontFragment sends b with the don't fragment bit set if w supports it, otherwise it is sent like any other
+// packet
+func WriteToDontFragment(w Conn, b []byte, addr *Addr) error {
+	if df, ok := w.(DontFragmentWriter); ok {
+		return df.WriteToDontFragment(b, addr)
+	}
+	return w.WriteTo(b, addr)
+}
+
 type NoopConn struct{}
 
 func (NoopConn) Rebind() error {
@@ -37,15 +62,51 @@ func (NoopConn) Rebind() error {
 func (NoopConn) LocalAddr() (*Addr, error) {
 	return nil, nil
 }
-func (NoopConn) ListenOut(_ EncReader, _ LightHouseHandlerFunc, _ *firewall.ConntrackCacheTicker, _ int) {
+func (NoopConn) LocalAddrs() ([]*Addr, error) {
+	return nil, nil
+}
+func (NoopConn) ListenOut(_ EncReader, _ LightHouseHandlerFunc, _ func(), _ *firewall.ConntrackCacheTicker, _ int) {
 	return
 }
 func (NoopConn) WriteTo(_ []byte, _ *Addr) error {
 	return nil
 }
+func (NoopConn) WriteBatch(b [][]byte, _ []*Addr) (int, error) {
+	return len(b), nil
+}
 func (NoopConn) ReloadConfig(_ *config.C) {
 	return
 }
 func (NoopConn) Close() error {
 	return nil
 }
+
+// writeEach is WriteBatch for sockets that send one packet at a time
+func writeEach(writeTo func([]byte, *Addr) error, b [][]byte, addrs []*Addr) (int, error) {
+	var sent int
+	var firstErr error
+	for i := range b {
+		err := writeTo(b[i], addrs[i])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sent++
+	}
+
+	return sent, firstErr
+}
+
+// localAddrs is LocalAddrs for sockets that are dual stack whenever they are bound to ::
+func localAddrs(addr *Addr, err error) ([]*Addr, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	if addr.IP.Equal(net.IPv6unspecified) {
+		return []*Addr{NewAddr(net.IPv4zero, addr.Port), addr}, nil
+	}
+	return []*Addr{addr}, nil
+}
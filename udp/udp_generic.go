@@ -57,8 +57,19 @@ func (u *GenericConn) LocalAddr() (*Addr, error) {
 	}
 }
 
+func (u *GenericConn) LocalAddrs() ([]*Addr, error) {
+	return localAddrs(u.LocalAddr())
+}
+
+func (u *GenericConn) WriteBatch(b [][]byte, addrs []*Addr) (int, error) {
+	return writeEach(u.WriteTo, b, addrs)
+}
+
 func (u *GenericConn) ReloadConfig(c *config.C) {
 	// TODO
+	if c.GetBool("pmtu.enabled", false) {
+		u.l.Warn("pmtu.enabled can not set the don't fragment bit on this platform, probes may be fragmented and overestimate the path mtu")
+	}
 }
 
 func NewUDPStatsEmitter(udpConns []Conn) func() {
@@ -70,7 +81,7 @@ type rawMessage struct {
 	Len uint32
 }
 
-func (u *GenericConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firewall.ConntrackCacheTicker, q int) {
+func (u *GenericConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, flush func(), cache *firewall.ConntrackCacheTicker, q int) {
 	plaintext := make([]byte, MTU)
 	buffer := make([]byte, MTU)
 	h := &header.H{}
@@ -89,5 +100,6 @@ func (u *GenericConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *f
 		udpAddr.IP = rua.IP
 		udpAddr.Port = uint16(rua.Port)
 		r(udpAddr, plaintext[:0], buffer[:n], h, fwPacket, lhf, nb, q, cache.Get(u.l))
+		flush()
 	}
 }
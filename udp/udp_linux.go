@@ -5,8 +5,11 @@ package udp
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
@@ -20,11 +23,77 @@ import (
 
 //TODO: make it support reload as best you can!
 
+const (
+	// maxGSOSegments is the most packets the kernel will split a single udp gso send into
+	maxGSOSegments = 64
+	// maxGSOBytes bounds the payload of a single udp gso send, it has to fit in one ip packet before it is split
+	maxGSOBytes = 65000
+	// maxGROBytes is the largest read the kernel hands us when it coalesces packets
+	maxGROBytes = 65535
+)
+
 type StdConn struct {
 	sysFd int
 	isV4  bool
-	l     *logrus.Logger
-	batch int
+	// dualStack is set for ipv6 sockets that also send and receive ipv4, as ipv4 mapped ipv6 addresses
+	dualStack bool
+	l         *logrus.Logger
+	batch     int
+
+	// gso is set when WriteBatch may have the kernel split runs of packets to the same address for us
+	gsoSupported bool
+	gso          atomic.Bool
+	// gro is set when the kernel may coalesce packets from the same sender into a single read, not reloadable
+	gro bool
+
+	writes sync.Pool
+
+	// pmtu is set while path mtu probes should carry the don't fragment bit. Linux can't set the bit on a single ipv4
+	// packet sent from a udp socket, those probes go out over probeFd instead, a send only raw socket that is opened the
+	// first time pmtu is turned on and is -1 until then.
+	pmtu      atomic.Bool
+	probeFd   atomic.Int32
+	probeLock sync.Mutex
+
+	// closed stops the read loop, a closed fd number can be handed to the next socket we open
+	closed atomic.Bool
+}
+
+// writeState is the scratch space WriteBatch needs to describe a batch to sendmmsg
+type writeState struct {
+	msgs  []rawMessage
+	iovs  []iovec
+	names []unix.RawSockaddrInet6
+	cmsgs []byte
+
+	// first and count are the packets that went into each message
+	first []int
+	count []int
+}
+
+func (ws *writeState) grow(n int) {
+	if len(ws.msgs) >= n {
+		return
+	}
+
+	ws.msgs = make([]rawMessage, n)
+	ws.iovs = make([]iovec, n)
+	ws.names = make([]unix.RawSockaddrInet6, n)
+	ws.cmsgs = make([]byte, n*unix.CmsgSpace(2))
+	ws.first = make([]int, n)
+	ws.count = make([]int, n)
+}
+
+// gsoControl returns the control message for message i that has the kernel split it into size byte packets
+func (ws *writeState) gsoControl(i int, size int) []byte {
+	space := unix.CmsgSpace(2)
+	b := ws.cmsgs[i*space : (i+1)*space]
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = unix.SOL_UDP
+	h.Type = unix.UDP_SEGMENT
+	h.SetLen(unix.CmsgLen(2))
+	binary.NativeEndian.PutUint16(b[unix.CmsgLen(0):], uint16(size))
+	return b
 }
 
 var x int
@@ -54,24 +123,35 @@ func maybeIPV4(ip net.IP) (net.IP, bool) {
 	return ip, false
 }
 
+// NewListener opens a udp socket bound to ip and port. :: gets a dual stack socket that sends and receives both ipv4
+// and ipv6, unless the host has no ipv6 at all. 0.0.0.0 is ipv4 alone.
 func NewListener(l *logrus.Logger, ip net.IP, port int, multi bool, batch int) (Conn, error) {
+	dualStack := ip.IsUnspecified() && ip.To4() == nil
+
 	ipV4, isV4 := maybeIPV4(ip)
-	af := unix.AF_INET6
-	if isV4 {
-		af = unix.AF_INET
+	fd, err := openSocket(isV4)
+	if err != nil && dualStack && errors.Is(err, unix.EAFNOSUPPORT) {
+		l.Warn("ipv6 is not available, listening on ipv4 only")
+		dualStack, isV4, ipV4 = false, true, net.IPv4zero.To4()
+		fd, err = openSocket(isV4)
 	}
-	syscall.ForkLock.RLock()
-	fd, err := unix.Socket(af, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
-	if err == nil {
-		unix.CloseOnExec(fd)
-	}
-	syscall.ForkLock.RUnlock()
 
 	if err != nil {
-		unix.Close(fd)
 		return nil, fmt.Errorf("unable to open socket: %s", err)
 	}
 
+	if !isV4 {
+		// Don't leave the choice to net.ipv6.bindv6only
+		v6Only := 1
+		if dualStack {
+			v6Only = 0
+		}
+		if err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, v6Only); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("unable to set IPV6_V6ONLY: %s", err)
+		}
+	}
+
 	if multi {
 		if err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
 			return nil, fmt.Errorf("unable to set SO_REUSEPORT: %s", err)
@@ -98,7 +178,29 @@ func NewListener(l *logrus.Logger, ip net.IP, port int, multi bool, batch int) (
 	//v, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_INCOMING_CPU)
 	//l.Println(v, err)
 
-	return &StdConn{sysFd: fd, isV4: isV4, l: l, batch: batch}, err
+	// The kernel knows about udp gso if it knows the socket option
+	_, gsoErr := unix.GetsockoptInt(fd, unix.IPPROTO_UDP, unix.UDP_SEGMENT)
+
+	u := &StdConn{sysFd: fd, isV4: isV4, dualStack: dualStack, l: l, batch: batch, gsoSupported: gsoErr == nil}
+	u.writes.New = func() any { return &writeState{} }
+	u.probeFd.Store(-1)
+	return u, err
+}
+
+func openSocket(isV4 bool) (int, error) {
+	af := unix.AF_INET6
+	if isV4 {
+		af = unix.AF_INET
+	}
+
+	syscall.ForkLock.RLock()
+	fd, err := unix.Socket(af, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
+	if err == nil {
+		unix.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+
+	return fd, err
 }
 
 func (u *StdConn) Rebind() error {
@@ -121,6 +223,118 @@ func (u *StdConn) GetSendBuffer() (int, error) {
 	return unix.GetsockoptInt(int(u.sysFd), unix.SOL_SOCKET, unix.SO_SNDBUF)
 }
 
+// setPathMtuDiscovery stops the kernel from setting the don't fragment bit on anything sent from the socket, so it
+// fragments packets that don't fit what it has learned about the path instead of dropping them
+func (u *StdConn) setPathMtuDiscovery() error {
+	if !u.isV4 {
+		err := unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DONT)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Also covers ipv4 mapped addresses on an ipv6 socket
+	return unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DONT)
+}
+
+// openProbeSocket opens the raw socket ipv4 path mtu probes are sent from. IPPROTO_RAW sockets only send, nothing that
+// arrives for our port is taken away from the udp socket.
+func (u *StdConn) openProbeSocket() error {
+	u.probeLock.Lock()
+	defer u.probeLock.Unlock()
+	if u.probeFd.Load() >= 0 || u.closed.Load() {
+		return nil
+	}
+
+	syscall.ForkLock.RLock()
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_RAW)
+	if err == nil {
+		unix.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	u.probeFd.Store(int32(fd))
+	return nil
+}
+
+// WriteToDontFragment sends a path mtu probe with the don't fragment bit set, everything else sent from the socket
+// keeps being fragmented by the kernel. Ipv6 probes ask for it on the packet itself, ipv4 probes are built by hand and
+// sent from the raw probe socket. Without pmtu.enabled this is WriteTo.
+func (u *StdConn) WriteToDontFragment(b []byte, addr *Addr) error {
+	if !u.pmtu.Load() {
+		return u.WriteTo(b, addr)
+	}
+
+	if ip4 := addr.IP.To4(); ip4 != nil && (u.isV4 || u.dualStack) {
+		return u.writeTo4DontFragment(b, ip4, addr.Port)
+	}
+	if u.isV4 {
+		return fmt.Errorf("Listener is IPv4, but writing to IPv6 remote")
+	}
+	return u.writeTo6DontFragment(b, addr)
+}
+
+func (u *StdConn) writeTo6DontFragment(b []byte, addr *Addr) error {
+	oob := make([]byte, unix.CmsgSpace(4))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.IPPROTO_IPV6
+	h.Type = unix.IPV6_DONTFRAG
+	h.SetLen(unix.CmsgLen(4))
+	binary.NativeEndian.PutUint32(oob[unix.CmsgLen(0):], 1)
+
+	sa := &unix.SockaddrInet6{Port: int(addr.Port)}
+	copy(sa.Addr[:], addr.IP.To16())
+	if _, err := unix.SendmsgN(u.sysFd, b, oob, sa, 0); err != nil {
+		return &net.OpError{Op: "sendmsg", Err: err}
+	}
+	return nil
+}
+
+func (u *StdConn) writeTo4DontFragment(b []byte, ip4 net.IP, port uint16) error {
+	fd := int(u.probeFd.Load())
+	if fd < 0 {
+		return fmt.Errorf("no socket to send ipv4 path mtu probes from")
+	}
+
+	sa, err := unix.Getsockname(u.sysFd)
+	if err != nil {
+		return err
+	}
+
+	// The source has to match the udp socket so the probe looks like the rest of the tunnel to nat and firewalls on the
+	// way. The kernel fills in the total length, id and header checksum, and the source address too when the socket is
+	// not bound to one. A zero udp checksum means there is none.
+	p := make([]byte, 28+len(b))
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[6:8], 0x4000) // don't fragment
+	p[8] = 64
+	p[9] = unix.IPPROTO_UDP
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		copy(p[12:16], sa.Addr[:])
+		binary.BigEndian.PutUint16(p[20:22], uint16(sa.Port))
+	case *unix.SockaddrInet6:
+		if src := net.IP(sa.Addr[:]).To4(); src != nil {
+			copy(p[12:16], src)
+		}
+		binary.BigEndian.PutUint16(p[20:22], uint16(sa.Port))
+	}
+	copy(p[16:20], ip4)
+	binary.BigEndian.PutUint16(p[22:24], port)
+	binary.BigEndian.PutUint16(p[24:26], uint16(8+len(b)))
+	copy(p[28:], b)
+
+	dst := &unix.SockaddrInet4{}
+	copy(dst.Addr[:], ip4)
+	if err := unix.Sendto(fd, p, 0, dst); err != nil {
+		return &net.OpError{Op: "sendto", Err: err}
+	}
+	return nil
+}
+
 func (u *StdConn) LocalAddr() (*Addr, error) {
 	sa, err := unix.Getsockname(u.sysFd)
 	if err != nil {
@@ -140,7 +354,19 @@ func (u *StdConn) LocalAddr() (*Addr, error) {
 	return addr, nil
 }
 
-func (u *StdConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firewall.ConntrackCacheTicker, q int) {
+func (u *StdConn) LocalAddrs() ([]*Addr, error) {
+	addr, err := u.LocalAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	if u.dualStack {
+		return []*Addr{NewAddr(net.IPv4zero, addr.Port), addr}, nil
+	}
+	return []*Addr{addr}, nil
+}
+
+func (u *StdConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, flush func(), cache *firewall.ConntrackCacheTicker, q int) {
 	plaintext := make([]byte, MTU)
 	h := &header.H{}
 	fwPacket := &firewall.Packet{}
@@ -149,15 +375,34 @@ func (u *StdConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firew
 
 	//TODO: should we track this?
 	//metric := metrics.GetOrRegisterHistogram("test.batch_read", nil, metrics.NewExpDecaySample(1028, 0.015))
-	msgs, buffers, names := u.PrepareRawMessages(u.batch)
+	size := MTU
+	var controls [][]byte
+	if u.gro {
+		size = maxGROBytes
+		controls = make([][]byte, u.batch)
+		for i := range controls {
+			controls[i] = make([]byte, unix.CmsgSpace(4))
+		}
+	}
+
+	msgs, buffers, names := u.PrepareRawMessages(u.batch, size)
 	read := u.ReadMulti
 	if u.batch == 1 {
 		read = u.ReadSingle
 	}
 
 	for {
+		for i := range controls {
+			// The kernel tells us how much control data it wrote over the length we give it
+			msgs[i].Hdr.setControl(controls[i])
+		}
+
+		if u.closed.Load() {
+			return
+		}
+
 		n, err := read(msgs)
-		if err != nil {
+		if err != nil || u.closed.Load() {
 			u.l.WithError(err).Debug("udp socket is closed, exiting read loop")
 			return
 		}
@@ -170,8 +415,23 @@ func (u *StdConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firew
 				udpAddr.IP = names[i][8:24]
 			}
 			udpAddr.Port = binary.BigEndian.Uint16(names[i][2:4])
-			r(udpAddr, plaintext[:0], buffers[i][:msgs[i].Len], h, fwPacket, lhf, nb, q, cache.Get(u.l))
+
+			b := buffers[i][:msgs[i].Len]
+			segment := len(b)
+			if u.gro {
+				if s := groSize(controls[i][:msgs[i].Hdr.controlLen()]); s > 0 {
+					segment = s
+				}
+			}
+
+			// A coalesced read holds packets of segment bytes, the last one may be shorter
+			for len(b) > 0 {
+				p := b[:min(segment, len(b))]
+				b = b[len(p):]
+				r(udpAddr, plaintext[:0], p, h, fwPacket, lhf, nb, q, cache.Get(u.l))
+			}
 		}
+		flush()
 	}
 }
 
@@ -223,6 +483,150 @@ func (u *StdConn) WriteTo(b []byte, addr *Addr) error {
 	return u.writeTo6(b, addr)
 }
 
+// WriteBatch sends all of b with as few sendmmsg calls as possible. With gso, runs of packets of the same size to the
+// same address are sent as a single message that the kernel, or the nic, splits back into packets.
+func (u *StdConn) WriteBatch(b [][]byte, addrs []*Addr) (int, error) {
+	if len(b) == 1 {
+		if err := u.WriteTo(b[0], addrs[0]); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+
+	ws := u.writes.Get().(*writeState)
+	defer u.writes.Put(ws)
+	ws.grow(len(b))
+
+	var firstErr error
+	gso := u.gso.Load()
+	msgs, iovs := 0, 0
+	for i := 0; i < len(b); {
+		hdr := &ws.msgs[msgs].Hdr
+		nameLen, err := u.rawName(addrs[i], &ws.names[msgs])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			i++
+			continue
+		}
+
+		// Every packet in a gso message is the same size except for the last one, which can be shorter
+		j := i + 1
+		if gso {
+			size, total := len(b[i]), len(b[i])
+			for j < len(b) && j-i < maxGSOSegments && len(b[j-1]) == size && len(b[j]) <= size &&
+				total+len(b[j]) <= maxGSOBytes && addrs[j].Equals(addrs[i]) {
+				total += len(b[j])
+				j++
+			}
+		}
+
+		for k := i; k < j; k++ {
+			ws.iovs[iovs+k-i].set(b[k])
+		}
+		hdr.setIov(ws.iovs[iovs : iovs+j-i])
+		hdr.Name = (*byte)(unsafe.Pointer(&ws.names[msgs]))
+		hdr.Namelen = nameLen
+		if j-i > 1 {
+			hdr.setControl(ws.gsoControl(msgs, len(b[i])))
+		} else {
+			hdr.setControl(nil)
+		}
+
+		ws.first[msgs] = i
+		ws.count[msgs] = j - i
+		iovs += j - i
+		msgs++
+		i = j
+	}
+
+	sent := 0
+	for m := 0; m < msgs; {
+		n, _, errno := unix.Syscall6(
+			unix.SYS_SENDMMSG,
+			uintptr(u.sysFd),
+			uintptr(unsafe.Pointer(&ws.msgs[m])),
+			uintptr(msgs-m),
+			0,
+			0,
+			0,
+		)
+
+		if errno != 0 {
+			if errno == unix.EIO && ws.count[m] > 1 {
+				// The nic can not checksum the packets for us, send the rest without gso from now on
+				u.l.WithError(errno).Warn("udp gso failed, disabling it for this socket")
+				u.gso.Store(false)
+				rest, err := u.WriteBatch(b[ws.first[m]:], addrs[ws.first[m]:])
+				if firstErr == nil {
+					firstErr = err
+				}
+				return sent + rest, firstErr
+			}
+
+			// Only the first message failed, skip it and carry on
+			if firstErr == nil {
+				firstErr = &net.OpError{Op: "sendmmsg", Err: errno}
+			}
+			m++
+			continue
+		}
+
+		for k := m; k < m+int(n); k++ {
+			sent += ws.count[k]
+		}
+		m += int(n)
+	}
+
+	return sent, firstErr
+}
+
+// rawName fills name with the address in the form the kernel wants and returns its length
+func (u *StdConn) rawName(addr *Addr, name *unix.RawSockaddrInet6) (uint32, error) {
+	// Little Endian -> Network Endian
+	port := (addr.Port >> 8) | ((addr.Port & 0xff) << 8)
+
+	if u.isV4 {
+		addrV4, isAddrV4 := maybeIPV4(addr.IP)
+		if !isAddrV4 {
+			return 0, fmt.Errorf("Listener is IPv4, but writing to IPv6 remote")
+		}
+
+		rsa := (*unix.RawSockaddrInet4)(unsafe.Pointer(name))
+		*rsa = unix.RawSockaddrInet4{Family: unix.AF_INET, Port: port}
+		copy(rsa.Addr[:], addrV4)
+		return unix.SizeofSockaddrInet4, nil
+	}
+
+	*name = unix.RawSockaddrInet6{Family: unix.AF_INET6, Port: port}
+	copy(name.Addr[:], addr.IP.To16())
+	return unix.SizeofSockaddrInet6, nil
+}
+
+// groSize returns the size of the packets the kernel coalesced into a read, or 0 if it holds a single packet
+func groSize(control []byte) int {
+	for len(control) >= unix.CmsgLen(0) {
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&control[0]))
+		l := int(h.Len)
+		if l < unix.CmsgLen(0) || l > len(control) {
+			return 0
+		}
+
+		if h.Level == unix.SOL_UDP && h.Type == unix.UDP_GRO && l >= unix.CmsgLen(4) {
+			return int(binary.NativeEndian.Uint32(control[unix.CmsgLen(0):]))
+		}
+
+		next := unix.CmsgSpace(l - unix.CmsgLen(0))
+		if next > len(control) {
+			return 0
+		}
+		control = control[next:]
+	}
+
+	return 0
+}
+
 func (u *StdConn) writeTo6(b []byte, addr *Addr) error {
 	var rsa unix.RawSockaddrInet6
 	rsa.Family = unix.AF_INET6
@@ -314,6 +718,31 @@ func (u *StdConn) ReloadConfig(c *config.C) {
 			u.l.WithError(err).Error("Failed to set listen.write_buffer")
 		}
 	}
+
+	u.gso.Store(u.gsoSupported && c.GetBool("listen.gso", true))
+
+	if c.InitialLoad() && c.GetBool("listen.gro", false) {
+		// The read loop sizes its buffers for gro when it starts so this can't be turned on later
+		err := unix.SetsockoptInt(u.sysFd, unix.IPPROTO_UDP, unix.UDP_GRO, 1)
+		if err == nil {
+			u.gro = true
+		} else {
+			u.l.WithError(err).Error("Failed to set listen.gro")
+		}
+	}
+
+	// Only probes carry the don't fragment bit, everything else is left for the kernel to fragment so inner packets
+	// that allow fragmentation still make it across a path with a smaller mtu
+	pmtu := c.GetBool("pmtu.enabled", false)
+	if pmtu {
+		if err := u.setPathMtuDiscovery(); err != nil {
+			u.l.WithError(err).Error("Failed to set the path mtu discovery mode")
+		}
+		if err := u.openProbeSocket(); err != nil {
+			u.l.WithError(err).Error("Failed to open the ipv4 path mtu probe socket, ipv4 probes will fail")
+		}
+	}
+	u.pmtu.Store(pmtu)
 }
 
 func (u *StdConn) getMemInfo(meminfo *_SK_MEMINFO) error {
@@ -326,7 +755,17 @@ func (u *StdConn) getMemInfo(meminfo *_SK_MEMINFO) error {
 }
 
 func (u *StdConn) Close() error {
-	//TODO: this will not interrupt the read loop
+	// Closing the fd does not wake a blocked recvmmsg, shutdown does. The error is ENOTCONN for an unconnected socket
+	// but the reader is woken up regardless.
+	u.closed.Store(true)
+	_ = unix.Shutdown(u.sysFd, unix.SHUT_RDWR)
+
+	u.probeLock.Lock()
+	if fd := int(u.probeFd.Swap(-1)); fd >= 0 {
+		_ = unix.Close(fd)
+	}
+	u.probeLock.Unlock()
+
 	return syscall.Close(u.sysFd)
 }
 
@@ -33,13 +33,13 @@ type rawMessage struct {
 	Pad0 [4]byte
 }
 
-func (u *StdConn) PrepareRawMessages(n int) ([]rawMessage, [][]byte, [][]byte) {
+func (u *StdConn) PrepareRawMessages(n int, size int) ([]rawMessage, [][]byte, [][]byte) {
 	msgs := make([]rawMessage, n)
 	buffers := make([][]byte, n)
 	names := make([][]byte, n)
 
 	for i := range msgs {
-		buffers[i] = make([]byte, MTU)
+		buffers[i] = make([]byte, size)
 		names[i] = make([]byte, unix.SizeofSockaddrInet6)
 
 		//TODO: this is still silly, no need for an array
@@ -56,3 +56,28 @@ func (u *StdConn) PrepareRawMessages(n int) ([]rawMessage, [][]byte, [][]byte) {
 
 	return msgs, buffers, names
 }
+
+func (v *iovec) set(b []byte) {
+	v.Base = &b[0]
+	v.Len = uint64(len(b))
+}
+
+func (h *msghdr) setIov(iov []iovec) {
+	h.Iov = &iov[0]
+	h.Iovlen = uint64(len(iov))
+}
+
+func (h *msghdr) setControl(b []byte) {
+	if len(b) == 0 {
+		h.Control = nil
+		h.Controllen = 0
+		return
+	}
+
+	h.Control = &b[0]
+	h.Controllen = uint64(len(b))
+}
+
+func (h *msghdr) controlLen() int {
+	return int(h.Controllen)
+}
@@ -0,0 +1,189 @@
+//go:build linux && !android && !e2e_testing
+// +build linux,!android,!e2e_testing
+
+package udp
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func testListener(t *testing.T, ip net.IP, cfg string) *StdConn {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	assert.NoError(t, c.LoadString(cfg))
+
+	conn, err := NewListener(l, ip, 0, false, 64)
+	assert.NoError(t, err)
+	conn.ReloadConfig(c)
+	t.Cleanup(func() { conn.Close() })
+	return conn.(*StdConn)
+}
+
+func TestStdConn_WriteBatch(t *testing.T) {
+	for _, cfg := range []string{"listen: {gso: false, read_buffer: 1048576}", "listen: {gso: true, gro: true, read_buffer: 1048576}"} {
+		t.Run(cfg, func(t *testing.T) {
+			tx := testListener(t, net.IPv4(127, 0, 0, 1), cfg)
+			rx := testListener(t, net.IPv4(127, 0, 0, 1), cfg)
+			assert.Equal(t, strings.Contains(cfg, "gso: true"), tx.gso.Load())
+			rxAddr, err := rx.LocalAddr()
+			assert.NoError(t, err)
+
+			// Runs of same sized packets to the same address with a short one at the end, and some strays
+			var b [][]byte
+			var addrs []*Addr
+			for i := 0; i < 100; i++ {
+				size := 1200
+				if i%10 == 9 {
+					size = 100 + i
+				}
+				b = append(b, bytes.Repeat([]byte{byte(i)}, size))
+				addrs = append(addrs, rxAddr)
+			}
+
+			got := make(chan []byte, 100)
+			go rx.ListenOut(func(_ *Addr, _ []byte, p []byte, _ *header.H, _ *firewall.Packet, _ LightHouseHandlerFunc, _ []byte, _ int, _ firewall.ConntrackCache) {
+				got <- append([]byte{}, p...)
+			}, nil, func() {}, firewall.NewConntrackCacheTicker(0), 0)
+
+			sent, err := tx.WriteBatch(b, addrs)
+			assert.NoError(t, err)
+			assert.Equal(t, len(b), sent)
+
+			for i := range b {
+				select {
+				case p := <-got:
+					assert.Equal(t, b[i], p)
+				case <-time.After(time.Second):
+					t.Fatalf("Only got %d packets", i)
+				}
+			}
+		})
+	}
+}
+
+func TestStdConn_DualStack(t *testing.T) {
+	dual := testListener(t, net.IPv6zero, "listen: {}")
+	v4 := testListener(t, net.IPv4(127, 0, 0, 1), "listen: {}")
+	v6 := testListener(t, net.IPv6loopback, "listen: {}")
+
+	addr, err := dual.LocalAddr()
+	assert.NoError(t, err)
+	addrs, err := dual.LocalAddrs()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Addr{NewAddr(net.IPv4zero, addr.Port), NewAddr(net.IPv6zero, addr.Port)}, addrs)
+
+	addrs, err = v4.LocalAddrs()
+	assert.NoError(t, err)
+	assert.Len(t, addrs, 1)
+	assert.NotNil(t, addrs[0].IP.To4())
+
+	// 0.0.0.0 is ipv4 alone, only :: asks for both
+	any4 := testListener(t, net.IPv4zero, "listen: {}")
+	assert.True(t, any4.isV4)
+	assert.False(t, any4.dualStack)
+	assert.Error(t, any4.WriteTo([]byte("nope"), NewAddr(net.IPv6loopback, addr.Port)))
+
+	addrs, err = v6.LocalAddrs()
+	assert.NoError(t, err)
+	assert.Len(t, addrs, 1)
+	assert.Nil(t, addrs[0].IP.To4())
+
+	type packet struct {
+		from *Addr
+		data string
+	}
+	listen := func(c *StdConn) chan packet {
+		got := make(chan packet, 10)
+		go c.ListenOut(func(from *Addr, _ []byte, p []byte, _ *header.H, _ *firewall.Packet, _ LightHouseHandlerFunc, _ []byte, _ int, _ firewall.ConntrackCache) {
+			got <- packet{from.Copy(), string(p)}
+		}, nil, func() {}, firewall.NewConntrackCacheTicker(0), 0)
+		return got
+	}
+	dualGot, v4Got, v6Got := listen(dual), listen(v4), listen(v6)
+
+	recv := func(got chan packet) packet {
+		select {
+		case p := <-got:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for a packet")
+			return packet{}
+		}
+	}
+
+	// The dual stack socket hears from, and answers, both families
+	assert.NoError(t, v4.WriteTo([]byte("from v4"), NewAddr(net.IPv4(127, 0, 0, 1), addr.Port)))
+	p := recv(dualGot)
+	assert.Equal(t, "from v4", p.data)
+	assert.NotNil(t, p.from.IP.To4())
+	assert.NoError(t, dual.WriteTo([]byte("to v4"), p.from))
+	assert.Equal(t, "to v4", recv(v4Got).data)
+
+	assert.NoError(t, v6.WriteTo([]byte("from v6"), NewAddr(net.IPv6loopback, addr.Port)))
+	p = recv(dualGot)
+	assert.Equal(t, "from v6", p.data)
+	assert.Nil(t, p.from.IP.To4())
+	assert.NoError(t, dual.WriteTo([]byte("to v6"), p.from))
+	assert.Equal(t, "to v6", recv(v6Got).data)
+
+	// Single family sockets can't cross over
+	assert.Error(t, v4.WriteTo([]byte("nope"), NewAddr(net.IPv6loopback, addr.Port)))
+	assert.Error(t, v6.WriteTo([]byte("nope"), NewAddr(net.IPv4(127, 0, 0, 1), addr.Port)))
+}
+
+func TestStdConn_WriteToDontFragment(t *testing.T) {
+	for _, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback} {
+		t.Run(ip.String(), func(t *testing.T) {
+			tx := testListener(t, ip, "pmtu: {enabled: true}")
+			rx := testListener(t, ip, "listen: {}")
+			if ip.To4() != nil && tx.probeFd.Load() < 0 {
+				t.Skip("ipv4 probes need CAP_NET_RAW")
+			}
+			txAddr, err := tx.LocalAddr()
+			assert.NoError(t, err)
+			rxAddr, err := rx.LocalAddr()
+			assert.NoError(t, err)
+
+			type packet struct {
+				from *Addr
+				data string
+			}
+			got := make(chan packet, 10)
+			go rx.ListenOut(func(from *Addr, _ []byte, p []byte, _ *header.H, _ *firewall.Packet, _ LightHouseHandlerFunc, _ []byte, _ int, _ firewall.ConntrackCache) {
+				got <- packet{from.Copy(), string(p)}
+			}, nil, func() {}, firewall.NewConntrackCacheTicker(0), 0)
+
+			// The probe asks for the bit itself, the socket keeps letting the kernel fragment everything else
+			assert.NoError(t, WriteToDontFragment(tx, []byte("probe"), rxAddr))
+			select {
+			case p := <-got:
+				assert.Equal(t, "probe", p.data)
+				assert.Equal(t, txAddr.Port, p.from.Port)
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timed out waiting for the probe")
+			}
+			v, err := unix.GetsockoptInt(tx.sysFd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER)
+			assert.NoError(t, err)
+			assert.Equal(t, unix.IP_PMTUDISC_DONT, v)
+
+			// Turning pmtu off sends probes like anything else
+			c := config.NewC(test.NewLogger())
+			assert.NoError(t, c.LoadString("pmtu: {enabled: false}"))
+			tx.ReloadConfig(c)
+			assert.False(t, tx.pmtu.Load())
+			assert.NoError(t, WriteToDontFragment(tx, []byte("plain"), rxAddr))
+			assert.Equal(t, "plain", (<-got).data)
+		})
+	}
+}
@@ -68,6 +68,11 @@ func NewRIOListener(l *logrus.Logger, ip net.IP, port int) (*RIOConn, error) {
 
 	u := &RIOConn{l: l}
 
+	if ip.IsUnspecified() {
+		// Listen on both ipv4 and ipv6
+		ip = net.IPv6unspecified
+	}
+
 	addr := [16]byte{}
 	copy(addr[:], ip.To16())
 	err := u.bind(&windows.SockaddrInet6{Addr: addr, Port: port})
@@ -119,7 +124,7 @@ func (u *RIOConn) bind(sa windows.Sockaddr) error {
 	return nil
 }
 
-func (u *RIOConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firewall.ConntrackCacheTicker, q int) {
+func (u *RIOConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, flush func(), cache *firewall.ConntrackCacheTicker, q int) {
 	plaintext := make([]byte, MTU)
 	buffer := make([]byte, MTU)
 	h := &header.H{}
@@ -140,6 +145,7 @@ func (u *RIOConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firew
 		p[0] = byte(rua.Port >> 8)
 		p[1] = byte(rua.Port)
 		r(udpAddr, plaintext[:0], buffer[:n], h, fwPacket, lhf, nb, q, cache.Get(u.l))
+		flush()
 	}
 }
 
@@ -308,10 +314,18 @@ func (u *RIOConn) LocalAddr() (*Addr, error) {
 	}, nil
 }
 
+func (u *RIOConn) LocalAddrs() ([]*Addr, error) {
+	return localAddrs(u.LocalAddr())
+}
+
 func (u *RIOConn) Rebind() error {
 	return nil
 }
 
+func (u *RIOConn) WriteBatch(b [][]byte, addrs []*Addr) (int, error) {
+	return writeEach(u.WriteTo, b, addrs)
+}
+
 func (u *RIOConn) ReloadConfig(*config.C) {}
 
 func (u *RIOConn) Close() error {
@@ -119,7 +119,11 @@ func (u *TesterConn) WriteTo(b []byte, addr *Addr) error {
 	return nil
 }
 
-func (u *TesterConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *firewall.ConntrackCacheTicker, q int) {
+func (u *TesterConn) WriteBatch(b [][]byte, addrs []*Addr) (int, error) {
+	return writeEach(u.WriteTo, b, addrs)
+}
+
+func (u *TesterConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, flush func(), cache *firewall.ConntrackCacheTicker, q int) {
 	plaintext := make([]byte, MTU)
 	h := &header.H{}
 	fwPacket := &firewall.Packet{}
@@ -134,6 +138,7 @@ func (u *TesterConn) ListenOut(r EncReader, lhf LightHouseHandlerFunc, cache *fi
 		ua.Port = p.FromPort
 		copy(ua.IP, p.FromIp.To16())
 		r(ua, plaintext[:0], p.Data, h, fwPacket, lhf, nb, q, cache.Get(u.l))
+		flush()
 	}
 }
 
@@ -148,6 +153,10 @@ func (u *TesterConn) LocalAddr() (*Addr, error) {
 	return u.Addr, nil
 }
 
+func (u *TesterConn) LocalAddrs() ([]*Addr, error) {
+	return []*Addr{u.Addr}, nil
+}
+
 func (u *TesterConn) Rebind() error {
 	return nil
 }